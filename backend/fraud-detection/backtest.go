@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BacktestReport compares a candidate ruleset with the decisions that were
+// actually made on the same transactions
+type BacktestReport struct {
+	CandidateVersion string `json:"candidate_version"`
+	Evaluated        int    `json:"evaluated"`
+	// Skipped counts assessments recorded without a feature snapshot
+	Skipped     int            `json:"skipped"`
+	Changed     int            `json:"changed"`
+	Transitions map[string]int `json:"transitions"`
+	Baseline    map[string]int `json:"baseline_decisions"`
+	Candidate   map[string]int `json:"candidate_decisions"`
+	// AverageScoreChange is the mean of candidate minus baseline score
+	AverageScoreChange float64         `json:"average_score_change"`
+	RuleHits           map[string]int  `json:"rule_hits"`
+	ShadowRuleHits     map[string]int  `json:"shadow_rule_hits"`
+	Labeled            BacktestLabeled `json:"labeled"`
+	ChangedSamples     []BacktestDiff  `json:"changed_samples"`
+}
+
+// BacktestLabeled measures both rulesets on labeled transactions. A
+// transaction counts as caught when the decision was not allow.
+type BacktestLabeled struct {
+	Fraud                   int      `json:"fraud"`
+	Legitimate              int      `json:"legitimate"`
+	BaselineCaught          int      `json:"baseline_caught"`
+	CandidateCaught         int      `json:"candidate_caught"`
+	BaselineCatchRate       *float64 `json:"baseline_catch_rate"`
+	CandidateCatchRate      *float64 `json:"candidate_catch_rate"`
+	BaselineFalsePositives  int      `json:"baseline_false_positives"`
+	CandidateFalsePositives int      `json:"candidate_false_positives"`
+}
+
+// BacktestDiff is a transaction whose decision the candidate would change
+type BacktestDiff struct {
+	TransactionID     string   `json:"transaction_id"`
+	Label             string   `json:"label,omitempty"`
+	BaselineScore     int      `json:"baseline_score"`
+	BaselineDecision  string   `json:"baseline_decision"`
+	CandidateScore    int      `json:"candidate_score"`
+	CandidateDecision string   `json:"candidate_decision"`
+	CandidateFactors  []string `json:"candidate_factors"`
+}
+
+const maxBacktestSamples = 50
+
+// runBacktest replays historical assessments against a candidate ruleset.
+// Each replay uses the feature snapshot, model prediction and list matches
+// recorded at decision time, so only the ruleset differs. Labels are looked
+// up by transaction id, falling back to a label stored on the record itself
+// as in the training export.
+func runBacktest(candidate *RuleSet, history []gin.H, labels map[string]string) BacktestReport {
+	report := BacktestReport{
+		CandidateVersion: candidate.Version,
+		Transitions:      map[string]int{},
+		Baseline:         map[string]int{},
+		Candidate:        map[string]int{},
+		RuleHits:         map[string]int{},
+		ShadowRuleHits:   map[string]int{},
+		ChangedSamples:   []BacktestDiff{},
+	}
+
+	var scoreChange int
+	for _, assessment := range history {
+		features, ok := assessment["features"].(map[string]interface{})
+		if !ok {
+			report.Skipped++
+			continue
+		}
+		report.Evaluated++
+
+		result, _ := scoreTransaction(candidate, features, assessmentPrediction(assessment), assessmentListMatches(assessment))
+		for _, match := range result.Matches {
+			report.RuleHits[match.RuleID]++
+		}
+		for _, match := range result.ShadowMatches {
+			report.ShadowRuleHits[match.RuleID]++
+		}
+
+		baselineDecision := fmt.Sprint(assessment["decision"])
+		baselineScore := assessmentScore(assessment)
+		report.Baseline[baselineDecision]++
+		report.Candidate[result.Decision]++
+		report.Transitions[baselineDecision+"->"+result.Decision]++
+		scoreChange += result.Score - baselineScore
+
+		transactionId := fmt.Sprint(assessment["transaction_id"])
+		label, ok := labels[transactionId]
+		if !ok {
+			label, _ = assessment["label"].(string)
+		}
+		if fraud, known := fraudLabels[label]; known {
+			baselineCaught := baselineDecision != "allow"
+			candidateCaught := result.Decision != "allow"
+			if fraud {
+				report.Labeled.Fraud++
+				report.Labeled.BaselineCaught += boolCount(baselineCaught)
+				report.Labeled.CandidateCaught += boolCount(candidateCaught)
+			} else {
+				report.Labeled.Legitimate++
+				report.Labeled.BaselineFalsePositives += boolCount(baselineCaught)
+				report.Labeled.CandidateFalsePositives += boolCount(candidateCaught)
+			}
+		}
+
+		if result.Decision != baselineDecision {
+			report.Changed++
+			if len(report.ChangedSamples) < maxBacktestSamples {
+				report.ChangedSamples = append(report.ChangedSamples, BacktestDiff{
+					TransactionID:     transactionId,
+					Label:             label,
+					BaselineScore:     baselineScore,
+					BaselineDecision:  baselineDecision,
+					CandidateScore:    result.Score,
+					CandidateDecision: result.Decision,
+					CandidateFactors:  result.Factors,
+				})
+			}
+		}
+	}
+
+	if report.Evaluated > 0 {
+		report.AverageScoreChange = float64(scoreChange) / float64(report.Evaluated)
+	}
+	report.Labeled.BaselineCatchRate = ratio(report.Labeled.BaselineCaught, report.Labeled.Fraud)
+	report.Labeled.CandidateCatchRate = ratio(report.Labeled.CandidateCaught, report.Labeled.Fraud)
+	return report
+}
+
+func boolCount(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// assessmentPrediction returns the model prediction recorded on an
+// assessment, whether it is held in memory or was decoded from JSON
+func assessmentPrediction(assessment gin.H) *Prediction {
+	switch prediction := assessment["model"].(type) {
+	case *Prediction:
+		return prediction
+	case map[string]interface{}:
+		var decoded Prediction
+		if redecode(prediction, &decoded) == nil {
+			return &decoded
+		}
+	}
+	return nil
+}
+
+// assessmentListMatches returns the list matches recorded on an assessment
+func assessmentListMatches(assessment gin.H) []ListMatch {
+	switch matches := assessment["list_matches"].(type) {
+	case []ListMatch:
+		return matches
+	case []interface{}:
+		var decoded []ListMatch
+		if redecode(matches, &decoded) == nil {
+			return decoded
+		}
+	}
+	return nil
+}
+
+func redecode(value interface{}, target interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
+// filterAssessments returns a copy of the history created in [from, to).
+// Callers must hold riskMu.
+func filterAssessments(from, to time.Time, decision string) []gin.H {
+	assessments := []gin.H{}
+	for _, assessment := range MockRiskScores {
+		createdAt, _ := time.Parse(time.RFC3339, fmt.Sprint(assessment["created_at"]))
+		if (!from.IsZero() && createdAt.Before(from)) || (!to.IsZero() && !createdAt.Before(to)) {
+			continue
+		}
+		if decision != "" && assessment["decision"] != decision {
+			continue
+		}
+		assessments = append(assessments, assessment)
+	}
+	return assessments
+}
+
+// handleListAssessments returns the analysed transaction history, newest
+// first, optionally filtered by time range and decision
+func handleListAssessments(c *gin.Context) {
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+		return
+	}
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if err != nil || limit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+		return
+	}
+
+	riskMu.RLock()
+	assessments := filterAssessments(from, to, c.Query("decision"))
+	total := len(assessments)
+	for i, j := 0, len(assessments)-1; i < j; i, j = i+1, j-1 {
+		assessments[i], assessments[j] = assessments[j], assessments[i]
+	}
+	if len(assessments) > limit {
+		assessments = assessments[:limit]
+	}
+	// Encode while holding the lock so stored records are not read while
+	// being written
+	body, err := json.Marshal(gin.H{
+		"assessments": assessments,
+		"count":       len(assessments),
+		"total":       total,
+	})
+	riskMu.RUnlock()
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// handleBacktest replays the stored history between from and to against the
+// candidate ruleset in the request body
+func handleBacktest(c *gin.Context) {
+	var request struct {
+		Ruleset json.RawMessage `json:"ruleset" binding:"required"`
+		From    string          `json:"from"`
+		To      string          `json:"to"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	candidate, err := parseRuleSet(request.Ruleset, "backtest")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var from, to time.Time
+	if request.From != "" {
+		if from, err = time.Parse(time.RFC3339, request.From); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+			return
+		}
+	}
+	if request.To != "" {
+		if to, err = time.Parse(time.RFC3339, request.To); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+			return
+		}
+	}
+
+	labelsMu.RLock()
+	labels := make(map[string]string, len(MockLabels))
+	for transactionId, label := range MockLabels {
+		labels[transactionId] = label.Label
+	}
+	labelsMu.RUnlock()
+
+	riskMu.RLock()
+	report := runBacktest(candidate, filterAssessments(from, to, ""), labels)
+	riskMu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"backtest": report,
+	})
+}
+
+// runBacktestCommand implements the backtest subcommand, which replays an
+// exported history file offline:
+//
+//	fraud-detection backtest -rules candidate.json -history assessments.json [-labels labels.json]
+//
+// The history may be the GET /assessments response, a JSON array of
+// assessments or JSON lines such as the training export. Labels may be a
+// JSON array of labels or an object with a labels array.
+func runBacktestCommand(args []string) error {
+	flags := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	rulesPath := flags.String("rules", "", "candidate ruleset JSON file")
+	historyPath := flags.String("history", "", "assessment history file")
+	labelsPath := flags.String("labels", "", "optional labels JSON file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *rulesPath == "" || *historyPath == "" {
+		flags.Usage()
+		return fmt.Errorf("-rules and -history are required")
+	}
+
+	data, err := os.ReadFile(*rulesPath)
+	if err != nil {
+		return err
+	}
+	candidate, err := parseRuleSet(data, *rulesPath)
+	if err != nil {
+		return err
+	}
+
+	history, err := readHistoryFile(*historyPath)
+	if err != nil {
+		return err
+	}
+
+	labels := map[string]string{}
+	if *labelsPath != "" {
+		if labels, err = readLabelsFile(*labelsPath); err != nil {
+			return err
+		}
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(runBacktest(candidate, history, labels))
+}
+
+func readHistoryFile(path string) ([]gin.H, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	trimmed := bytes.TrimSpace(data)
+
+	var history []gin.H
+	var response struct {
+		Assessments *[]gin.H `json:"assessments"`
+	}
+	switch {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		err = json.Unmarshal(trimmed, &history)
+	case json.Unmarshal(trimmed, &response) == nil && response.Assessments != nil:
+		history = *response.Assessments
+	default:
+		// One assessment per line
+		scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			var assessment gin.H
+			if err := json.Unmarshal(line, &assessment); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			history = append(history, assessment)
+		}
+		err = scanner.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// Replay in decision order regardless of how the file was sorted
+	sort.SliceStable(history, func(i, j int) bool {
+		return fmt.Sprint(history[i]["created_at"]) < fmt.Sprint(history[j]["created_at"])
+	})
+	return history, nil
+}
+
+func readLabelsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []Label
+	if err := json.Unmarshal(data, &list); err != nil {
+		var wrapped struct {
+			Labels []Label `json:"labels"`
+		}
+		if err := json.Unmarshal(data, &wrapped); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		list = wrapped.Labels
+	}
+
+	labels := make(map[string]string, len(list))
+	for _, label := range list {
+		labels[label.TransactionID] = label.Label
+	}
+	return labels, nil
+}
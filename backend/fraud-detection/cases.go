@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Case is a review decision waiting on, or resolved by, an analyst.
+// Status moves from open to in_review when claimed and ends as approved or
+// declined.
+type Case struct {
+	ID            string      `json:"id"`
+	AssessmentID  string      `json:"assessment_id"`
+	TransactionID string      `json:"transaction_id"`
+	PaymentID     string      `json:"payment_id,omitempty"`
+	UserID        string      `json:"user_id"`
+	Score         int         `json:"score"`
+	Factors       []string    `json:"factors"`
+	Status        string      `json:"status"`
+	AssignedTo    string      `json:"assigned_to,omitempty"`
+	Notes         []CaseNote  `json:"notes"`
+	Audit         []CaseEvent `json:"audit"`
+	Resolution    string      `json:"resolution,omitempty"`
+	// PaymentAction is the capture or void sent to the payment service
+	PaymentAction string `json:"payment_action,omitempty"`
+	// PaymentMismatch says how the payment was settled when it had already
+	// been captured or voided against the analyst's decision
+	PaymentMismatch string     `json:"payment_mismatch,omitempty"`
+	DueAt           time.Time  `json:"due_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	ResolvedAt      *time.Time `json:"resolved_at,omitempty"`
+}
+
+// CaseNote is an analyst's annotation on a case
+type CaseNote struct {
+	Analyst   string    `json:"analyst"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CaseEvent is an audit trail entry for a case
+type CaseEvent struct {
+	Action    string    `json:"action"`
+	Analyst   string    `json:"analyst,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// caseView is a case as returned by the API, with its SLA state
+type caseView struct {
+	Case
+	SLABreached bool `json:"sla_breached"`
+}
+
+// MockCases represents a simple in-memory case store
+var MockCases = map[string]*Case{}
+
+var casesMu sync.Mutex
+
+var paymentClient = &http.Client{Timeout: 5 * time.Second}
+
+// caseSLA is how long analysts have to resolve a case
+func caseSLA() time.Duration {
+	sla, err := time.ParseDuration(os.Getenv("CASE_SLA"))
+	if err != nil || sla <= 0 {
+		return 4 * time.Hour
+	}
+	return sla
+}
+
+func paymentServiceURL() string {
+	if url := os.Getenv("PAYMENT_SERVICE_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:4002"
+}
+
+// openCase creates a case for an assessment sent to review
+func openCase(assessmentId, transactionId, paymentId, userId string, score int, factors []string, now time.Time) *Case {
+	now = now.UTC()
+	reviewCase := &Case{
+		ID:            "case_" + uuid.New().String()[:8],
+		AssessmentID:  assessmentId,
+		TransactionID: transactionId,
+		PaymentID:     paymentId,
+		UserID:        userId,
+		Score:         score,
+		Factors:       factors,
+		Status:        "open",
+		Notes:         []CaseNote{},
+		Audit:         []CaseEvent{{Action: "created", Detail: fmt.Sprintf("score %d", score), CreatedAt: now}},
+		DueAt:         now.Add(caseSLA()),
+		CreatedAt:     now,
+	}
+
+	casesMu.Lock()
+	MockCases[reviewCase.ID] = reviewCase
+	casesMu.Unlock()
+	return reviewCase
+}
+
+func (rc *Case) view(now time.Time) caseView {
+	copied := *rc
+	copied.Notes = append([]CaseNote(nil), rc.Notes...)
+	copied.Audit = append([]CaseEvent(nil), rc.Audit...)
+
+	breached := now.After(rc.DueAt)
+	if rc.ResolvedAt != nil {
+		breached = rc.ResolvedAt.After(rc.DueAt)
+	}
+	return caseView{Case: copied, SLABreached: breached}
+}
+
+func (rc *Case) record(action, analyst, detail string) {
+	rc.Audit = append(rc.Audit, CaseEvent{Action: action, Analyst: analyst, Detail: detail, CreatedAt: time.Now().UTC()})
+}
+
+func (rc *Case) resolved() bool {
+	return rc.Status == "approved" || rc.Status == "declined"
+}
+
+// bindAnalyst reads the analyst performing an action from the request body
+func bindAnalyst(c *gin.Context, request interface{}) bool {
+	if err := c.ShouldBindJSON(request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return false
+	}
+	return true
+}
+
+// handleListCases returns the queue, most urgent first. It can be filtered
+// by status and assigned_to.
+func handleListCases(c *gin.Context) {
+	status := c.Query("status")
+	assignedTo := c.Query("assigned_to")
+	now := time.Now()
+
+	casesMu.Lock()
+	cases := []caseView{}
+	for _, reviewCase := range MockCases {
+		if (status == "" || reviewCase.Status == status) && (assignedTo == "" || reviewCase.AssignedTo == assignedTo) {
+			cases = append(cases, reviewCase.view(now))
+		}
+	}
+	casesMu.Unlock()
+
+	sort.Slice(cases, func(i, j int) bool { return cases[i].DueAt.Before(cases[j].DueAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"cases": cases,
+		"count": len(cases),
+	})
+}
+
+func handleGetCase(c *gin.Context) {
+	casesMu.Lock()
+	reviewCase, ok := MockCases[c.Param("id")]
+	var result caseView
+	if ok {
+		result = reviewCase.view(time.Now())
+	}
+	casesMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"case": result,
+	})
+}
+
+func handleClaimCase(c *gin.Context) {
+	var request struct {
+		Analyst string `json:"analyst" binding:"required"`
+	}
+	if !bindAnalyst(c, &request) {
+		return
+	}
+
+	casesMu.Lock()
+	defer casesMu.Unlock()
+
+	reviewCase, ok := MockCases[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return
+	}
+	if reviewCase.resolved() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Case is already resolved"})
+		return
+	}
+	if reviewCase.Status == "in_review" && reviewCase.AssignedTo != request.Analyst {
+		c.JSON(http.StatusConflict, gin.H{"error": "Case is claimed by " + reviewCase.AssignedTo})
+		return
+	}
+
+	if reviewCase.AssignedTo != request.Analyst {
+		reviewCase.Status = "in_review"
+		reviewCase.AssignedTo = request.Analyst
+		reviewCase.record("claimed", request.Analyst, "")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Case claimed successfully",
+		"case":    reviewCase.view(time.Now()),
+	})
+}
+
+func handleReleaseCase(c *gin.Context) {
+	var request struct {
+		Analyst string `json:"analyst" binding:"required"`
+	}
+	if !bindAnalyst(c, &request) {
+		return
+	}
+
+	casesMu.Lock()
+	defer casesMu.Unlock()
+
+	reviewCase, ok := MockCases[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return
+	}
+	if reviewCase.Status != "in_review" || reviewCase.AssignedTo != request.Analyst {
+		c.JSON(http.StatusConflict, gin.H{"error": "Case is not claimed by " + request.Analyst})
+		return
+	}
+
+	reviewCase.Status = "open"
+	reviewCase.AssignedTo = ""
+	reviewCase.record("released", request.Analyst, "")
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Case released successfully",
+		"case":    reviewCase.view(time.Now()),
+	})
+}
+
+func handleAddCaseNote(c *gin.Context) {
+	var request struct {
+		Analyst string `json:"analyst" binding:"required"`
+		Text    string `json:"text" binding:"required"`
+	}
+	if !bindAnalyst(c, &request) {
+		return
+	}
+
+	casesMu.Lock()
+	defer casesMu.Unlock()
+
+	reviewCase, ok := MockCases[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return
+	}
+
+	reviewCase.Notes = append(reviewCase.Notes, CaseNote{Analyst: request.Analyst, Text: request.Text, CreatedAt: time.Now().UTC()})
+	reviewCase.record("note_added", request.Analyst, "")
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Note added successfully",
+		"case":    reviewCase.view(time.Now()),
+	})
+}
+
+// handleResolveCase approves or declines a claimed case. When the case is
+// tied to a payment, the held payment is captured or voided first and the
+// case stays claimed if the payment service rejects the call.
+func handleResolveCase(c *gin.Context) {
+	id := c.Param("id")
+	var request struct {
+		Analyst  string `json:"analyst" binding:"required"`
+		Decision string `json:"decision" binding:"required"`
+		Reason   string `json:"reason"`
+	}
+	if !bindAnalyst(c, &request) {
+		return
+	}
+	if request.Decision != "approve" && request.Decision != "decline" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "decision must be approve or decline"})
+		return
+	}
+
+	casesMu.Lock()
+	reviewCase, ok := MockCases[id]
+	var paymentId string
+	var err error
+	switch {
+	case !ok:
+	case reviewCase.Status != "in_review" || reviewCase.AssignedTo != request.Analyst:
+		err = fmt.Errorf("case must be claimed by %s before it is resolved", request.Analyst)
+	default:
+		paymentId = reviewCase.PaymentID
+	}
+	casesMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Case not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Call the payment service without holding the lock; the claim keeps
+	// other analysts from resolving the case in the meantime
+	action := map[string]string{"approve": "capture", "decline": "void"}[request.Decision]
+	settled := ""
+	if paymentId != "" {
+		var err error
+		if settled, err = callPaymentService(action, paymentId); err != nil {
+			casesMu.Lock()
+			reviewCase.record("payment_"+action+"_failed", request.Analyst, err.Error())
+			casesMu.Unlock()
+			c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to " + action + " payment: " + err.Error()})
+			return
+		}
+	}
+
+	casesMu.Lock()
+	defer casesMu.Unlock()
+
+	now := time.Now().UTC()
+	decision := request.Decision
+	switch {
+	case paymentId == "":
+	case settled == "":
+		reviewCase.PaymentAction = action
+		reviewCase.record("payment_"+action, request.Analyst, paymentId)
+	default:
+		// The payment was captured or voided before the analyst got to it,
+		// so the case follows what happened to the payment
+		decision = settledDecisions[settled]
+		reviewCase.record("payment_already_settled", request.Analyst, fmt.Sprintf("%s is %s", paymentId, settled))
+		if decision != request.Decision {
+			reviewCase.PaymentMismatch = fmt.Sprintf("analyst chose to %s but the payment's status was already %s", request.Decision, settled)
+			reviewCase.record("payment_mismatch", request.Analyst, reviewCase.PaymentMismatch)
+		}
+	}
+	reviewCase.Status = map[string]string{"approve": "approved", "decline": "declined"}[decision]
+	reviewCase.Resolution = request.Reason
+	reviewCase.ResolvedAt = &now
+	reviewCase.record(reviewCase.Status, request.Analyst, request.Reason)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Case resolved successfully",
+		"case":    reviewCase.view(now),
+	})
+}
+
+// settledDecisions maps the status of a payment that is no longer held to
+// the decision it amounts to. Refunded payments were captured first.
+var settledDecisions = map[string]string{
+	"captured":           "approve",
+	"succeeded":          "approve",
+	"partially_refunded": "approve",
+	"refunded":           "approve",
+	"voided":             "decline",
+}
+
+// callPaymentService captures or voids a held payment. A payment that is no
+// longer held is left alone, and the status it was settled in is returned
+// instead.
+func callPaymentService(action, paymentId string) (string, error) {
+	resp, err := paymentClient.Post(paymentServiceURL()+"/"+action+"/"+paymentId, "application/json", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", nil
+	case http.StatusConflict:
+		status, err := fetchPaymentStatus(paymentId)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := settledDecisions[status]; !ok {
+			return "", fmt.Errorf("payment is %s", status)
+		}
+		return status, nil
+	default:
+		return "", fmt.Errorf("payment service returned %s", resp.Status)
+	}
+}
+
+// fetchPaymentStatus reads a payment's status from the payment service
+func fetchPaymentStatus(paymentId string) (string, error) {
+	resp, err := paymentClient.Get(paymentServiceURL() + "/status/" + paymentId)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("payment service returned %s reading the payment", resp.Status)
+	}
+	var body struct {
+		Payment struct {
+			Status string `json:"status"`
+		} `json:"payment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("reading payment status: %w", err)
+	}
+	return body.Payment.Status, nil
+}
+
+// handleCaseMetrics summarises the queue: cases by status, SLA breaches,
+// the age of the oldest unresolved case and time to resolution
+func handleCaseMetrics(c *gin.Context) {
+	now := time.Now()
+
+	casesMu.Lock()
+	byStatus := map[string]int{"open": 0, "in_review": 0, "approved": 0, "declined": 0}
+	breachedOpen, breachedResolved, resolved := 0, 0, 0
+	var oldest time.Duration
+	var resolutionTotal time.Duration
+	for _, reviewCase := range MockCases {
+		byStatus[reviewCase.Status]++
+		view := reviewCase.view(now)
+		if reviewCase.resolved() {
+			resolved++
+			resolutionTotal += reviewCase.ResolvedAt.Sub(reviewCase.CreatedAt)
+			if view.SLABreached {
+				breachedResolved++
+			}
+			continue
+		}
+		if view.SLABreached {
+			breachedOpen++
+		}
+		if age := now.Sub(reviewCase.CreatedAt); age > oldest {
+			oldest = age
+		}
+	}
+	casesMu.Unlock()
+
+	var averageResolution float64
+	if resolved > 0 {
+		averageResolution = (resolutionTotal / time.Duration(resolved)).Seconds()
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"by_status":                  byStatus,
+		"sla":                        caseSLA().String(),
+		"sla_breached_unresolved":    breachedOpen,
+		"sla_breached_resolved":      breachedResolved,
+		"oldest_unresolved_seconds":  int(oldest.Seconds()),
+		"average_resolution_seconds": int(averageResolution),
+		"resolved":                   resolved,
+		"unresolved":                 byStatus["open"] + byStatus["in_review"],
+	})
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The rule expression language is a small, side-effect free language over a
+// flat map of dotted attribute names such as txn.amount or user.is_new.
+//
+//	literals     42  1.5  "text"  'text'  true  false  null  ["US", "CA"]
+//	attributes   txn.amount  user.known_device
+//	operators    ||  &&  !  ==  !=  <  <=  >  >=  +  -  *  /  %  in
+//	functions    lower(s)  upper(s)  len(x)  abs(n)  min(a, b)  max(a, b)
+//	             contains(s, sub)  starts_with(s, prefix)
+//
+// Attributes that are not present evaluate to null, and null means unknown:
+// comparisons, in, functions and ! over null are null too, && and || only
+// decide when the known side settles the result, and null never counts as a
+// match. So a rule over a missing attribute never matches, even with != or !.
+// Compare with the null literal, as in txn.country == null or
+// txn.country != null, to test whether an attribute is present.
+
+// Expr is a compiled expression
+type Expr interface {
+	Eval(env map[string]interface{}) (interface{}, error)
+}
+
+// CompileExpr parses an expression into an evaluable tree
+func CompileExpr(source string) (Expr, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	expr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+	return expr, nil
+}
+
+// Truthy reports whether an evaluated value counts as a match
+func Truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	default:
+		return false
+	}
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "+", "-", "*", "/", "%", "(", ")", "[", "]", ","}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		r := rune(source[i])
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || (r == '.' && i+1 < len(source) && unicode.IsDigit(rune(source[i+1]))):
+			start := i
+			for i < len(source) && (unicode.IsDigit(rune(source[i])) || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokNumber, source[start:i], start})
+		case r == '"' || r == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(source) && rune(source[i]) != r {
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+				}
+				sb.WriteByte(source[i])
+				i++
+			}
+			if i >= len(source) {
+				return nil, fmt.Errorf("unterminated string at offset %d", start)
+			}
+			i++
+			tokens = append(tokens, token{tokString, sb.String(), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(source) && (unicode.IsLetter(rune(source[i])) || unicode.IsDigit(rune(source[i])) || source[i] == '_' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{tokIdent, source[start:i], start})
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{tokOp, op, i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", r, i)
+			}
+		}
+	}
+	return append(tokens, token{tokEOF, "end of expression", len(source)}), nil
+}
+
+// binaryPrecedence lists binary operators from loosest to tightest binding
+var binaryPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4, "in": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(text string) error {
+	tok := p.next()
+	if tok.kind != tokOp || tok.text != text {
+		return fmt.Errorf("expected %q at offset %d, found %q", text, tok.pos, tok.text)
+	}
+	return nil
+}
+
+func (p *exprParser) binaryOp() (string, int, bool) {
+	tok := p.peek()
+	if tok.kind != tokOp && !(tok.kind == tokIdent && tok.text == "in") {
+		return "", 0, false
+	}
+	prec, ok := binaryPrecedence[tok.text]
+	return tok.text, prec, ok
+}
+
+func (p *exprParser) parseBinary(minPrec int) (Expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, prec, ok := p.binaryOp()
+		if !ok || prec <= minPrec {
+			return left, nil
+		}
+		p.next()
+		right, err := p.parseBinary(prec)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryExpr{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (Expr, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "!" || tok.text == "-") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op: tok.text, operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (Expr, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		value, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", tok.text, tok.pos)
+		}
+		return literalExpr{value}, nil
+	case tokString:
+		return literalExpr{tok.text}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return literalExpr{true}, nil
+		case "false":
+			return literalExpr{false}, nil
+		case "null":
+			return literalExpr{nil}, nil
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return p.parseCall(tok)
+		}
+		return attributeExpr(tok.text), nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			expr, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			return expr, p.expect(")")
+		case "[":
+			var items listExpr
+			for {
+				if next := p.peek(); next.kind == tokOp && next.text == "]" {
+					p.next()
+					return items, nil
+				}
+				item, err := p.parseBinary(0)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+				if next := p.peek(); next.kind == tokOp && next.text == "," {
+					p.next()
+				} else if err := p.expect("]"); err != nil {
+					return nil, err
+				} else {
+					return items, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+func (p *exprParser) parseCall(name token) (Expr, error) {
+	fn, ok := exprFunctions[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+	p.next() // (
+
+	call := &callExpr{name: name.text, fn: fn}
+	for {
+		if next := p.peek(); next.kind == tokOp && next.text == ")" {
+			p.next()
+			break
+		}
+		arg, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+		if next := p.peek(); next.kind == tokOp && next.text == "," {
+			p.next()
+		} else if err := p.expect(")"); err != nil {
+			return nil, err
+		} else {
+			break
+		}
+	}
+	if call.fn.arity != len(call.args) {
+		return nil, fmt.Errorf("%s expects %d arguments, got %d", name.text, call.fn.arity, len(call.args))
+	}
+	return call, nil
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e literalExpr) Eval(map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+type attributeExpr string
+
+func (e attributeExpr) Eval(env map[string]interface{}) (interface{}, error) {
+	return normalizeValue(env[string(e)]), nil
+}
+
+type listExpr []Expr
+
+func (e listExpr) Eval(env map[string]interface{}) (interface{}, error) {
+	values := make([]interface{}, 0, len(e))
+	for _, item := range e {
+		value, err := item.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+type unaryExpr struct {
+	op      string
+	operand Expr
+}
+
+func (e *unaryExpr) Eval(env map[string]interface{}) (interface{}, error) {
+	value, err := e.operand.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, nil
+	}
+	if e.op == "!" {
+		return !Truthy(value), nil
+	}
+	number, ok := value.(float64)
+	if !ok {
+		return nil, nil
+	}
+	return -number, nil
+}
+
+type binaryExpr struct {
+	op          string
+	left, right Expr
+}
+
+func (e *binaryExpr) Eval(env map[string]interface{}) (interface{}, error) {
+	left, err := e.left.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Logical operators short-circuit, and are only null when the known
+	// operand does not decide the result
+	switch e.op {
+	case "&&":
+		if left != nil && !Truthy(left) {
+			return false, nil
+		}
+		right, err := e.right.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if right != nil && !Truthy(right) {
+			return false, nil
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return true, nil
+	case "||":
+		if Truthy(left) {
+			return true, nil
+		}
+		right, err := e.right.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if Truthy(right) {
+			return true, nil
+		}
+		if left == nil || right == nil {
+			return nil, nil
+		}
+		return false, nil
+	}
+
+	right, err := e.right.Eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Comparing with the null literal tests for presence, and anything else
+	// involving null is unknown
+	if e.op == "==" || e.op == "!=" {
+		if isNullLiteral(e.left) || isNullLiteral(e.right) {
+			return valuesEqual(left, right) == (e.op == "=="), nil
+		}
+	}
+	if left == nil || right == nil {
+		return nil, nil
+	}
+
+	switch e.op {
+	case "==":
+		return valuesEqual(left, right), nil
+	case "!=":
+		return !valuesEqual(left, right), nil
+	case "in":
+		list, ok := right.([]interface{})
+		if !ok {
+			if haystack, ok := right.(string); ok {
+				needle, ok := left.(string)
+				return ok && strings.Contains(haystack, needle), nil
+			}
+			return false, nil
+		}
+		for _, item := range list {
+			if valuesEqual(left, item) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	// Ordering comparisons work on two numbers or two strings
+	if ls, ok := left.(string); ok {
+		rs, ok := right.(string)
+		if !ok {
+			return false, nil
+		}
+		switch e.op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		case "+":
+			return ls + rs, nil
+		}
+		return nil, nil
+	}
+
+	ln, lok := left.(float64)
+	rn, rok := right.(float64)
+	if !lok || !rok {
+		switch e.op {
+		case "<", "<=", ">", ">=":
+			return false, nil
+		}
+		return nil, nil
+	}
+
+	switch e.op {
+	case "<":
+		return ln < rn, nil
+	case "<=":
+		return ln <= rn, nil
+	case ">":
+		return ln > rn, nil
+	case ">=":
+		return ln >= rn, nil
+	case "+":
+		return ln + rn, nil
+	case "-":
+		return ln - rn, nil
+	case "*":
+		return ln * rn, nil
+	case "/":
+		if rn == 0 {
+			return nil, nil
+		}
+		return ln / rn, nil
+	case "%":
+		if rn == 0 {
+			return nil, nil
+		}
+		return math.Mod(ln, rn), nil
+	}
+	return nil, fmt.Errorf("unknown operator %q", e.op)
+}
+
+func isNullLiteral(e Expr) bool {
+	literal, ok := e.(literalExpr)
+	return ok && literal.value == nil
+}
+
+type exprFunction struct {
+	arity int
+	call  func(args []interface{}) interface{}
+}
+
+var exprFunctions = map[string]exprFunction{
+	"lower": {1, func(args []interface{}) interface{} {
+		if s, ok := args[0].(string); ok {
+			return strings.ToLower(s)
+		}
+		return nil
+	}},
+	"upper": {1, func(args []interface{}) interface{} {
+		if s, ok := args[0].(string); ok {
+			return strings.ToUpper(s)
+		}
+		return nil
+	}},
+	"len": {1, func(args []interface{}) interface{} {
+		switch v := args[0].(type) {
+		case string:
+			return float64(len(v))
+		case []interface{}:
+			return float64(len(v))
+		}
+		return float64(0)
+	}},
+	"abs": {1, func(args []interface{}) interface{} {
+		if n, ok := args[0].(float64); ok {
+			return math.Abs(n)
+		}
+		return nil
+	}},
+	"min": {2, func(args []interface{}) interface{} {
+		a, aok := args[0].(float64)
+		b, bok := args[1].(float64)
+		if !aok || !bok {
+			return nil
+		}
+		return math.Min(a, b)
+	}},
+	"max": {2, func(args []interface{}) interface{} {
+		a, aok := args[0].(float64)
+		b, bok := args[1].(float64)
+		if !aok || !bok {
+			return nil
+		}
+		return math.Max(a, b)
+	}},
+	"contains": {2, func(args []interface{}) interface{} {
+		s, sok := args[0].(string)
+		sub, subok := args[1].(string)
+		return sok && subok && strings.Contains(s, sub)
+	}},
+	"starts_with": {2, func(args []interface{}) interface{} {
+		s, sok := args[0].(string)
+		prefix, pok := args[1].(string)
+		return sok && pok && strings.HasPrefix(s, prefix)
+	}},
+}
+
+type callExpr struct {
+	name string
+	fn   exprFunction
+	args []Expr
+}
+
+func (e *callExpr) Eval(env map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, 0, len(e.args))
+	for _, arg := range e.args {
+		value, err := arg.Eval(env)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, nil
+		}
+		args = append(args, value)
+	}
+	return e.fn.call(args), nil
+}
+
+// normalizeValue converts attribute values into the types the evaluator
+// understands: float64, string, bool, nil and []interface{}
+func normalizeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return items
+	}
+	return value
+}
+
+func valuesEqual(a, b interface{}) bool {
+	a, b = normalizeValue(a), normalizeValue(b)
+	switch av := a.(type) {
+	case nil:
+		return b == nil
+	case float64:
+		bv, ok := b.(float64)
+		return ok && av == bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	}
+	return false
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompileExprErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+	}{
+		{"empty", ""},
+		{"unterminated string", `txn.country == "US`},
+		{"unexpected character", "txn.amount # 5"},
+		{"dangling operator", "txn.amount >"},
+		{"unclosed paren", "(txn.amount > 5"},
+		{"trailing token", "txn.amount 5"},
+		{"unknown function", "shout(txn.country)"},
+		{"wrong arity", "lower(txn.country, txn.currency)"},
+		{"unclosed list", `txn.country in ["US", "CA"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := CompileExpr(tt.source); err == nil {
+				t.Errorf("CompileExpr(%q) succeeded, want an error", tt.source)
+			}
+		})
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	env := map[string]interface{}{
+		"txn.amount":        1500,
+		"txn.country":       "GB",
+		"txn.email":         "Someone@Example.com",
+		"user.is_new":       false,
+		"user.known_device": true,
+		"user.avg_amount":   200.0,
+		"user.countries":    []string{"GB", "FR"},
+	}
+
+	tests := []struct {
+		source string
+		want   interface{}
+	}{
+		// Literals and arithmetic
+		{"42", 42.0},
+		{"'single' + \"double\"", "singledouble"},
+		{"1 + 2 * 3", 7.0},
+		{"(1 + 2) * 3", 9.0},
+		{"-txn.amount", -1500.0},
+		{"7 % 4", 3.0},
+		{"1 / 0", nil},
+
+		// Comparisons
+		{"txn.amount > 1000", true},
+		{"txn.amount > user.avg_amount * 5", true},
+		{"txn.amount <= 1000", false},
+		{`txn.country == "GB"`, true},
+		{`txn.country != "GB"`, false},
+		{`txn.country < "US"`, true},
+		{`txn.amount == "1500"`, false},
+		{`txn.amount < "2000"`, false},
+
+		// Logic and precedence
+		{"!user.is_new && user.known_device", true},
+		{"user.is_new || txn.amount > 1000 && user.known_device", true},
+		{"(user.is_new || txn.amount > 1000) && !user.known_device", false},
+
+		// Membership and functions
+		{`txn.country in ["US", "GB"]`, true},
+		{`txn.country in user.countries`, true},
+		{`"Example" in txn.email`, true},
+		{`lower(txn.email) == "someone@example.com"`, true},
+		{`upper(txn.country)`, "GB"},
+		{`len(user.countries)`, 2.0},
+		{`abs(-3)`, 3.0},
+		{`min(txn.amount, 100)`, 100.0},
+		{`max(txn.amount, 100)`, 1500.0},
+		{`contains(txn.email, "@")`, true},
+		{`starts_with(txn.email, "Some")`, true},
+		{`[1, "a"]`, []interface{}{1.0, "a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := CompileExpr(tt.source)
+			if err != nil {
+				t.Fatalf("CompileExpr(%q): %v", tt.source, err)
+			}
+			got, err := expr.Eval(env)
+			if err != nil {
+				t.Fatalf("Eval(%q): %v", tt.source, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Eval(%q) = %#v, want %#v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+// Rules over attributes that are not present must never match, whichever
+// operator they use
+func TestExprMissingAttributesNeverMatch(t *testing.T) {
+	sources := []string{
+		"txn.amount > 1000",
+		"txn.amount <= 1000",
+		`txn.country == "US"`,
+		`txn.country != "US"`,
+		"!user.known_device",
+		`!(txn.country == "US")`,
+		`txn.country in ["US", "CA"]`,
+		`!(txn.country in ["US", "CA"])`,
+		"txn.amount + 1 > 0",
+		"-txn.amount < 0",
+		"len(txn.email) == 0",
+		`!contains(txn.email, "@")`,
+		"user.known_device || !user.known_device",
+		"true && !user.known_device",
+		"!user.known_device || false",
+	}
+
+	for _, source := range sources {
+		t.Run(source, func(t *testing.T) {
+			expr, err := CompileExpr(source)
+			if err != nil {
+				t.Fatalf("CompileExpr(%q): %v", source, err)
+			}
+			got, err := expr.Eval(map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("Eval(%q): %v", source, err)
+			}
+			if Truthy(got) {
+				t.Errorf("Eval(%q) on an empty env = %#v, want no match", source, got)
+			}
+		})
+	}
+}
+
+func TestExprNullLogic(t *testing.T) {
+	present := map[string]interface{}{"txn.country": "US"}
+	tests := []struct {
+		source string
+		env    map[string]interface{}
+		want   interface{}
+	}{
+		{"txn.country == null", nil, true},
+		{"txn.country != null", nil, false},
+		{"null == txn.country", present, false},
+		{"txn.country != null", present, true},
+		{"user.known_device && false", nil, false},
+		{"false && user.known_device", nil, false},
+		{"user.known_device && true", nil, nil},
+		{"user.known_device || true", nil, true},
+		{"true || user.known_device", nil, true},
+		{"user.known_device || false", nil, nil},
+		{"!user.known_device", nil, nil},
+		{`txn.country != "US"`, nil, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.source, func(t *testing.T) {
+			expr, err := CompileExpr(tt.source)
+			if err != nil {
+				t.Fatalf("CompileExpr(%q): %v", tt.source, err)
+			}
+			got, err := expr.Eval(tt.env)
+			if err != nil {
+				t.Fatalf("Eval(%q): %v", tt.source, err)
+			}
+			if got != tt.want {
+				t.Errorf("Eval(%q) = %#v, want %#v", tt.source, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRulesCompile(t *testing.T) {
+	rules := defaultRuleSet
+	rules.Rules = append([]Rule(nil), defaultRuleSet.Rules...)
+	if err := rules.compile(); err != nil {
+		t.Fatalf("default ruleset does not compile: %v", err)
+	}
+}
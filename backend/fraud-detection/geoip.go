@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GeoInfo is what the IP database knows about an address
+type GeoInfo struct {
+	Country   string   `json:"country,omitempty"`
+	ASN       int      `json:"asn,omitempty"`
+	ASOrg     string   `json:"as_org,omitempty"`
+	IsHosting bool     `json:"is_hosting"`
+	IsVPN     bool     `json:"is_vpn"`
+	IsTor     bool     `json:"is_tor"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+type geoRange struct {
+	start netip.Addr
+	end   netip.Addr
+	info  GeoInfo
+}
+
+// geoDatabase is an IP range table sorted by start address
+type geoDatabase struct {
+	ranges []geoRange
+	source string
+}
+
+var (
+	geoDB   *geoDatabase
+	geoDBMu sync.RWMutex
+)
+
+// geoColumns maps the accepted header names onto fields. Both plain names
+// and the column names used by MaxMind's CSV exports are understood.
+var geoColumns = map[string]string{
+	"network":                        "network",
+	"start_ip":                       "start_ip",
+	"end_ip":                         "end_ip",
+	"country":                        "country",
+	"country_iso_code":               "country",
+	"asn":                            "asn",
+	"autonomous_system_number":       "asn",
+	"as_org":                         "as_org",
+	"autonomous_system_organization": "as_org",
+	"is_hosting":                     "is_hosting",
+	"is_hosting_provider":            "is_hosting",
+	"is_vpn":                         "is_vpn",
+	"is_anonymous_vpn":               "is_vpn",
+	"is_tor":                         "is_tor",
+	"is_tor_exit_node":               "is_tor",
+	"latitude":                       "latitude",
+	"longitude":                      "longitude",
+}
+
+// loadGeoDatabase reads a CSV IP range database. Each row describes either a
+// CIDR network or a start_ip/end_ip range; every other column is optional.
+// Binary .mmdb files are not supported, export them to CSV first.
+func loadGeoDatabase(path string) (*geoDatabase, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("%s: missing header row", path)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		if field, ok := geoColumns[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[field] = i
+		}
+	}
+	_, hasNetwork := columns["network"]
+	_, hasStart := columns["start_ip"]
+	_, hasEnd := columns["end_ip"]
+	if !hasNetwork && !(hasStart && hasEnd) {
+		return nil, fmt.Errorf("%s: needs a network column or start_ip and end_ip columns", path)
+	}
+
+	db := &geoDatabase{source: path}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		var entry geoRange
+		if network := field("network"); network != "" {
+			prefix, err := netip.ParsePrefix(network)
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: invalid network %q", path, line, network)
+			}
+			entry.start, entry.end = prefixRange(prefix.Masked())
+		} else {
+			entry.start, err = netip.ParseAddr(field("start_ip"))
+			if err == nil {
+				entry.end, err = netip.ParseAddr(field("end_ip"))
+			}
+			if err != nil || entry.end.Less(entry.start) || entry.start.Is4() != entry.end.Is4() {
+				return nil, fmt.Errorf("%s line %d: invalid range", path, line)
+			}
+		}
+
+		entry.info.Country = strings.ToUpper(field("country"))
+		entry.info.ASOrg = field("as_org")
+		entry.info.ASN, _ = strconv.Atoi(strings.TrimPrefix(strings.ToUpper(field("asn")), "AS"))
+		entry.info.IsHosting = parseFlag(field("is_hosting"))
+		entry.info.IsVPN = parseFlag(field("is_vpn"))
+		entry.info.IsTor = parseFlag(field("is_tor"))
+		latitude, latErr := strconv.ParseFloat(field("latitude"), 64)
+		longitude, lonErr := strconv.ParseFloat(field("longitude"), 64)
+		if latErr == nil && lonErr == nil {
+			entry.info.Latitude = &latitude
+			entry.info.Longitude = &longitude
+		}
+
+		db.ranges = append(db.ranges, entry)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool { return db.ranges[i].start.Less(db.ranges[j].start) })
+	return db, nil
+}
+
+func parseFlag(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes", "y":
+		return true
+	}
+	return false
+}
+
+// prefixRange returns the first and last address in a network
+func prefixRange(prefix netip.Prefix) (netip.Addr, netip.Addr) {
+	start := prefix.Addr()
+	bytes := start.AsSlice()
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 1 << (7 - bit%8)
+	}
+	end, _ := netip.AddrFromSlice(bytes)
+	return start, end
+}
+
+// Lookup finds the range containing an address. Ranges are expected not to
+// overlap; when they do, the one starting closest below the address wins.
+func (db *geoDatabase) Lookup(ip string) (GeoInfo, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return GeoInfo{}, false
+	}
+	addr = addr.Unmap()
+
+	// Index of the first range starting after addr
+	i := sort.Search(len(db.ranges), func(i int) bool { return addr.Less(db.ranges[i].start) })
+	if i == 0 {
+		return GeoInfo{}, false
+	}
+	candidate := db.ranges[i-1]
+	if candidate.end.Less(addr) {
+		return GeoInfo{}, false
+	}
+	return candidate.info, true
+}
+
+// lookupIP resolves an address against the loaded database, if any
+func lookupIP(ip string) (GeoInfo, bool) {
+	geoDBMu.RLock()
+	db := geoDB
+	geoDBMu.RUnlock()
+
+	if db == nil || ip == "" {
+		return GeoInfo{}, false
+	}
+	return db.Lookup(ip)
+}
+
+// distanceKm is the great-circle distance between two coordinates
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadiusKm = 6371.0
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
+
+// addGeoFeatures adds ip.*, card.country and geo.* attributes for rule
+// evaluation. Travel speed compares the transaction with the user's most
+// recent earlier transaction whose IP address could be located.
+// Callers must hold riskMu.
+func addGeoFeatures(features map[string]interface{}, userId string, geo GeoInfo, located bool, cardCountry string, now time.Time) {
+	features["ip.country"] = geo.Country
+	features["ip.asn"] = float64(geo.ASN)
+	features["ip.is_hosting"] = geo.IsHosting
+	features["ip.is_vpn"] = geo.IsVPN
+	features["ip.is_tor"] = geo.IsTor
+	features["ip.is_anonymous"] = geo.IsHosting || geo.IsVPN || geo.IsTor
+	features["card.country"] = cardCountry
+	features["geo.country_mismatch"] = geo.Country != "" && cardCountry != "" && geo.Country != cardCountry
+
+	var distance, speed float64
+	if located && geo.Latitude != nil {
+		for i := len(MockRiskScores) - 1; i >= 0; i-- {
+			risk := MockRiskScores[i]
+			previous, ok := risk["ip_geo"].(*GeoInfo)
+			if risk["user_id"] != userId || !ok || previous == nil || previous.Latitude == nil {
+				continue
+			}
+			createdAt, err := time.Parse(time.RFC3339, fmt.Sprint(risk["created_at"]))
+			if err != nil {
+				continue
+			}
+
+			distance = distanceKm(*previous.Latitude, *previous.Longitude, *geo.Latitude, *geo.Longitude)
+			// Treat anything under a minute apart as a minute so that two
+			// near-simultaneous transactions do not divide by zero
+			hours := math.Max(now.Sub(createdAt).Hours(), 1.0/60)
+			speed = distance / hours
+			break
+		}
+	}
+	features["geo.travel_distance_km"] = math.Round(distance)
+	features["geo.travel_speed_kmh"] = math.Round(speed)
+}
+
+func handleLookupIP(c *gin.Context) {
+	geoDBMu.RLock()
+	loaded := geoDB != nil
+	geoDBMu.RUnlock()
+	if !loaded {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "GEOIP_DB_FILE is not configured"})
+		return
+	}
+
+	ip := c.Param("ip")
+	if _, err := netip.ParseAddr(ip); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+
+	geo, ok := lookupIP(ip)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "IP address not found in database"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"ip":  ip,
+		"geo": geo,
+	})
+}
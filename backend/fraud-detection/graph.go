@@ -0,0 +1,352 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The link graph connects each user to the devices, cards, emails and IP
+// addresses seen on their transactions. Users that share any of these are
+// two hops apart. Node ids are "<type>:<value>".
+var (
+	graphEdges = map[string]map[string]time.Time{}
+	graphMu    sync.RWMutex
+)
+
+// graphLinkTypes are the attributes that link users together
+var graphLinkTypes = []string{"device", "card", "email", "ip"}
+
+// maxGraphNodes bounds how much of a component a single query walks
+const maxGraphNodes = 1000
+
+// graphEdgeMaxAge is how long a link is kept after it was last seen
+func graphEdgeMaxAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv("GRAPH_EDGE_MAX_AGE"))
+	if err != nil || age <= 0 {
+		return 90 * 24 * time.Hour
+	}
+	return age
+}
+
+// graphHubAccounts is how many accounts an attribute can be shared by before
+// it is treated as a hub, such as a carrier or office IP address. Walks do
+// not pass through hubs, so they do not link every account behind them.
+func graphHubAccounts() int {
+	accounts, err := strconv.Atoi(os.Getenv("GRAPH_HUB_ACCOUNTS"))
+	if err != nil || accounts <= 0 {
+		return 50
+	}
+	return accounts
+}
+
+// fraudsters holds, for each user, the transactions labeled as fraud. It is
+// kept up to date as labels are recorded and guarded by labelsMu.
+var fraudsters = map[string]map[string]bool{}
+
+// GraphNode is a node in a user's connected component
+type GraphNode struct {
+	ID    string `json:"id"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	// Depth is the number of hops from the queried user
+	Depth     int  `json:"depth"`
+	Fraudster bool `json:"fraudster,omitempty"`
+	// Hub is set on attributes shared by too many accounts to walk through
+	Hub bool `json:"hub,omitempty"`
+}
+
+// GraphEdge links a user to an attribute
+type GraphEdge struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+func graphNodeID(kind, value string) string {
+	return kind + ":" + value
+}
+
+func splitGraphNodeID(id string) (string, string) {
+	kind, value, _ := strings.Cut(id, ":")
+	return kind, value
+}
+
+// linkTransaction adds the edges for one transaction
+func linkTransaction(userId string, attributes map[string]string, seen time.Time) {
+	if userId == "" {
+		return
+	}
+	user := graphNodeID("user", userId)
+
+	graphMu.Lock()
+	defer graphMu.Unlock()
+
+	for _, kind := range graphLinkTypes {
+		value := attributes[kind]
+		if value == "" {
+			continue
+		}
+		node := graphNodeID(kind, value)
+		for _, pair := range [][2]string{{user, node}, {node, user}} {
+			if graphEdges[pair[0]] == nil {
+				graphEdges[pair[0]] = map[string]time.Time{}
+			}
+			if seen.After(graphEdges[pair[0]][pair[1]]) {
+				graphEdges[pair[0]][pair[1]] = seen
+			}
+		}
+	}
+}
+
+// seedGraph links the transactions already in the history. Callers must
+// hold riskMu.
+func seedGraph() {
+	for _, risk := range MockRiskScores {
+		seen, _ := time.Parse(time.RFC3339, fmt.Sprint(risk["created_at"]))
+		userId, _ := risk["user_id"].(string)
+		linkTransaction(userId, graphAttributes(risk), seen)
+	}
+}
+
+// graphAttributes reads the linking attributes stored on an assessment
+func graphAttributes(risk gin.H) map[string]string {
+	value := func(key string) string {
+		text, _ := risk[key].(string)
+		return text
+	}
+	return map[string]string{
+		"device": value("device_id"),
+		"card":   value("card_fingerprint"),
+		"email":  strings.ToLower(value("email")),
+		"ip":     value("ip_address"),
+	}
+}
+
+// markFraudster records a user's transaction as labeled fraud or not.
+// Callers must hold labelsMu.
+func markFraudster(userId, transactionId string, fraud bool) {
+	if fraud {
+		if fraudsters[userId] == nil {
+			fraudsters[userId] = map[string]bool{}
+		}
+		fraudsters[userId][transactionId] = true
+		return
+	}
+	delete(fraudsters[userId], transactionId)
+	if len(fraudsters[userId]) == 0 {
+		delete(fraudsters, userId)
+	}
+}
+
+// isFraudster reports whether any of a user's transactions is labeled as
+// fraud. Callers must hold labelsMu.
+func isFraudster(userId string) bool {
+	return len(fraudsters[userId]) > 0
+}
+
+// isGraphHub reports whether a node is an attribute shared by too many
+// accounts to walk through. Callers must hold graphMu.
+func isGraphHub(node string) bool {
+	kind, _ := splitGraphNodeID(node)
+	return kind != "user" && len(graphEdges[node]) > graphHubAccounts()
+}
+
+// pruneGraph drops links last seen before cutoff, and nodes left with none
+func pruneGraph(cutoff time.Time) int {
+	graphMu.Lock()
+	defer graphMu.Unlock()
+
+	pruned := 0
+	for node, neighbours := range graphEdges {
+		for neighbour, lastSeen := range neighbours {
+			if lastSeen.Before(cutoff) {
+				delete(neighbours, neighbour)
+				pruned++
+			}
+		}
+		if len(neighbours) == 0 {
+			delete(graphEdges, node)
+		}
+	}
+	// Each link is stored in both directions
+	return pruned / 2
+}
+
+// runGraphPruning ages links out of the graph every interval
+func runGraphPruning(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if pruned := pruneGraph(now.Add(-graphEdgeMaxAge())); pruned > 0 {
+			log.Printf("Pruned %d stale links from the link graph", pruned)
+		}
+	}
+}
+
+// walkGraph does a breadth-first walk from a node up to maxDepth hops,
+// visiting at most maxGraphNodes nodes. Hubs are visited but not walked
+// through. Callers must hold graphMu.
+func walkGraph(start string, maxDepth int) (map[string]int, bool) {
+	depths := map[string]int{start: 0}
+	queue := []string{start}
+	truncated := false
+
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if depths[node] == maxDepth || isGraphHub(node) {
+			continue
+		}
+		neighbours := make([]string, 0, len(graphEdges[node]))
+		for neighbour := range graphEdges[node] {
+			neighbours = append(neighbours, neighbour)
+		}
+		sort.Strings(neighbours)
+		for _, neighbour := range neighbours {
+			if _, seen := depths[neighbour]; seen {
+				continue
+			}
+			if len(depths) >= maxGraphNodes {
+				truncated = true
+				break
+			}
+			depths[neighbour] = depths[node] + 1
+			queue = append(queue, neighbour)
+		}
+	}
+	return depths, truncated
+}
+
+// addGraphFeatures adds graph.* attributes for rule evaluation: how many
+// accounts share each of the transaction's attributes, how many other
+// accounts the user is linked to and whether any of those accounts, within
+// four hops, belongs to a known fraudster. Call it after linking the
+// transaction.
+func addGraphFeatures(features map[string]interface{}, userId string, attributes map[string]string) map[string]interface{} {
+	summary := map[string]interface{}{}
+	linkedUsers := []string{}
+
+	graphMu.RLock()
+	for _, kind := range graphLinkTypes {
+		accounts := 0
+		if value := attributes[kind]; value != "" {
+			accounts = len(graphEdges[graphNodeID(kind, value)])
+		}
+		features["graph."+kind+"_accounts"] = float64(accounts)
+		summary[kind+"_accounts"] = accounts
+	}
+	depths, _ := walkGraph(graphNodeID("user", userId), 4)
+	for node := range depths {
+		if kind, value := splitGraphNodeID(node); kind == "user" && value != userId {
+			linkedUsers = append(linkedUsers, value)
+		}
+	}
+	graphMu.RUnlock()
+
+	labelsMu.RLock()
+	linked, linkedFraudsters := len(linkedUsers), 0
+	for _, user := range linkedUsers {
+		if isFraudster(user) {
+			linkedFraudsters++
+		}
+	}
+	userIsFraudster := isFraudster(userId)
+	labelsMu.RUnlock()
+
+	features["graph.linked_accounts"] = float64(linked)
+	features["graph.linked_fraudsters"] = float64(linkedFraudsters)
+	features["graph.linked_to_fraudster"] = linkedFraudsters > 0
+	features["user.is_fraudster"] = userIsFraudster
+	summary["linked_accounts"] = linked
+	summary["linked_fraudsters"] = linkedFraudsters
+	return summary
+}
+
+// handleGetUserGraph returns the connected component around a user, up to
+// depth hops away (default 4)
+func handleGetUserGraph(c *gin.Context) {
+	userId := c.Param("userId")
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "4"))
+	if err != nil || depth < 1 || depth > 10 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "depth must be between 1 and 10"})
+		return
+	}
+
+	start := graphNodeID("user", userId)
+
+	graphMu.RLock()
+	if _, ok := graphEdges[start]; !ok {
+		graphMu.RUnlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found in link graph"})
+		return
+	}
+
+	depths, truncated := walkGraph(start, depth)
+	nodes := make([]GraphNode, 0, len(depths))
+	edges := []GraphEdge{}
+	for id, nodeDepth := range depths {
+		kind, value := splitGraphNodeID(id)
+		nodes = append(nodes, GraphNode{
+			ID:    id,
+			Type:  kind,
+			Value: value,
+			Depth: nodeDepth,
+			Hub:   isGraphHub(id),
+		})
+		// Edges always join a user to an attribute; list each once
+		if kind != "user" {
+			continue
+		}
+		for neighbour, lastSeen := range graphEdges[id] {
+			if _, ok := depths[neighbour]; ok {
+				edges = append(edges, GraphEdge{From: id, To: neighbour, LastSeen: lastSeen})
+			}
+		}
+	}
+	graphMu.RUnlock()
+
+	labelsMu.RLock()
+	for i, node := range nodes {
+		nodes[i].Fraudster = node.Type == "user" && isFraudster(node.Value)
+	}
+	labelsMu.RUnlock()
+
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Depth != nodes[j].Depth {
+			return nodes[i].Depth < nodes[j].Depth
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].From != edges[j].From {
+			return edges[i].From < edges[j].From
+		}
+		return edges[i].To < edges[j].To
+	})
+
+	accounts := 0
+	for _, node := range nodes {
+		if node.Type == "user" {
+			accounts++
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"user_id":   userId,
+		"depth":     depth,
+		"accounts":  accounts,
+		"nodes":     nodes,
+		"edges":     edges,
+		"truncated": truncated,
+	})
+}
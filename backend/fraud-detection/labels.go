@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Label is the ground truth for a transaction, learned after the decision
+type Label struct {
+	TransactionID string    `json:"transaction_id"`
+	AssessmentID  string    `json:"assessment_id"`
+	Label         string    `json:"label"`
+	Source        string    `json:"source,omitempty"`
+	Notes         string    `json:"notes,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// fraudLabels says whether each label means the transaction was fraudulent
+var fraudLabels = map[string]bool{
+	"confirmed_fraud": true,
+	"chargeback":      true,
+	"false_positive":  false,
+	"legitimate":      false,
+}
+
+// MockLabels holds labels by transaction id
+var MockLabels = map[string]*Label{}
+
+var labelsMu sync.RWMutex
+
+// DetectionMetrics compares a predictor with labels. Predicted positive means
+// the rule fired, the score fell in the band or the decision was not allow.
+// Rates are null when they would divide by zero.
+type DetectionMetrics struct {
+	TruePositives     int      `json:"true_positives"`
+	FalsePositives    int      `json:"false_positives"`
+	FalseNegatives    int      `json:"false_negatives"`
+	TrueNegatives     int      `json:"true_negatives"`
+	Precision         *float64 `json:"precision"`
+	Recall            *float64 `json:"recall"`
+	FalsePositiveRate *float64 `json:"false_positive_rate"`
+}
+
+func (m *DetectionMetrics) add(predicted, fraud bool) {
+	switch {
+	case predicted && fraud:
+		m.TruePositives++
+	case predicted && !fraud:
+		m.FalsePositives++
+	case !predicted && fraud:
+		m.FalseNegatives++
+	default:
+		m.TrueNegatives++
+	}
+}
+
+func (m *DetectionMetrics) finish() {
+	m.Precision = ratio(m.TruePositives, m.TruePositives+m.FalsePositives)
+	m.Recall = ratio(m.TruePositives, m.TruePositives+m.FalseNegatives)
+	m.FalsePositiveRate = ratio(m.FalsePositives, m.FalsePositives+m.TrueNegatives)
+}
+
+func ratio(numerator, denominator int) *float64 {
+	if denominator == 0 {
+		return nil
+	}
+	value := float64(numerator) / float64(denominator)
+	return &value
+}
+
+// MetricsReport is the performance of the decision, each rule and each score
+// band over a set of labeled assessments
+type MetricsReport struct {
+	Labeled    int                          `json:"labeled"`
+	Fraud      int                          `json:"fraud"`
+	Decision   DetectionMetrics             `json:"decision"`
+	Rules      map[string]*DetectionMetrics `json:"rules"`
+	ScoreBands map[string]*DetectionMetrics `json:"score_bands"`
+}
+
+// labeledAssessment joins an assessment with its label
+type labeledAssessment struct {
+	assessment gin.H
+	label      Label
+	createdAt  time.Time
+}
+
+// scoreBand names the 10-point band a score falls in, e.g. "30-39"
+func scoreBand(score int) string {
+	low := score / 10 * 10
+	if low >= 90 {
+		return "90-100"
+	}
+	return fmt.Sprintf("%d-%d", low, low+9)
+}
+
+func assessmentScore(assessment gin.H) int {
+	switch score := assessment["score"].(type) {
+	case int:
+		return score
+	case float64:
+		return int(score)
+	}
+	return 0
+}
+
+func assessmentRules(assessment gin.H) []string {
+	rules, _ := assessment["rules"].([]string)
+	return rules
+}
+
+// findAssessment returns the latest assessment for a transaction.
+// Callers must hold riskMu.
+func findAssessment(transactionId string) (gin.H, bool) {
+	for i := len(MockRiskScores) - 1; i >= 0; i-- {
+		if MockRiskScores[i]["transaction_id"] == transactionId {
+			return MockRiskScores[i], true
+		}
+	}
+	return nil, false
+}
+
+// labeledAssessments returns every labeled assessment created in [from, to).
+// A zero bound is open. Callers must hold riskMu.
+func labeledAssessments(from, to time.Time) []labeledAssessment {
+	labelsMu.RLock()
+	defer labelsMu.RUnlock()
+
+	results := []labeledAssessment{}
+	for _, assessment := range MockRiskScores {
+		label, ok := MockLabels[fmt.Sprint(assessment["transaction_id"])]
+		if !ok || label.AssessmentID != assessment["id"] {
+			continue
+		}
+		createdAt, _ := time.Parse(time.RFC3339, fmt.Sprint(assessment["created_at"]))
+		if (!from.IsZero() && createdAt.Before(from)) || (!to.IsZero() && !createdAt.Before(to)) {
+			continue
+		}
+		results = append(results, labeledAssessment{assessment: assessment, label: *label, createdAt: createdAt})
+	}
+	return results
+}
+
+// buildMetrics measures the decision, every rule seen in the data and every
+// score band against the labels
+func buildMetrics(labeled []labeledAssessment) MetricsReport {
+	report := MetricsReport{
+		Labeled:    len(labeled),
+		Rules:      map[string]*DetectionMetrics{},
+		ScoreBands: map[string]*DetectionMetrics{},
+	}
+
+	for _, item := range labeled {
+		for _, rule := range assessmentRules(item.assessment) {
+			if report.Rules[rule] == nil {
+				report.Rules[rule] = &DetectionMetrics{}
+			}
+		}
+		band := scoreBand(assessmentScore(item.assessment))
+		if report.ScoreBands[band] == nil {
+			report.ScoreBands[band] = &DetectionMetrics{}
+		}
+	}
+
+	for _, item := range labeled {
+		fraud := fraudLabels[item.label.Label]
+		if fraud {
+			report.Fraud++
+		}
+		report.Decision.add(item.assessment["decision"] != "allow", fraud)
+
+		fired := map[string]bool{}
+		for _, rule := range assessmentRules(item.assessment) {
+			fired[rule] = true
+		}
+		for rule, metrics := range report.Rules {
+			metrics.add(fired[rule], fraud)
+		}
+
+		band := scoreBand(assessmentScore(item.assessment))
+		for name, metrics := range report.ScoreBands {
+			metrics.add(name == band, fraud)
+		}
+	}
+
+	report.Decision.finish()
+	for _, metrics := range report.Rules {
+		metrics.finish()
+	}
+	for _, metrics := range report.ScoreBands {
+		metrics.finish()
+	}
+	return report
+}
+
+// periodStart truncates a time to the start of its day, week or month
+func periodStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch interval {
+	case "week":
+		// Weeks start on Monday
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case "month":
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return day
+}
+
+func parseTimeQuery(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+func handleRecordLabel(c *gin.Context) {
+	var request struct {
+		TransactionId string `json:"transaction_id" binding:"required"`
+		Label         string `json:"label" binding:"required"`
+		Source        string `json:"source"`
+		Notes         string `json:"notes"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if _, ok := fraudLabels[request.Label]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "label must be confirmed_fraud, chargeback, false_positive or legitimate"})
+		return
+	}
+
+	riskMu.RLock()
+	assessment, ok := findAssessment(request.TransactionId)
+	riskMu.RUnlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Risk assessment not found for this transaction"})
+		return
+	}
+
+	now := time.Now().UTC()
+	label := &Label{
+		TransactionID: request.TransactionId,
+		AssessmentID:  fmt.Sprint(assessment["id"]),
+		Label:         request.Label,
+		Source:        request.Source,
+		Notes:         request.Notes,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+
+	labelsMu.Lock()
+	status := http.StatusCreated
+	if existing, ok := MockLabels[request.TransactionId]; ok {
+		label.CreatedAt = existing.CreatedAt
+		status = http.StatusOK
+	}
+	MockLabels[request.TransactionId] = label
+	markFraudster(fmt.Sprint(assessment["user_id"]), request.TransactionId, fraudLabels[request.Label])
+	labelsMu.Unlock()
+
+	c.JSON(status, gin.H{
+		"message": "Label recorded successfully",
+		"label":   label,
+	})
+}
+
+func handleListLabels(c *gin.Context) {
+	labelsMu.RLock()
+	labels := make([]Label, 0, len(MockLabels))
+	for _, label := range MockLabels {
+		labels = append(labels, *label)
+	}
+	labelsMu.RUnlock()
+
+	sort.Slice(labels, func(i, j int) bool { return labels[i].CreatedAt.Before(labels[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"labels": labels,
+		"count":  len(labels),
+	})
+}
+
+func handleGetLabel(c *gin.Context) {
+	labelsMu.RLock()
+	label, ok := MockLabels[c.Param("transactionId")]
+	var result Label
+	if ok {
+		result = *label
+	}
+	labelsMu.RUnlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Label not found for this transaction"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"label": result,
+	})
+}
+
+// handleLabelMetrics reports precision, recall and false-positive rate for
+// labeled assessments created between from and to, overall and per day,
+// week or month
+func handleLabelMetrics(c *gin.Context) {
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+		return
+	}
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+		return
+	}
+	interval := c.DefaultQuery("interval", "day")
+	if interval != "day" && interval != "week" && interval != "month" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "interval must be day, week or month"})
+		return
+	}
+
+	riskMu.RLock()
+	labeled := labeledAssessments(from, to)
+	riskMu.RUnlock()
+
+	periods := map[time.Time][]labeledAssessment{}
+	for _, item := range labeled {
+		start := periodStart(item.createdAt, interval)
+		periods[start] = append(periods[start], item)
+	}
+	starts := make([]time.Time, 0, len(periods))
+	for start := range periods {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	series := []gin.H{}
+	for _, start := range starts {
+		series = append(series, gin.H{
+			"period_start": start.Format("2006-01-02"),
+			"metrics":      buildMetrics(periods[start]),
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"interval": interval,
+		"overall":  buildMetrics(labeled),
+		"series":   series,
+	})
+}
+
+// handleExportTrainingData writes labeled assessments with the features
+// captured at decision time, as CSV (one column per feature) or JSONL
+func handleExportTrainingData(c *gin.Context) {
+	format := c.DefaultQuery("format", "jsonl")
+	if format != "jsonl" && format != "csv" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date"})
+		return
+	}
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date"})
+		return
+	}
+
+	riskMu.RLock()
+	defer riskMu.RUnlock()
+	labeled := labeledAssessments(from, to)
+
+	c.Header("Content-Disposition", "attachment; filename=training."+format)
+	c.Status(http.StatusOK)
+
+	if format == "jsonl" {
+		c.Header("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(c.Writer)
+		for _, item := range labeled {
+			features, _ := item.assessment["features"].(map[string]interface{})
+			encoder.Encode(gin.H{
+				"transaction_id":  item.label.TransactionID,
+				"assessment_id":   item.label.AssessmentID,
+				"label":           item.label.Label,
+				"is_fraud":        fraudLabels[item.label.Label],
+				"score":           assessmentScore(item.assessment),
+				"decision":        item.assessment["decision"],
+				"ruleset_version": item.assessment["ruleset_version"],
+				"created_at":      item.assessment["created_at"],
+				"features":        features,
+			})
+		}
+		return
+	}
+
+	// Every feature seen in the export becomes a column
+	featureSet := map[string]bool{}
+	for _, item := range labeled {
+		features, _ := item.assessment["features"].(map[string]interface{})
+		for name := range features {
+			featureSet[name] = true
+		}
+	}
+	featureNames := make([]string, 0, len(featureSet))
+	for name := range featureSet {
+		featureNames = append(featureNames, name)
+	}
+	sort.Strings(featureNames)
+
+	c.Header("Content-Type", "text/csv")
+	writer := csv.NewWriter(c.Writer)
+	header := append([]string{"transaction_id", "assessment_id", "label", "is_fraud", "score", "decision", "ruleset_version", "created_at"}, featureNames...)
+	writer.Write(header)
+	for _, item := range labeled {
+		features, _ := item.assessment["features"].(map[string]interface{})
+		row := []string{
+			item.label.TransactionID,
+			item.label.AssessmentID,
+			item.label.Label,
+			strconv.FormatBool(fraudLabels[item.label.Label]),
+			strconv.Itoa(assessmentScore(item.assessment)),
+			fmt.Sprint(item.assessment["decision"]),
+			fmt.Sprint(item.assessment["ruleset_version"]),
+			fmt.Sprint(item.assessment["created_at"]),
+		}
+		for _, name := range featureNames {
+			row = append(row, formatFeature(features[name]))
+		}
+		writer.Write(row)
+	}
+	writer.Flush()
+}
+
+// formatFeature writes a feature value as a CSV cell: booleans as 0 or 1 so
+// the column can be used as a number, and missing values as empty
+func formatFeature(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
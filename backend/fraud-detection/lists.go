@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ListEntry blocks or allows transactions carrying a specific value. IP
+// entries may be a single address or a CIDR range.
+type ListEntry struct {
+	ID        string     `json:"id"`
+	List      string     `json:"list"`
+	Type      string     `json:"type"`
+	Value     string     `json:"value"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+
+	prefix netip.Prefix
+}
+
+// ListMatch is a list entry that matched a transaction
+type ListMatch struct {
+	EntryID string `json:"entry_id"`
+	List    string `json:"list"`
+	Type    string `json:"type"`
+	Value   string `json:"value"`
+	Matched string `json:"matched"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ListEntryRequest creates or replaces a list entry. TTL is a duration such
+// as "24h" and takes precedence over ExpiresAt.
+type ListEntryRequest struct {
+	List      string     `json:"list" binding:"required"`
+	Type      string     `json:"type" binding:"required"`
+	Value     string     `json:"value" binding:"required"`
+	Reason    string     `json:"reason"`
+	TTL       string     `json:"ttl"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+var listTypes = map[string]bool{"ip": true, "device": true, "email": true, "bin": true, "country": true}
+
+// MockListEntries represents a simple in-memory block and allow list store
+var MockListEntries = map[string]*ListEntry{}
+
+var listsMu sync.RWMutex
+
+// newListEntry validates a request and normalizes its value
+func newListEntry(request ListEntryRequest, now time.Time) (*ListEntry, error) {
+	list := strings.ToLower(strings.TrimSpace(request.List))
+	if list != "block" && list != "allow" {
+		return nil, fmt.Errorf("list must be block or allow")
+	}
+	kind := strings.ToLower(strings.TrimSpace(request.Type))
+	if !listTypes[kind] {
+		return nil, fmt.Errorf("type must be one of ip, device, email, bin or country")
+	}
+
+	entry := &ListEntry{
+		ID:        "list_" + uuid.New().String()[:8],
+		List:      list,
+		Type:      kind,
+		Reason:    request.Reason,
+		ExpiresAt: request.ExpiresAt,
+		CreatedAt: now,
+	}
+
+	value := strings.TrimSpace(request.Value)
+	switch kind {
+	case "ip":
+		prefix, err := parseIPOrPrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ip address or CIDR %q", value)
+		}
+		entry.prefix = prefix
+		value = prefix.String()
+	case "email":
+		value = strings.ToLower(value)
+	case "bin":
+		if len(value) < 6 || len(value) > 8 || strings.Trim(value, "0123456789") != "" {
+			return nil, fmt.Errorf("bin must be 6 to 8 digits")
+		}
+	case "country":
+		value = strings.ToUpper(value)
+		if len(value) != 2 {
+			return nil, fmt.Errorf("country must be a two-letter code")
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("value is required")
+	}
+	entry.Value = value
+
+	if request.TTL != "" {
+		ttl, err := time.ParseDuration(request.TTL)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid ttl %q", request.TTL)
+		}
+		expiresAt := now.Add(ttl)
+		entry.ExpiresAt = &expiresAt
+	}
+	return entry, nil
+}
+
+func parseIPOrPrefix(value string) (netip.Prefix, error) {
+	if strings.Contains(value, "/") {
+		prefix, err := netip.ParsePrefix(value)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func (e *ListEntry) expired(now time.Time) bool {
+	return e.ExpiresAt != nil && !now.Before(*e.ExpiresAt)
+}
+
+// matches reports whether the entry covers value, which must already be
+// normalized the same way as entry values
+func (e *ListEntry) matches(value string) bool {
+	if e.Type != "ip" {
+		return e.Value == value
+	}
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return false
+	}
+	return e.prefix.Contains(addr.Unmap())
+}
+
+// listAttributes extracts the values checked against lists from a
+// transaction, keyed by list type
+func listAttributes(ipAddress, deviceId, email, cardBin, country string) map[string]string {
+	return map[string]string{
+		"ip":      strings.TrimSpace(ipAddress),
+		"device":  strings.TrimSpace(deviceId),
+		"email":   strings.ToLower(strings.TrimSpace(email)),
+		"bin":     strings.TrimSpace(cardBin),
+		"country": strings.ToUpper(strings.TrimSpace(country)),
+	}
+}
+
+// matchLists returns every unexpired entry that matches the transaction,
+// blocklist matches first
+func matchLists(attributes map[string]string, now time.Time) []ListMatch {
+	listsMu.RLock()
+	defer listsMu.RUnlock()
+
+	matches := []ListMatch{}
+	for _, entry := range MockListEntries {
+		value := attributes[entry.Type]
+		if value == "" || entry.expired(now) {
+			continue
+		}
+		// BIN entries match any card number that starts with them
+		if entry.Type == "bin" && strings.HasPrefix(value, entry.Value) {
+			value = entry.Value
+		}
+		if !entry.matches(value) {
+			continue
+		}
+		matches = append(matches, ListMatch{
+			EntryID: entry.ID,
+			List:    entry.List,
+			Type:    entry.Type,
+			Value:   entry.Value,
+			Matched: attributes[entry.Type],
+			Reason:  entry.Reason,
+		})
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].List != matches[j].List {
+			return matches[i].List == "block"
+		}
+		return matches[i].EntryID < matches[j].EntryID
+	})
+	return matches
+}
+
+// applyListMatches overrides a rule result when the transaction is on a list.
+// A blocklist hit denies with the maximum score and beats any allowlist hit;
+// an allowlist hit on its own allows with a score of zero.
+func applyListMatches(result *RuleResult, matches []ListMatch) {
+	if len(matches) == 0 {
+		return
+	}
+
+	for _, match := range matches {
+		result.Factors = append(result.Factors, match.List+"list_"+match.Type+":"+match.Value)
+	}
+	if matches[0].List == "block" {
+		result.Score = 100
+		result.Decision = "deny"
+	} else {
+		result.Score = 0
+		result.Decision = "allow"
+	}
+}
+
+// countryFromLocation takes the country code from a "City, CC" location
+func countryFromLocation(location string) string {
+	parts := strings.Split(location, ",")
+	country := strings.TrimSpace(parts[len(parts)-1])
+	if len(country) != 2 {
+		return ""
+	}
+	return strings.ToUpper(country)
+}
+
+// purgeExpiredListEntries drops expired entries. Callers must hold listsMu.
+func purgeExpiredListEntries(now time.Time) {
+	for id, entry := range MockListEntries {
+		if entry.expired(now) {
+			delete(MockListEntries, id)
+		}
+	}
+}
+
+func handleListEntries(c *gin.Context) {
+	list := c.Query("list")
+	kind := c.Query("type")
+
+	listsMu.Lock()
+	purgeExpiredListEntries(time.Now())
+	entries := []ListEntry{}
+	for _, entry := range MockListEntries {
+		if (list == "" || entry.List == list) && (kind == "" || entry.Type == kind) {
+			entries = append(entries, *entry)
+		}
+	}
+	listsMu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+func handleGetListEntry(c *gin.Context) {
+	listsMu.RLock()
+	entry, ok := MockListEntries[c.Param("id")]
+	var result ListEntry
+	if ok {
+		result = *entry
+	}
+	listsMu.RUnlock()
+
+	if !ok || result.expired(time.Now()) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List entry not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entry": result,
+	})
+}
+
+func handleCreateListEntry(c *gin.Context) {
+	var request ListEntryRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	entry, err := newListEntry(request, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	listsMu.Lock()
+	MockListEntries[entry.ID] = entry
+	listsMu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "List entry created successfully",
+		"entry":   entry,
+	})
+}
+
+func handleUpdateListEntry(c *gin.Context) {
+	id := c.Param("id")
+	var request ListEntryRequest
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	listsMu.Lock()
+	defer listsMu.Unlock()
+
+	existing, ok := MockListEntries[id]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List entry not found"})
+		return
+	}
+
+	entry, err := newListEntry(request, time.Now().UTC())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entry.ID = id
+	entry.CreatedAt = existing.CreatedAt
+	MockListEntries[id] = entry
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "List entry updated successfully",
+		"entry":   entry,
+	})
+}
+
+func handleDeleteListEntry(c *gin.Context) {
+	id := c.Param("id")
+
+	listsMu.Lock()
+	_, ok := MockListEntries[id]
+	delete(MockListEntries, id)
+	listsMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "List entry not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "List entry deleted successfully",
+	})
+}
+
+// handleImportListEntries bulk loads entries from a CSV body. The header row
+// names the columns: list, type and value are required, reason, ttl and
+// expires_at are optional. The list and type query parameters fill in
+// columns the file leaves out. Nothing is imported if any row is invalid.
+func handleImportListEntries(c *gin.Context) {
+	reader := csv.NewReader(c.Request.Body)
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV header row is required"})
+		return
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := columns["value"]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSV must have a value column"})
+		return
+	}
+
+	now := time.Now().UTC()
+	entries := []*ListEntry{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		field := func(name, fallback string) string {
+			if i, ok := columns[name]; ok && i < len(record) && strings.TrimSpace(record[i]) != "" {
+				return strings.TrimSpace(record[i])
+			}
+			return fallback
+		}
+
+		request := ListEntryRequest{
+			List:   field("list", c.Query("list")),
+			Type:   field("type", c.Query("type")),
+			Value:  field("value", ""),
+			Reason: field("reason", c.Query("reason")),
+			TTL:    field("ttl", c.Query("ttl")),
+		}
+		if expires := field("expires_at", ""); expires != "" {
+			expiresAt, err := time.Parse(time.RFC3339, expires)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("line %d: invalid expires_at %q", line, expires)})
+				return
+			}
+			request.ExpiresAt = &expiresAt
+		}
+
+		entry, err := newListEntry(request, now)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("line %d: %v", line, err)})
+			return
+		}
+		entries = append(entries, entry)
+	}
+
+	listsMu.Lock()
+	for _, entry := range entries {
+		MockListEntries[entry.ID] = entry
+	}
+	listsMu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "List entries imported successfully",
+		"imported": len(entries),
+	})
+}
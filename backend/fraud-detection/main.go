@@ -2,9 +2,12 @@ package main
 
 import (
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -15,35 +18,121 @@ import (
 // MockRiskScores represents a simple in-memory risk score store
 var MockRiskScores = []gin.H{
 	{
-		"id":          "risk_1",
+		"id":             "risk_1",
 		"transaction_id": "txn_1",
-		"user_id":     "usr_1",
-		"score":       15, // Low risk (0-100 scale)
-		"factors":     []string{"verified_user", "common_ip_address", "known_device"},
-		"decision":    "allow",
-		"created_at":  "2023-04-06T10:30:00Z",
+		"user_id":        "usr_1",
+		"amount":         120.0,
+		"currency":       "USD",
+		"ip_address":     "203.0.113.10",
+		"device_id":      "dev_1",
+		"location":       "New York, US",
+		"score":          15, // Low risk (0-100 scale)
+		"factors":        []string{"verified_user", "common_ip_address", "known_device"},
+		"decision":       "allow",
+		"created_at":     "2023-04-06T10:30:00Z",
 	},
 	{
-		"id":          "risk_2",
+		"id":             "risk_2",
 		"transaction_id": "txn_2",
-		"user_id":     "usr_2",
-		"score":       25,
-		"factors":     []string{"verified_user", "unusual_location", "known_device"},
-		"decision":    "allow",
-		"created_at":  "2023-04-05T14:20:00Z",
+		"user_id":        "usr_2",
+		"amount":         80.0,
+		"currency":       "USD",
+		"ip_address":     "198.51.100.7",
+		"device_id":      "dev_2",
+		"location":       "Chicago, US",
+		"score":          25,
+		"factors":        []string{"verified_user", "unusual_location", "known_device"},
+		"decision":       "allow",
+		"created_at":     "2023-04-05T14:20:00Z",
 	},
 	{
-		"id":          "risk_3",
+		"id":             "risk_3",
 		"transaction_id": "txn_3",
-		"user_id":     "usr_3",
-		"score":       75, // High risk
-		"factors":     []string{"new_user", "unusual_amount", "suspicious_ip_address"},
-		"decision":    "review",
-		"created_at":  "2023-04-06T09:15:00Z",
+		"user_id":        "usr_3",
+		"amount":         2500.0,
+		"currency":       "USD",
+		"ip_address":     "192.0.2.44",
+		"device_id":      "",
+		"location":       "Lagos, NG",
+		"score":          75, // High risk
+		"factors":        []string{"new_user", "unusual_amount", "suspicious_ip_address"},
+		"decision":       "review",
+		"created_at":     "2023-04-06T09:15:00Z",
 	},
 }
 
+var riskMu sync.RWMutex
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		if err := runBacktestCommand(os.Args[2:]); err != nil {
+			log.Fatalf("Backtest failed: %v", err)
+		}
+		return
+	}
+
+	if err := loadRules(); err != nil {
+		log.Fatalf("Failed to load fraud rules: %v", err)
+	}
+	if rulesFilePath != "" {
+		interval, err := time.ParseDuration(os.Getenv("RULES_RELOAD_INTERVAL"))
+		if err != nil || interval <= 0 {
+			interval = 10 * time.Second
+		}
+		go watchRules(interval)
+	}
+
+	if path := os.Getenv("GEOIP_DB_FILE"); path != "" {
+		db, err := loadGeoDatabase(path)
+		if err != nil {
+			log.Fatalf("Failed to load IP database: %v", err)
+		}
+		geoDB = db
+		log.Printf("Loaded %d IP ranges from %s", len(db.ranges), path)
+	}
+
+	if modelFilePath != "" {
+		model, err := reloadModel()
+		if err != nil {
+			log.Fatalf("Failed to load fraud model: %v", err)
+		}
+		log.Printf("Loaded %s fraud model %s", model.Type, model.Version)
+	}
+
+	store, err := newVelocityStore(os.Getenv("VELOCITY_BACKEND"))
+	if err != nil {
+		log.Fatalf("Failed to create velocity store: %v", err)
+	}
+	velocity = store
+	if snapshotPath := os.Getenv("VELOCITY_SNAPSHOT_FILE"); snapshotPath != "" {
+		if err := loadVelocitySnapshot(snapshotPath); err != nil {
+			log.Printf("Failed to restore velocity snapshot: %v", err)
+		}
+		interval, err := time.ParseDuration(os.Getenv("VELOCITY_SNAPSHOT_INTERVAL"))
+		if err != nil || interval <= 0 {
+			interval = time.Minute
+		}
+		go runVelocitySnapshots(snapshotPath, interval)
+
+		// Save a final snapshot when the service is stopped
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		go func() {
+			<-signals
+			if err := saveVelocitySnapshot(snapshotPath); err != nil {
+				log.Printf("Failed to snapshot velocity counters: %v", err)
+			}
+			os.Exit(0)
+		}()
+	}
+
+	seedGraph()
+	pruneInterval, err := time.ParseDuration(os.Getenv("GRAPH_PRUNE_INTERVAL"))
+	if err != nil || pruneInterval <= 0 {
+		pruneInterval = time.Hour
+	}
+	go runGraphPruning(pruneInterval)
+
 	r := gin.Default()
 
 	// Configure CORS
@@ -69,6 +158,47 @@ func main() {
 	r.POST("/analyze", handleAnalyzeTransaction)
 	r.GET("/transaction/:transactionId", handleGetTransactionRisk)
 	r.GET("/user/:userId", handleGetUserRiskHistory)
+	r.GET("/assessments", handleListAssessments)
+	r.POST("/backtest", handleBacktest)
+
+	// Rule administration endpoints
+	r.GET("/rules", handleGetRules)
+	r.PUT("/rules", handleUpdateRules)
+	r.POST("/rules/reload", handleReloadRules)
+
+	// Block and allow list endpoints
+	r.GET("/lists", handleListEntries)
+	r.POST("/lists", handleCreateListEntry)
+	r.POST("/lists/import", handleImportListEntries)
+	r.GET("/lists/:id", handleGetListEntry)
+	r.PUT("/lists/:id", handleUpdateListEntry)
+	r.DELETE("/lists/:id", handleDeleteListEntry)
+
+	// Scoring model endpoints
+	r.GET("/model", handleGetModel)
+	r.POST("/model/reload", handleReloadModel)
+
+	// Analyst case management endpoints
+	r.GET("/cases", handleListCases)
+	r.GET("/cases/metrics", handleCaseMetrics)
+	r.GET("/cases/:id", handleGetCase)
+	r.POST("/cases/:id/claim", handleClaimCase)
+	r.POST("/cases/:id/release", handleReleaseCase)
+	r.POST("/cases/:id/notes", handleAddCaseNote)
+	r.POST("/cases/:id/resolve", handleResolveCase)
+
+	// Outcome label endpoints
+	r.GET("/labels", handleListLabels)
+	r.POST("/labels", handleRecordLabel)
+	r.GET("/labels/metrics", handleLabelMetrics)
+	r.GET("/labels/export", handleExportTrainingData)
+	r.GET("/labels/:transactionId", handleGetLabel)
+
+	// Link graph endpoints
+	r.GET("/graph/user/:userId", handleGetUserGraph)
+
+	// IP intelligence endpoints
+	r.GET("/geoip/:ip", handleLookupIP)
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -91,6 +221,16 @@ func handleAnalyzeTransaction(c *gin.Context) {
 		IpAddress     string  `json:"ip_address"`
 		DeviceId      string  `json:"device_id"`
 		Location      string  `json:"location"`
+		// CardFingerprint identifies the card without exposing its number
+		CardFingerprint string `json:"card_fingerprint"`
+		Email           string `json:"email"`
+		CardBin         string `json:"card_bin"`
+		// Country defaults to the country code at the end of Location
+		Country string `json:"country"`
+		// CardCountry is the card issuer's country
+		CardCountry string `json:"card_country"`
+		// PaymentId is the held payment an analyst's decision applies to
+		PaymentId string `json:"payment_id"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -98,68 +238,162 @@ func handleAnalyzeTransaction(c *gin.Context) {
 		return
 	}
 
-	// In a real system, perform actual fraud detection analysis
-	// For demo purposes, we'll generate a random risk score and decision
-	
-	// Seed the random number generator
-	rand.Seed(time.Now().UnixNano())
-	
-	// Generate a risk score between 0 and 100
-	riskScore := rand.Intn(101)
-	
-	// Determine factors that contribute to the risk score
-	factors := []string{}
-	
-	// Add some randomized factors
-	if rand.Intn(2) == 1 {
-		factors = append(factors, "verified_user")
-	} else {
-		factors = append(factors, "new_user")
-	}
-	
-	if request.Amount > 1000 {
-		factors = append(factors, "high_amount")
-	}
-	
-	if rand.Intn(2) == 1 {
-		factors = append(factors, "common_ip_address")
-	} else {
-		factors = append(factors, "unusual_ip_address")
-	}
-	
-	// Determine decision based on risk score
-	var decision string
-	if riskScore < 30 {
-		decision = "allow"
-	} else if riskScore < 70 {
-		decision = "review"
-	} else {
-		decision = "deny"
-	}
-	
+	now := time.Now()
+	features := map[string]interface{}{
+		"txn.amount":           request.Amount,
+		"txn.currency":         request.Currency,
+		"txn.ip_address":       request.IpAddress,
+		"txn.device_id":        request.DeviceId,
+		"txn.location":         request.Location,
+		"txn.card_fingerprint": request.CardFingerprint,
+		"txn.hour":             float64(now.UTC().Hour()),
+	}
+
+	riskMu.Lock()
+	defer riskMu.Unlock()
+
+	addUserFeatures(features, request.UserId, request.IpAddress, request.DeviceId, request.Location)
+	velocityStats := recordVelocity(features,
+		velocityKeys(request.UserId, request.IpAddress, request.DeviceId, request.CardFingerprint),
+		VelocityEvent{Time: now, Amount: request.Amount, CardFingerprint: request.CardFingerprint})
+
+	linkAttributes := map[string]string{
+		"device": request.DeviceId,
+		"card":   request.CardFingerprint,
+		"email":  strings.ToLower(strings.TrimSpace(request.Email)),
+		"ip":     request.IpAddress,
+	}
+	linkTransaction(request.UserId, linkAttributes, now)
+	links := addGraphFeatures(features, request.UserId, linkAttributes)
+
+	ipGeo, located := lookupIP(request.IpAddress)
+	addGeoFeatures(features, request.UserId, ipGeo, located, strings.ToUpper(request.CardCountry), now)
+
+	country := request.Country
+	if country == "" {
+		country = ipGeo.Country
+	}
+	if country == "" {
+		country = countryFromLocation(request.Location)
+	}
+	listMatches := matchLists(listAttributes(request.IpAddress, request.DeviceId, request.Email, request.CardBin, country), now)
+
+	var prediction *Prediction
+	if model := currentModel(); model != nil {
+		p := model.Predict(features)
+		prediction = &p
+	}
+	result, ruleScore := scoreTransaction(currentRules(), features, prediction, listMatches)
+	for _, match := range result.ShadowMatches {
+		log.Printf("Shadow rule %s matched transaction %s", match.RuleID, request.TransactionId)
+	}
+
+	triggered := make([]string, 0, len(result.Matches))
+	for _, match := range result.Matches {
+		triggered = append(triggered, match.RuleID)
+	}
+
 	// Create risk assessment record
 	riskId := "risk_" + uuid.New().String()[:8]
 	riskAssessment := gin.H{
-		"id":             riskId,
-		"transaction_id": request.TransactionId,
-		"user_id":        request.UserId,
-		"score":          riskScore,
-		"factors":        factors,
-		"decision":       decision,
-		"created_at":     time.Now().Format(time.RFC3339),
-	}
-	
+		"id":               riskId,
+		"transaction_id":   request.TransactionId,
+		"user_id":          request.UserId,
+		"amount":           request.Amount,
+		"currency":         request.Currency,
+		"ip_address":       request.IpAddress,
+		"device_id":        request.DeviceId,
+		"location":         request.Location,
+		"card_fingerprint": request.CardFingerprint,
+		"email":            request.Email,
+		"card_bin":         request.CardBin,
+		"country":          country,
+		"card_country":     strings.ToUpper(request.CardCountry),
+		"velocity":         velocityStats,
+		"list_matches":     listMatches,
+		"links":            links,
+		"score":            result.Score,
+		"rule_score":       ruleScore,
+		"model":            prediction,
+		"factors":          result.Factors,
+		"rules":            triggered,
+		"shadow_rules":     result.ShadowMatches,
+		"ruleset_version":  result.Version,
+		"features":         features,
+		"decision":         result.Decision,
+		"created_at":       now.Format(time.RFC3339),
+	}
+
+	if located {
+		riskAssessment["ip_geo"] = &ipGeo
+	}
+	if request.PaymentId != "" {
+		riskAssessment["payment_id"] = request.PaymentId
+	}
+
+	// Review decisions go to the analyst queue
+	if result.Decision == "review" {
+		reviewCase := openCase(riskId, request.TransactionId, request.PaymentId, request.UserId, result.Score, result.Factors, now)
+		riskAssessment["case_id"] = reviewCase.ID
+	}
+
 	// Add to mock risk scores
 	MockRiskScores = append(MockRiskScores, riskAssessment)
-	
+
 	c.JSON(http.StatusOK, gin.H{
 		"risk_assessment": riskAssessment,
 	})
 }
 
+// addUserFeatures summarises a user's earlier assessments as user.*
+// attributes for rule evaluation. Callers must hold riskMu.
+func addUserFeatures(features map[string]interface{}, userId, ipAddress, deviceId, location string) {
+	var count, denied int
+	var total float64
+	knownDevice, knownIp, knownLocation := false, false, false
+
+	for _, risk := range MockRiskScores {
+		if risk["user_id"] != userId {
+			continue
+		}
+		count++
+		if risk["decision"] == "deny" {
+			denied++
+		}
+		if amount, ok := risk["amount"].(float64); ok {
+			total += amount
+		}
+		if deviceId != "" && risk["device_id"] == deviceId {
+			knownDevice = true
+		}
+		if ipAddress != "" && risk["ip_address"] == ipAddress {
+			knownIp = true
+		}
+		if location != "" && risk["location"] == location {
+			knownLocation = true
+		}
+	}
+
+	var average float64
+	if count > 0 {
+		average = total / float64(count)
+	}
+
+	features["user.transaction_count"] = float64(count)
+	features["user.is_new"] = count == 0
+	features["user.denied_count"] = float64(denied)
+	features["user.avg_amount"] = average
+	features["user.known_device"] = knownDevice
+	features["user.known_ip"] = knownIp
+	features["user.known_location"] = knownLocation
+}
+
 func handleGetTransactionRisk(c *gin.Context) {
 	transactionId := c.Param("transactionId")
-	
+
+	riskMu.RLock()
+	defer riskMu.RUnlock()
+
 	// Find risk assessment for the transaction
 	for _, risk := range MockRiskScores {
 		if risk["transaction_id"] == transactionId {
@@ -169,13 +403,16 @@ func handleGetTransactionRisk(c *gin.Context) {
 			return
 		}
 	}
-	
+
 	c.JSON(http.StatusNotFound, gin.H{"error": "Risk assessment not found for this transaction"})
 }
 
 func handleGetUserRiskHistory(c *gin.Context) {
 	userId := c.Param("userId")
-	
+
+	riskMu.RLock()
+	defer riskMu.RUnlock()
+
 	// Find all risk assessments for the user
 	var userRiskHistory []gin.H
 	for _, risk := range MockRiskScores {
@@ -183,9 +420,9 @@ func handleGetUserRiskHistory(c *gin.Context) {
 			userRiskHistory = append(userRiskHistory, risk)
 		}
 	}
-	
+
 	c.JSON(http.StatusOK, gin.H{
 		"risk_history": userRiskHistory,
 		"count":        len(userRiskHistory),
 	})
-} 
\ No newline at end of file
+}
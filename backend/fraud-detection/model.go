@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Model is a trained fraud model in SecurePay's JSON format. Type is
+// logistic_regression or tree_ensemble; both produce log-odds that are
+// turned into a fraud probability with the logistic function.
+//
+// ONNX and other binary formats are not supported because scoring them
+// needs a native runtime. Export the model to this format instead: linear
+// models as coefficients and boosted trees, such as XGBoost or LightGBM
+// dumps, as node lists.
+type Model struct {
+	Version string `json:"version"`
+	Type    string `json:"type"`
+
+	// Logistic regression
+	Intercept float64        `json:"intercept"`
+	Features  []ModelFeature `json:"features,omitempty"`
+
+	// Tree ensemble
+	BaseScore float64     `json:"base_score"`
+	Trees     []ModelTree `json:"trees,omitempty"`
+
+	Source   string    `json:"source,omitempty"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// ModelFeature is one logistic regression input. The raw value is optionally
+// log1p transformed, then standardized with Mean and Std when Std is set.
+// Default is used when the transaction has no numeric value for the feature.
+type ModelFeature struct {
+	Name      string  `json:"name"`
+	Weight    float64 `json:"weight"`
+	Transform string  `json:"transform,omitempty"`
+	Mean      float64 `json:"mean,omitempty"`
+	Std       float64 `json:"std,omitempty"`
+	Default   float64 `json:"default,omitempty"`
+}
+
+// ModelTree is a regression tree whose root is Nodes[0]
+type ModelTree struct {
+	Nodes []ModelNode `json:"nodes"`
+}
+
+// ModelNode is a split, or a leaf when Leaf is set. Values below Threshold go
+// left. Missing says where transactions without the feature go, left by
+// default. Value is the node's expected output, used to explain predictions;
+// when omitted it is taken as the mean of its children.
+type ModelNode struct {
+	Feature   string   `json:"feature,omitempty"`
+	Threshold float64  `json:"threshold,omitempty"`
+	Left      int      `json:"left,omitempty"`
+	Right     int      `json:"right,omitempty"`
+	Missing   string   `json:"missing,omitempty"`
+	Leaf      *float64 `json:"leaf,omitempty"`
+	Value     *float64 `json:"value,omitempty"`
+}
+
+// Prediction is a model's view of one transaction. Contributions are in
+// log-odds and add up, with Bias, to the model's log-odds output.
+type Prediction struct {
+	Version       string                `json:"version"`
+	Probability   float64               `json:"probability"`
+	Score         int                   `json:"score"`
+	Bias          float64               `json:"bias"`
+	Contributions []FeatureContribution `json:"contributions"`
+}
+
+// FeatureContribution is how much a feature moved the prediction
+type FeatureContribution struct {
+	Feature      string      `json:"feature"`
+	Value        interface{} `json:"value"`
+	Contribution float64     `json:"contribution"`
+}
+
+var (
+	activeModel   *Model
+	modelMu       sync.RWMutex
+	modelFilePath = os.Getenv("MODEL_FILE")
+)
+
+// loadModelFile reads and validates a model file
+func loadModelFile(path string) (*Model, error) {
+	if strings.HasSuffix(strings.ToLower(path), ".onnx") {
+		return nil, fmt.Errorf("%s: ONNX models are not supported, export the model to the JSON format", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var model Model
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := model.prepare(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	model.Source = path
+	model.LoadedAt = time.Now().UTC()
+	return &model, nil
+}
+
+// prepare validates the model and fills in missing node values
+func (m *Model) prepare() error {
+	if m.Version == "" {
+		return fmt.Errorf("model version is required")
+	}
+
+	switch m.Type {
+	case "logistic_regression":
+		if len(m.Features) == 0 {
+			return fmt.Errorf("logistic regression needs at least one feature")
+		}
+		for _, feature := range m.Features {
+			if feature.Name == "" {
+				return fmt.Errorf("feature name is required")
+			}
+			if feature.Transform != "" && feature.Transform != "log1p" {
+				return fmt.Errorf("feature %s: unknown transform %q", feature.Name, feature.Transform)
+			}
+		}
+	case "tree_ensemble":
+		if len(m.Trees) == 0 {
+			return fmt.Errorf("tree ensemble needs at least one tree")
+		}
+		for i := range m.Trees {
+			if err := m.Trees[i].prepare(); err != nil {
+				return fmt.Errorf("tree %d: %w", i, err)
+			}
+		}
+	default:
+		return fmt.Errorf("model type must be logistic_regression or tree_ensemble")
+	}
+	return nil
+}
+
+// prepare checks the tree is well formed and computes node values
+func (t *ModelTree) prepare() error {
+	if len(t.Nodes) == 0 {
+		return fmt.Errorf("tree has no nodes")
+	}
+
+	visiting := make([]bool, len(t.Nodes))
+	var walk func(i int) (float64, error)
+	walk = func(i int) (float64, error) {
+		if i < 0 || i >= len(t.Nodes) {
+			return 0, fmt.Errorf("node index %d out of range", i)
+		}
+		if visiting[i] {
+			return 0, fmt.Errorf("node %d is reachable more than once", i)
+		}
+		visiting[i] = true
+
+		node := &t.Nodes[i]
+		if node.Leaf != nil {
+			node.Value = node.Leaf
+			return *node.Leaf, nil
+		}
+		if node.Feature == "" {
+			return 0, fmt.Errorf("node %d is neither a leaf nor a split", i)
+		}
+		if node.Missing != "" && node.Missing != "left" && node.Missing != "right" {
+			return 0, fmt.Errorf("node %d: missing must be left or right", i)
+		}
+		if node.Left == 0 || node.Right == 0 {
+			return 0, fmt.Errorf("node %d needs left and right children", i)
+		}
+		left, err := walk(node.Left)
+		if err != nil {
+			return 0, err
+		}
+		right, err := walk(node.Right)
+		if err != nil {
+			return 0, err
+		}
+		if node.Value == nil {
+			mean := (left + right) / 2
+			node.Value = &mean
+		}
+		return *node.Value, nil
+	}
+
+	_, err := walk(0)
+	return err
+}
+
+// numericFeature reads a feature as a number. Booleans count as 0 or 1;
+// anything else non-numeric is treated as missing.
+func numericFeature(features map[string]interface{}, name string) (float64, bool) {
+	switch value := normalizeValue(features[name]).(type) {
+	case float64:
+		return value, true
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// Predict scores a transaction and attributes the result to its features
+func (m *Model) Predict(features map[string]interface{}) Prediction {
+	contributions := map[string]float64{}
+	var bias, logit float64
+
+	if m.Type == "logistic_regression" {
+		bias = m.Intercept
+		logit = bias
+		for _, feature := range m.Features {
+			value, ok := numericFeature(features, feature.Name)
+			if !ok {
+				value = feature.Default
+			}
+			if feature.Transform == "log1p" {
+				value = math.Log1p(math.Max(value, 0))
+			}
+			if feature.Std != 0 {
+				value = (value - feature.Mean) / feature.Std
+			}
+			contribution := feature.Weight * value
+			contributions[feature.Name] += contribution
+			logit += contribution
+		}
+	} else {
+		// Each split on the path to the leaf is credited with the change in
+		// expected value it caused
+		bias = m.BaseScore
+		for _, tree := range m.Trees {
+			bias += *tree.Nodes[0].Value
+		}
+		logit = bias
+		for _, tree := range m.Trees {
+			node := tree.Nodes[0]
+			for node.Leaf == nil {
+				next := node.Left
+				value, ok := numericFeature(features, node.Feature)
+				if (!ok && node.Missing == "right") || (ok && value >= node.Threshold) {
+					next = node.Right
+				}
+				child := tree.Nodes[next]
+				contribution := *child.Value - *node.Value
+				contributions[node.Feature] += contribution
+				logit += contribution
+				node = child
+			}
+		}
+	}
+
+	probability := 1 / (1 + math.Exp(-logit))
+	prediction := Prediction{
+		Version:       m.Version,
+		Probability:   math.Round(probability*10000) / 10000,
+		Score:         int(math.Round(probability * 100)),
+		Bias:          bias,
+		Contributions: []FeatureContribution{},
+	}
+	for name, contribution := range contributions {
+		prediction.Contributions = append(prediction.Contributions, FeatureContribution{
+			Feature:      name,
+			Value:        features[name],
+			Contribution: math.Round(contribution*10000) / 10000,
+		})
+	}
+	sort.Slice(prediction.Contributions, func(i, j int) bool {
+		a, b := math.Abs(prediction.Contributions[i].Contribution), math.Abs(prediction.Contributions[j].Contribution)
+		if a != b {
+			return a > b
+		}
+		return prediction.Contributions[i].Feature < prediction.Contributions[j].Feature
+	})
+	return prediction
+}
+
+func currentModel() *Model {
+	modelMu.RLock()
+	defer modelMu.RUnlock()
+	return activeModel
+}
+
+// reloadModel loads MODEL_FILE and makes it the active model
+func reloadModel() (*Model, error) {
+	model, err := loadModelFile(modelFilePath)
+	if err != nil {
+		return nil, err
+	}
+	modelMu.Lock()
+	activeModel = model
+	modelMu.Unlock()
+	return model, nil
+}
+
+// blendScores mixes the model score into the rule score by the ruleset's
+// weights and re-decides. Without a model or a model weight the rule result
+// is left as it is.
+func blendScores(rs *RuleSet, result *RuleResult, prediction *Prediction) {
+	if prediction == nil || rs.Blend.Model <= 0 {
+		return
+	}
+	total := rs.Blend.Rules + rs.Blend.Model
+	score := (rs.Blend.Rules*float64(result.Score) + rs.Blend.Model*float64(prediction.Score)) / total
+	result.Score = clampScore(int(math.Round(score)))
+	result.Decision = rs.Decide(result.Score)
+}
+
+func handleGetModel(c *gin.Context) {
+	model := currentModel()
+	if model == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No model is loaded"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"model": model,
+		"blend": currentRules().Blend,
+	})
+}
+
+func handleReloadModel(c *gin.Context) {
+	if modelFilePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "MODEL_FILE is not configured"})
+		return
+	}
+
+	model, err := reloadModel()
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Model reloaded successfully",
+		"model":   model,
+	})
+}
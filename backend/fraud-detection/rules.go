@@ -0,0 +1,398 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Rule adds Points to the risk score and reports Factor when its expression
+// matches. Negative points lower the score for trusted behaviour. Rules in
+// shadow mode are evaluated and reported but never change the score.
+type Rule struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+	Expression  string `json:"expression"`
+	Points      int    `json:"points"`
+	Factor      string `json:"factor"`
+	Mode        string `json:"mode,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+
+	compiled Expr
+}
+
+// Thresholds map a score onto a decision: scores below Review are allowed,
+// scores below Deny are sent to review and anything else is denied
+type Thresholds struct {
+	Review int `json:"review"`
+	Deny   int `json:"deny"`
+}
+
+// BlendWeights set how much the rule score and the model score count
+// towards the final score. A zero model weight ignores the model.
+type BlendWeights struct {
+	Rules float64 `json:"rules"`
+	Model float64 `json:"model"`
+}
+
+// RuleSet is a versioned collection of rules
+type RuleSet struct {
+	Version    string       `json:"version"`
+	BaseScore  int          `json:"base_score"`
+	Thresholds Thresholds   `json:"thresholds"`
+	Blend      BlendWeights `json:"blend"`
+	Rules      []Rule       `json:"rules"`
+	Source     string       `json:"source,omitempty"`
+	LoadedAt   time.Time    `json:"loaded_at"`
+}
+
+// RuleMatch is a rule that fired for a transaction
+type RuleMatch struct {
+	RuleID string `json:"rule_id"`
+	Factor string `json:"factor"`
+	Points int    `json:"points"`
+}
+
+// RuleResult is the outcome of evaluating a ruleset
+type RuleResult struct {
+	Score         int         `json:"score"`
+	Decision      string      `json:"decision"`
+	Factors       []string    `json:"factors"`
+	Matches       []RuleMatch `json:"matches"`
+	ShadowMatches []RuleMatch `json:"shadow_matches"`
+	Version       string      `json:"version"`
+}
+
+// defaultRuleSet is used when RULES_FILE is not configured
+var defaultRuleSet = RuleSet{
+	Version:    "builtin-5",
+	BaseScore:  10,
+	Thresholds: Thresholds{Review: 30, Deny: 70},
+	Blend:      BlendWeights{Rules: 0.6, Model: 0.4},
+	Rules: []Rule{
+		{ID: "new_user", Description: "First transaction seen for this user", Expression: "user.is_new", Points: 15, Factor: "new_user"},
+		{ID: "verified_user", Description: "Established user with no prior denials", Expression: "user.transaction_count >= 3 && user.denied_count == 0", Points: -10, Factor: "verified_user"},
+		{ID: "high_amount", Description: "Amount above 1000", Expression: "txn.amount > 1000", Points: 25, Factor: "high_amount"},
+		{ID: "unusual_amount", Description: "Amount far above the user's average", Expression: "user.transaction_count >= 3 && txn.amount > user.avg_amount * 5", Points: 20, Factor: "unusual_amount"},
+		{ID: "known_device", Description: "Device used by this user before", Expression: "user.known_device", Points: -5, Factor: "known_device"},
+		{ID: "new_device", Description: "Established user on a device not seen before", Expression: "!user.is_new && txn.device_id != '' && !user.known_device", Points: 15, Factor: "new_device"},
+		{ID: "missing_device", Description: "No device identifier supplied", Expression: "txn.device_id == ''", Points: 10, Factor: "missing_device"},
+		{ID: "common_ip_address", Description: "IP address used by this user before", Expression: "user.known_ip", Points: -5, Factor: "common_ip_address"},
+		{ID: "unusual_ip_address", Description: "Established user on an IP address not seen before", Expression: "!user.is_new && txn.ip_address != '' && !user.known_ip", Points: 15, Factor: "unusual_ip_address"},
+		{ID: "unusual_location", Description: "Established user in a location not seen before", Expression: "!user.is_new && txn.location != '' && !user.known_location", Points: 10, Factor: "unusual_location"},
+		{ID: "ip_country_mismatch", Description: "IP address country differs from the card issuer country", Expression: "geo.country_mismatch", Points: 20, Factor: "ip_country_mismatch"},
+		{ID: "tor_exit_node", Description: "IP address is a Tor exit node", Expression: "ip.is_tor", Points: 35, Factor: "tor_exit_node"},
+		{ID: "vpn_ip_address", Description: "IP address belongs to a VPN provider", Expression: "ip.is_vpn && !ip.is_tor", Points: 15, Factor: "vpn_ip_address"},
+		{ID: "hosting_ip_address", Description: "IP address belongs to a hosting provider", Expression: "ip.is_hosting && !ip.is_vpn && !ip.is_tor", Points: 15, Factor: "hosting_ip_address"},
+		{ID: "impossible_travel", Description: "Faster than an airliner since the user's previous transaction", Expression: "geo.travel_distance_km > 500 && geo.travel_speed_kmh > 900", Points: 35, Factor: "impossible_travel"},
+		{ID: "user_burst", Description: "More than 5 transactions from the user in a minute", Expression: "velocity.user.count_1m > 5", Points: 30, Factor: "high_velocity_user"},
+		{ID: "card_testing", Description: "Several cards tried from one device or IP address within an hour", Expression: "velocity.device.cards_1h >= 3 || velocity.ip.cards_1h >= 3", Points: 40, Factor: "card_testing"},
+		{ID: "ip_burst", Description: "More than 20 transactions from the IP address in an hour", Expression: "velocity.ip.count_1h > 20", Points: 20, Factor: "high_velocity_ip_address"},
+		{ID: "card_burst", Description: "More than 10 transactions on the card in a day", Expression: "velocity.card.count_24h > 10", Points: 20, Factor: "high_velocity_card"},
+		{ID: "daily_volume", Description: "User spent more than 10000 in a day", Expression: "velocity.user.amount_24h > 10000", Points: 20, Factor: "high_daily_volume"},
+		{ID: "shared_device", Description: "Device used by three or more accounts", Expression: "graph.device_accounts >= 3", Points: 15, Factor: "device_shared_by_accounts"},
+		{ID: "shared_card", Description: "Card used by three or more accounts", Expression: "graph.card_accounts >= 3", Points: 20, Factor: "card_shared_by_accounts"},
+		{ID: "linked_to_fraudster", Description: "Shares a device, card, email or IP address with a known fraudster", Expression: "graph.linked_to_fraudster", Points: 40, Factor: "linked_to_fraudster"},
+		{ID: "known_fraudster", Description: "User has a transaction labeled as fraud", Expression: "user.is_fraudster", Points: 50, Factor: "known_fraudster"},
+		{ID: "prior_denials", Description: "User has been denied before", Expression: "user.denied_count > 0", Points: 25, Factor: "previously_denied_user"},
+	},
+}
+
+var (
+	activeRules   *RuleSet
+	rulesMu       sync.RWMutex
+	rulesModTime  time.Time
+	rulesFilePath = os.Getenv("RULES_FILE")
+)
+
+// compile validates the ruleset and compiles every rule expression
+func (rs *RuleSet) compile() error {
+	if rs.Version == "" {
+		return fmt.Errorf("ruleset version is required")
+	}
+	if rs.Thresholds.Review <= 0 || rs.Thresholds.Deny <= rs.Thresholds.Review || rs.Thresholds.Deny > 100 {
+		return fmt.Errorf("thresholds must satisfy 0 < review < deny <= 100")
+	}
+	if rs.Blend.Rules < 0 || rs.Blend.Model < 0 {
+		return fmt.Errorf("blend weights must not be negative")
+	}
+
+	seen := map[string]bool{}
+	for i := range rs.Rules {
+		rule := &rs.Rules[i]
+		if rule.ID == "" {
+			return fmt.Errorf("rule %d has no id", i)
+		}
+		if seen[rule.ID] {
+			return fmt.Errorf("duplicate rule id %q", rule.ID)
+		}
+		seen[rule.ID] = true
+		if rule.Factor == "" {
+			rule.Factor = rule.ID
+		}
+		if rule.Mode != "" && rule.Mode != "active" && rule.Mode != "shadow" {
+			return fmt.Errorf("rule %s: mode must be active or shadow", rule.ID)
+		}
+
+		compiled, err := CompileExpr(rule.Expression)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", rule.ID, err)
+		}
+		rule.compiled = compiled
+	}
+	return nil
+}
+
+// Evaluate scores a transaction's attributes against the ruleset
+func (rs *RuleSet) Evaluate(features map[string]interface{}) RuleResult {
+	result := RuleResult{
+		Score:         rs.BaseScore,
+		Factors:       []string{},
+		Matches:       []RuleMatch{},
+		ShadowMatches: []RuleMatch{},
+		Version:       rs.Version,
+	}
+
+	for _, rule := range rs.Rules {
+		if rule.Disabled {
+			continue
+		}
+		value, err := rule.compiled.Eval(features)
+		if err != nil {
+			log.Printf("Rule %s failed to evaluate: %v", rule.ID, err)
+			continue
+		}
+		if !Truthy(value) {
+			continue
+		}
+		match := RuleMatch{RuleID: rule.ID, Factor: rule.Factor, Points: rule.Points}
+		if rule.Mode == "shadow" {
+			result.ShadowMatches = append(result.ShadowMatches, match)
+			continue
+		}
+		result.Score += rule.Points
+		result.Factors = append(result.Factors, rule.Factor)
+		result.Matches = append(result.Matches, match)
+	}
+
+	result.Score = clampScore(result.Score)
+	result.Decision = rs.Decide(result.Score)
+	return result
+}
+
+// scoreTransaction runs the full decision pipeline: rules, then the model
+// blend, then any list override. Live scoring and backtests both use it so a
+// replay decides exactly as production would have.
+func scoreTransaction(rs *RuleSet, features map[string]interface{}, prediction *Prediction, listMatches []ListMatch) (RuleResult, int) {
+	result := rs.Evaluate(features)
+	ruleScore := result.Score
+	blendScores(rs, &result, prediction)
+	applyListMatches(&result, listMatches)
+	return result, ruleScore
+}
+
+// Decide maps a score onto allow, review or deny
+func (rs *RuleSet) Decide(score int) string {
+	switch {
+	case score < rs.Thresholds.Review:
+		return "allow"
+	case score < rs.Thresholds.Deny:
+		return "review"
+	default:
+		return "deny"
+	}
+}
+
+func clampScore(score int) int {
+	if score < 0 {
+		return 0
+	}
+	if score > 100 {
+		return 100
+	}
+	return score
+}
+
+// currentRules returns the active ruleset. Rulesets are never modified after
+// they are activated, so callers may use the result without holding a lock.
+func currentRules() *RuleSet {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	return activeRules
+}
+
+func activateRules(rs *RuleSet) {
+	rulesMu.Lock()
+	activeRules = rs
+	rulesMu.Unlock()
+	log.Printf("Activated fraud ruleset %s with %d rules", rs.Version, len(rs.Rules))
+}
+
+// parseRuleSet decodes and compiles a ruleset document
+func parseRuleSet(data []byte, source string) (*RuleSet, error) {
+	var rs RuleSet
+	if err := json.Unmarshal(data, &rs); err != nil {
+		return nil, err
+	}
+	if err := rs.compile(); err != nil {
+		return nil, err
+	}
+	rs.Source = source
+	rs.LoadedAt = time.Now().UTC()
+	return &rs, nil
+}
+
+// loadRules activates the ruleset from RULES_FILE, or the built-in ruleset
+// when no file is configured
+func loadRules() error {
+	if rulesFilePath == "" {
+		rs := defaultRuleSet
+		rs.Rules = append([]Rule(nil), defaultRuleSet.Rules...)
+		if err := rs.compile(); err != nil {
+			return err
+		}
+		rs.Source = "builtin"
+		rs.LoadedAt = time.Now().UTC()
+		activateRules(&rs)
+		return nil
+	}
+	return reloadRulesFile(true)
+}
+
+// reloadRulesFile reloads RULES_FILE if it changed since the last load. An
+// invalid file is reported and the previous ruleset stays active.
+func reloadRulesFile(force bool) error {
+	info, err := os.Stat(rulesFilePath)
+	if err != nil {
+		return err
+	}
+
+	rulesMu.RLock()
+	unchanged := info.ModTime().Equal(rulesModTime)
+	rulesMu.RUnlock()
+	if unchanged && !force {
+		return nil
+	}
+
+	data, err := os.ReadFile(rulesFilePath)
+	if err != nil {
+		return err
+	}
+	rs, err := parseRuleSet(data, rulesFilePath)
+	if err != nil {
+		return fmt.Errorf("%s: %w", rulesFilePath, err)
+	}
+
+	rulesMu.Lock()
+	rulesModTime = info.ModTime()
+	rulesMu.Unlock()
+	activateRules(rs)
+	return nil
+}
+
+// watchRules polls RULES_FILE and hot-reloads it when it changes
+func watchRules(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := reloadRulesFile(false); err != nil {
+			log.Printf("Failed to reload fraud rules: %v", err)
+		}
+	}
+}
+
+// persistRules writes a ruleset to RULES_FILE so the next hot reload picks
+// up the same version
+func persistRules(data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(rulesFilePath), ".rules-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), rulesFilePath); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(rulesFilePath)
+	if err != nil {
+		return err
+	}
+	rulesMu.Lock()
+	rulesModTime = info.ModTime()
+	rulesMu.Unlock()
+	return nil
+}
+
+func handleGetRules(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"ruleset": currentRules(),
+	})
+}
+
+// handleUpdateRules replaces the active ruleset. When rules are file backed
+// the new ruleset is also written to RULES_FILE.
+func handleUpdateRules(c *gin.Context) {
+	data, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	rs, err := parseRuleSet(data, "api")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if rs.Version == currentRules().Version {
+		c.JSON(http.StatusConflict, gin.H{"error": "Ruleset version " + rs.Version + " is already active"})
+		return
+	}
+
+	if rulesFilePath != "" {
+		document, _ := json.MarshalIndent(rs, "", "  ")
+		if err := persistRules(document); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to persist ruleset: " + err.Error()})
+			return
+		}
+		rs.Source = rulesFilePath
+	}
+	activateRules(rs)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Ruleset updated successfully",
+		"ruleset": rs,
+	})
+}
+
+func handleReloadRules(c *gin.Context) {
+	if rulesFilePath == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "RULES_FILE is not configured"})
+		return
+	}
+
+	if err := reloadRulesFile(true); err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Ruleset reloaded successfully",
+		"ruleset": currentRules(),
+	})
+}
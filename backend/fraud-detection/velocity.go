@@ -0,0 +1,294 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VelocityEvent is a single transaction counted towards velocity windows
+type VelocityEvent struct {
+	Time            time.Time `json:"time"`
+	Amount          float64   `json:"amount"`
+	CardFingerprint string    `json:"card_fingerprint,omitempty"`
+}
+
+// WindowStats summarises the events for one key inside one window. Amounts
+// are summed as submitted, without currency conversion.
+type WindowStats struct {
+	Count         int     `json:"count"`
+	DistinctCards int     `json:"distinct_cards"`
+	Amount        float64 `json:"amount"`
+}
+
+// VelocityStore keeps recent events per key, where a key identifies a user,
+// IP address, device or card fingerprint
+type VelocityStore interface {
+	Record(key string, event VelocityEvent)
+	Stats(key string, window time.Duration, now time.Time) WindowStats
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+// velocityDimensions are the attributes velocity is tracked for
+var velocityDimensions = []string{"user", "ip", "device", "card"}
+
+// velocityWindows are the sliding windows reported for every dimension
+var velocityWindows = []struct {
+	Name     string
+	Duration time.Duration
+}{
+	{"1m", time.Minute},
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// velocityRetention is how long events are kept, which is the longest window
+const velocityRetention = 24 * time.Hour
+
+var velocity VelocityStore
+
+// newVelocityStore creates the backend named by VELOCITY_BACKEND
+func newVelocityStore(backend string) (VelocityStore, error) {
+	switch backend {
+	case "", "memory":
+		return newMemoryVelocityStore(
+			envInt("VELOCITY_MAX_KEYS", 100000),
+			envInt("VELOCITY_MAX_EVENTS_PER_KEY", 1000),
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown velocity backend %q", backend)
+	}
+}
+
+func envInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil || value <= 0 {
+		return fallback
+	}
+	return value
+}
+
+// memoryVelocityStore is a bounded in-memory VelocityStore. When it holds
+// maxKeys keys the least recently updated key is evicted, and each key keeps
+// at most maxEvents of its most recent events.
+type memoryVelocityStore struct {
+	mu        sync.Mutex
+	maxKeys   int
+	maxEvents int
+	entries   map[string]*list.Element
+	// recency orders keys from most to least recently updated
+	recency *list.List
+}
+
+type velocityEntry struct {
+	key    string
+	events []VelocityEvent
+}
+
+func newMemoryVelocityStore(maxKeys, maxEvents int) *memoryVelocityStore {
+	return &memoryVelocityStore{
+		maxKeys:   maxKeys,
+		maxEvents: maxEvents,
+		entries:   map[string]*list.Element{},
+		recency:   list.New(),
+	}
+}
+
+func (s *memoryVelocityStore) Record(key string, event VelocityEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.append(key, event)
+}
+
+// append adds an event to a key. Callers must hold s.mu.
+func (s *memoryVelocityStore) append(key string, event VelocityEvent) {
+	element, ok := s.entries[key]
+	if !ok {
+		for len(s.entries) >= s.maxKeys {
+			oldest := s.recency.Back()
+			delete(s.entries, oldest.Value.(*velocityEntry).key)
+			s.recency.Remove(oldest)
+		}
+		element = s.recency.PushFront(&velocityEntry{key: key})
+		s.entries[key] = element
+	} else {
+		s.recency.MoveToFront(element)
+	}
+
+	entry := element.Value.(*velocityEntry)
+	entry.events = append(entry.events, event)
+	entry.events = pruneEvents(entry.events, event.Time.Add(-velocityRetention), s.maxEvents)
+}
+
+// pruneEvents drops events older than cutoff and keeps at most max events
+func pruneEvents(events []VelocityEvent, cutoff time.Time, max int) []VelocityEvent {
+	start := 0
+	for start < len(events) && events[start].Time.Before(cutoff) {
+		start++
+	}
+	if len(events)-start > max {
+		start = len(events) - max
+	}
+	if start == 0 {
+		return events
+	}
+	return append([]VelocityEvent(nil), events[start:]...)
+}
+
+func (s *memoryVelocityStore) Stats(key string, window time.Duration, now time.Time) WindowStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats WindowStats
+	element, ok := s.entries[key]
+	if !ok {
+		return stats
+	}
+
+	cutoff := now.Add(-window)
+	cards := map[string]bool{}
+	events := element.Value.(*velocityEntry).events
+	for i := len(events) - 1; i >= 0 && !events[i].Time.Before(cutoff); i-- {
+		stats.Count++
+		stats.Amount += events[i].Amount
+		if events[i].CardFingerprint != "" {
+			cards[events[i].CardFingerprint] = true
+		}
+	}
+	stats.DistinctCards = len(cards)
+	return stats
+}
+
+// Snapshot writes every key's events as JSON
+func (s *memoryVelocityStore) Snapshot(w io.Writer) error {
+	s.mu.Lock()
+	snapshot := make(map[string][]VelocityEvent, len(s.entries))
+	for key, element := range s.entries {
+		snapshot[key] = element.Value.(*velocityEntry).events
+	}
+	err := json.NewEncoder(w).Encode(snapshot)
+	s.mu.Unlock()
+	return err
+}
+
+// Restore loads a snapshot, discarding events that have already expired
+func (s *memoryVelocityStore) Restore(r io.Reader) error {
+	var snapshot map[string][]VelocityEvent
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := time.Now().Add(-velocityRetention)
+	for key, events := range snapshot {
+		for _, event := range events {
+			if !event.Time.Before(cutoff) {
+				s.append(key, event)
+			}
+		}
+	}
+	return nil
+}
+
+// velocityKeys maps each dimension to its store key for a transaction.
+// Dimensions the transaction has no value for are left out.
+func velocityKeys(userId, ipAddress, deviceId, cardFingerprint string) map[string]string {
+	keys := map[string]string{}
+	values := map[string]string{
+		"user":   userId,
+		"ip":     ipAddress,
+		"device": deviceId,
+		"card":   cardFingerprint,
+	}
+	for dimension, value := range values {
+		if value != "" {
+			keys[dimension] = dimension + ":" + value
+		}
+	}
+	return keys
+}
+
+// recordVelocity counts a transaction and returns the window stats for each
+// of its dimensions, including the transaction itself. The stats are also
+// added to features as velocity.<dimension>.<count|cards|amount>_<window>.
+func recordVelocity(features map[string]interface{}, keys map[string]string, event VelocityEvent) map[string]map[string]WindowStats {
+	for _, key := range keys {
+		velocity.Record(key, event)
+	}
+
+	result := map[string]map[string]WindowStats{}
+	for _, dimension := range velocityDimensions {
+		key, ok := keys[dimension]
+		windows := map[string]WindowStats{}
+		for _, window := range velocityWindows {
+			var stats WindowStats
+			if ok {
+				stats = velocity.Stats(key, window.Duration, event.Time)
+			}
+			windows[window.Name] = stats
+
+			prefix := "velocity." + dimension + "."
+			features[prefix+"count_"+window.Name] = float64(stats.Count)
+			features[prefix+"cards_"+window.Name] = float64(stats.DistinctCards)
+			features[prefix+"amount_"+window.Name] = stats.Amount
+		}
+		if ok {
+			result[dimension] = windows
+		}
+	}
+	return result
+}
+
+// loadVelocitySnapshot restores VELOCITY_SNAPSHOT_FILE if it exists
+func loadVelocitySnapshot(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return velocity.Restore(file)
+}
+
+// saveVelocitySnapshot writes the store to path, replacing the previous
+// snapshot only once the new one is complete
+func saveVelocitySnapshot(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".velocity-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := velocity.Snapshot(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// runVelocitySnapshots saves a snapshot every interval
+func runVelocitySnapshots(path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := saveVelocitySnapshot(path); err != nil {
+			log.Printf("Failed to snapshot velocity counters: %v", err)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// CheckoutLineItem is a single product line in a checkout session
+type CheckoutLineItem struct {
+	Name       string  `json:"name" binding:"required"`
+	UnitAmount float64 `json:"unit_amount" binding:"required"`
+	Quantity   int     `json:"quantity"`
+}
+
+// CheckoutSession is a hosted, single-use payment page created by a merchant
+type CheckoutSession struct {
+	ID          string             `json:"id"`
+	Code        string             `json:"code"`
+	URL         string             `json:"url"`
+	MerchantID  string             `json:"merchant_id"`
+	CustomerID  string             `json:"customer_id,omitempty"`
+	LineItems   []CheckoutLineItem `json:"line_items"`
+	Currency    string             `json:"currency"`
+	AmountTotal float64            `json:"amount_total"`
+	SuccessURL  string             `json:"success_url"`
+	CancelURL   string             `json:"cancel_url"`
+	WebhookURL  string             `json:"webhook_url,omitempty"`
+	Status      string             `json:"status"`
+	PaymentID   string             `json:"payment_id,omitempty"`
+	ExpiresAt   time.Time          `json:"expires_at"`
+	CreatedAt   time.Time          `json:"created_at"`
+	CompletedAt *time.Time         `json:"completed_at,omitempty"`
+}
+
+// CheckoutEvent is emitted when a session completes or expires
+type CheckoutEvent struct {
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	SessionID string          `json:"session_id"`
+	Session   CheckoutSession `json:"session"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+const (
+	defaultCheckoutExpiry = 24 * time.Hour
+	maxCheckoutExpiry     = 7 * 24 * time.Hour
+	checkoutCodeLength    = 8
+	checkoutCodeAlphabet  = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// MockCheckoutSessions represents a simple in-memory checkout session store
+var MockCheckoutSessions = map[string]*CheckoutSession{}
+
+// MockCheckoutEvents records every checkout event that has been fired
+var MockCheckoutEvents = []CheckoutEvent{}
+
+// checkoutCodes maps a payment link code to its session id
+var checkoutCodes = map[string]string{}
+
+var checkoutMu sync.Mutex
+
+var webhookClient = &http.Client{Timeout: 5 * time.Second}
+
+func checkoutBaseURL() string {
+	if base := os.Getenv("CHECKOUT_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return "http://localhost:4002"
+}
+
+// newCheckoutCode returns a short random code for a payment link. Callers
+// must hold checkoutMu.
+func newCheckoutCode() (string, error) {
+	alphabet := big.NewInt(int64(len(checkoutCodeAlphabet)))
+	for {
+		code := make([]byte, checkoutCodeLength)
+		for i := range code {
+			n, err := rand.Int(rand.Reader, alphabet)
+			if err != nil {
+				return "", err
+			}
+			code[i] = checkoutCodeAlphabet[n.Int64()]
+		}
+		if _, taken := checkoutCodes[string(code)]; !taken {
+			return string(code), nil
+		}
+	}
+}
+
+// expireCheckoutSession marks an open session as expired if its expiry has
+// passed and reports whether it did. Callers must hold checkoutMu.
+func expireCheckoutSession(session *CheckoutSession, now time.Time) bool {
+	if session.Status != "open" || now.Before(session.ExpiresAt) {
+		return false
+	}
+	session.Status = "expired"
+	recordCheckoutEvent("checkout.session.expired", session)
+	return true
+}
+
+// recordCheckoutEvent stores an event and delivers it to the session's
+// webhook in the background. Callers must hold checkoutMu.
+func recordCheckoutEvent(kind string, session *CheckoutSession) {
+	event := CheckoutEvent{
+		ID:        "evt_" + uuid.New().String()[:8],
+		Type:      kind,
+		SessionID: session.ID,
+		Session:   *session,
+		CreatedAt: time.Now().UTC(),
+	}
+	MockCheckoutEvents = append(MockCheckoutEvents, event)
+
+	if session.WebhookURL != "" {
+		go deliverCheckoutEvent(session.WebhookURL, event)
+	}
+}
+
+func deliverCheckoutEvent(url string, event CheckoutEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode checkout event %s: %v", event.ID, err)
+		return
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to deliver checkout event %s: %v", event.ID, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("Checkout event %s webhook returned %s", event.ID, resp.Status)
+	}
+}
+
+// runCheckoutExpiry expires open sessions whose expiry has passed. It times
+// out abandoned 3-D Secure challenges first, since a session stays in
+// processing until its payment's challenge is finished.
+func runCheckoutExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		expireThreeDSChallenges(now)
+
+		checkoutMu.Lock()
+		for _, session := range MockCheckoutSessions {
+			expireCheckoutSession(session, now)
+		}
+		checkoutMu.Unlock()
+	}
+}
+
+func handleCreateCheckoutSession(c *gin.Context) {
+	var request struct {
+		MerchantId string             `json:"merchant_id" binding:"required"`
+		CustomerId string             `json:"customer_id"`
+		LineItems  []CheckoutLineItem `json:"line_items" binding:"required,dive"`
+		Currency   string             `json:"currency" binding:"required"`
+		SuccessURL string             `json:"success_url" binding:"required"`
+		CancelURL  string             `json:"cancel_url" binding:"required"`
+		WebhookURL string             `json:"webhook_url"`
+		ExpiresIn  int                `json:"expires_in"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if _, ok := getMerchant(request.MerchantId); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Merchant not found"})
+		return
+	}
+
+	currency, ok := normalizeCurrency(request.Currency)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return
+	}
+
+	if len(request.LineItems) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one line item is required"})
+		return
+	}
+
+	var total float64
+	for i, item := range request.LineItems {
+		if item.Quantity == 0 {
+			request.LineItems[i].Quantity = 1
+		}
+		if item.UnitAmount <= 0 || request.LineItems[i].Quantity < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Line items need a positive unit amount and quantity"})
+			return
+		}
+		request.LineItems[i].UnitAmount = roundMinor(item.UnitAmount, currency)
+		total += request.LineItems[i].UnitAmount * float64(request.LineItems[i].Quantity)
+	}
+
+	expiresIn := defaultCheckoutExpiry
+	if request.ExpiresIn != 0 {
+		expiresIn = time.Duration(request.ExpiresIn) * time.Second
+	}
+	if expiresIn < time.Minute || expiresIn > maxCheckoutExpiry {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("expires_in must be between 60 and %d seconds", int(maxCheckoutExpiry.Seconds()))})
+		return
+	}
+
+	now := time.Now().UTC()
+
+	checkoutMu.Lock()
+	code, err := newCheckoutCode()
+	if err != nil {
+		checkoutMu.Unlock()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create payment link"})
+		return
+	}
+
+	session := &CheckoutSession{
+		ID:          "cs_" + uuid.New().String()[:8],
+		Code:        code,
+		URL:         checkoutBaseURL() + "/pay/" + code,
+		MerchantID:  request.MerchantId,
+		CustomerID:  request.CustomerId,
+		LineItems:   request.LineItems,
+		Currency:    currency,
+		AmountTotal: roundMinor(total, currency),
+		SuccessURL:  request.SuccessURL,
+		CancelURL:   request.CancelURL,
+		WebhookURL:  request.WebhookURL,
+		Status:      "open",
+		ExpiresAt:   now.Add(expiresIn),
+		CreatedAt:   now,
+	}
+	MockCheckoutSessions[session.ID] = session
+	checkoutCodes[code] = session.ID
+	result := *session
+	checkoutMu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":          "Checkout session created successfully",
+		"checkout_session": result,
+	})
+}
+
+func handleGetCheckoutSession(c *gin.Context) {
+	checkoutMu.Lock()
+	session, ok := MockCheckoutSessions[c.Param("id")]
+	if ok {
+		expireCheckoutSession(session, time.Now())
+	}
+	var result CheckoutSession
+	if ok {
+		result = *session
+	}
+	checkoutMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkout session not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"checkout_session": result,
+	})
+}
+
+// handleExpireCheckoutSession lets a merchant close an open session early
+func handleExpireCheckoutSession(c *gin.Context) {
+	checkoutMu.Lock()
+	defer checkoutMu.Unlock()
+
+	session, ok := MockCheckoutSessions[c.Param("id")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Checkout session not found"})
+		return
+	}
+	if session.Status != "open" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Only open checkout sessions can be expired"})
+		return
+	}
+
+	session.ExpiresAt = time.Now().UTC()
+	expireCheckoutSession(session, session.ExpiresAt)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":          "Checkout session expired successfully",
+		"checkout_session": *session,
+	})
+}
+
+func handleListCheckoutEvents(c *gin.Context) {
+	sessionId := c.Query("session_id")
+
+	checkoutMu.Lock()
+	events := []CheckoutEvent{}
+	for _, event := range MockCheckoutEvents {
+		if sessionId == "" || event.SessionID == sessionId {
+			events = append(events, event)
+		}
+	}
+	checkoutMu.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].CreatedAt.Before(events[j].CreatedAt) })
+
+	c.JSON(http.StatusOK, gin.H{
+		"events": events,
+		"count":  len(events),
+	})
+}
+
+// sessionByCode looks up the session behind a payment link. Callers must hold
+// checkoutMu.
+func sessionByCode(code string) (*CheckoutSession, bool) {
+	id, ok := checkoutCodes[code]
+	if !ok {
+		return nil, false
+	}
+	session, ok := MockCheckoutSessions[id]
+	return session, ok
+}
+
+// handleGetPaymentLink returns the customer-facing view of a session
+func handleGetPaymentLink(c *gin.Context) {
+	checkoutMu.Lock()
+	session, ok := sessionByCode(c.Param("code"))
+	var result CheckoutSession
+	if ok {
+		expireCheckoutSession(session, time.Now())
+		result = *session
+	}
+	checkoutMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment link not found"})
+		return
+	}
+
+	merchant, _ := getMerchant(result.MerchantID)
+	c.JSON(http.StatusOK, gin.H{
+		"checkout": gin.H{
+			"merchant_name": merchant.Name,
+			"line_items":    result.LineItems,
+			"currency":      result.Currency,
+			"amount_total":  result.AmountTotal,
+			"status":        result.Status,
+			"expires_at":    result.ExpiresAt,
+			"cancel_url":    result.CancelURL,
+		},
+	})
+}
+
+// handleCompletePaymentLink pays a session through the regular payment flow.
+// The session is moved to processing while the payment runs so a link can
+// only ever be paid once.
+func handleCompletePaymentLink(c *gin.Context) {
+	var request struct {
+		CustomerId    string `json:"customer_id"`
+		PaymentMethod string `json:"payment_method" binding:"required"`
+		CardBrand     string `json:"card_brand"`
+		CardCountry   string `json:"card_country"`
+		CardBin       string `json:"card_bin"`
+		// Signals passed on to fraud screening
+		DeviceId        string `json:"device_id"`
+		Email           string `json:"email"`
+		CardFingerprint string `json:"card_fingerprint"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	checkoutMu.Lock()
+	session, ok := sessionByCode(c.Param("code"))
+	if !ok {
+		checkoutMu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment link not found"})
+		return
+	}
+	expireCheckoutSession(session, time.Now())
+	if session.Status != "open" {
+		status := session.Status
+		checkoutMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Checkout session is " + status})
+		return
+	}
+	session.Status = "processing"
+	paymentRequest := PaymentRequest{
+		Amount:        session.AmountTotal,
+		Currency:      session.Currency,
+		PaymentMethod: request.PaymentMethod,
+		CustomerId:    session.CustomerID,
+		MerchantId:    session.MerchantID,
+		CardBrand:     request.CardBrand,
+		CardCountry:   request.CardCountry,
+		CardBin:       request.CardBin,
+		// The customer's browser talks to the hosted page directly, so the
+		// client address is the customer's
+		IpAddress:       c.ClientIP(),
+		DeviceId:        request.DeviceId,
+		Email:           request.Email,
+		CardFingerprint: request.CardFingerprint,
+	}
+	checkoutMu.Unlock()
+
+	if paymentRequest.CustomerId == "" {
+		paymentRequest.CustomerId = request.CustomerId
+	}
+	if paymentRequest.CustomerId == "" {
+		paymentRequest.CustomerId = "guest_" + session.Code
+	}
+
+	payment, err := processPayment(paymentRequest)
+
+	checkoutMu.Lock()
+	if err != nil {
+		session.Status = "open"
+		checkoutMu.Unlock()
+		respondPaymentError(c, err)
+		return
+	}
+	session.PaymentID = fmt.Sprint(payment["id"])
+
+	// A payment held for fraud review keeps the session in processing until
+	// an analyst captures or voids it
+	if payment["status"] == "held" {
+		checkoutMu.Unlock()
+		c.JSON(http.StatusAccepted, gin.H{
+			"message": "Payment held for fraud review",
+			"payment": payment,
+		})
+		return
+	}
+
+	// A payment waiting on 3-D Secure keeps the session in processing until
+	// the challenge resolves
+	if payment["status"] == "requires_action" {
+		checkoutMu.Unlock()
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Payment requires authentication",
+			"payment":     payment,
+			"next_action": payment["next_action"],
+		})
+		return
+	}
+
+	completeCheckoutSession(session)
+	successURL := session.SuccessURL
+	checkoutMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Payment processed successfully",
+		"payment":      payment,
+		"redirect_url": successURL,
+	})
+}
+
+// completeCheckoutSession marks a session paid and fires its completion
+// event. Callers must hold checkoutMu.
+func completeCheckoutSession(session *CheckoutSession) {
+	completedAt := time.Now().UTC()
+	session.Status = "complete"
+	session.CompletedAt = &completedAt
+	recordCheckoutEvent("checkout.session.completed", session)
+}
+
+// resumeCheckoutForPayment settles a session whose payment was waiting on
+// authentication or fraud review. A failed payment reopens the session so the
+// customer can try again before it expires.
+func resumeCheckoutForPayment(paymentId string, succeeded bool) {
+	checkoutMu.Lock()
+	defer checkoutMu.Unlock()
+
+	for _, session := range MockCheckoutSessions {
+		if session.PaymentID != paymentId || session.Status != "processing" {
+			continue
+		}
+		if succeeded {
+			completeCheckoutSession(session)
+		} else {
+			session.Status = "open"
+			session.PaymentID = ""
+			expireCheckoutSession(session, time.Now())
+		}
+		return
+	}
+}
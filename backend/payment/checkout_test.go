@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// checkoutEventsFor returns the types of the events recorded for a session
+func checkoutEventsFor(sessionId string) []string {
+	kinds := []string{}
+	for _, event := range MockCheckoutEvents {
+		if event.SessionID == sessionId {
+			kinds = append(kinds, event.Type)
+		}
+	}
+	return kinds
+}
+
+func TestExpireCheckoutSession(t *testing.T) {
+	expiresAt := time.Date(2026, time.May, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		status     string
+		now        time.Time
+		expired    bool
+		wantStatus string
+	}{
+		{"open before expiry", "open", expiresAt.Add(-time.Second), false, "open"},
+		{"open at expiry", "open", expiresAt, true, "expired"},
+		{"open after expiry", "open", expiresAt.Add(time.Hour), true, "expired"},
+		{"processing after expiry", "processing", expiresAt.Add(time.Hour), false, "processing"},
+		{"complete after expiry", "complete", expiresAt.Add(time.Hour), false, "complete"},
+		{"already expired", "expired", expiresAt.Add(time.Hour), false, "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := &CheckoutSession{ID: "cs_" + strings.ReplaceAll(tt.name, " ", "_"), Status: tt.status, ExpiresAt: expiresAt}
+
+			checkoutMu.Lock()
+			expired := expireCheckoutSession(session, tt.now)
+			events := checkoutEventsFor(session.ID)
+			checkoutMu.Unlock()
+
+			if expired != tt.expired || session.Status != tt.wantStatus {
+				t.Errorf("expired %v with status %s, want %v with %s", expired, session.Status, tt.expired, tt.wantStatus)
+			}
+			wantEvents := 0
+			if tt.expired {
+				wantEvents = 1
+			}
+			if len(events) != wantEvents || (wantEvents == 1 && events[0] != "checkout.session.expired") {
+				t.Errorf("events %v, want %d checkout.session.expired", events, wantEvents)
+			}
+		})
+	}
+}
+
+// An expired payment link can be viewed but not paid
+func TestPaymentLinkExpiry(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/pay/:code", handleGetPaymentLink)
+	r.POST("/pay/:code", handleCompletePaymentLink)
+
+	session := &CheckoutSession{
+		ID:          "cs_link_expiry",
+		Code:        "link_expiry",
+		MerchantID:  "mer_1",
+		Currency:    "USD",
+		AmountTotal: 25,
+		Status:      "open",
+		ExpiresAt:   time.Now().Add(-time.Minute),
+	}
+	checkoutMu.Lock()
+	MockCheckoutSessions[session.ID] = session
+	checkoutCodes[session.Code] = session.ID
+	checkoutMu.Unlock()
+	defer func() {
+		checkoutMu.Lock()
+		delete(MockCheckoutSessions, session.ID)
+		delete(checkoutCodes, session.Code)
+		checkoutMu.Unlock()
+	}()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/pay/link_expiry", nil))
+	var view struct {
+		Checkout struct {
+			Status string `json:"status"`
+		} `json:"checkout"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &view); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET returned %d: %s", w.Code, w.Body)
+	}
+	if view.Checkout.Status != "expired" {
+		t.Errorf("status %s, want expired", view.Checkout.Status)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/pay/link_expiry", strings.NewReader(`{"payment_method": "card"}`)))
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "Checkout session is expired") {
+		t.Errorf("POST returned %d: %s, want 409", w.Code, w.Body)
+	}
+
+	checkoutMu.Lock()
+	events := checkoutEventsFor(session.ID)
+	checkoutMu.Unlock()
+	if len(events) != 1 {
+		t.Errorf("events %v, want one checkout.session.expired", events)
+	}
+}
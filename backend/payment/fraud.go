@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// RiskCheck is the fraud screening outcome stored on a payment. Status is
+// completed when fraud-detection answered, or unavailable when it did not
+// and the fail-open policy let the payment continue.
+type RiskCheck struct {
+	Status       string   `json:"status"`
+	AssessmentID string   `json:"assessment_id,omitempty"`
+	Score        *int     `json:"score,omitempty"`
+	Decision     string   `json:"decision,omitempty"`
+	Factors      []string `json:"factors,omitempty"`
+	CaseID       string   `json:"case_id,omitempty"`
+}
+
+func fraudServiceURL() string {
+	if url := os.Getenv("FRAUD_SERVICE_URL"); url != "" {
+		return strings.TrimRight(url, "/")
+	}
+	return "http://localhost:4006"
+}
+
+// fraudCheckTimeout bounds how long a payment waits on fraud screening
+func fraudCheckTimeout() time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv("FRAUD_CHECK_TIMEOUT"))
+	if err != nil || timeout <= 0 {
+		return 800 * time.Millisecond
+	}
+	return timeout
+}
+
+// fraudFailPolicy decides what happens when fraud screening is unavailable:
+// open lets the payment continue, closed fails it
+func fraudFailPolicy() string {
+	if os.Getenv("FRAUD_FAIL_POLICY") == "closed" {
+		return "closed"
+	}
+	return "open"
+}
+
+// checkFraud asks fraud-detection to assess a payment before it is
+// authorized
+func checkFraud(request PaymentRequest, paymentId string, amount float64, currency string) (*RiskCheck, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"transaction_id":   paymentId,
+		"payment_id":       paymentId,
+		"user_id":          request.CustomerId,
+		"amount":           amount,
+		"currency":         currency,
+		"ip_address":       request.IpAddress,
+		"device_id":        request.DeviceId,
+		"location":         request.Location,
+		"email":            request.Email,
+		"card_fingerprint": request.CardFingerprint,
+		"card_bin":         request.CardBin,
+		"card_country":     request.CardCountry,
+	})
+
+	client := &http.Client{Timeout: fraudCheckTimeout()}
+	resp, err := client.Post(fraudServiceURL()+"/analyze", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fraud service returned %s", resp.Status)
+	}
+
+	var result struct {
+		RiskAssessment struct {
+			ID       string   `json:"id"`
+			Score    int      `json:"score"`
+			Decision string   `json:"decision"`
+			Factors  []string `json:"factors"`
+			CaseID   string   `json:"case_id"`
+		} `json:"risk_assessment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	assessment := result.RiskAssessment
+	switch assessment.Decision {
+	case "allow", "review", "deny":
+	default:
+		return nil, fmt.Errorf("fraud service returned unknown decision %q", assessment.Decision)
+	}
+	return &RiskCheck{
+		Status:       "completed",
+		AssessmentID: assessment.ID,
+		Score:        &assessment.Score,
+		Decision:     assessment.Decision,
+		Factors:      assessment.Factors,
+		CaseID:       assessment.CaseID,
+	}, nil
+}
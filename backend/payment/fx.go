@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// currencyMinorUnits lists the active ISO 4217 currency codes and the number
+// of decimal places each one is settled in
+var currencyMinorUnits = map[string]int{
+	"AED": 2, "AFN": 2, "ALL": 2, "AMD": 2, "ANG": 2, "AOA": 2, "ARS": 2, "AUD": 2,
+	"AWG": 2, "AZN": 2, "BAM": 2, "BBD": 2, "BDT": 2, "BGN": 2, "BHD": 3, "BIF": 0,
+	"BMD": 2, "BND": 2, "BOB": 2, "BRL": 2, "BSD": 2, "BTN": 2, "BWP": 2, "BYN": 2,
+	"BZD": 2, "CAD": 2, "CDF": 2, "CHF": 2, "CLP": 0, "CNY": 2, "COP": 2, "CRC": 2,
+	"CUP": 2, "CVE": 2, "CZK": 2, "DJF": 0, "DKK": 2, "DOP": 2, "DZD": 2, "EGP": 2,
+	"ERN": 2, "ETB": 2, "EUR": 2, "FJD": 2, "FKP": 2, "GBP": 2, "GEL": 2, "GHS": 2,
+	"GIP": 2, "GMD": 2, "GNF": 0, "GTQ": 2, "GYD": 2, "HKD": 2, "HNL": 2, "HTG": 2,
+	"HUF": 2, "IDR": 2, "ILS": 2, "INR": 2, "IQD": 3, "IRR": 2, "ISK": 0, "JMD": 2,
+	"JOD": 3, "JPY": 0, "KES": 2, "KGS": 2, "KHR": 2, "KMF": 0, "KPW": 2, "KRW": 0,
+	"KWD": 3, "KYD": 2, "KZT": 2, "LAK": 2, "LBP": 2, "LKR": 2, "LRD": 2, "LSL": 2,
+	"LYD": 3, "MAD": 2, "MDL": 2, "MGA": 2, "MKD": 2, "MMK": 2, "MNT": 2, "MOP": 2,
+	"MRU": 2, "MUR": 2, "MVR": 2, "MWK": 2, "MXN": 2, "MYR": 2, "MZN": 2, "NAD": 2,
+	"NGN": 2, "NIO": 2, "NOK": 2, "NPR": 2, "NZD": 2, "OMR": 3, "PAB": 2, "PEN": 2,
+	"PGK": 2, "PHP": 2, "PKR": 2, "PLN": 2, "PYG": 0, "QAR": 2, "RON": 2, "RSD": 2,
+	"RUB": 2, "RWF": 0, "SAR": 2, "SBD": 2, "SCR": 2, "SDG": 2, "SEK": 2, "SGD": 2,
+	"SHP": 2, "SLE": 2, "SOS": 2, "SRD": 2, "SSP": 2, "STN": 2, "SVC": 2, "SYP": 2,
+	"SZL": 2, "THB": 2, "TJS": 2, "TMT": 2, "TND": 3, "TOP": 2, "TRY": 2, "TTD": 2,
+	"TWD": 2, "TZS": 2, "UAH": 2, "UGX": 0, "USD": 2, "UYU": 2, "UZS": 2, "VES": 2,
+	"VND": 0, "VUV": 0, "WST": 2, "XAF": 0, "XCD": 2, "XOF": 0, "XPF": 0, "YER": 2,
+	"ZAR": 2, "ZMW": 2, "ZWL": 2,
+}
+
+// normalizeCurrency upper-cases a currency code and reports whether it is a
+// known ISO 4217 code
+func normalizeCurrency(code string) (string, bool) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	_, ok := currencyMinorUnits[code]
+	return code, ok
+}
+
+// minorScale is how many minor units make up one unit of a currency
+func minorScale(currency string) float64 {
+	digits, ok := currencyMinorUnits[strings.ToUpper(currency)]
+	if !ok {
+		digits = 2
+	}
+	return math.Pow10(digits)
+}
+
+// roundMinor rounds an amount to the minor units of its currency
+func roundMinor(amount float64, currency string) float64 {
+	scale := minorScale(currency)
+	return math.Round(amount*scale) / scale
+}
+
+// FXRate is the value of one unit of the table's base currency
+type FXRate struct {
+	Rate      float64   `json:"rate"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// FXRateTable holds exchange rates against a single base currency. Markup is
+// a percentage taken off the mid-market rate on every conversion.
+type FXRateTable struct {
+	Base      string            `json:"base"`
+	Markup    float64           `json:"markup"`
+	Rates     map[string]FXRate `json:"rates"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// FXQuote records the rate used for a conversion so it can be stored on a
+// payment and replayed for refunds
+type FXQuote struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	MidRate   float64   `json:"mid_rate"`
+	Markup    float64   `json:"markup"`
+	Rate      float64   `json:"rate"`
+	RatesAsOf time.Time `json:"rates_as_of"`
+}
+
+var fxTableUpdated = time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+
+// MockFXRates is the active rate table
+var MockFXRates = FXRateTable{
+	Base:   "USD",
+	Markup: 0.5,
+	Rates: map[string]FXRate{
+		"USD": {Rate: 1, UpdatedAt: fxTableUpdated},
+		"EUR": {Rate: 0.91, UpdatedAt: fxTableUpdated},
+		"GBP": {Rate: 0.80, UpdatedAt: fxTableUpdated},
+		"CAD": {Rate: 1.35, UpdatedAt: fxTableUpdated},
+		"AUD": {Rate: 1.49, UpdatedAt: fxTableUpdated},
+		"JPY": {Rate: 132.8, UpdatedAt: fxTableUpdated},
+		"CHF": {Rate: 0.91, UpdatedAt: fxTableUpdated},
+		"INR": {Rate: 82.1, UpdatedAt: fxTableUpdated},
+		"PKR": {Rate: 283.9, UpdatedAt: fxTableUpdated},
+	},
+	UpdatedAt: fxTableUpdated,
+}
+
+var fxMu sync.RWMutex
+
+// loadFXRates replaces the built-in rate table with the one in the file named
+// by FX_RATES_FILE, if set
+func loadFXRates() error {
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var table FXRateTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := table.normalize(time.Now()); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	fxMu.Lock()
+	MockFXRates = table
+	fxMu.Unlock()
+
+	log.Printf("Loaded %d FX rates from %s", len(table.Rates), path)
+	return nil
+}
+
+// normalize validates the table and fills in missing timestamps
+func (t *FXRateTable) normalize(now time.Time) error {
+	base, ok := normalizeCurrency(t.Base)
+	if !ok {
+		return fmt.Errorf("unknown base currency %q", t.Base)
+	}
+	t.Base = base
+
+	if t.Markup < 0 || t.Markup >= 100 {
+		return fmt.Errorf("markup must be between 0 and 100")
+	}
+
+	rates := make(map[string]FXRate, len(t.Rates)+1)
+	for code, rate := range t.Rates {
+		currency, ok := normalizeCurrency(code)
+		if !ok {
+			return fmt.Errorf("unknown currency %q", code)
+		}
+		if rate.Rate <= 0 {
+			return fmt.Errorf("rate for %s must be positive", currency)
+		}
+		if rate.UpdatedAt.IsZero() {
+			rate.UpdatedAt = now
+		}
+		rates[currency] = rate
+	}
+	rates[base] = FXRate{Rate: 1, UpdatedAt: now}
+	t.Rates = rates
+
+	if t.UpdatedAt.IsZero() {
+		t.UpdatedAt = now
+	}
+	return nil
+}
+
+// maxFXRateAge returns how old a rate may be before it is refused, or zero
+// when FX_MAX_RATE_AGE is not set
+func maxFXRateAge() time.Duration {
+	age, err := time.ParseDuration(os.Getenv("FX_MAX_RATE_AGE"))
+	if err != nil {
+		return 0
+	}
+	return age
+}
+
+// quoteFX returns the rate for converting from one currency to another using
+// the current table
+func quoteFX(from, to string) (FXQuote, error) {
+	fxMu.RLock()
+	defer fxMu.RUnlock()
+
+	if from == to {
+		return FXQuote{From: from, To: to, MidRate: 1, Rate: 1, RatesAsOf: MockFXRates.UpdatedAt}, nil
+	}
+
+	fromRate, ok := MockFXRates.Rates[from]
+	if !ok {
+		return FXQuote{}, fmt.Errorf("no FX rate available for %s", from)
+	}
+	toRate, ok := MockFXRates.Rates[to]
+	if !ok {
+		return FXQuote{}, fmt.Errorf("no FX rate available for %s", to)
+	}
+
+	asOf := fromRate.UpdatedAt
+	if toRate.UpdatedAt.Before(asOf) {
+		asOf = toRate.UpdatedAt
+	}
+	if maxAge := maxFXRateAge(); maxAge > 0 && time.Since(asOf) > maxAge {
+		return FXQuote{}, fmt.Errorf("FX rate for %s to %s is stale", from, to)
+	}
+
+	mid := toRate.Rate / fromRate.Rate
+	return FXQuote{
+		From:      from,
+		To:        to,
+		MidRate:   mid,
+		Markup:    MockFXRates.Markup,
+		Rate:      mid * (1 - MockFXRates.Markup/100),
+		RatesAsOf: asOf,
+	}, nil
+}
+
+// Convert applies the quote to an amount in the quote's source currency
+func (q FXQuote) Convert(amount float64) float64 {
+	return roundMinor(amount*q.Rate, q.To)
+}
+
+// refundRatePolicy returns the default policy for converting refunds back to
+// the settlement currency: "original" reuses the payment's rate and "current"
+// quotes the rate table again
+func refundRatePolicy() string {
+	if policy := os.Getenv("FX_REFUND_POLICY"); policy == "current" {
+		return policy
+	}
+	return "original"
+}
+
+func handleGetFXRates(c *gin.Context) {
+	fxMu.RLock()
+	table := MockFXRates
+	fxMu.RUnlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"fx_rates": table,
+	})
+}
+
+func handleUpdateFXRates(c *gin.Context) {
+	var request struct {
+		Base    string            `json:"base"`
+		Markup  *float64          `json:"markup"`
+		Rates   map[string]FXRate `json:"rates"`
+		Replace bool              `json:"replace"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	fxMu.Lock()
+	defer fxMu.Unlock()
+
+	// Rates are merged into the current table unless the caller asks for a
+	// full replacement or changes the base currency
+	table := FXRateTable{
+		Base:   MockFXRates.Base,
+		Markup: MockFXRates.Markup,
+		Rates:  map[string]FXRate{},
+	}
+	if request.Base != "" {
+		table.Base = request.Base
+	}
+	if request.Markup != nil {
+		table.Markup = *request.Markup
+	}
+	if !request.Replace && strings.EqualFold(table.Base, MockFXRates.Base) {
+		for currency, rate := range MockFXRates.Rates {
+			table.Rates[currency] = rate
+		}
+	}
+	now := time.Now().UTC()
+	for currency, rate := range request.Rates {
+		rate.UpdatedAt = now
+		table.Rates[currency] = rate
+	}
+	table.UpdatedAt = now
+
+	if err := table.normalize(now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	MockFXRates = table
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "FX rates updated successfully",
+		"fx_rates": table,
+	})
+}
+
+func handleGetFXQuote(c *gin.Context) {
+	from, fromOk := normalizeCurrency(c.Query("from"))
+	to, toOk := normalizeCurrency(c.Query("to"))
+	if !fromOk || !toOk {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported currency"})
+		return
+	}
+
+	quote, err := quoteFX(from, to)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+		return
+	}
+
+	response := gin.H{"quote": quote}
+	if raw := c.Query("amount"); raw != "" {
+		amount, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid amount"})
+			return
+		}
+		response["amount"] = roundMinor(amount, from)
+		response["converted_amount"] = quote.Convert(amount)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
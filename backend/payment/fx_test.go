@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRoundMinor(t *testing.T) {
+	tests := []struct {
+		name     string
+		amount   float64
+		currency string
+		want     float64
+	}{
+		{"two decimals", 10.005001, "USD", 10.01},
+		{"two decimals down", 10.004, "EUR", 10},
+		{"zero decimals", 1234.5, "JPY", 1235},
+		{"zero decimals down", 1234.49, "KRW", 1234},
+		{"three decimals", 1.23456, "KWD", 1.235},
+		{"three decimals down", 1.2344, "BHD", 1.234},
+		{"lower-case code", 1234.5, "jpy", 1235},
+		{"unknown code uses two decimals", 1.236, "XXX", 1.24},
+		{"negative amount", -1.23456, "KWD", -1.235},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roundMinor(tt.amount, tt.currency); got != tt.want {
+				t.Errorf("roundMinor(%v, %s) = %v, want %v", tt.amount, tt.currency, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeCurrency(t *testing.T) {
+	tests := []struct {
+		code  string
+		want  string
+		known bool
+	}{
+		{"USD", "USD", true},
+		{"jpy", "JPY", true},
+		{" kwd ", "KWD", true},
+		{"Bhd", "BHD", true},
+		{"XXX", "XXX", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			got, known := normalizeCurrency(tt.code)
+			if got != tt.want || known != tt.known {
+				t.Errorf("normalizeCurrency(%q) = %q, %v, want %q, %v", tt.code, got, known, tt.want, tt.known)
+			}
+		})
+	}
+}
+
+func TestQuoteFX(t *testing.T) {
+	now := time.Now()
+	fxMu.Lock()
+	saved := MockFXRates
+	MockFXRates = FXRateTable{
+		Base:   "USD",
+		Markup: 0.5,
+		Rates: map[string]FXRate{
+			"USD": {Rate: 1, UpdatedAt: now},
+			"EUR": {Rate: 0.91, UpdatedAt: now.Add(-time.Hour)},
+			"JPY": {Rate: 132.8, UpdatedAt: now},
+			"GBP": {Rate: 0.80, UpdatedAt: now.Add(-48 * time.Hour)},
+		},
+		UpdatedAt: now,
+	}
+	fxMu.Unlock()
+	defer func() {
+		fxMu.Lock()
+		MockFXRates = saved
+		fxMu.Unlock()
+	}()
+
+	tests := []struct {
+		name      string
+		maxAge    string
+		from, to  string
+		amount    float64
+		converted float64
+		wantErr   string
+	}{
+		{name: "same currency", from: "USD", to: "USD", amount: 10.5, converted: 10.5},
+		{name: "markup taken off the mid rate", from: "USD", to: "JPY", amount: 100, converted: 13214},
+		{name: "cross rate", from: "EUR", to: "JPY", amount: 10, converted: 1452},
+		{name: "unknown currency", from: "USD", to: "KWD", wantErr: "no FX rate available for KWD"},
+		{name: "no maximum age", from: "USD", to: "GBP", amount: 100, converted: 79.60},
+		{name: "fresh rates", maxAge: "24h", from: "EUR", to: "JPY", amount: 10, converted: 1452},
+		{name: "stale target rate", maxAge: "24h", from: "USD", to: "GBP", wantErr: "FX rate for USD to GBP is stale"},
+		{name: "stale source rate", maxAge: "24h", from: "GBP", to: "EUR", wantErr: "FX rate for GBP to EUR is stale"},
+		{name: "stale within the hour", maxAge: "30m", from: "EUR", to: "USD", wantErr: "FX rate for EUR to USD is stale"},
+		{name: "same currency is never stale", maxAge: "1ns", from: "GBP", to: "GBP", amount: 1, converted: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FX_MAX_RATE_AGE", tt.maxAge)
+			quote, err := quoteFX(tt.from, tt.to)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("quoteFX: %v", err)
+			}
+			if got := quote.Convert(tt.amount); got != tt.converted {
+				t.Errorf("converted %v %s to %v %s, want %v", tt.amount, tt.from, got, tt.to, tt.converted)
+			}
+		})
+	}
+}
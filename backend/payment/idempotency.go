@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyKeyTTL is how long a response is kept for requests retried
+// with the same Idempotency-Key
+const idempotencyKeyTTL = 24 * time.Hour
+
+// idempotentResponse is the response to a POST /process request made with
+// an Idempotency-Key. Done is false while the first request is running.
+type idempotentResponse struct {
+	Fingerprint string
+	Done        bool
+	Status      int
+	Body        gin.H
+	CreatedAt   time.Time
+}
+
+// MockIdempotencyKeys represents a simple in-memory store of responses by
+// idempotency key
+var MockIdempotencyKeys = map[string]*idempotentResponse{}
+
+var idempotencyMu sync.Mutex
+
+// paymentFingerprint identifies what a payment request charges, so a key
+// reused for a different charge is caught
+func paymentFingerprint(request PaymentRequest) string {
+	return fmt.Sprintf("%s|%s|%s|%v", request.MerchantId, request.CustomerId, request.Currency, request.Amount)
+}
+
+// beginIdempotentRequest claims key for a request. It returns the stored
+// response when the key has already been used, and false when this request
+// should run and finish with finishIdempotentRequest.
+func beginIdempotentRequest(key, fingerprint string) (*idempotentResponse, bool) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+
+	now := time.Now()
+	for k, response := range MockIdempotencyKeys {
+		if response.Done && now.Sub(response.CreatedAt) > idempotencyKeyTTL {
+			delete(MockIdempotencyKeys, k)
+		}
+	}
+
+	if response, ok := MockIdempotencyKeys[key]; ok {
+		result := *response
+		return &result, true
+	}
+	MockIdempotencyKeys[key] = &idempotentResponse{Fingerprint: fingerprint, CreatedAt: now}
+	return nil, false
+}
+
+// finishIdempotentRequest stores the response to a request that claimed
+// key. Server errors are not stored, so the request can be retried.
+func finishIdempotentRequest(key string, status int, body gin.H) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+
+	if status >= http.StatusInternalServerError {
+		delete(MockIdempotencyKeys, key)
+		return
+	}
+	response := MockIdempotencyKeys[key]
+	response.Done = true
+	response.Status = status
+	response.Body = body
+}
+
+// replayIdempotentResponse answers a request whose key has been used before
+// with the first request's response
+func replayIdempotentResponse(c *gin.Context, response *idempotentResponse, fingerprint string) {
+	switch {
+	case response.Fingerprint != fingerprint:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used for a different payment"})
+	case !response.Done:
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+	default:
+		c.Header("Idempotent-Replayed", "true")
+		c.JSON(response.Status, response.Body)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -33,14 +34,51 @@ var MockPayments = []gin.H{
 	},
 }
 
+// paymentsMu guards MockPayments and every payment record in it, including
+// the split and 3-D Secure details they point to. Records are copied with
+// copyPayment before they leave the lock.
+var paymentsMu sync.Mutex
+
+// copyPayment copies a payment record so it can be read or encoded once
+// paymentsMu is released. Callers must hold paymentsMu.
+func copyPayment(payment gin.H) gin.H {
+	result := make(gin.H, len(payment))
+	for key, value := range payment {
+		result[key] = value
+	}
+	if threeDS, ok := payment["three_d_secure"].(*ThreeDSecure); ok && threeDS != nil {
+		copied := *threeDS
+		result["three_d_secure"] = &copied
+	}
+	if split, ok := payment["split"].(*Split); ok && split != nil {
+		copied := *split
+		copied.Shares = append([]SplitShare(nil), split.Shares...)
+		result["split"] = &copied
+	}
+	return result
+}
+
 func main() {
+	if err := loadFeeSchedules(); err != nil {
+		log.Fatalf("Failed to load fee schedules: %v", err)
+	}
+	if err := loadFXRates(); err != nil {
+		log.Fatalf("Failed to load FX rates: %v", err)
+	}
+
+	expiryInterval, err := time.ParseDuration(os.Getenv("CHECKOUT_EXPIRY_INTERVAL"))
+	if err != nil || expiryInterval <= 0 {
+		expiryInterval = time.Minute
+	}
+	go runCheckoutExpiry(expiryInterval)
+
 	r := gin.Default()
 
 	// Configure CORS
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"*"},
 		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key"},
 		ExposeHeaders:    []string{"Content-Length"},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
@@ -60,6 +98,42 @@ func main() {
 	r.GET("/status/:id", handleGetPaymentStatus)
 	r.GET("/", handleListPayments)
 	r.POST("/refund/:id", handleRefundPayment)
+	r.POST("/capture/:id", handleCapturePayment)
+	r.POST("/void/:id", handleVoidPayment)
+
+	// Pricing endpoints
+	r.GET("/pricing/schedules", handleListFeeSchedules)
+	r.GET("/pricing/schedules/:id", handleGetFeeSchedule)
+	r.PUT("/pricing/schedules/:id", handleUpsertFeeSchedule)
+
+	// FX endpoints
+	r.GET("/fx/rates", handleGetFXRates)
+	r.PUT("/fx/rates", handleUpdateFXRates)
+	r.GET("/fx/quote", handleGetFXQuote)
+
+	// Merchant endpoints
+	r.GET("/merchants/:id", handleGetMerchant)
+	r.PUT("/merchants/:id", handleUpsertMerchant)
+	r.GET("/merchants/:id/balance", handleGetBalance)
+
+	// Connected account endpoints
+	r.POST("/merchants/:id/accounts", handleCreateConnectedAccount)
+	r.GET("/merchants/:id/accounts", handleListConnectedAccounts)
+	r.GET("/accounts/:id/balance", handleGetBalance)
+
+	// Checkout session endpoints
+	r.POST("/checkout/sessions", handleCreateCheckoutSession)
+	r.GET("/checkout/sessions/:id", handleGetCheckoutSession)
+	r.POST("/checkout/sessions/:id/expire", handleExpireCheckoutSession)
+	r.GET("/checkout/events", handleListCheckoutEvents)
+
+	// Hosted payment link endpoints
+	r.GET("/pay/:code", handleGetPaymentLink)
+	r.POST("/pay/:code", handleCompletePaymentLink)
+
+	// Simulated 3-D Secure access control server
+	r.GET("/3ds/challenge/:id", handleGetThreeDSChallenge)
+	r.POST("/3ds/challenge/:id", handleSubmitThreeDSChallenge)
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -73,93 +147,498 @@ func main() {
 	}
 }
 
+// PaymentRequest is the body accepted by POST /process
+type PaymentRequest struct {
+	Amount            float64       `json:"amount" binding:"required"`
+	Currency          string        `json:"currency" binding:"required"`
+	PaymentMethod     string        `json:"payment_method" binding:"required"`
+	CustomerId        string        `json:"customer_id" binding:"required"`
+	SavePaymentMethod bool          `json:"save_payment_method"`
+	MerchantId        string        `json:"merchant_id"`
+	CardBrand         string        `json:"card_brand"`
+	CardCountry       string        `json:"card_country"`
+	CardBin           string        `json:"card_bin"`
+	Split             *SplitRequest `json:"split"`
+	// RiskScore is an optional 0-100 score for testing 3-D Secure. It can
+	// only raise the fraud check's score, never lower it.
+	RiskScore *int `json:"risk_score"`
+	// Signals passed on to fraud screening
+	IpAddress       string `json:"ip_address"`
+	DeviceId        string `json:"device_id"`
+	Location        string `json:"location"`
+	Email           string `json:"email"`
+	CardFingerprint string `json:"card_fingerprint"`
+}
+
+// paymentError is a payment failure together with the HTTP status it should
+// be reported with
+type paymentError struct {
+	Status  int
+	Message string
+}
+
+func (e *paymentError) Error() string {
+	return e.Message
+}
+
 func handleProcessPayment(c *gin.Context) {
-	var paymentRequest struct {
-		Amount         float64 `json:"amount" binding:"required"`
-		Currency       string  `json:"currency" binding:"required"`
-		PaymentMethod  string  `json:"payment_method" binding:"required"`
-		CustomerId     string  `json:"customer_id" binding:"required"`
-		SavePaymentMethod bool  `json:"save_payment_method"`
-	}
+	var paymentRequest PaymentRequest
 
 	if err := c.ShouldBindJSON(&paymentRequest); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
 		return
 	}
 
+	// A request retried with the same Idempotency-Key gets the first
+	// response back instead of charging again
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		c.JSON(processPaymentResponse(paymentRequest))
+		return
+	}
+	fingerprint := paymentFingerprint(paymentRequest)
+	if response, used := beginIdempotentRequest(key, fingerprint); used {
+		replayIdempotentResponse(c, response, fingerprint)
+		return
+	}
+	status, body := processPaymentResponse(paymentRequest)
+	finishIdempotentRequest(key, status, body)
+	c.JSON(status, body)
+}
+
+// processPaymentResponse processes a payment and returns the response to
+// send for it
+func processPaymentResponse(paymentRequest PaymentRequest) (int, gin.H) {
+	payment, err := processPayment(paymentRequest)
+	if err != nil {
+		// Payments stopped by fraud screening are still recorded
+		if payment != nil {
+			return paymentErrorStatus(err), gin.H{
+				"error":   err.Error(),
+				"payment": payment,
+			}
+		}
+		return paymentErrorStatus(err), gin.H{"error": err.Error()}
+	}
+
+	message := "Payment processed successfully"
+	switch payment["status"] {
+	case "requires_action":
+		message = "Payment requires authentication"
+	case "held":
+		message = "Payment held for fraud review"
+	}
+
+	return http.StatusOK, gin.H{
+		"message": message,
+		"payment": payment,
+	}
+}
+
+func respondPaymentError(c *gin.Context, err error) {
+	c.JSON(paymentErrorStatus(err), gin.H{"error": err.Error()})
+}
+
+func paymentErrorStatus(err error) int {
+	if paymentErr, ok := err.(*paymentError); ok {
+		return paymentErr.Status
+	}
+	return http.StatusInternalServerError
+}
+
+// processPayment prices, converts, screens and records a payment. It is
+// shared by POST /process and checkout session completion. A payment stopped
+// by fraud screening is recorded and returned together with the error. The
+// payment returned is a copy of the stored record.
+func processPayment(paymentRequest PaymentRequest) (gin.H, error) {
+	var merchant Merchant
+	if paymentRequest.MerchantId != "" {
+		var ok bool
+		if merchant, ok = getMerchant(paymentRequest.MerchantId); !ok {
+			return nil, &paymentError{http.StatusNotFound, "Merchant not found"}
+		}
+	}
+
+	currency, ok := normalizeCurrency(paymentRequest.Currency)
+	if !ok {
+		return nil, &paymentError{http.StatusBadRequest, "Unsupported currency"}
+	}
+	amount := roundMinor(paymentRequest.Amount, currency)
+	if amount <= 0 {
+		return nil, &paymentError{http.StatusBadRequest, "Amount must be greater than zero"}
+	}
+
+	// Payments settle in the merchant's currency; without a merchant they
+	// settle in the currency they were made in
+	settlementCurrency := merchant.SettlementCurrency
+	if settlementCurrency == "" {
+		settlementCurrency = currency
+	}
+	quote, err := quoteFX(currency, settlementCurrency)
+	if err != nil {
+		return nil, &paymentError{http.StatusUnprocessableEntity, err.Error()}
+	}
+	settlementAmount := quote.Convert(amount)
+
+	var fx *FXQuote
+	if currency != settlementCurrency {
+		fx = &quote
+	}
+
+	// Price the payment before it is recorded so the volume tier only
+	// counts earlier payments
+	fees := computePaymentFees(merchant, settlementAmount, settlementCurrency, currency, paymentRequest.CardBrand, paymentRequest.CardCountry)
+
+	split, err := resolveSplit(paymentRequest.Split, paymentRequest.MerchantId, amount, quote, fees.Total)
+	if err != nil {
+		return nil, &paymentError{http.StatusBadRequest, err.Error()}
+	}
+
 	// Generate a payment ID
 	paymentId := "pmt_" + uuid.New().String()[:8]
 
 	// Create a new payment record
 	payment := gin.H{
-		"id":                paymentId,
-		"amount":            paymentRequest.Amount,
-		"currency":          paymentRequest.Currency,
-		"status":            "succeeded", // Always succeed for demo
-		"payment_method":    paymentRequest.PaymentMethod,
-		"customer_id":       paymentRequest.CustomerId,
-		"created_at":        time.Now().Format(time.RFC3339),
-		"transaction_id":    "txn_" + uuid.New().String()[:8],
+		"id":                  paymentId,
+		"amount":              amount,
+		"currency":            currency,
+		"status":              "pending",
+		"payment_method":      paymentRequest.PaymentMethod,
+		"customer_id":         paymentRequest.CustomerId,
+		"merchant_id":         paymentRequest.MerchantId,
+		"card_brand":          paymentRequest.CardBrand,
+		"card_country":        paymentRequest.CardCountry,
+		"card_bin":            paymentRequest.CardBin,
+		"settlement_amount":   settlementAmount,
+		"settlement_currency": settlementCurrency,
+		"fx":                  fx,
+		"fees":                fees,
+		"split":               split,
+		"created_at":          time.Now().Format(time.RFC3339),
 	}
 
+	// Screen the payment for fraud before anything is authorized
+	risk, err := checkFraud(paymentRequest, paymentId, amount, currency)
+	if err != nil {
+		log.Printf("Fraud check for payment %s failed: %v", paymentId, err)
+		risk = &RiskCheck{Status: "unavailable"}
+		if fraudFailPolicy() == "closed" {
+			payment["risk"] = risk
+			payment["status"] = "failed"
+			payment["failure_reason"] = "fraud_check_unavailable"
+			return recordPayment(payment, false), &paymentError{http.StatusServiceUnavailable, "Fraud screening is unavailable"}
+		}
+	}
+	payment["risk"] = risk
+
+	switch risk.Decision {
+	case "deny":
+		payment["status"] = "failed"
+		payment["failure_reason"] = "fraud_denied"
+		return recordPayment(payment, false), &paymentError{http.StatusPaymentRequired, "Payment declined by fraud screening"}
+	case "review":
+		// Held payments wait for an analyst to capture or void them
+		payment["status"] = "held"
+		return recordPayment(payment, false), nil
+	}
+
+	riskScore := risk.Score
+	if paymentRequest.RiskScore != nil && (riskScore == nil || *paymentRequest.RiskScore > *riskScore) {
+		riskScore = paymentRequest.RiskScore
+	}
+
+	// Cards may need the cardholder to authenticate with their issuer
+	// before the payment can be authorized
+	threeDS, challenge := startThreeDSecure(paymentRequest, paymentId, riskScore)
+	payment["three_d_secure"] = threeDS
+	if challenge != nil {
+		payment["status"] = "requires_action"
+		payment["next_action"] = gin.H{
+			"type": "three_d_secure_redirect",
+			"url":  challenge.URL,
+		}
+	}
+
+	return recordPayment(payment, challenge == nil), nil
+}
+
+// recordPayment adds a new payment to the store, authorizing it when it needs
+// no further customer action, and returns a copy of it
+func recordPayment(payment gin.H, authorize bool) gin.H {
+	paymentsMu.Lock()
+	defer paymentsMu.Unlock()
+
 	// Add to mock payments (in a real app, we'd save to a database)
 	MockPayments = append(MockPayments, payment)
-
-	c.JSON(http.StatusOK, gin.H{
-		"message": "Payment processed successfully",
-		"payment": payment,
-	})
+	if authorize {
+		authorizePayment(payment)
+	}
+	return copyPayment(payment)
 }
 
-func handleGetPaymentStatus(c *gin.Context) {
-	id := c.Param("id")
+// authorizePayment completes a payment that needs no further customer
+// action and posts it to the merchant and connected account balances.
+// Callers must hold paymentsMu.
+func authorizePayment(payment gin.H) {
+	payment["status"] = "succeeded" // Always succeed for demo
+	payment["transaction_id"] = "txn_" + uuid.New().String()[:8]
+	delete(payment, "next_action")
 
-	// Search for the payment in our mock data
+	paymentId, _ := payment["id"].(string)
+	merchantId, _ := payment["merchant_id"].(string)
+	settlementAmount, _ := payment["settlement_amount"].(float64)
+	settlementCurrency, _ := payment["settlement_currency"].(string)
+	fees, _ := payment["fees"].(FeeBreakdown)
+	split, _ := payment["split"].(*Split)
+	postPaymentBalances(paymentId, merchantId, settlementAmount, settlementCurrency, fees, split)
+	addMonthlyVolume(merchantId, settlementCurrency, settlementAmount, time.Now())
+}
+
+// findPayment returns the stored payment record with the given id. Callers
+// must hold paymentsMu.
+func findPayment(id string) (gin.H, bool) {
 	for _, payment := range MockPayments {
 		if payment["id"] == id {
-			c.JSON(http.StatusOK, gin.H{
-				"payment": payment,
-			})
-			return
+			return payment, true
 		}
 	}
+	return nil, false
+}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+func handleGetPaymentStatus(c *gin.Context) {
+	paymentsMu.Lock()
+	payment, ok := findPayment(c.Param("id"))
+	if ok {
+		payment = copyPayment(payment)
+	}
+	paymentsMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"payment": payment,
+	})
 }
 
 func handleListPayments(c *gin.Context) {
+	paymentsMu.Lock()
+	payments := make([]gin.H, len(MockPayments))
+	for i, payment := range MockPayments {
+		payments[i] = copyPayment(payment)
+	}
+	paymentsMu.Unlock()
+
 	// Return all mock payments
 	c.JSON(http.StatusOK, gin.H{
-		"payments": MockPayments,
-		"count":    len(MockPayments),
+		"payments": payments,
+		"count":    len(payments),
 	})
 }
 
 func handleRefundPayment(c *gin.Context) {
 	id := c.Param("id")
 
+	var request struct {
+		Amount         float64         `json:"amount"`
+		RatePolicy     string          `json:"rate_policy"`
+		SplitReversals []SplitReversal `json:"split_reversals"`
+	}
+
+	// The body is optional; an empty request refunds the full remaining
+	// amount using the default policy
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+
+	policy := request.RatePolicy
+	if policy == "" {
+		policy = refundRatePolicy()
+	}
+	if policy != "original" && policy != "current" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "rate_policy must be original or current"})
+		return
+	}
+
+	paymentsMu.Lock()
+	defer paymentsMu.Unlock()
+
 	// Search for the payment in our mock data
 	for i, payment := range MockPayments {
-		if payment["id"] == id {
-			// Create a refund
-			refundId := "ref_" + uuid.New().String()[:8]
-			
-			// Update the payment status
-			MockPayments[i]["status"] = "refunded"
-			
-			c.JSON(http.StatusOK, gin.H{
-				"message": "Payment refunded successfully",
-				"refund": gin.H{
-					"id":         refundId,
-					"payment_id": id,
-					"amount":     payment["amount"],
-					"status":     "succeeded",
-					"created_at": time.Now().Format(time.RFC3339),
-				},
-			})
+		if payment["id"] != id {
+			continue
+		}
+
+		if payment["status"] != "succeeded" && payment["status"] != "partially_refunded" {
+			c.JSON(http.StatusConflict, gin.H{"error": "Payment cannot be refunded"})
+			return
+		}
+
+		paymentAmount, _ := payment["amount"].(float64)
+		currency, _ := payment["currency"].(string)
+		refunded, _ := payment["amount_refunded"].(float64)
+		remaining := roundMinor(paymentAmount-refunded, currency)
+
+		refundAmount := remaining
+		if request.Amount != 0 {
+			refundAmount = roundMinor(request.Amount, currency)
+		}
+		if refundAmount <= 0 || refundAmount > remaining {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Refund amount exceeds the refundable amount"})
+			return
+		}
+
+		// Convert the refund back into the settlement currency at the
+		// payment's original rate or at today's rate
+		settlementCurrency, ok := payment["settlement_currency"].(string)
+		if !ok {
+			settlementCurrency = currency
+		}
+		quote := FXQuote{From: currency, To: settlementCurrency, MidRate: 1, Rate: 1}
+		original, converted := payment["fx"].(*FXQuote)
+		converted = converted && original != nil
+		if converted {
+			quote = *original
+			if policy == "current" {
+				var err error
+				if quote, err = quoteFX(original.From, original.To); err != nil {
+					c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+					return
+				}
+			}
+		}
+
+		split, _ := payment["split"].(*Split)
+		reversals, err := planSplitReversals(split, paymentAmount, refundAmount, remaining, currency, request.SplitReversals)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+
+		// Create a refund
+		refundId := "ref_" + uuid.New().String()[:8]
+		settlementAmount := quote.Convert(refundAmount)
+		refund := gin.H{
+			"id":                  refundId,
+			"payment_id":          id,
+			"amount":              refundAmount,
+			"currency":            currency,
+			"settlement_amount":   settlementAmount,
+			"settlement_currency": settlementCurrency,
+			"status":              "succeeded",
+			"created_at":          time.Now().Format(time.RFC3339),
+		}
+		if converted {
+			refund["fx"] = quote
+			refund["rate_policy"] = policy
+		}
+
+		// Take each reversed share back from its connected account and the
+		// rest of the refund from the merchant
+		if merchantId, _ := payment["merchant_id"].(string); merchantId != "" {
+			merchantDebit := settlementAmount
+			splitReversals := []gin.H{}
+			if split != nil {
+				for j, share := range split.Shares {
+					amount := reversals[share.AccountID]
+					if amount == 0 {
+						continue
+					}
+					reversed := quote.Convert(amount)
+					postBalance(share.AccountID, id, refundId, "share_reversal", -reversed, settlementCurrency)
+					merchantDebit -= reversed
+					split.Shares[j].Reversed = roundMinor(share.Reversed+amount, currency)
+					splitReversals = append(splitReversals, gin.H{
+						"account_id":        share.AccountID,
+						"amount":            amount,
+						"settlement_amount": reversed,
+					})
+				}
+				refund["split_reversals"] = splitReversals
+			}
+			postBalance(merchantId, id, refundId, "refund", -roundMinor(merchantDebit, settlementCurrency), settlementCurrency)
+		}
+
+		// Update the payment status
+		refunds, _ := payment["refunds"].([]gin.H)
+		MockPayments[i]["refunds"] = append(refunds, refund)
+		MockPayments[i]["amount_refunded"] = roundMinor(refunded+refundAmount, currency)
+		if refundAmount == remaining {
+			MockPayments[i]["status"] = "refunded"
+		} else {
+			MockPayments[i]["status"] = "partially_refunded"
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message": "Payment refunded successfully",
+			"refund":  refund,
+		})
+		return
 	}
 
 	c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
-} 
\ No newline at end of file
+}
+
+// handleCapturePayment authorizes a payment that was held for fraud review
+// once an analyst approves it
+func handleCapturePayment(c *gin.Context) {
+	id := c.Param("id")
+
+	paymentsMu.Lock()
+	payment, ok := findPayment(id)
+	if !ok {
+		paymentsMu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if payment["status"] != "held" {
+		paymentsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Only held payments can be captured"})
+		return
+	}
+	authorizePayment(payment)
+	payment = copyPayment(payment)
+	paymentsMu.Unlock()
+
+	resumeCheckoutForPayment(id, true)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Payment captured successfully",
+		"payment": payment,
+	})
+}
+
+// handleVoidPayment cancels a payment that was held for fraud review once an
+// analyst declines it. Nothing was posted to balances, so nothing is reversed.
+func handleVoidPayment(c *gin.Context) {
+	id := c.Param("id")
+
+	paymentsMu.Lock()
+	payment, ok := findPayment(id)
+	if !ok {
+		paymentsMu.Unlock()
+		c.JSON(http.StatusNotFound, gin.H{"error": "Payment not found"})
+		return
+	}
+	if payment["status"] != "held" {
+		paymentsMu.Unlock()
+		c.JSON(http.StatusConflict, gin.H{"error": "Only held payments can be voided"})
+		return
+	}
+	payment["status"] = "voided"
+	payment["voided_at"] = time.Now().Format(time.RFC3339)
+	payment = copyPayment(payment)
+	paymentsMu.Unlock()
+
+	resumeCheckoutForPayment(id, false)
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Payment voided successfully",
+		"payment": payment,
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Merchant holds the per-merchant settings the payment service needs to
+// price and settle a payment
+type Merchant struct {
+	ID                 string `json:"id"`
+	Name               string `json:"name"`
+	Country            string `json:"country"`
+	SettlementCurrency string `json:"settlement_currency"`
+	PricingSchedule    string `json:"pricing_schedule,omitempty"`
+	// SubscriptionCustomerID is the merchant's customer id in
+	// subscription-management, whose plan sets their fee schedule
+	SubscriptionCustomerID string `json:"subscription_customer_id,omitempty"`
+	CreatedAt              string `json:"created_at"`
+	UpdatedAt              string `json:"updated_at"`
+}
+
+// MockMerchants represents a simple in-memory merchant store
+var MockMerchants = map[string]*Merchant{
+	"mer_1": {
+		ID:                 "mer_1",
+		Name:               "Acme Store",
+		Country:            "US",
+		SettlementCurrency: "USD",
+		CreatedAt:          "2023-03-01T09:00:00Z",
+		UpdatedAt:          "2023-03-01T09:00:00Z",
+	},
+}
+
+var merchantsMu sync.RWMutex
+
+// getMerchant returns a copy of the merchant so callers can read it without
+// holding the lock
+func getMerchant(id string) (Merchant, bool) {
+	merchantsMu.RLock()
+	defer merchantsMu.RUnlock()
+
+	merchant, ok := MockMerchants[id]
+	if !ok {
+		return Merchant{}, false
+	}
+	return *merchant, true
+}
+
+func handleGetMerchant(c *gin.Context) {
+	merchant, ok := getMerchant(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Merchant not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"merchant": merchant,
+	})
+}
+
+func handleUpsertMerchant(c *gin.Context) {
+	id := c.Param("id")
+
+	var request struct {
+		Name               string  `json:"name"`
+		Country            string  `json:"country"`
+		SettlementCurrency string  `json:"settlement_currency"`
+		PricingSchedule    *string `json:"pricing_schedule"`
+		// An empty subscription customer id unlinks the merchant's plan
+		SubscriptionCustomerID *string `json:"subscription_customer_id"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	if request.SettlementCurrency != "" {
+		var ok bool
+		if request.SettlementCurrency, ok = normalizeCurrency(request.SettlementCurrency); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported settlement currency"})
+			return
+		}
+	}
+
+	if request.PricingSchedule != nil && *request.PricingSchedule != "" {
+		if _, ok := getFeeSchedule(*request.PricingSchedule); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown pricing schedule"})
+			return
+		}
+	}
+
+	now := time.Now().Format(time.RFC3339)
+
+	merchantsMu.Lock()
+	merchant, exists := MockMerchants[id]
+	if !exists {
+		merchant = &Merchant{ID: id, SettlementCurrency: "USD", CreatedAt: now}
+		MockMerchants[id] = merchant
+	}
+	if request.Name != "" {
+		merchant.Name = request.Name
+	}
+	if request.Country != "" {
+		merchant.Country = strings.ToUpper(request.Country)
+	}
+	if request.SettlementCurrency != "" {
+		merchant.SettlementCurrency = request.SettlementCurrency
+	}
+	// An omitted pricing schedule keeps the override, while an empty one
+	// clears it so the merchant falls back to the schedule of their
+	// subscription plan
+	if request.PricingSchedule != nil {
+		merchant.PricingSchedule = *request.PricingSchedule
+	}
+	previousCustomer := merchant.SubscriptionCustomerID
+	if request.SubscriptionCustomerID != nil {
+		merchant.SubscriptionCustomerID = strings.TrimSpace(*request.SubscriptionCustomerID)
+	}
+	merchant.UpdatedAt = now
+	result := *merchant
+	merchantsMu.Unlock()
+
+	// Read the plan again on the next payment
+	if previousCustomer != "" {
+		forgetSubscriptionPlan(previousCustomer)
+	}
+
+	status := http.StatusOK
+	if !exists {
+		status = http.StatusCreated
+	}
+
+	c.JSON(status, gin.H{
+		"message":  "Merchant saved successfully",
+		"merchant": result,
+	})
+}
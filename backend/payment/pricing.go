@@ -0,0 +1,513 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FeeRate is a percentage plus fixed fee pair
+type FeeRate struct {
+	Percentage float64 `json:"percentage"`
+	Fixed      float64 `json:"fixed"`
+}
+
+// VolumeTier applies its rate once a merchant's processed volume for the
+// current month reaches MinVolume
+type VolumeTier struct {
+	MinVolume float64 `json:"min_volume"`
+	FeeRate
+}
+
+// FeeSchedule describes how fees are computed for a payment
+type FeeSchedule struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	FeeRate
+	// CardBrands overrides the base and tiered rate for specific brands
+	CardBrands map[string]FeeRate `json:"card_brands,omitempty"`
+	// CrossBorderPercentage is added when the card was issued outside the
+	// merchant's country
+	CrossBorderPercentage float64 `json:"cross_border_percentage"`
+	// CurrencyConversionPercentage is added when the payment currency differs
+	// from the merchant's settlement currency
+	CurrencyConversionPercentage float64      `json:"currency_conversion_percentage"`
+	VolumeTiers                  []VolumeTier `json:"volume_tiers,omitempty"`
+}
+
+// FeeLine is a single component of a fee breakdown
+type FeeLine struct {
+	Type        string  `json:"type"`
+	Description string  `json:"description"`
+	Percentage  float64 `json:"percentage"`
+	Fixed       float64 `json:"fixed"`
+	Amount      float64 `json:"amount"`
+}
+
+// FeeBreakdown is the full fee calculation stored on a payment. Source says
+// where the schedule came from: merchant, subscription, default, or
+// default_plan_lookup_failed when the merchant's plan could not be read.
+type FeeBreakdown struct {
+	ScheduleID string    `json:"schedule_id"`
+	Source     string    `json:"source"`
+	Currency   string    `json:"currency"`
+	Lines      []FeeLine `json:"lines"`
+	Total      float64   `json:"total"`
+	Net        float64   `json:"net"`
+}
+
+// FeeInput carries the payment attributes that influence pricing. Amount and
+// Currency are the settlement amount and currency, which fee schedules are
+// denominated in.
+type FeeInput struct {
+	Amount         float64
+	Currency       string
+	CardBrand      string
+	CrossBorder    bool
+	Conversion     bool
+	MonthlyVolume  float64
+	ScheduleSource string
+}
+
+// MockFeeSchedules holds the configured fee schedules keyed by id
+var MockFeeSchedules = map[string]FeeSchedule{
+	"standard": {
+		ID:                           "standard",
+		Name:                         "Standard",
+		FeeRate:                      FeeRate{Percentage: 2.9, Fixed: 0.30},
+		CardBrands:                   map[string]FeeRate{"amex": {Percentage: 3.5, Fixed: 0.30}},
+		CrossBorderPercentage:        1.5,
+		CurrencyConversionPercentage: 1.0,
+	},
+	"growth": {
+		ID:                           "growth",
+		Name:                         "Growth",
+		FeeRate:                      FeeRate{Percentage: 2.7, Fixed: 0.30},
+		CardBrands:                   map[string]FeeRate{"amex": {Percentage: 3.3, Fixed: 0.30}},
+		CrossBorderPercentage:        1.25,
+		CurrencyConversionPercentage: 1.0,
+		VolumeTiers: []VolumeTier{
+			{MinVolume: 50000, FeeRate: FeeRate{Percentage: 2.5, Fixed: 0.25}},
+		},
+	},
+	"enterprise": {
+		ID:                           "enterprise",
+		Name:                         "Enterprise",
+		FeeRate:                      FeeRate{Percentage: 2.4, Fixed: 0.20},
+		CrossBorderPercentage:        1.0,
+		CurrencyConversionPercentage: 0.75,
+		VolumeTiers: []VolumeTier{
+			{MinVolume: 100000, FeeRate: FeeRate{Percentage: 2.2, Fixed: 0.15}},
+			{MinVolume: 1000000, FeeRate: FeeRate{Percentage: 1.9, Fixed: 0.10}},
+		},
+	},
+}
+
+// PlanFeeSchedules maps subscription-management plan ids to fee schedules
+var PlanFeeSchedules = map[string]string{
+	"plan_basic":      "standard",
+	"plan_premium":    "growth",
+	"plan_enterprise": "enterprise",
+}
+
+const defaultFeeSchedule = "standard"
+
+var pricingMu sync.RWMutex
+
+var subscriptionClient = &http.Client{Timeout: 2 * time.Second}
+
+// subscriptionPlan is a merchant's plan as last read from
+// subscription-management. A failed lookup is cached too, for a shorter
+// time, so an outage does not slow down every payment.
+type subscriptionPlan struct {
+	PlanID    string
+	Err       error
+	ExpiresAt time.Time
+}
+
+// planFailureTTL is how long a failed plan lookup is remembered
+const planFailureTTL = 30 * time.Second
+
+// subscriptionPlans caches plans by subscription customer id
+var subscriptionPlans = map[string]subscriptionPlan{}
+
+var subscriptionPlansMu sync.Mutex
+
+// subscriptionPlanTTL is how long a merchant's plan is cached
+func subscriptionPlanTTL() time.Duration {
+	ttl, err := time.ParseDuration(os.Getenv("SUBSCRIPTION_PLAN_TTL"))
+	if err != nil || ttl <= 0 {
+		return 5 * time.Minute
+	}
+	return ttl
+}
+
+// monthlyVolumeKey is a merchant's volume in one settlement currency
+type monthlyVolumeKey struct {
+	MerchantID string
+	Currency   string
+}
+
+// monthlyVolumes are the running totals of payments authorized in
+// volumeMonth. They start again from zero with each calendar month.
+var (
+	volumeMonth    string
+	monthlyVolumes = map[monthlyVolumeKey]float64{}
+	volumesMu      sync.Mutex
+)
+
+// loadFeeSchedules replaces the built-in schedules with the ones in the file
+// named by FEE_SCHEDULES_FILE, if set
+func loadFeeSchedules() error {
+	path := os.Getenv("FEE_SCHEDULES_FILE")
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var config struct {
+		Schedules []FeeSchedule     `json:"schedules"`
+		Plans     map[string]string `json:"plans"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	schedules := make(map[string]FeeSchedule, len(config.Schedules))
+	for _, schedule := range config.Schedules {
+		if err := schedule.validate(); err != nil {
+			return err
+		}
+		schedules[schedule.ID] = schedule.normalized()
+	}
+	if _, ok := schedules[defaultFeeSchedule]; !ok {
+		return fmt.Errorf("%s must define the %q schedule", path, defaultFeeSchedule)
+	}
+
+	pricingMu.Lock()
+	MockFeeSchedules = schedules
+	if config.Plans != nil {
+		PlanFeeSchedules = config.Plans
+	}
+	pricingMu.Unlock()
+
+	log.Printf("Loaded %d fee schedules from %s", len(schedules), path)
+	return nil
+}
+
+func (s FeeSchedule) validate() error {
+	if s.ID == "" {
+		return fmt.Errorf("fee schedule id is required")
+	}
+	if s.Percentage < 0 || s.Fixed < 0 || s.CrossBorderPercentage < 0 || s.CurrencyConversionPercentage < 0 {
+		return fmt.Errorf("fee schedule %s: rates must not be negative", s.ID)
+	}
+	for _, tier := range s.VolumeTiers {
+		if tier.MinVolume < 0 || tier.Percentage < 0 || tier.Fixed < 0 {
+			return fmt.Errorf("fee schedule %s: volume tiers must not be negative", s.ID)
+		}
+	}
+	return nil
+}
+
+// normalized lower-cases card brands and sorts tiers by volume so Compute can
+// walk them in order
+func (s FeeSchedule) normalized() FeeSchedule {
+	if len(s.CardBrands) > 0 {
+		brands := make(map[string]FeeRate, len(s.CardBrands))
+		for brand, rate := range s.CardBrands {
+			brands[strings.ToLower(brand)] = rate
+		}
+		s.CardBrands = brands
+	}
+	tiers := append([]VolumeTier(nil), s.VolumeTiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinVolume < tiers[j].MinVolume })
+	s.VolumeTiers = tiers
+	return s
+}
+
+// Compute applies the schedule to a payment. Card brand pricing takes
+// precedence over volume tiers, which take precedence over the base rate.
+func (s FeeSchedule) Compute(in FeeInput) FeeBreakdown {
+	rate := s.FeeRate
+	description := "Processing fee"
+	for _, tier := range s.VolumeTiers {
+		if in.MonthlyVolume >= tier.MinVolume {
+			rate = tier.FeeRate
+			description = fmt.Sprintf("Processing fee (volume tier %.0f+)", tier.MinVolume)
+		}
+	}
+	if brandRate, ok := s.CardBrands[strings.ToLower(in.CardBrand)]; ok {
+		rate = brandRate
+		description = fmt.Sprintf("Processing fee (%s)", strings.ToLower(in.CardBrand))
+	}
+
+	lines := []FeeLine{{
+		Type:        "processing",
+		Description: description,
+		Percentage:  rate.Percentage,
+		Fixed:       rate.Fixed,
+		Amount:      roundMinor(in.Amount*rate.Percentage/100+rate.Fixed, in.Currency),
+	}}
+
+	if in.CrossBorder && s.CrossBorderPercentage > 0 {
+		lines = append(lines, FeeLine{
+			Type:        "cross_border",
+			Description: "Cross-border surcharge",
+			Percentage:  s.CrossBorderPercentage,
+			Amount:      roundMinor(in.Amount*s.CrossBorderPercentage/100, in.Currency),
+		})
+	}
+
+	if in.Conversion && s.CurrencyConversionPercentage > 0 {
+		lines = append(lines, FeeLine{
+			Type:        "currency_conversion",
+			Description: "Currency conversion surcharge",
+			Percentage:  s.CurrencyConversionPercentage,
+			Amount:      roundMinor(in.Amount*s.CurrencyConversionPercentage/100, in.Currency),
+		})
+	}
+
+	var total float64
+	for _, line := range lines {
+		total += line.Amount
+	}
+	total = roundMinor(total, in.Currency)
+
+	return FeeBreakdown{
+		ScheduleID: s.ID,
+		Source:     in.ScheduleSource,
+		Currency:   in.Currency,
+		Lines:      lines,
+		Total:      total,
+		Net:        roundMinor(in.Amount-total, in.Currency),
+	}
+}
+
+func getFeeSchedule(id string) (FeeSchedule, bool) {
+	pricingMu.RLock()
+	defer pricingMu.RUnlock()
+
+	schedule, ok := MockFeeSchedules[id]
+	return schedule, ok
+}
+
+// resolveFeeSchedule picks the schedule for a merchant: an explicit
+// assignment wins, then the plan of the merchant's active subscription, then
+// the default schedule. The second return value records which one was used.
+// Only merchants with a subscription customer id have a plan to look up.
+func resolveFeeSchedule(merchant Merchant) (FeeSchedule, string) {
+	if merchant.PricingSchedule != "" {
+		if schedule, ok := getFeeSchedule(merchant.PricingSchedule); ok {
+			return schedule, "merchant"
+		}
+	}
+
+	source := "default"
+	if merchant.SubscriptionCustomerID != "" {
+		planId, err := subscriptionPlanFor(merchant.SubscriptionCustomerID, time.Now())
+		if err != nil {
+			source = "default_plan_lookup_failed"
+		} else if planId != "" {
+			pricingMu.RLock()
+			scheduleId := PlanFeeSchedules[planId]
+			pricingMu.RUnlock()
+			if schedule, ok := getFeeSchedule(scheduleId); ok {
+				return schedule, "subscription"
+			}
+		}
+	}
+
+	schedule, _ := getFeeSchedule(defaultFeeSchedule)
+	return schedule, source
+}
+
+// subscriptionPlanFor returns the plan of a subscription customer, from the
+// cache while it is fresh. A failed lookup falls back to the last plan read,
+// if there is one.
+func subscriptionPlanFor(customerId string, now time.Time) (string, error) {
+	subscriptionPlansMu.Lock()
+	cached, ok := subscriptionPlans[customerId]
+	subscriptionPlansMu.Unlock()
+	if ok && now.Before(cached.ExpiresAt) {
+		return cached.PlanID, cached.Err
+	}
+
+	planId, err := fetchSubscriptionPlan(customerId)
+	expiresAt := now.Add(subscriptionPlanTTL())
+	if err != nil {
+		log.Printf("Failed to look up subscription plan for customer %s: %v", customerId, err)
+		expiresAt = now.Add(planFailureTTL)
+		if ok && cached.Err == nil {
+			// Keep pricing on the plan last read rather than the default
+			// schedule
+			planId, err = cached.PlanID, nil
+		}
+	}
+
+	subscriptionPlansMu.Lock()
+	subscriptionPlans[customerId] = subscriptionPlan{PlanID: planId, Err: err, ExpiresAt: expiresAt}
+	subscriptionPlansMu.Unlock()
+	return planId, err
+}
+
+// forgetSubscriptionPlan drops a cached plan, so the next payment reads it
+// again
+func forgetSubscriptionPlan(customerId string) {
+	subscriptionPlansMu.Lock()
+	delete(subscriptionPlans, customerId)
+	subscriptionPlansMu.Unlock()
+}
+
+// fetchSubscriptionPlan asks subscription-management for the plan of the
+// customer's active or trialing subscription. It returns an empty plan id
+// when the customer has none.
+func fetchSubscriptionPlan(customerId string) (string, error) {
+	baseURL := os.Getenv("SUBSCRIPTION_SERVICE_URL")
+	if baseURL == "" {
+		baseURL = "http://localhost:4007"
+	}
+
+	resp, err := subscriptionClient.Get(strings.TrimRight(baseURL, "/") + "/customer/" + url.PathEscape(customerId))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("subscription service returned %s", resp.Status)
+	}
+
+	var body struct {
+		Subscriptions []struct {
+			PlanId string `json:"plan_id"`
+			Status string `json:"status"`
+		} `json:"subscriptions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	for _, subscription := range body.Subscriptions {
+		if subscription.Status == "active" || subscription.Status == "trial" {
+			return subscription.PlanId, nil
+		}
+	}
+	return "", nil
+}
+
+// addMonthlyVolume adds an authorized payment to its merchant's volume for
+// the month. Refunds do not reduce it.
+func addMonthlyVolume(merchantId, currency string, amount float64, now time.Time) {
+	if merchantId == "" {
+		return
+	}
+
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+
+	if month := now.Format("2006-01"); month != volumeMonth {
+		volumeMonth = month
+		monthlyVolumes = map[monthlyVolumeKey]float64{}
+	}
+	key := monthlyVolumeKey{MerchantID: merchantId, Currency: currency}
+	monthlyVolumes[key] = roundMinor(monthlyVolumes[key]+amount, currency)
+}
+
+// monthlyVolume is the merchant's volume in a settlement currency for the
+// calendar month containing now
+func monthlyVolume(merchantId, currency string, now time.Time) float64 {
+	volumesMu.Lock()
+	defer volumesMu.Unlock()
+
+	if now.Format("2006-01") != volumeMonth {
+		return 0
+	}
+	return monthlyVolumes[monthlyVolumeKey{MerchantID: merchantId, Currency: currency}]
+}
+
+// computePaymentFees prices a payment for the given merchant on its
+// settlement amount
+func computePaymentFees(merchant Merchant, settlementAmount float64, settlementCurrency, presentmentCurrency, cardBrand, cardCountry string) FeeBreakdown {
+	schedule, source := resolveFeeSchedule(merchant)
+
+	return schedule.Compute(FeeInput{
+		Amount:         settlementAmount,
+		Currency:       settlementCurrency,
+		CardBrand:      cardBrand,
+		CrossBorder:    cardCountry != "" && merchant.Country != "" && !strings.EqualFold(cardCountry, merchant.Country),
+		Conversion:     presentmentCurrency != settlementCurrency,
+		MonthlyVolume:  monthlyVolume(merchant.ID, settlementCurrency, time.Now()),
+		ScheduleSource: source,
+	})
+}
+
+func handleListFeeSchedules(c *gin.Context) {
+	pricingMu.RLock()
+	schedules := make([]FeeSchedule, 0, len(MockFeeSchedules))
+	for _, schedule := range MockFeeSchedules {
+		schedules = append(schedules, schedule)
+	}
+	plans := make(map[string]string, len(PlanFeeSchedules))
+	for planId, scheduleId := range PlanFeeSchedules {
+		plans[planId] = scheduleId
+	}
+	pricingMu.RUnlock()
+
+	sort.Slice(schedules, func(i, j int) bool { return schedules[i].ID < schedules[j].ID })
+
+	c.JSON(http.StatusOK, gin.H{
+		"schedules": schedules,
+		"plans":     plans,
+		"count":     len(schedules),
+	})
+}
+
+func handleGetFeeSchedule(c *gin.Context) {
+	schedule, ok := getFeeSchedule(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fee schedule not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"schedule": schedule,
+	})
+}
+
+func handleUpsertFeeSchedule(c *gin.Context) {
+	var schedule FeeSchedule
+	if err := c.ShouldBindJSON(&schedule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	schedule.ID = c.Param("id")
+	if err := schedule.validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	schedule = schedule.normalized()
+
+	pricingMu.Lock()
+	MockFeeSchedules[schedule.ID] = schedule
+	pricingMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Fee schedule saved successfully",
+		"schedule": schedule,
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// resetMonthlyVolumes starts the month's running totals from zero
+func resetMonthlyVolumes(t *testing.T) {
+	t.Helper()
+	volumesMu.Lock()
+	volumeMonth, monthlyVolumes = "", map[monthlyVolumeKey]float64{}
+	volumesMu.Unlock()
+}
+
+func TestComputePaymentFees(t *testing.T) {
+	tests := []struct {
+		name        string
+		schedule    string
+		volume      float64
+		volumeIn    string
+		amount      float64
+		currency    string
+		presentment string
+		cardBrand   string
+		cardCountry string
+		lines       []string
+		total, net  float64
+	}{
+		{
+			name: "base rate", amount: 100, currency: "USD", cardBrand: "visa", cardCountry: "US",
+			lines: []string{"processing 3.20"}, total: 3.20, net: 96.80,
+		},
+		{
+			name: "card brand rate", amount: 100, currency: "USD", cardBrand: "AMEX", cardCountry: "US",
+			lines: []string{"processing 3.80"}, total: 3.80, net: 96.20,
+		},
+		{
+			name: "cross-border card", amount: 100, currency: "USD", cardBrand: "visa", cardCountry: "GB",
+			lines: []string{"processing 3.20", "cross_border 1.50"}, total: 4.70, net: 95.30,
+		},
+		{
+			name: "converted from another currency", amount: 100, currency: "USD", presentment: "EUR", cardBrand: "visa", cardCountry: "US",
+			lines: []string{"processing 3.20", "currency_conversion 1.00"}, total: 4.20, net: 95.80,
+		},
+		{
+			name: "cross-border and converted", amount: 100, currency: "USD", presentment: "EUR", cardBrand: "visa", cardCountry: "FR",
+			lines: []string{"processing 3.20", "cross_border 1.50", "currency_conversion 1.00"}, total: 5.70, net: 94.30,
+		},
+		{
+			name: "unknown card country is not cross-border", amount: 100, currency: "USD", cardBrand: "visa",
+			lines: []string{"processing 3.20"}, total: 3.20, net: 96.80,
+		},
+		{
+			name: "below the volume tier", schedule: "growth", volume: 49999.99, amount: 100, currency: "USD", cardBrand: "visa",
+			lines: []string{"processing 3.00"}, total: 3.00, net: 97.00,
+		},
+		{
+			name: "at the volume tier", schedule: "growth", volume: 50000, amount: 100, currency: "USD", cardBrand: "visa",
+			lines: []string{"processing 2.75"}, total: 2.75, net: 97.25,
+		},
+		{
+			name: "highest volume tier reached", schedule: "enterprise", volume: 1500000, amount: 100, currency: "USD", cardBrand: "visa",
+			lines: []string{"processing 2.00"}, total: 2.00, net: 98.00,
+		},
+		{
+			name: "card brand rate beats the volume tier", schedule: "growth", volume: 60000, amount: 100, currency: "USD", cardBrand: "amex",
+			lines: []string{"processing 3.60"}, total: 3.60, net: 96.40,
+		},
+		{
+			name: "volume in another currency does not count", schedule: "growth", volume: 60000, volumeIn: "EUR", amount: 100, currency: "USD", cardBrand: "visa",
+			lines: []string{"processing 3.00"}, total: 3.00, net: 97.00,
+		},
+		{
+			name: "zero-decimal settlement currency", amount: 1000, currency: "JPY", cardBrand: "visa", cardCountry: "GB",
+			lines: []string{"processing 29.00", "cross_border 15.00"}, total: 44, net: 956,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetMonthlyVolumes(t)
+			merchant := Merchant{ID: "mer_fees", Country: "US", SettlementCurrency: tt.currency, PricingSchedule: tt.schedule}
+			if tt.volume > 0 {
+				volumeIn := tt.volumeIn
+				if volumeIn == "" {
+					volumeIn = tt.currency
+				}
+				addMonthlyVolume(merchant.ID, volumeIn, tt.volume, time.Now())
+			}
+			presentment := tt.presentment
+			if presentment == "" {
+				presentment = tt.currency
+			}
+
+			fees := computePaymentFees(merchant, tt.amount, tt.currency, presentment, tt.cardBrand, tt.cardCountry)
+
+			lines := []string{}
+			for _, line := range fees.Lines {
+				lines = append(lines, fmt.Sprintf("%s %.2f", line.Type, line.Amount))
+			}
+			if !reflect.DeepEqual(lines, tt.lines) {
+				t.Errorf("lines %q, want %q", lines, tt.lines)
+			}
+			if fees.Total != tt.total || fees.Net != tt.net || fees.Currency != tt.currency {
+				t.Errorf("total %v and net %v %s, want %v and %v %s", fees.Total, fees.Net, fees.Currency, tt.total, tt.net, tt.currency)
+			}
+			wantSchedule, wantSource := tt.schedule, "merchant"
+			if wantSchedule == "" {
+				wantSchedule, wantSource = defaultFeeSchedule, "default"
+			}
+			if fees.ScheduleID != wantSchedule || fees.Source != wantSource {
+				t.Errorf("schedule %s from %s, want %s from %s", fees.ScheduleID, fees.Source, wantSchedule, wantSource)
+			}
+		})
+	}
+}
+
+func TestMonthlyVolumeStartsEachMonthAtZero(t *testing.T) {
+	resetMonthlyVolumes(t)
+	march := time.Date(2026, time.March, 31, 23, 0, 0, 0, time.UTC)
+	addMonthlyVolume("mer_volume", "USD", 40000.10, march)
+	addMonthlyVolume("mer_volume", "USD", 9999.90, march)
+	addMonthlyVolume("mer_volume", "EUR", 500, march)
+
+	if got := monthlyVolume("mer_volume", "USD", march); got != 50000 {
+		t.Errorf("March volume %v, want 50000", got)
+	}
+	if got := monthlyVolume("mer_volume", "EUR", march); got != 500 {
+		t.Errorf("March EUR volume %v, want 500", got)
+	}
+
+	april := march.Add(2 * time.Hour)
+	if got := monthlyVolume("mer_volume", "USD", april); got != 0 {
+		t.Errorf("April volume %v, want 0", got)
+	}
+	addMonthlyVolume("mer_volume", "USD", 10, april)
+	if got := monthlyVolume("mer_volume", "USD", april); got != 10 {
+		t.Errorf("April volume %v, want 10", got)
+	}
+}
+
+// A merchant linked to a subscription customer is priced on their plan's
+// schedule, which is read once per TTL; a failed lookup falls back to the
+// default schedule and says so
+func TestResolveFeeScheduleFromPlan(t *testing.T) {
+	lookups := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lookups++
+		if r.URL.Path != "/customer/cus_plan" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"subscriptions": [{"plan_id": "plan_basic", "status": "canceled"}, {"plan_id": "plan_enterprise", "status": "active"}]}`)
+	}))
+	defer server.Close()
+	t.Setenv("SUBSCRIPTION_SERVICE_URL", server.URL)
+
+	tests := []struct {
+		name     string
+		merchant Merchant
+		schedule string
+		source   string
+		lookups  int
+	}{
+		{"no subscription customer", Merchant{ID: "mer_plan"}, "standard", "default", 0},
+		{"plan schedule", Merchant{ID: "mer_plan", SubscriptionCustomerID: "cus_plan"}, "enterprise", "subscription", 1},
+		{"cached plan", Merchant{ID: "mer_plan", SubscriptionCustomerID: "cus_plan"}, "enterprise", "subscription", 0},
+		{"merchant schedule wins", Merchant{ID: "mer_plan", SubscriptionCustomerID: "cus_plan", PricingSchedule: "growth"}, "growth", "merchant", 0},
+		{"lookup fails", Merchant{ID: "mer_plan", SubscriptionCustomerID: "cus_missing"}, "standard", "default_plan_lookup_failed", 1},
+		{"failure is cached", Merchant{ID: "mer_plan", SubscriptionCustomerID: "cus_missing"}, "standard", "default_plan_lookup_failed", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := lookups
+			schedule, source := resolveFeeSchedule(tt.merchant)
+			if schedule.ID != tt.schedule || source != tt.source {
+				t.Errorf("schedule %s from %s, want %s from %s", schedule.ID, source, tt.schedule, tt.source)
+			}
+			if got := lookups - before; got != tt.lookups {
+				t.Errorf("%d lookups, want %d", got, tt.lookups)
+			}
+		})
+	}
+
+	forgetSubscriptionPlan("cus_plan")
+	forgetSubscriptionPlan("cus_missing")
+}
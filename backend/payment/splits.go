@@ -0,0 +1,412 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ConnectedAccount is a seller sub-account that belongs to a platform merchant
+type ConnectedAccount struct {
+	ID         string `json:"id"`
+	MerchantID string `json:"merchant_id"`
+	Name       string `json:"name"`
+	Email      string `json:"email,omitempty"`
+	CreatedAt  string `json:"created_at"`
+}
+
+// BalanceTransaction is a single posting to an account balance. Merchants
+// post to a balance keyed by their own merchant id.
+type BalanceTransaction struct {
+	ID        string  `json:"id"`
+	AccountID string  `json:"account_id"`
+	PaymentID string  `json:"payment_id"`
+	RefundID  string  `json:"refund_id,omitempty"`
+	Type      string  `json:"type"`
+	Amount    float64 `json:"amount"`
+	Currency  string  `json:"currency"`
+	CreatedAt string  `json:"created_at"`
+}
+
+// SplitShareRequest asks for a fixed amount or a percentage of the charge to
+// go to a connected account
+type SplitShareRequest struct {
+	AccountID  string  `json:"account_id" binding:"required"`
+	Amount     float64 `json:"amount"`
+	Percentage float64 `json:"percentage"`
+}
+
+// SplitRequest is the split specification accepted by POST /process.
+// ApplicationFee and ApplicationFeePercentage are retained by the merchant.
+type SplitRequest struct {
+	ApplicationFee           float64             `json:"application_fee"`
+	ApplicationFeePercentage float64             `json:"application_fee_percentage"`
+	Shares                   []SplitShareRequest `json:"shares"`
+}
+
+// SplitShare is a resolved share stored on the payment
+type SplitShare struct {
+	AccountID        string  `json:"account_id"`
+	Amount           float64 `json:"amount"`
+	SettlementAmount float64 `json:"settlement_amount"`
+	Reversed         float64 `json:"reversed"`
+}
+
+// Split is the resolved split stored on the payment. Amounts are in the
+// payment currency unless prefixed with settlement.
+type Split struct {
+	ApplicationFee           float64      `json:"application_fee"`
+	SettlementApplicationFee float64      `json:"settlement_application_fee"`
+	Shares                   []SplitShare `json:"shares"`
+}
+
+// SplitReversal moves part of a refund onto a specific connected account
+type SplitReversal struct {
+	AccountID string  `json:"account_id" binding:"required"`
+	Amount    float64 `json:"amount"`
+}
+
+// MockConnectedAccounts represents a simple in-memory connected account store
+var MockConnectedAccounts = map[string]*ConnectedAccount{
+	"acct_1": {
+		ID:         "acct_1",
+		MerchantID: "mer_1",
+		Name:       "Acme Seller One",
+		CreatedAt:  "2023-03-02T09:00:00Z",
+	},
+}
+
+// MockBalances holds account balances by account id and currency
+var MockBalances = map[string]map[string]float64{}
+
+// MockBalanceTransactions is the ledger behind MockBalances
+var MockBalanceTransactions = []BalanceTransaction{}
+
+var accountsMu sync.RWMutex
+var balancesMu sync.Mutex
+
+func getConnectedAccount(id string) (ConnectedAccount, bool) {
+	accountsMu.RLock()
+	defer accountsMu.RUnlock()
+
+	account, ok := MockConnectedAccounts[id]
+	if !ok {
+		return ConnectedAccount{}, false
+	}
+	return *account, true
+}
+
+// postBalance records a ledger entry and applies it to the account balance
+func postBalance(accountId, paymentId, refundId, kind string, amount float64, currency string) {
+	if amount == 0 {
+		return
+	}
+
+	balancesMu.Lock()
+	defer balancesMu.Unlock()
+
+	if MockBalances[accountId] == nil {
+		MockBalances[accountId] = map[string]float64{}
+	}
+	MockBalances[accountId][currency] = roundMinor(MockBalances[accountId][currency]+amount, currency)
+
+	MockBalanceTransactions = append(MockBalanceTransactions, BalanceTransaction{
+		ID:        "btx_" + uuid.New().String()[:8],
+		AccountID: accountId,
+		PaymentID: paymentId,
+		RefundID:  refundId,
+		Type:      kind,
+		Amount:    amount,
+		Currency:  currency,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+}
+
+// allocateMinor divides total between parts in proportion to weights. Each
+// part is rounded to the currency's minor units by the largest remainder
+// method, so the parts always add up to total exactly.
+func allocateMinor(total float64, weights []float64, currency string) []float64 {
+	scale := minorScale(currency)
+	units := math.Round(total * scale)
+	parts := make([]float64, len(weights))
+
+	var weightSum float64
+	for _, weight := range weights {
+		weightSum += weight
+	}
+	if weightSum <= 0 {
+		return parts
+	}
+
+	remainders := make([]float64, len(weights))
+	order := make([]int, len(weights))
+	allocated := 0.0
+	for i, weight := range weights {
+		// Drop float noise so exact shares are not rounded down a unit
+		exact := math.Round(units*weight/weightSum*1e6) / 1e6
+		parts[i] = math.Floor(exact)
+		remainders[i] = exact - parts[i]
+		allocated += parts[i]
+		order[i] = i
+	}
+	// Hand the units lost to rounding down to the largest remainders
+	sort.SliceStable(order, func(a, b int) bool { return remainders[order[a]] > remainders[order[b]] })
+	for k := 0; k < int(units-allocated); k++ {
+		parts[order[k%len(order)]]++
+	}
+	for i := range parts {
+		parts[i] /= scale
+	}
+	return parts
+}
+
+// resolveSplit validates a split specification against the merchant's
+// connected accounts and works out each share in both currencies. The shares
+// must leave the merchant enough to pay fees, the processing fees in the
+// settlement currency.
+func resolveSplit(spec *SplitRequest, merchantId string, amount float64, quote FXQuote, fees float64) (*Split, error) {
+	if spec == nil {
+		return nil, nil
+	}
+	if merchantId == "" {
+		return nil, fmt.Errorf("merchant_id is required for split payments")
+	}
+	if spec.ApplicationFee < 0 || spec.ApplicationFeePercentage < 0 {
+		return nil, fmt.Errorf("application fee must not be negative")
+	}
+	if spec.ApplicationFee > 0 && spec.ApplicationFeePercentage > 0 {
+		return nil, fmt.Errorf("set either application_fee or application_fee_percentage")
+	}
+
+	currency := quote.From
+	split := &Split{ApplicationFee: roundMinor(spec.ApplicationFee, currency)}
+	if spec.ApplicationFeePercentage > 0 {
+		split.ApplicationFee = roundMinor(amount*spec.ApplicationFeePercentage/100, currency)
+	}
+	allocated := split.ApplicationFee
+	seen := map[string]bool{}
+	for _, share := range spec.Shares {
+		account, ok := getConnectedAccount(share.AccountID)
+		if !ok || account.MerchantID != merchantId {
+			return nil, fmt.Errorf("connected account %s not found", share.AccountID)
+		}
+		if seen[share.AccountID] {
+			return nil, fmt.Errorf("connected account %s appears more than once", share.AccountID)
+		}
+		seen[share.AccountID] = true
+
+		if (share.Amount > 0) == (share.Percentage > 0) || share.Amount < 0 || share.Percentage < 0 {
+			return nil, fmt.Errorf("share for %s must set either a positive amount or a positive percentage", share.AccountID)
+		}
+
+		shareAmount := roundMinor(share.Amount, currency)
+		if share.Percentage > 0 {
+			shareAmount = roundMinor(amount*share.Percentage/100, currency)
+		}
+		allocated += shareAmount
+
+		split.Shares = append(split.Shares, SplitShare{
+			AccountID: share.AccountID,
+			Amount:    shareAmount,
+		})
+	}
+
+	if roundMinor(allocated, currency) > amount {
+		return nil, fmt.Errorf("split shares and application fee exceed the payment amount")
+	}
+
+	// Convert the application fee, the shares and what the merchant keeps
+	// together, so they add up to the settlement amount to the minor unit
+	weights := []float64{split.ApplicationFee}
+	for _, share := range split.Shares {
+		weights = append(weights, share.Amount)
+	}
+	weights = append(weights, roundMinor(amount-allocated, currency))
+	settlementAmount := quote.Convert(amount)
+	parts := allocateMinor(settlementAmount, weights, quote.To)
+	split.SettlementApplicationFee = parts[0]
+	var settlementShares float64
+	for i := range split.Shares {
+		split.Shares[i].SettlementAmount = parts[i+1]
+		settlementShares += parts[i+1]
+	}
+
+	if roundMinor(settlementShares, quote.To) > roundMinor(settlementAmount-fees, quote.To) {
+		return nil, fmt.Errorf("split shares exceed the payment amount after processing fees")
+	}
+	return split, nil
+}
+
+// postPaymentBalances credits each share to its connected account and the
+// remainder, less processing fees, to the merchant
+func postPaymentBalances(paymentId, merchantId string, settlementAmount float64, settlementCurrency string, fees FeeBreakdown, split *Split) {
+	if merchantId == "" {
+		return
+	}
+
+	remainder := settlementAmount
+	if split != nil {
+		for _, share := range split.Shares {
+			postBalance(share.AccountID, paymentId, "", "payment_share", share.SettlementAmount, settlementCurrency)
+			remainder -= share.SettlementAmount
+		}
+		postBalance(merchantId, paymentId, "", "application_fee", split.SettlementApplicationFee, settlementCurrency)
+		remainder -= split.SettlementApplicationFee
+	}
+
+	postBalance(merchantId, paymentId, "", "payment", roundMinor(remainder, settlementCurrency), settlementCurrency)
+	postBalance(merchantId, paymentId, "", "processing_fee", -fees.Total, settlementCurrency)
+}
+
+// planSplitReversals decides how much of a refund each share gives back.
+// Without explicit instructions every share is reversed in proportion to the
+// refunded fraction of the payment, and a refund of everything that remains
+// reverses whatever is left of each share.
+func planSplitReversals(split *Split, paymentAmount, refundAmount, remaining float64, currency string, explicit []SplitReversal) (map[string]float64, error) {
+	reversals := map[string]float64{}
+	if split == nil {
+		if len(explicit) > 0 {
+			return nil, fmt.Errorf("payment has no split to reverse")
+		}
+		return reversals, nil
+	}
+
+	shares := map[string]SplitShare{}
+	for _, share := range split.Shares {
+		shares[share.AccountID] = share
+	}
+
+	if len(explicit) == 0 {
+		// Divide the refund between the shares and the merchant so the
+		// reversals never add up to more than the refund
+		weights := []float64{}
+		merchantPart := paymentAmount
+		for _, share := range split.Shares {
+			weights = append(weights, share.Amount)
+			merchantPart -= share.Amount
+		}
+		parts := allocateMinor(refundAmount, append(weights, roundMinor(merchantPart, currency)), currency)
+		for i, share := range split.Shares {
+			shareRemaining := roundMinor(share.Amount-share.Reversed, currency)
+			amount := parts[i]
+			if amount > shareRemaining || refundAmount == remaining {
+				amount = shareRemaining
+			}
+			reversals[share.AccountID] = amount
+		}
+		return reversals, nil
+	}
+
+	var total float64
+	for _, reversal := range explicit {
+		share, ok := shares[reversal.AccountID]
+		if !ok {
+			return nil, fmt.Errorf("account %s is not part of this payment's split", reversal.AccountID)
+		}
+		if _, seen := reversals[reversal.AccountID]; seen {
+			return nil, fmt.Errorf("account %s is listed more than once", reversal.AccountID)
+		}
+		amount := roundMinor(reversal.Amount, currency)
+		if amount < 0 || amount > roundMinor(share.Amount-share.Reversed, currency) {
+			return nil, fmt.Errorf("reversal for %s exceeds its remaining share", reversal.AccountID)
+		}
+		reversals[reversal.AccountID] = amount
+		total += amount
+	}
+	if roundMinor(total, currency) > refundAmount {
+		return nil, fmt.Errorf("split reversals exceed the refund amount")
+	}
+	return reversals, nil
+}
+
+func handleCreateConnectedAccount(c *gin.Context) {
+	merchantId := c.Param("id")
+	if _, ok := getMerchant(merchantId); !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Merchant not found"})
+		return
+	}
+
+	var request struct {
+		Name  string `json:"name" binding:"required"`
+		Email string `json:"email"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	account := &ConnectedAccount{
+		ID:         "acct_" + uuid.New().String()[:8],
+		MerchantID: merchantId,
+		Name:       request.Name,
+		Email:      request.Email,
+		CreatedAt:  time.Now().Format(time.RFC3339),
+	}
+
+	accountsMu.Lock()
+	MockConnectedAccounts[account.ID] = account
+	accountsMu.Unlock()
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Connected account created successfully",
+		"account": account,
+	})
+}
+
+func handleListConnectedAccounts(c *gin.Context) {
+	merchantId := c.Param("id")
+
+	accountsMu.RLock()
+	accounts := []ConnectedAccount{}
+	for _, account := range MockConnectedAccounts {
+		if account.MerchantID == merchantId {
+			accounts = append(accounts, *account)
+		}
+	}
+	accountsMu.RUnlock()
+
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].CreatedAt < accounts[j].CreatedAt })
+
+	c.JSON(http.StatusOK, gin.H{
+		"accounts": accounts,
+		"count":    len(accounts),
+	})
+}
+
+// handleGetBalance returns the balance and ledger for a connected account or,
+// when the id is a merchant id, for the merchant itself
+func handleGetBalance(c *gin.Context) {
+	id := c.Param("id")
+	if _, ok := getConnectedAccount(id); !ok {
+		if _, ok := getMerchant(id); !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+			return
+		}
+	}
+
+	balancesMu.Lock()
+	balances := map[string]float64{}
+	for currency, amount := range MockBalances[id] {
+		balances[currency] = amount
+	}
+	transactions := []BalanceTransaction{}
+	for _, txn := range MockBalanceTransactions {
+		if txn.AccountID == id {
+			transactions = append(transactions, txn)
+		}
+	}
+	balancesMu.Unlock()
+
+	c.JSON(http.StatusOK, gin.H{
+		"account_id":   id,
+		"balances":     balances,
+		"transactions": transactions,
+	})
+}
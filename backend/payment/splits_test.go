@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestAllocateMinor(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    float64
+		weights  []float64
+		currency string
+		want     []float64
+	}{
+		{"even split", 90, []float64{1, 1, 1}, "EUR", []float64{30, 30, 30}},
+		{"remainder to the largest fractions", 100, []float64{1, 1, 1}, "USD", []float64{33.34, 33.33, 33.33}},
+		{"exact shares are not rounded down", 0.3, []float64{0.1, 0.2}, "USD", []float64{0.1, 0.2}},
+		{"zero decimals", 1321, []float64{5, 5}, "JPY", []float64{661, 660}},
+		{"three decimals", 1, []float64{1, 2}, "KWD", []float64{0.333, 0.667}},
+		{"zero weight gets nothing", 10, []float64{0, 3, 1}, "USD", []float64{0, 7.5, 2.5}},
+		{"no weight", 10, []float64{0, 0}, "USD", []float64{0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allocateMinor(tt.total, tt.weights, tt.currency); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("allocateMinor(%v, %v) = %v, want %v", tt.total, tt.weights, got, tt.want)
+			}
+		})
+	}
+}
+
+// addConnectedAccount adds an account for the length of a test
+func addConnectedAccount(t *testing.T, id, merchantId string) {
+	t.Helper()
+	accountsMu.Lock()
+	MockConnectedAccounts[id] = &ConnectedAccount{ID: id, MerchantID: merchantId, Name: id}
+	accountsMu.Unlock()
+	t.Cleanup(func() {
+		accountsMu.Lock()
+		delete(MockConnectedAccounts, id)
+		accountsMu.Unlock()
+	})
+}
+
+func TestResolveSplit(t *testing.T) {
+	addConnectedAccount(t, "acct_split", "mer_1")
+
+	usd := FXQuote{From: "USD", To: "USD", Rate: 1}
+	eur := FXQuote{From: "USD", To: "EUR", Rate: 0.9}
+	jpy := FXQuote{From: "USD", To: "JPY", Rate: 132.136}
+
+	tests := []struct {
+		name    string
+		spec    SplitRequest
+		amount  float64
+		quote   FXQuote
+		fees    float64
+		want    []string
+		wantErr string
+	}{
+		{
+			name:   "amount, percentage and application fee",
+			spec:   SplitRequest{ApplicationFee: 5, Shares: []SplitShareRequest{{AccountID: "acct_1", Percentage: 30}, {AccountID: "acct_split", Amount: 20}}},
+			amount: 100, quote: usd, fees: 3.20,
+			want: []string{"fee 5.00 5.00", "acct_1 30.00 30.00", "acct_split 20.00 20.00"},
+		},
+		{
+			name:   "application fee percentage",
+			spec:   SplitRequest{ApplicationFeePercentage: 2.5, Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 10}}},
+			amount: 80, quote: usd,
+			want: []string{"fee 2.00 2.00", "acct_1 10.00 10.00"},
+		},
+		{
+			name:   "converted shares add up to the settlement amount",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 33.33}, {AccountID: "acct_split", Amount: 33.33}}},
+			amount: 100, quote: eur, fees: 3.20,
+			want: []string{"fee 0.00 0.00", "acct_1 33.33 30.00", "acct_split 33.33 30.00"},
+		},
+		{
+			name:   "zero-decimal settlement currency",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Percentage: 50}, {AccountID: "acct_split", Percentage: 50}}},
+			amount: 10, quote: jpy,
+			want: []string{"fee 0.00 0.00", "acct_1 5.00 661.00", "acct_split 5.00 660.00"},
+		},
+		{
+			name:   "shares up to the amount after fees",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 96.80}}},
+			amount: 100, quote: usd, fees: 3.20,
+			want: []string{"fee 0.00 0.00", "acct_1 96.80 96.80"},
+		},
+		{
+			name:   "shares exceed the amount after fees",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 96.81}}},
+			amount: 100, quote: usd, fees: 3.20,
+			wantErr: "split shares exceed the payment amount after processing fees",
+		},
+		{
+			name:   "shares exceed the amount",
+			spec:   SplitRequest{ApplicationFee: 1, Shares: []SplitShareRequest{{AccountID: "acct_1", Percentage: 60}, {AccountID: "acct_split", Percentage: 40}}},
+			amount: 100, quote: usd,
+			wantErr: "split shares and application fee exceed the payment amount",
+		},
+		{
+			name:   "duplicate account",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 10}, {AccountID: "acct_1", Amount: 5}}},
+			amount: 100, quote: usd,
+			wantErr: "connected account acct_1 appears more than once",
+		},
+		{
+			name:   "unknown account",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_missing", Amount: 10}}},
+			amount: 100, quote: usd,
+			wantErr: "connected account acct_missing not found",
+		},
+		{
+			name:   "amount and percentage",
+			spec:   SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 10, Percentage: 10}}},
+			amount: 100, quote: usd,
+			wantErr: "share for acct_1 must set either a positive amount or a positive percentage",
+		},
+		{
+			name:   "both application fees",
+			spec:   SplitRequest{ApplicationFee: 1, ApplicationFeePercentage: 1},
+			amount: 100, quote: usd,
+			wantErr: "set either application_fee or application_fee_percentage",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split, err := resolveSplit(&tt.spec, "mer_1", tt.amount, tt.quote, tt.fees)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveSplit: %v", err)
+			}
+			got := []string{fmt.Sprintf("fee %.2f %.2f", split.ApplicationFee, split.SettlementApplicationFee)}
+			for _, share := range split.Shares {
+				got = append(got, fmt.Sprintf("%s %.2f %.2f", share.AccountID, share.Amount, share.SettlementAmount))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("split %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("account of another merchant", func(t *testing.T) {
+		spec := SplitRequest{Shares: []SplitShareRequest{{AccountID: "acct_1", Amount: 10}}}
+		if _, err := resolveSplit(&spec, "mer_2", 100, usd, 0); err == nil {
+			t.Error("split to another merchant's account was accepted")
+		}
+	})
+}
+
+func TestPlanSplitReversals(t *testing.T) {
+	tests := []struct {
+		name      string
+		reversed  [2]float64
+		refund    float64
+		remaining float64
+		explicit  []SplitReversal
+		want      map[string]float64
+		wantErr   string
+	}{
+		{
+			name:   "proportional",
+			refund: 50, remaining: 100,
+			want: map[string]float64{"acct_1": 15, "acct_split": 10},
+		},
+		{
+			name:   "proportional reversals stay within the refund",
+			refund: 33.33, remaining: 100,
+			want: map[string]float64{"acct_1": 10, "acct_split": 6.67},
+		},
+		{
+			name:     "proportional reversal capped at the remaining share",
+			reversed: [2]float64{25, 0},
+			refund:   50, remaining: 75,
+			want: map[string]float64{"acct_1": 5, "acct_split": 10},
+		},
+		{
+			name:     "refund of everything left reverses the rest",
+			reversed: [2]float64{20, 10},
+			refund:   40, remaining: 40,
+			want: map[string]float64{"acct_1": 10, "acct_split": 10},
+		},
+		{
+			name:   "explicit",
+			refund: 30, remaining: 100,
+			explicit: []SplitReversal{{AccountID: "acct_1", Amount: 20}},
+			want:     map[string]float64{"acct_1": 20},
+		},
+		{
+			name:     "explicit within what is left",
+			reversed: [2]float64{0, 15},
+			refund:   30, remaining: 70,
+			explicit: []SplitReversal{{AccountID: "acct_1", Amount: 25}, {AccountID: "acct_split", Amount: 5}},
+			want:     map[string]float64{"acct_1": 25, "acct_split": 5},
+		},
+		{
+			name:     "explicit over the remaining share",
+			reversed: [2]float64{0, 15},
+			refund:   30, remaining: 70,
+			explicit: []SplitReversal{{AccountID: "acct_split", Amount: 5.01}},
+			wantErr:  "reversal for acct_split exceeds its remaining share",
+		},
+		{
+			name:   "explicit over the refund",
+			refund: 30, remaining: 100,
+			explicit: []SplitReversal{{AccountID: "acct_1", Amount: 20}, {AccountID: "acct_split", Amount: 10.01}},
+			wantErr:  "split reversals exceed the refund amount",
+		},
+		{
+			name:   "explicit negative",
+			refund: 30, remaining: 100,
+			explicit: []SplitReversal{{AccountID: "acct_1", Amount: -1}},
+			wantErr:  "reversal for acct_1 exceeds its remaining share",
+		},
+		{
+			name:   "explicit duplicate account",
+			refund: 30, remaining: 100,
+			explicit: []SplitReversal{{AccountID: "acct_1", Amount: 5}, {AccountID: "acct_1", Amount: 5}},
+			wantErr:  "account acct_1 is listed more than once",
+		},
+		{
+			name:   "explicit account not in the split",
+			refund: 30, remaining: 100,
+			explicit: []SplitReversal{{AccountID: "acct_other", Amount: 5}},
+			wantErr:  "account acct_other is not part of this payment's split",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			split := &Split{Shares: []SplitShare{
+				{AccountID: "acct_1", Amount: 30, SettlementAmount: 30, Reversed: tt.reversed[0]},
+				{AccountID: "acct_split", Amount: 20, SettlementAmount: 20, Reversed: tt.reversed[1]},
+			}}
+			got, err := planSplitReversals(split, 100, tt.refund, tt.remaining, "USD", tt.explicit)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("planSplitReversals: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reversals %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("payment without a split", func(t *testing.T) {
+		if got, err := planSplitReversals(nil, 100, 50, 100, "USD", nil); err != nil || len(got) != 0 {
+			t.Errorf("got %v, %v, want no reversals", got, err)
+		}
+		explicit := []SplitReversal{{AccountID: "acct_1", Amount: 5}}
+		if _, err := planSplitReversals(nil, 100, 50, 100, "USD", explicit); err == nil {
+			t.Error("explicit reversal of a payment without a split was accepted")
+		}
+	})
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// ThreeDSecure records the outcome of 3-D Secure authentication on a payment
+type ThreeDSecure struct {
+	Version string `json:"version"`
+	// Trigger is why authentication ran: issuer or risk
+	Trigger string `json:"trigger"`
+	// Flow is frictionless or challenge
+	Flow string `json:"flow"`
+	// Status is challenge_required, authenticated, attempted or failed
+	Status         string `json:"status"`
+	ChallengeID    string `json:"challenge_id,omitempty"`
+	LiabilityShift bool   `json:"liability_shift"`
+}
+
+// ThreeDSChallenge is a pending cardholder challenge on the simulated ACS
+type ThreeDSChallenge struct {
+	ID          string     `json:"id"`
+	PaymentID   string     `json:"payment_id"`
+	URL         string     `json:"url"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// simulatedIssuer describes how a test card's issuer handles 3-D Secure.
+// Behavior is challenge, frictionless or unavailable.
+type simulatedIssuer struct {
+	Name     string
+	Behavior string
+}
+
+// simulatedIssuers maps test card BINs to their issuer behavior. Cards with
+// any other BIN only authenticate when the risk score requires it.
+var simulatedIssuers = map[string]simulatedIssuer{
+	"400000": {Name: "Simulated Challenge Bank", Behavior: "challenge"},
+	"400001": {Name: "Simulated Frictionless Bank", Behavior: "frictionless"},
+	"400002": {Name: "Simulated Offline Bank", Behavior: "unavailable"},
+	"510000": {Name: "Simulated Challenge Credit Union", Behavior: "challenge"},
+}
+
+const (
+	threeDSVersion          = "2.2.0"
+	threeDSTestOTP          = "123456"
+	threeDSMaxAttempts      = 3
+	threeDSChallengeTimeout = 10 * time.Minute
+)
+
+// MockChallenges represents a simple in-memory store of 3DS challenges
+var MockChallenges = map[string]*ThreeDSChallenge{}
+
+var challengesMu sync.Mutex
+
+// threeDSRiskThreshold is the risk score at or above which a card payment is
+// stepped up to a challenge
+func threeDSRiskThreshold() int {
+	threshold, err := strconv.Atoi(os.Getenv("THREEDS_RISK_THRESHOLD"))
+	if err != nil {
+		return 50
+	}
+	return threshold
+}
+
+func acsBaseURL() string {
+	if base := os.Getenv("THREEDS_ACS_URL"); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	return checkoutBaseURL()
+}
+
+// startThreeDSecure decides whether a card payment needs authentication,
+// from its issuer and its risk score. It returns nil when no authentication
+// ran, and a challenge when the cardholder has to complete one before the
+// payment can be authorized.
+func startThreeDSecure(request PaymentRequest, paymentId string, riskScore *int) (*ThreeDSecure, *ThreeDSChallenge) {
+	if request.PaymentMethod != "card" {
+		return nil, nil
+	}
+
+	issuer, known := simulatedIssuers[binPrefix(request.CardBin)]
+	riskRequired := riskScore != nil && *riskScore >= threeDSRiskThreshold()
+
+	trigger := "issuer"
+	switch {
+	case known && issuer.Behavior == "challenge":
+	case riskRequired:
+		trigger = "risk"
+	case known && issuer.Behavior == "frictionless":
+		return &ThreeDSecure{Version: threeDSVersion, Trigger: trigger, Flow: "frictionless", Status: "authenticated", LiabilityShift: true}, nil
+	case known && issuer.Behavior == "unavailable":
+		// The issuer could not authenticate but the attempt still shifts
+		// liability away from the merchant
+		return &ThreeDSecure{Version: threeDSVersion, Trigger: trigger, Flow: "frictionless", Status: "attempted", LiabilityShift: true}, nil
+	default:
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	challengeId := "3ds_" + uuid.New().String()[:8]
+	challenge := &ThreeDSChallenge{
+		ID:        challengeId,
+		PaymentID: paymentId,
+		URL:       acsBaseURL() + "/3ds/challenge/" + challengeId,
+		Status:    "pending",
+		ExpiresAt: now.Add(threeDSChallengeTimeout),
+		CreatedAt: now,
+	}
+
+	challengesMu.Lock()
+	MockChallenges[challengeId] = challenge
+	challengesMu.Unlock()
+
+	return &ThreeDSecure{
+		Version:     threeDSVersion,
+		Trigger:     trigger,
+		Flow:        "challenge",
+		Status:      "challenge_required",
+		ChallengeID: challengeId,
+	}, challenge
+}
+
+func binPrefix(bin string) string {
+	if len(bin) > 6 {
+		return bin[:6]
+	}
+	return bin
+}
+
+// finishThreeDSChallenge resumes the payment behind a challenge: a passed
+// challenge authorizes it and shifts liability, anything else fails it. It
+// returns a copy of the payment. Callers must hold challengesMu.
+func finishThreeDSChallenge(challenge *ThreeDSChallenge, status string) gin.H {
+	now := time.Now().UTC()
+	challenge.Status = status
+	challenge.CompletedAt = &now
+
+	paymentsMu.Lock()
+	payment, ok := findPayment(challenge.PaymentID)
+	if !ok || payment["status"] != "requires_action" {
+		if ok {
+			payment = copyPayment(payment)
+		}
+		paymentsMu.Unlock()
+		return payment
+	}
+
+	threeDS, _ := payment["three_d_secure"].(*ThreeDSecure)
+	if status == "succeeded" {
+		if threeDS != nil {
+			threeDS.Status = "authenticated"
+			threeDS.LiabilityShift = true
+		}
+		authorizePayment(payment)
+	} else {
+		if threeDS != nil {
+			threeDS.Status = "failed"
+			threeDS.LiabilityShift = false
+		}
+		payment["status"] = "failed"
+		payment["failure_reason"] = "authentication_" + status
+		delete(payment, "next_action")
+	}
+	payment = copyPayment(payment)
+	paymentsMu.Unlock()
+
+	resumeCheckoutForPayment(challenge.PaymentID, status == "succeeded")
+	return payment
+}
+
+// lookupChallenge returns a challenge, timing it out first if it has been
+// left pending too long. Callers must hold challengesMu.
+func lookupChallenge(id string) (*ThreeDSChallenge, bool) {
+	challenge, ok := MockChallenges[id]
+	if ok && challenge.Status == "pending" && time.Now().After(challenge.ExpiresAt) {
+		finishThreeDSChallenge(challenge, "timed_out")
+	}
+	return challenge, ok
+}
+
+// expireThreeDSChallenges times out every challenge left pending past its
+// expiry, failing its payment and reopening any checkout session waiting on
+// it, so abandoned challenges do not hold either forever
+func expireThreeDSChallenges(now time.Time) {
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	for _, challenge := range MockChallenges {
+		if challenge.Status == "pending" && now.After(challenge.ExpiresAt) {
+			finishThreeDSChallenge(challenge, "timed_out")
+		}
+	}
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head><title>SecurePay 3-D Secure</title></head>
+<body>
+<h1>Verify your purchase</h1>
+<p>{{.Amount}} {{.Currency}}</p>
+{{if eq .Status "pending"}}
+<p>Enter the one-time code sent by your bank. In this simulation the code is {{.OTP}}.</p>
+<form method="POST" action="{{.Action}}">
+<input name="otp" autocomplete="one-time-code">
+<button type="submit">Verify</button>
+<button type="submit" name="cancel" value="true">Cancel</button>
+</form>
+{{else}}
+<p>This challenge is {{.Status}}.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// handleGetThreeDSChallenge serves the simulated ACS challenge page
+func handleGetThreeDSChallenge(c *gin.Context) {
+	challengesMu.Lock()
+	challenge, ok := lookupChallenge(c.Param("id"))
+	var result ThreeDSChallenge
+	if ok {
+		result = *challenge
+	}
+	challengesMu.Unlock()
+
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+		return
+	}
+
+	paymentsMu.Lock()
+	payment, _ := findPayment(result.PaymentID)
+	amount, currency := payment["amount"], payment["currency"]
+	paymentsMu.Unlock()
+
+	c.Status(http.StatusOK)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	challengePage.Execute(c.Writer, gin.H{
+		"Amount":   amount,
+		"Currency": currency,
+		"Status":   result.Status,
+		"OTP":      threeDSTestOTP,
+		"Action":   result.URL,
+	})
+}
+
+// handleSubmitThreeDSChallenge checks the cardholder's one-time code. The
+// challenge fails after too many wrong codes or when it is cancelled.
+func handleSubmitThreeDSChallenge(c *gin.Context) {
+	var request struct {
+		OTP    string `json:"otp" form:"otp"`
+		Cancel bool   `json:"cancel" form:"cancel"`
+	}
+
+	if err := c.ShouldBind(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	challengesMu.Lock()
+	defer challengesMu.Unlock()
+
+	challenge, ok := lookupChallenge(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Challenge not found"})
+		return
+	}
+	if challenge.Status != "pending" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Challenge is " + challenge.Status})
+		return
+	}
+
+	var payment gin.H
+	switch {
+	case request.Cancel:
+		payment = finishThreeDSChallenge(challenge, "canceled")
+	case request.OTP == threeDSTestOTP:
+		payment = finishThreeDSChallenge(challenge, "succeeded")
+	default:
+		challenge.Attempts++
+		if challenge.Attempts < threeDSMaxAttempts {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{
+				"error":              "Incorrect verification code",
+				"attempts_remaining": threeDSMaxAttempts - challenge.Attempts,
+			})
+			return
+		}
+		payment = finishThreeDSChallenge(challenge, "failed")
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenge": *challenge,
+		"payment":   payment,
+	})
+}
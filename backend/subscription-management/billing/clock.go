@@ -0,0 +1,52 @@
+package billing
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the engine what time it is. Tests swap in a FixedClock to
+// drive renewals without waiting for periods to pass.
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock reads the wall clock
+type SystemClock struct{}
+
+// Now returns the current time in UTC
+func (SystemClock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// FixedClock always returns the time it was last set to
+type FixedClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFixedClock returns a clock stopped at now
+func NewFixedClock(now time.Time) *FixedClock {
+	return &FixedClock{now: now}
+}
+
+// Now returns the clock's time
+func (c *FixedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set moves the clock to now
+func (c *FixedClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d
+func (c *FixedClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,134 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ErrNotCreditable is returned when an invoice cannot be credited as asked
+var ErrNotCreditable = errors.New("invoice cannot be credited")
+
+// CreditRequest says how much of an invoice to credit and why
+type CreditRequest struct {
+	Amount float64
+	Reason models.CreditNoteReason
+	Memo   string
+	// Refund returns the amount of a paid invoice to the payment method
+	// that paid it. Otherwise it is taken off the subscription's next
+	// invoice. Credits on unpaid invoices lower what is left to pay.
+	Refund bool
+}
+
+// CreditResult is the credit note issued and the invoice it corrected
+type CreditResult struct {
+	CreditNote *models.CreditNote `json:"credit_note"`
+	Invoice    *models.Invoice    `json:"invoice"`
+}
+
+// IssueCreditNote corrects a finalized invoice with a credit note. It holds
+// the subscription's billing lease so the invoice is not being charged
+// while its amount due changes.
+func (e *Engine) IssueCreditNote(ctx context.Context, invoiceId string, request CreditRequest) (*CreditResult, error) {
+	invoice, err := e.Repo.GetInvoice(ctx, invoiceId)
+	if err != nil {
+		return nil, err
+	}
+	_, release, err := e.lease(ctx, invoice.SubscriptionID, "credit")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// Re-read under the lease; a run may have charged it meanwhile
+	if invoice, err = e.Repo.GetInvoice(ctx, invoiceId); err != nil {
+		return nil, err
+	}
+	if request.Amount <= 0 || request.Amount > roundAmount(invoice.Amount-invoice.AmountCredited) {
+		return nil, fmt.Errorf("%w: at most %.2f %s is left to credit", ErrNotCreditable,
+			roundAmount(invoice.Amount-invoice.AmountCredited), invoice.Currency)
+	}
+
+	description := request.Memo
+	if description == "" {
+		description = "Credit"
+		if invoice.Number != "" {
+			description = "Credit for invoice " + invoice.Number
+		}
+	}
+	note := &models.CreditNote{
+		ID:         "cn_" + uuid.New().String()[:8],
+		MerchantID: e.MerchantID,
+		InvoiceID:  invoice.ID,
+		Amount:     roundAmount(request.Amount),
+		Reason:     request.Reason,
+		Memo:       request.Memo,
+		Items:      []models.InvoiceItem{{Description: description, Amount: roundAmount(request.Amount), Quantity: 1}},
+	}
+
+	switch invoice.Status {
+	case models.Open, models.Overdue:
+		if request.Refund {
+			return nil, fmt.Errorf("%w: an unpaid invoice cannot be refunded", ErrNotCreditable)
+		}
+		note.Method = models.CreditReduceDue
+	case models.Paid:
+		if !request.Refund {
+			note.Method = models.CreditBalance
+			break
+		}
+		if invoice.PaymentID == "" {
+			return nil, fmt.Errorf("%w: the invoice was not paid through the payment service", ErrNotCreditable)
+		}
+		note.Method = models.CreditRefund
+		if err := e.refund(ctx, invoice, note); err != nil {
+			return nil, err
+		}
+		if invoice, err = e.Repo.GetInvoice(ctx, invoiceId); err != nil {
+			return nil, err
+		}
+		return &CreditResult{CreditNote: note, Invoice: invoice}, nil
+	default:
+		return nil, fmt.Errorf("%w: it is %s", ErrNotCreditable, invoice.Status)
+	}
+
+	if invoice, err = e.Repo.CreateCreditNote(ctx, note); err != nil {
+		return nil, err
+	}
+	return &CreditResult{CreditNote: note, Invoice: invoice}, nil
+}
+
+// refund returns note's amount of invoice through the payment service and
+// records it with note. The amount is reserved on the invoice before the
+// payment service is asked, so it cannot be credited twice while the
+// refund is in flight, and stays reserved unless the payment service
+// refused the refund.
+func (e *Engine) refund(ctx context.Context, invoice *models.Invoice, note *models.CreditNote) error {
+	if _, err := e.Repo.ReserveRefund(ctx, invoice.ID, note.Amount); err != nil {
+		return err
+	}
+
+	refundId, err := e.Gateway.Refund(ctx, invoice.PaymentID, note.Amount)
+	if err != nil {
+		var decline *DeclineError
+		if !errors.As(err, &decline) {
+			log.Printf("Refund of %.2f %s on invoice %s has an unknown outcome; the amount stays reserved: %v",
+				note.Amount, invoice.Currency, invoice.ID, err)
+		} else if releaseErr := e.Repo.ReleaseRefund(ctx, invoice.ID, note.Amount); releaseErr != nil {
+			log.Printf("Refund of %.2f %s on invoice %s was refused but its reservation was not released: %v",
+				note.Amount, invoice.Currency, invoice.ID, releaseErr)
+		}
+		return fmt.Errorf("%w for invoice %s: %v", ErrRefundFailed, invoice.ID, err)
+	}
+	note.RefundID = refundId
+	if _, err := e.Repo.CreateCreditNote(ctx, note); err != nil {
+		log.Printf("Refund %s of %.2f %s on invoice %s went through but its credit note was not saved: %v",
+			refundId, note.Amount, invoice.Currency, invoice.ID, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package billing
+
+import (
+	"fmt"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// discountLine returns the negative line coupon takes off amount, a charge
+// for fraction of a period on plan. For a credit the line is positive: the
+// customer is refunded the discounted price, not the full one. It returns
+// false when there is nothing to discount.
+func discountLine(coupon *models.Coupon, plan *models.Plan, amount, fraction float64) (models.InvoiceItem, bool) {
+	if coupon == nil || !coupon.AppliesTo(plan.ID) {
+		return models.InvoiceItem{}, false
+	}
+	if coupon.AmountOff > 0 && coupon.Currency != plan.Currency {
+		return models.InvoiceItem{}, false
+	}
+
+	discount := roundAmount(coupon.Discount(amount, fraction))
+	if discount == 0 {
+		return models.InvoiceItem{}, false
+	}
+	description := fmt.Sprintf("%s (%s)", coupon.Name, coupon.Label())
+	if amount < 0 {
+		description = fmt.Sprintf("%s (%s) on unused time", coupon.Name, coupon.Label())
+	}
+	return models.InvoiceItem{
+		Description: description,
+		Amount:      -discount,
+		Quantity:    1,
+		Type:        models.ItemDiscount,
+	}, true
+}
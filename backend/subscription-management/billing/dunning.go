@@ -0,0 +1,163 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// DunningPolicy says how a declined renewal is chased. Each retry is
+// scheduled relative to the invoice's due date. When the last retry fails
+// the subscription is suspended, and after SuspendFor it ends with
+// EndStatus.
+type DunningPolicy struct {
+	Schedule   []time.Duration
+	SuspendFor time.Duration
+	// EndStatus is Canceled or Expired
+	EndStatus models.SubscriptionStatus
+}
+
+// DefaultDunningPolicy retries 1, 3, 5 and 7 days after the due date, then
+// suspends for a week before canceling
+func DefaultDunningPolicy() DunningPolicy {
+	return DunningPolicy{
+		Schedule:   []time.Duration{24 * time.Hour, 3 * 24 * time.Hour, 5 * 24 * time.Hour, 7 * 24 * time.Hour},
+		SuspendFor: 7 * 24 * time.Hour,
+		EndStatus:  models.Canceled,
+	}
+}
+
+// ParseDunningSchedule parses a comma separated list of days after the due
+// date, such as "1,3,5,7". The days must increase.
+func ParseDunningSchedule(s string) ([]time.Duration, error) {
+	schedule := []time.Duration{}
+	last := 0
+	for _, field := range strings.Split(s, ",") {
+		days, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || days <= last {
+			return nil, fmt.Errorf("dunning schedule must be increasing days, such as 1,3,5,7")
+		}
+		schedule = append(schedule, time.Duration(days)*24*time.Hour)
+		last = days
+	}
+	return schedule, nil
+}
+
+// ParseEndStatus returns the status a subscription ends in when dunning
+// gives up: "canceled" or "expired"
+func ParseEndStatus(s string) (models.SubscriptionStatus, error) {
+	switch status := models.SubscriptionStatus(s); status {
+	case models.Canceled, models.Expired:
+		return status, nil
+	}
+	return "", fmt.Errorf("dunning end status must be canceled or expired")
+}
+
+// dun records a declined renewal charge. The invoice becomes overdue and
+// the subscription past due until the next retry; after the last one the
+// subscription is suspended.
+func (e *Engine) dun(ctx context.Context, subscription *models.Subscription, invoice *models.Invoice, now time.Time) (outcome, error) {
+	invoice.Status = models.Overdue
+	invoice.NextPaymentAttempt = nil
+
+	result, status := suspended, models.Suspended
+	if attempt := invoice.AttemptCount; attempt <= len(e.Dunning.Schedule) {
+		retryAt := invoice.DueDate.Add(e.Dunning.Schedule[attempt-1])
+		if retryAt.Before(now) {
+			retryAt = now
+		}
+		invoice.NextPaymentAttempt = &retryAt
+		result, status = failed, models.PastDue
+	}
+
+	if err := e.Repo.UpdateInvoice(ctx, invoice); err != nil {
+		return failed, err
+	}
+	if err := e.Repo.SetSubscriptionStatus(ctx, subscription.ID, status, now); err != nil {
+		return failed, err
+	}
+
+	message := fmt.Sprintf("Payment of %.2f %s for %s failed: %s.", invoice.AmountDue(), invoice.Currency, subscription.Plan.Name, invoice.LastPaymentError)
+	if invoice.NextPaymentAttempt != nil {
+		e.notify(ctx, subscription.CustomerID, "payment_failed",
+			fmt.Sprintf("%s We will try again on %s. Update your payment method to pay now.", message, invoice.NextPaymentAttempt.Format("Jan 2, 2006")))
+	} else {
+		e.notify(ctx, subscription.CustomerID, "subscription_suspended",
+			fmt.Sprintf("%s Your subscription is suspended. Update your payment method to reactivate it.", message))
+	}
+	return result, nil
+}
+
+// endSuspended ends subscriptions that have been suspended for longer than
+// the policy allows, voiding the renewals they never paid
+func (e *Engine) endSuspended(ctx context.Context, owner string, now time.Time) (int, error) {
+	ids, err := e.Repo.SuspendedBefore(ctx, now.Add(-e.Dunning.SuspendFor), e.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	ended := 0
+	for _, id := range ids {
+		ok, err := e.endSubscription(ctx, id, owner, now)
+		if err != nil {
+			log.Printf("Ending suspended subscription %s failed: %v", id, err)
+			continue
+		}
+		if ok {
+			ended++
+		}
+	}
+	return ended, nil
+}
+
+func (e *Engine) endSubscription(ctx context.Context, subscriptionId, owner string, now time.Time) (bool, error) {
+	leased, err := e.Repo.AcquireBillingLease(ctx, subscriptionId, owner, e.LeaseTTL)
+	if err != nil || !leased {
+		return false, err
+	}
+	defer e.releaseLease(subscriptionId, owner)
+
+	// A payment may have reactivated it since it was listed
+	subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+	if err != nil || subscription.Status != models.Suspended {
+		return false, err
+	}
+	if err := e.Repo.VoidUnpaidInvoices(ctx, subscription.ID); err != nil {
+		return false, err
+	}
+	if err := e.Repo.SetSubscriptionStatus(ctx, subscription.ID, e.Dunning.EndStatus, now); err != nil {
+		return false, err
+	}
+	e.notify(ctx, subscription.CustomerID, "subscription_"+string(e.Dunning.EndStatus),
+		fmt.Sprintf("Your subscription to %s has been %s because its renewal could not be collected.", subscription.Plan.Name, e.Dunning.EndStatus))
+	return true, nil
+}
+
+// RetryCustomer retries the overdue renewals of a customer's past due and
+// suspended subscriptions now, without waiting for the dunning schedule.
+// It is called when the customer updates their payment method so a
+// successful charge reactivates them at once.
+func (e *Engine) RetryCustomer(ctx context.Context, customerId string) (RunReport, error) {
+	now := e.Clock.Now()
+	report := RunReport{AsOf: now, Invoices: []string{}}
+	owner := fmt.Sprintf("%s/retry/%d", e.instance, e.nextRun())
+
+	subscriptions, err := e.Repo.ListCustomerSubscriptions(ctx, customerId)
+	if err != nil {
+		return report, err
+	}
+	for _, subscription := range subscriptions {
+		if subscription.Status != models.PastDue && subscription.Status != models.Suspended {
+			continue
+		}
+		report.Due++
+		result, invoices, err := e.renew(ctx, subscription.ID, owner, now, true)
+		report.record(subscription.ID, result, invoices, err)
+	}
+	return report, nil
+}
@@ -0,0 +1,95 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+func TestDunningProgression(t *testing.T) {
+	declined := &DeclineError{Reason: "card declined"}
+	after := func(d time.Duration) *time.Time {
+		t := periodEnd.Add(d)
+		return &t
+	}
+
+	type step struct {
+		at                 time.Duration
+		status             models.SubscriptionStatus
+		periodEnd          time.Time
+		invoiceStatus      models.InvoiceStatus
+		attempts           int
+		nextPaymentAttempt *time.Time
+	}
+	tests := []struct {
+		name     string
+		outcomes []error
+		steps    []step
+	}{
+		{
+			name:     "every retry declined",
+			outcomes: []error{declined, declined, declined},
+			steps: []step{
+				{0, models.PastDue, periodEnd, models.Overdue, 1, after(1 * day)},
+				{12 * time.Hour, models.PastDue, periodEnd, models.Overdue, 1, after(1 * day)},
+				{1 * day, models.PastDue, periodEnd, models.Overdue, 2, after(3 * day)},
+				{3 * day, models.Suspended, periodEnd, models.Overdue, 3, nil},
+				{8 * day, models.Suspended, periodEnd, models.Overdue, 3, nil},
+				{10 * day, models.Canceled, periodEnd, models.Void, 3, nil},
+			},
+		},
+		{
+			name:     "paid on the first retry",
+			outcomes: []error{declined},
+			steps: []step{
+				{0, models.PastDue, periodEnd, models.Overdue, 1, after(1 * day)},
+				{1 * day, models.Active, nextEnd, models.Paid, 2, nil},
+			},
+		},
+		{
+			name:     "paid on the last retry",
+			outcomes: []error{declined, declined},
+			steps: []step{
+				{0, models.PastDue, periodEnd, models.Overdue, 1, after(1 * day)},
+				{1 * day, models.PastDue, periodEnd, models.Overdue, 2, after(3 * day)},
+				{3 * day, models.Active, nextEnd, models.Paid, 3, nil},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBilling(models.Subscription{Status: models.Active}, 30, "pm_card", tt.outcomes...)
+			b.engine.Dunning = DunningPolicy{
+				Schedule:   []time.Duration{1 * day, 3 * day},
+				SuspendFor: 7 * day,
+				EndStatus:  models.Canceled,
+			}
+			for _, step := range tt.steps {
+				b.clock.Set(periodEnd.Add(step.at))
+				b.run(t)
+
+				subscription := b.store.subscription("sub_1")
+				if subscription.Status != step.status || !subscription.CurrentPeriodEnd.Equal(step.periodEnd) {
+					t.Errorf("at +%v: subscription is %s until %v, want %s until %v",
+						step.at, subscription.Status, subscription.CurrentPeriodEnd, step.status, step.periodEnd)
+				}
+				invoices := b.store.subscriptionInvoices("sub_1")
+				if len(invoices) != 1 {
+					t.Fatalf("at +%v: %d invoices, want 1", step.at, len(invoices))
+				}
+				invoice := invoices[0]
+				if invoice.Status != step.invoiceStatus || invoice.AttemptCount != step.attempts {
+					t.Errorf("at +%v: invoice is %s after %d attempts, want %s after %d",
+						step.at, invoice.Status, invoice.AttemptCount, step.invoiceStatus, step.attempts)
+				}
+				switch next := invoice.NextPaymentAttempt; {
+				case next == nil && step.nextPaymentAttempt == nil:
+				case next == nil || step.nextPaymentAttempt == nil || !next.Equal(*step.nextPaymentAttempt):
+					t.Errorf("at +%v: next payment attempt %v, want %v", step.at, next, step.nextPaymentAttempt)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+// Package billing renews subscriptions: it invoices each subscription for
+// its next period when the current one ends and charges the invoice through
+// the payment service
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+// maxCatchUpPeriods bounds how many missed periods one run bills for a
+// single subscription
+const maxCatchUpPeriods = 12
+
+// Engine finds subscriptions whose period has ended and renews them, and
+// converts or expires trials that have ended
+type Engine struct {
+	Repo    Store
+	Gateway PaymentGateway
+	Clock   Clock
+	// Notifier is optional; without one customers are not told about
+	// their trials
+	Notifier Notifier
+
+	// LeaseTTL is how long a run holds a subscription; a crashed run
+	// blocks it for at most this long
+	LeaseTTL time.Duration
+	// Dunning is how declined renewals are retried and when they give up
+	// again
+	Dunning DunningPolicy
+	// BatchSize is the most subscriptions one run renews
+	BatchSize int
+	// TrialReminderLead is how long before a trial ends the customer is
+	// reminded
+	TrialReminderLead time.Duration
+	// MerchantID is the merchant invoices are issued and numbered by
+	MerchantID string
+
+	instance string
+	runs     int64
+}
+
+// NewEngine returns an engine with default lease, retry and batch settings
+func NewEngine(repo Store, gateway PaymentGateway, clock Clock) *Engine {
+	hostname, _ := os.Hostname()
+	return &Engine{
+		Repo:              repo,
+		Gateway:           gateway,
+		Clock:             clock,
+		LeaseTTL:          5 * time.Minute,
+		Dunning:           DefaultDunningPolicy(),
+		BatchSize:         100,
+		TrialReminderLead: 3 * 24 * time.Hour,
+		MerchantID:        "default",
+		instance:          fmt.Sprintf("%s-%d", hostname, os.Getpid()),
+	}
+}
+
+// RunReport summarizes one billing run
+type RunReport struct {
+	AsOf     time.Time `json:"as_of"`
+	Due      int       `json:"due"`
+	Renewed  int       `json:"renewed"`
+	Failed   int       `json:"failed"`
+	Skipped  int       `json:"skipped"`
+	Expired  int       `json:"expired"`
+	Reminded int       `json:"reminded"`
+	// Suspended counts renewals that failed their last retry; they are
+	// also counted as failed
+	Suspended int `json:"suspended"`
+	// Ended counts suspended subscriptions canceled or expired by dunning
+	Ended int `json:"ended"`
+	// Canceled counts subscriptions canceled at the end of their period
+	Canceled int      `json:"canceled"`
+	Invoices []string `json:"invoices"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// outcome is what happened to one subscription in a run
+type outcome int
+
+const (
+	skipped outcome = iota
+	renewed
+	failed
+	suspended
+	expired
+	canceled
+)
+
+// Run renews every subscription that is due at the clock's current time,
+// after reminding customers whose trials are about to end. It is safe to
+// call concurrently, from this or other replicas: each subscription is
+// leased to one run at a time, and an invoice is only ever created once per
+// subscription period.
+func (e *Engine) Run(ctx context.Context) (RunReport, error) {
+	now := e.Clock.Now()
+	report := RunReport{AsOf: now, Invoices: []string{}}
+	owner := fmt.Sprintf("%s/%d", e.instance, e.nextRun())
+
+	reminded, err := e.remindTrials(ctx, now)
+	if err != nil {
+		return report, err
+	}
+	report.Reminded = reminded
+
+	ids, err := e.Repo.DueSubscriptions(ctx, now, e.BatchSize)
+	if err != nil {
+		return report, err
+	}
+	report.Due = len(ids)
+
+	for _, id := range ids {
+		result, invoices, err := e.renew(ctx, id, owner, now, false)
+		report.record(id, result, invoices, err)
+	}
+
+	ended, err := e.endSuspended(ctx, owner, now)
+	if err != nil {
+		return report, err
+	}
+	report.Ended = ended
+	return report, nil
+}
+
+// record adds the outcome of renewing one subscription to the report
+func (r *RunReport) record(subscriptionId string, result outcome, invoices []string, err error) {
+	r.Invoices = append(r.Invoices, invoices...)
+	if err != nil {
+		log.Printf("Renewing subscription %s failed: %v", subscriptionId, err)
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", subscriptionId, err))
+		r.Failed++
+		return
+	}
+	switch result {
+	case renewed:
+		r.Renewed++
+	case failed:
+		r.Failed++
+	case suspended:
+		r.Failed++
+		r.Suspended++
+	case expired:
+		r.Expired++
+	case canceled:
+		r.Canceled++
+	default:
+		r.Skipped++
+	}
+}
+
+// Start runs the engine every interval until ctx is done
+func (e *Engine) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				report, err := e.Run(ctx)
+				if err != nil {
+					log.Printf("Billing run failed: %v", err)
+					continue
+				}
+				if report.Due > 0 || report.Ended > 0 {
+					log.Printf("Billing run: %d due, %d renewed, %d failed, %d skipped, %d ended",
+						report.Due, report.Renewed, report.Failed, report.Skipped, report.Ended)
+				}
+			}
+		}
+	}()
+}
+
+// renew bills a subscription for every period that has ended, up to
+// maxCatchUpPeriods, and returns the invoices it touched. With retryNow an
+// overdue renewal is charged at once, even for a suspended subscription.
+func (e *Engine) renew(ctx context.Context, subscriptionId, owner string, now time.Time, retryNow bool) (outcome, []string, error) {
+	leased, err := e.Repo.AcquireBillingLease(ctx, subscriptionId, owner, e.LeaseTTL)
+	if err != nil || !leased {
+		return skipped, nil, err
+	}
+	defer e.releaseLease(subscriptionId, owner)
+
+	result := skipped
+	invoices := []string{}
+	for i := 0; i < maxCatchUpPeriods; i++ {
+		// Re-read under the lease; another run may have renewed it already
+		subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+		if err != nil {
+			return result, invoices, err
+		}
+		if !renewable(subscription.Status, retryNow) || subscription.CurrentPeriodEnd.After(now) {
+			return result, invoices, nil
+		}
+		// A plan change scheduled for the end of the period takes effect
+		// before the next period is invoiced
+		if subscription.PendingPlanID != "" {
+			if _, err := e.Repo.ApplyPendingPlan(ctx, subscription.ID); err != nil {
+				return result, invoices, err
+			}
+			continue
+		}
+		if subscription.CancelAtPeriodEnd {
+			return e.cancelAtPeriodEnd(ctx, subscription)
+		}
+		if subscription.Status == models.Paused {
+			if subscription.ResumeAt != nil && !subscription.ResumeAt.After(subscription.CurrentPeriodEnd) {
+				resume(subscription)
+				if err := e.Repo.UpdateSubscription(ctx, subscription); err != nil {
+					return result, invoices, err
+				}
+				e.notify(ctx, subscription.CustomerID, "subscription_resumed",
+					fmt.Sprintf("Your subscription to %s has resumed.", subscription.Plan.Name))
+				continue
+			}
+			if subscription.PauseBehavior != models.PauseKeepAsDraft {
+				// The paused period is skipped; usage from before the pause
+				// is billed with the first invoice after it resumes
+				end := subscription.Plan.Interval.Next(subscription.CurrentPeriodEnd)
+				if _, err := e.Repo.AdvancePeriod(ctx, subscription.ID, subscription.CurrentPeriodEnd, subscription.CurrentPeriodEnd, end, models.Paused); err != nil {
+					return result, invoices, err
+				}
+				result = renewed
+				continue
+			}
+		}
+
+		usage, usageIds, err := e.usageLines(ctx, subscription, subscription.CurrentPeriodEnd)
+		if err != nil {
+			return result, invoices, err
+		}
+		renewal := renewalInvoice(subscription, usage)
+		renewal.MerchantID = e.MerchantID
+		if subscription.Status == models.Paused {
+			// Kept as a draft for the merchant to finalize or void
+			renewal.Status = models.Draft
+		}
+		if subscription.Status == models.Trial && renewal.Amount > 0 {
+			customer, err := e.Repo.GetCustomer(ctx, subscription.CustomerID)
+			if err != nil {
+				return result, invoices, err
+			}
+			if customer.DefaultPaymentMethod == "" {
+				return e.expireTrial(ctx, subscription)
+			}
+		}
+
+		invoice, _, err := e.Repo.EnsureRenewalInvoice(ctx, renewal, usageIds)
+		if err != nil {
+			return result, invoices, err
+		}
+		invoices = append(invoices, invoice.ID)
+
+		if subscription.Status == models.Paused {
+			if _, err := e.Repo.AdvancePeriod(ctx, subscription.ID, subscription.CurrentPeriodEnd, invoice.PeriodStart, invoice.PeriodEnd, models.Paused); err != nil {
+				return result, invoices, err
+			}
+			result = renewed
+			continue
+		}
+
+		switch invoice.Status {
+		case models.Paid:
+			// Collected by an earlier run that stopped before moving the
+			// period on
+		case models.Draft, models.Open, models.Overdue:
+			if !retryNow && invoice.NextPaymentAttempt != nil && invoice.NextPaymentAttempt.After(now) {
+				return result, invoices, nil
+			}
+			if invoice.Status == models.Draft {
+				// Kept as a draft while paused, then resumed before the
+				// period moved on
+				if invoice, err = e.Repo.FinalizeInvoice(ctx, invoice.ID); err != nil {
+					return result, invoices, err
+				}
+			}
+			paid, err := e.collect(ctx, invoice, subscription.CustomerID, owner, now)
+			if err != nil {
+				return result, invoices, err
+			}
+			if !paid {
+				result, err := e.dun(ctx, subscription, invoice, now)
+				return result, invoices, err
+			}
+		default:
+			// Void or canceled renewal invoices are settled by hand
+			return result, invoices, nil
+		}
+
+		if _, err := e.Repo.AdvancePeriod(ctx, subscription.ID, subscription.CurrentPeriodEnd, invoice.PeriodStart, invoice.PeriodEnd, models.Active); err != nil {
+			return result, invoices, err
+		}
+		switch subscription.Status {
+		case models.Trial:
+			e.notify(ctx, subscription.CustomerID, "trial_converted",
+				fmt.Sprintf("Your free trial of %s has ended and your subscription is now active.", subscription.Plan.Name))
+		case models.PastDue, models.Suspended:
+			e.notify(ctx, subscription.CustomerID, "payment_succeeded",
+				fmt.Sprintf("Your payment of %.2f %s went through and your subscription to %s is active again.", invoice.Amount, invoice.Currency, subscription.Plan.Name))
+		}
+		result = renewed
+	}
+	return result, invoices, nil
+}
+
+// renewable reports whether a subscription in status is billed for new
+// periods. Suspended subscriptions are only retried on request.
+func renewable(status models.SubscriptionStatus, retryNow bool) bool {
+	switch status {
+	case models.Active, models.Trial, models.PastDue, models.Paused:
+		return true
+	case models.Suspended:
+		return retryNow
+	}
+	return false
+}
+
+// cancelAtPeriodEnd carries out a cancellation scheduled for the end of the
+// subscription's period
+func (e *Engine) cancelAtPeriodEnd(ctx context.Context, subscription *models.Subscription) (outcome, []string, error) {
+	if err := e.Repo.VoidUnpaidInvoices(ctx, subscription.ID); err != nil {
+		return skipped, nil, err
+	}
+	if err := e.Repo.SetSubscriptionStatus(ctx, subscription.ID, models.Canceled, subscription.CurrentPeriodEnd); err != nil {
+		return skipped, nil, err
+	}
+	e.notify(ctx, subscription.CustomerID, "subscription_canceled",
+		fmt.Sprintf("Your subscription to %s has ended as you requested.", subscription.Plan.Name))
+	return canceled, nil, nil
+}
+
+// expireTrial ends a trial that has no payment method to convert with
+func (e *Engine) expireTrial(ctx context.Context, subscription *models.Subscription) (outcome, []string, error) {
+	ok, err := e.Repo.ExpireTrial(ctx, subscription.ID)
+	if err != nil || !ok {
+		return skipped, nil, err
+	}
+	e.notify(ctx, subscription.CustomerID, "trial_expired",
+		fmt.Sprintf("Your free trial of %s has ended. Add a payment method and subscribe again to keep using it.", subscription.Plan.Name))
+	return expired, nil, nil
+}
+
+// remindTrials tells customers whose trial ends within TrialReminderLead
+// what will happen when it does. Each trial is reminded once.
+func (e *Engine) remindTrials(ctx context.Context, now time.Time) (int, error) {
+	if e.Notifier == nil || e.TrialReminderLead <= 0 {
+		return 0, nil
+	}
+	ids, err := e.Repo.TrialsEndingBefore(ctx, now, now.Add(e.TrialReminderLead), e.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	reminded := 0
+	for _, id := range ids {
+		claimed, err := e.Repo.ClaimTrialReminder(ctx, id, now)
+		if err != nil || !claimed {
+			if err != nil {
+				log.Printf("Claiming trial reminder for %s failed: %v", id, err)
+			}
+			continue
+		}
+		if err := e.sendTrialReminder(ctx, id); err != nil {
+			log.Printf("Sending trial reminder for %s failed: %v", id, err)
+			if err := e.Repo.UnclaimTrialReminder(ctx, id); err != nil {
+				log.Printf("Releasing trial reminder for %s failed: %v", id, err)
+			}
+			continue
+		}
+		reminded++
+	}
+	return reminded, nil
+}
+
+func (e *Engine) sendTrialReminder(ctx context.Context, subscriptionId string) error {
+	subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return err
+	}
+	customer, err := e.Repo.GetCustomer(ctx, subscription.CustomerID)
+	if err != nil {
+		return err
+	}
+
+	plan := subscription.Plan
+	ends := subscription.CurrentPeriodEnd.Format("Jan 2, 2006")
+	message := fmt.Sprintf("Your free trial of %s ends on %s. Your payment method on file will then be charged %.2f %s.",
+		plan.Name, ends, roundAmount(plan.Amount*float64(subscription.Quantity)), plan.Currency)
+	switch {
+	case subscription.CancelAtPeriodEnd:
+		message = fmt.Sprintf("Your free trial of %s ends on %s. Your subscription will be canceled then and you will not be charged.", plan.Name, ends)
+	case customer.DefaultPaymentMethod == "":
+		message = fmt.Sprintf("Your free trial of %s ends on %s. Add a payment method to keep your subscription.", plan.Name, ends)
+	}
+	return e.Notifier.Notify(ctx, customer.ID, "trial_ending", message)
+}
+
+// notify sends a best-effort notification
+func (e *Engine) notify(ctx context.Context, customerId, kind, message string) {
+	if e.Notifier == nil {
+		return
+	}
+	if err := e.Notifier.Notify(ctx, customerId, kind, message); err != nil {
+		log.Printf("Sending %s notification to %s failed: %v", kind, customerId, err)
+	}
+}
+
+func (e *Engine) nextRun() int64 {
+	return atomic.AddInt64(&e.runs, 1)
+}
+
+// extendLease renews owner's lease before a charge, so a run that has been
+// renewing a subscription for a while still holds it while the charge is
+// made. It returns ErrLeaseLost if another run has taken the lease over.
+func (e *Engine) extendLease(ctx context.Context, subscriptionId, owner string) error {
+	extended, err := e.Repo.ExtendBillingLease(ctx, subscriptionId, owner, e.LeaseTTL)
+	if err != nil {
+		return err
+	}
+	if !extended {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+func (e *Engine) releaseLease(subscriptionId, owner string) {
+	if err := e.Repo.ReleaseBillingLease(context.Background(), subscriptionId, owner); err != nil {
+		log.Printf("Releasing billing lease on %s failed: %v", subscriptionId, err)
+	}
+}
+
+// renewalInvoice builds the invoice for the period after the subscription's
+// current one, with usage lines for the period just ended
+func renewalInvoice(subscription *models.Subscription, usage []models.InvoiceItem) *models.Invoice {
+	plan := subscription.Plan
+	start := subscription.CurrentPeriodEnd
+	end := plan.Interval.Next(start)
+	amount := roundAmount(plan.Amount * float64(subscription.Quantity))
+	items := []models.InvoiceItem{{
+		Description: fmt.Sprintf("%s x %s (%s - %s)", seats(subscription.Quantity), plan.Name, start.Format("Jan 2, 2006"), end.Format("Jan 2, 2006")),
+		Amount:      amount,
+		Quantity:    subscription.Quantity,
+		Type:        models.ItemSubscription,
+	}}
+	for _, line := range usage {
+		items = append(items, line)
+		amount = roundAmount(amount + line.Amount)
+	}
+	if discount, ok := discountLine(subscription.DiscountAt(start), plan, amount, 1); ok {
+		items = append(items, discount)
+		amount = roundAmount(amount + discount.Amount)
+	}
+
+	return &models.Invoice{
+		ID:             "in_" + uuid.New().String()[:8],
+		SubscriptionID: subscription.ID,
+		CustomerID:     subscription.CustomerID,
+		Amount:         amount,
+		Currency:       plan.Currency,
+		Status:         models.Open,
+		BillingReason:  models.ReasonSubscriptionCycle,
+		DueDate:        start,
+		PeriodStart:    start,
+		PeriodEnd:      end,
+		Description:    "Renewal of " + plan.Name,
+		Items:          items,
+	}
+}
+
+// collect charges an open invoice to the customer's default payment method
+// on behalf of the lease owner. It reports whether the invoice is now paid.
+// A paid invoice is saved; a declined one has the attempt recorded on it and
+// is left for the caller to save. An error means the outcome is unknown and
+// the invoice is left untouched so the next run tries again.
+//
+// The charge is keyed by the invoice and attempt number, so until a
+// declined attempt is saved every try is the same payment. A run that dies
+// after the charge goes through gets that payment back next time instead
+// of charging again.
+func (e *Engine) collect(ctx context.Context, invoice *models.Invoice, customerId, owner string, now time.Time) (bool, error) {
+	amount := invoice.AmountDue()
+	if amount <= 0 {
+		return true, e.markPaid(ctx, invoice, "", now)
+	}
+
+	customer, err := e.Repo.GetCustomer(ctx, customerId)
+	if err != nil {
+		return false, err
+	}
+
+	var paymentId string
+	if customer.DefaultPaymentMethod == "" {
+		err = &DeclineError{Reason: "no payment method on file"}
+	} else {
+		if err := e.extendLease(ctx, invoice.SubscriptionID, owner); err != nil {
+			return false, err
+		}
+		paymentId, err = e.Gateway.Charge(ctx, Charge{
+			InvoiceID:      invoice.ID,
+			CustomerID:     customer.ID,
+			Email:          customer.Email,
+			PaymentMethod:  customer.DefaultPaymentMethod,
+			Amount:         amount,
+			Currency:       invoice.Currency,
+			IdempotencyKey: fmt.Sprintf("%s-%d", invoice.ID, invoice.AttemptCount+1),
+		})
+	}
+
+	invoice.AttemptCount++
+	var decline *DeclineError
+	if errors.As(err, &decline) {
+		invoice.LastPaymentError = decline.Reason
+		if decline.PaymentID != "" {
+			invoice.PaymentID = decline.PaymentID
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, e.markPaid(ctx, invoice, paymentId, now)
+}
+
+func (e *Engine) markPaid(ctx context.Context, invoice *models.Invoice, paymentId string, now time.Time) error {
+	invoice.Status = models.Paid
+	invoice.PaidAt = &now
+	invoice.PaymentID = paymentId
+	invoice.LastPaymentError = ""
+	invoice.NextPaymentAttempt = nil
+	return e.Repo.UpdateInvoice(ctx, invoice)
+}
+
+// seats describes a seat count, such as "1 seat" or "5 seats"
+func seats(quantity int) string {
+	if quantity == 1 {
+		return "1 seat"
+	}
+	return fmt.Sprintf("%d seats", quantity)
+}
+
+// roundAmount rounds to cents
+func roundAmount(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
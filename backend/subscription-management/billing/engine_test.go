@@ -0,0 +1,225 @@
+package billing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+var (
+	periodStart = time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	periodEnd   = time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC)
+	nextEnd     = time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	day         = 24 * time.Hour
+)
+
+// testBilling is an engine over an in-memory store with one customer
+// subscribed to a monthly plan whose first period ends at periodEnd
+type testBilling struct {
+	engine   *Engine
+	store    *memStore
+	gateway  *fakeGateway
+	clock    *FixedClock
+	notifier *fakeNotifier
+}
+
+func newTestBilling(subscription models.Subscription, planAmount float64, paymentMethod string, outcomes ...error) *testBilling {
+	store := newMemStore()
+	store.addPlan(models.Plan{ID: "plan_basic", Name: "Basic", Amount: planAmount, Currency: "USD", Interval: models.Monthly, IsActive: true})
+	store.addCustomer(models.Customer{ID: "cus_1", Name: "Ada", Email: "ada@example.com", DefaultPaymentMethod: paymentMethod})
+	subscription.ID = "sub_1"
+	subscription.CustomerID = "cus_1"
+	subscription.PlanID = "plan_basic"
+	subscription.Quantity = 1
+	subscription.CurrentPeriodStart = periodStart
+	subscription.CurrentPeriodEnd = periodEnd
+	store.addSubscription(subscription)
+
+	b := &testBilling{
+		store:    store,
+		gateway:  newFakeGateway(outcomes...),
+		clock:    NewFixedClock(periodEnd),
+		notifier: &fakeNotifier{},
+	}
+	b.engine = NewEngine(store, b.gateway, b.clock)
+	b.engine.Notifier = b.notifier
+	return b
+}
+
+func (b *testBilling) run(t *testing.T) RunReport {
+	t.Helper()
+	report, err := b.engine.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run at %v: %v", b.clock.Now(), err)
+	}
+	return report
+}
+
+// A renewal whose charge has an unknown outcome is retried with the same
+// idempotency key, so the customer is charged exactly once however many
+// runs it takes
+func TestRenewalIsIdempotent(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []error
+		runs     int
+	}{
+		{"charged at once", nil, 1},
+		{"response lost after charging", []error{errResponseLost}, 2},
+		{"payment service unavailable", []error{errUnavailable}, 2},
+		{"unavailable then response lost", []error{errUnavailable, errResponseLost}, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBilling(models.Subscription{Status: models.Active}, 30, "pm_card", tt.outcomes...)
+			for i := 0; i < tt.runs; i++ {
+				report := b.run(t)
+				if wantFailed := i < tt.runs-1; (report.Failed == 1) != wantFailed {
+					t.Fatalf("run %d: report %+v, want failed %v", i+1, report, wantFailed)
+				}
+			}
+			// Nothing is left to bill
+			if report := b.run(t); report.Due != 0 {
+				t.Errorf("extra run found %d due", report.Due)
+			}
+
+			if got := b.gateway.paymentCount(); got != 1 {
+				t.Errorf("%d payments made, want 1", got)
+			}
+			if len(b.gateway.keys) != tt.runs {
+				t.Fatalf("%d charges tried, want %d", len(b.gateway.keys), tt.runs)
+			}
+			for _, key := range b.gateway.keys {
+				if key != b.gateway.keys[0] {
+					t.Errorf("idempotency keys %q differ", b.gateway.keys)
+					break
+				}
+			}
+
+			invoices := b.store.subscriptionInvoices("sub_1")
+			if len(invoices) != 1 {
+				t.Fatalf("%d invoices, want 1", len(invoices))
+			}
+			if invoice := invoices[0]; invoice.Status != models.Paid || invoice.PaymentID != "pay_1" || invoice.Amount != 30 {
+				t.Errorf("invoice is %s with payment %q for %v, want paid with pay_1 for 30", invoice.Status, invoice.PaymentID, invoice.Amount)
+			}
+			if subscription := b.store.subscription("sub_1"); subscription.Status != models.Active || !subscription.CurrentPeriodEnd.Equal(nextEnd) {
+				t.Errorf("subscription is %s until %v, want active until %v", subscription.Status, subscription.CurrentPeriodEnd, nextEnd)
+			}
+		})
+	}
+}
+
+func TestTrialEnd(t *testing.T) {
+	declined := &DeclineError{Reason: "card declined"}
+
+	tests := []struct {
+		name          string
+		planAmount    float64
+		paymentMethod string
+		cancel        bool
+		outcomes      []error
+		status        models.SubscriptionStatus
+		periodEnd     time.Time
+		invoices      []models.InvoiceStatus
+		payments      int
+		notifications []string
+	}{
+		{
+			name:          "converts with a payment method",
+			planAmount:    30,
+			paymentMethod: "pm_card",
+			status:        models.Active,
+			periodEnd:     nextEnd,
+			invoices:      []models.InvoiceStatus{models.Paid},
+			payments:      1,
+			notifications: []string{"trial_converted"},
+		},
+		{
+			name:          "expires without a payment method",
+			planAmount:    30,
+			status:        models.Expired,
+			periodEnd:     periodEnd,
+			invoices:      []models.InvoiceStatus{},
+			notifications: []string{"trial_expired"},
+		},
+		{
+			name:          "free plan converts without a payment method",
+			status:        models.Active,
+			periodEnd:     nextEnd,
+			invoices:      []models.InvoiceStatus{models.Paid},
+			notifications: []string{"trial_converted"},
+		},
+		{
+			name:          "declined conversion is dunned",
+			planAmount:    30,
+			paymentMethod: "pm_card",
+			outcomes:      []error{declined},
+			status:        models.PastDue,
+			periodEnd:     periodEnd,
+			invoices:      []models.InvoiceStatus{models.Overdue},
+			notifications: []string{"payment_failed"},
+		},
+		{
+			name:          "canceled at the end of the trial",
+			planAmount:    30,
+			paymentMethod: "pm_card",
+			cancel:        true,
+			status:        models.Canceled,
+			periodEnd:     periodEnd,
+			invoices:      []models.InvoiceStatus{},
+			notifications: []string{"subscription_canceled"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			trialEnd := periodEnd
+			b := newTestBilling(models.Subscription{
+				Status:            models.Trial,
+				TrialStart:        &periodStart,
+				TrialEnd:          &trialEnd,
+				CancelAtPeriodEnd: tt.cancel,
+			}, tt.planAmount, tt.paymentMethod, tt.outcomes...)
+			b.run(t)
+
+			subscription := b.store.subscription("sub_1")
+			if subscription.Status != tt.status || !subscription.CurrentPeriodEnd.Equal(tt.periodEnd) {
+				t.Errorf("subscription is %s until %v, want %s until %v",
+					subscription.Status, subscription.CurrentPeriodEnd, tt.status, tt.periodEnd)
+			}
+			invoices := []models.InvoiceStatus{}
+			for _, invoice := range b.store.subscriptionInvoices("sub_1") {
+				invoices = append(invoices, invoice.Status)
+			}
+			if !reflect.DeepEqual(invoices, tt.invoices) {
+				t.Errorf("invoices %v, want %v", invoices, tt.invoices)
+			}
+			if got := b.gateway.paymentCount(); got != tt.payments {
+				t.Errorf("%d payments made, want %d", got, tt.payments)
+			}
+			if !reflect.DeepEqual(b.notifier.kinds, tt.notifications) {
+				t.Errorf("notifications %v, want %v", b.notifier.kinds, tt.notifications)
+			}
+		})
+	}
+}
+
+// A customer is reminded once before the trial ends, with what will happen
+// when it does
+func TestTrialReminder(t *testing.T) {
+	trialEnd := periodEnd
+	b := newTestBilling(models.Subscription{Status: models.Trial, TrialStart: &periodStart, TrialEnd: &trialEnd}, 30, "pm_card")
+
+	for _, at := range []time.Duration{-4 * day, -2 * day, -1 * day} {
+		b.clock.Set(periodEnd.Add(at))
+		b.run(t)
+	}
+	if want := []string{"trial_ending"}; !reflect.DeepEqual(b.notifier.kinds, want) {
+		t.Errorf("notifications %v, want %v", b.notifier.kinds, want)
+	}
+}
@@ -0,0 +1,521 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// memStore is an in-memory Store. It hands out copies, like the database
+// does, so the engine only changes what it saves. Leases never expire, and
+// usage, metered components and pending items are not attached to
+// renewal invoices.
+type memStore struct {
+	mu            sync.Mutex
+	plans         map[string]*models.Plan
+	customers     map[string]*models.Customer
+	subscriptions map[string]*models.Subscription
+	invoices      map[string]*models.Invoice
+	notes         []models.CreditNote
+	pending       []models.PendingInvoiceItem
+	leases        map[string]string
+	invoiceNumber int64
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		plans:         map[string]*models.Plan{},
+		customers:     map[string]*models.Customer{},
+		subscriptions: map[string]*models.Subscription{},
+		invoices:      map[string]*models.Invoice{},
+		leases:        map[string]string{},
+	}
+}
+
+func (s *memStore) addPlan(plan models.Plan)             { s.plans[plan.ID] = &plan }
+func (s *memStore) addCustomer(customer models.Customer) { s.customers[customer.ID] = &customer }
+func (s *memStore) addSubscription(subscription models.Subscription) {
+	s.subscriptions[subscription.ID] = &subscription
+}
+
+// subscription returns the stored subscription for the test to inspect
+func (s *memStore) subscription(id string) models.Subscription {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return *s.subscriptions[id]
+}
+
+// subscriptionInvoices returns the stored invoices of a subscription,
+// oldest period first
+func (s *memStore) subscriptionInvoices(subscriptionId string) []models.Invoice {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoices := []models.Invoice{}
+	for _, invoice := range s.invoices {
+		if invoice.SubscriptionID == subscriptionId {
+			invoices = append(invoices, *copyInvoice(invoice))
+		}
+	}
+	sort.Slice(invoices, func(i, j int) bool { return invoices[i].PeriodStart.Before(invoices[j].PeriodStart) })
+	return invoices
+}
+
+func copyInvoice(invoice *models.Invoice) *models.Invoice {
+	c := *invoice
+	c.Items = append([]models.InvoiceItem(nil), invoice.Items...)
+	return &c
+}
+
+func (s *memStore) AcquireBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptions[subscriptionId]; !ok || s.leases[subscriptionId] != "" {
+		return false, nil
+	}
+	s.leases[subscriptionId] = owner
+	return true, nil
+}
+
+func (s *memStore) ExtendBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leases[subscriptionId] == owner, nil
+}
+
+func (s *memStore) ReleaseBillingLease(ctx context.Context, subscriptionId, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leases[subscriptionId] == owner {
+		delete(s.leases, subscriptionId)
+	}
+	return nil
+}
+
+func (s *memStore) GetSubscription(ctx context.Context, id string) (*models.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription, ok := s.subscriptions[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	c := *subscription
+	plan := *s.plans[c.PlanID]
+	c.Plan = &plan
+	return &c, nil
+}
+
+func (s *memStore) ListCustomerSubscriptions(ctx context.Context, customerId string) ([]models.Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscriptions := []models.Subscription{}
+	for _, subscription := range s.subscriptions {
+		if subscription.CustomerID == customerId {
+			subscriptions = append(subscriptions, *subscription)
+		}
+	}
+	return subscriptions, nil
+}
+
+func (s *memStore) UpdateSubscription(ctx context.Context, subscription *models.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := *subscription
+	c.Plan = nil
+	s.subscriptions[c.ID] = &c
+	return nil
+}
+
+func (s *memStore) DueSubscriptions(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	due := []*models.Subscription{}
+	for id, subscription := range s.subscriptions {
+		switch subscription.Status {
+		case models.Active, models.Trial, models.PastDue, models.Paused:
+			if !subscription.CurrentPeriodEnd.After(now) && s.leases[id] == "" {
+				due = append(due, subscription)
+			}
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if !due[i].CurrentPeriodEnd.Equal(due[j].CurrentPeriodEnd) {
+			return due[i].CurrentPeriodEnd.Before(due[j].CurrentPeriodEnd)
+		}
+		return due[i].ID < due[j].ID
+	})
+	ids := []string{}
+	for _, subscription := range due {
+		if len(ids) == limit {
+			break
+		}
+		ids = append(ids, subscription.ID)
+	}
+	return ids, nil
+}
+
+func (s *memStore) AdvancePeriod(ctx context.Context, subscriptionId string, from, start, end time.Time, status models.SubscriptionStatus) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := s.subscriptions[subscriptionId]
+	if subscription == nil || !subscription.CurrentPeriodEnd.Equal(from) {
+		return false, nil
+	}
+	subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd = start, end
+	subscription.Status = status
+	subscription.SuspendedAt = nil
+	return true, nil
+}
+
+func (s *memStore) ApplyPendingPlan(ctx context.Context, subscriptionId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := s.subscriptions[subscriptionId]
+	if subscription == nil || subscription.PendingPlanID == "" {
+		return false, nil
+	}
+	subscription.PlanID, subscription.PendingPlanID = subscription.PendingPlanID, ""
+	return true, nil
+}
+
+func (s *memStore) SetSubscriptionStatus(ctx context.Context, subscriptionId string, status models.SubscriptionStatus, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := s.subscriptions[subscriptionId]
+	if subscription == nil {
+		return repository.ErrNotFound
+	}
+	subscription.Status = status
+	if status != models.Suspended {
+		subscription.SuspendedAt = nil
+	} else if subscription.SuspendedAt == nil {
+		subscription.SuspendedAt = &at
+	}
+	if status == models.Canceled {
+		subscription.CanceledAt = &at
+	}
+	return nil
+}
+
+func (s *memStore) SuspendedBefore(ctx context.Context, cutoff time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id, subscription := range s.subscriptions {
+		if subscription.Status == models.Suspended && !subscription.SuspendedAt.After(cutoff) && len(ids) < limit {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memStore) TrialsEndingBefore(ctx context.Context, now, cutoff time.Time, limit int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := []string{}
+	for id, subscription := range s.subscriptions {
+		end := subscription.TrialEnd
+		if subscription.Status == models.Trial && subscription.TrialReminderAt == nil &&
+			end != nil && end.After(now) && !end.After(cutoff) && len(ids) < limit {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (s *memStore) ClaimTrialReminder(ctx context.Context, subscriptionId string, at time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := s.subscriptions[subscriptionId]
+	if subscription == nil || subscription.TrialReminderAt != nil {
+		return false, nil
+	}
+	subscription.TrialReminderAt = &at
+	return true, nil
+}
+
+func (s *memStore) UnclaimTrialReminder(ctx context.Context, subscriptionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[subscriptionId].TrialReminderAt = nil
+	return nil
+}
+
+func (s *memStore) ExpireTrial(ctx context.Context, subscriptionId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subscription := s.subscriptions[subscriptionId]
+	if subscription == nil || subscription.Status != models.Trial {
+		return false, nil
+	}
+	subscription.Status = models.Expired
+	return true, nil
+}
+
+func (s *memStore) GetInvoice(ctx context.Context, id string) (*models.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice, ok := s.invoices[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	return copyInvoice(invoice), nil
+}
+
+// finalize numbers invoice; the caller holds s.mu
+func (s *memStore) finalize(invoice *models.Invoice) {
+	s.invoiceNumber++
+	now := time.Now().UTC()
+	invoice.Number = fmt.Sprintf("INV-%06d", s.invoiceNumber)
+	invoice.FinalizedAt = &now
+}
+
+func (s *memStore) CreateInvoice(ctx context.Context, invoice *models.Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if invoice.Status != models.Draft {
+		s.finalize(invoice)
+	}
+	s.invoices[invoice.ID] = copyInvoice(invoice)
+	return nil
+}
+
+func (s *memStore) EnsureRenewalInvoice(ctx context.Context, invoice *models.Invoice, usageIds []string) (*models.Invoice, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.invoices {
+		if stored.SubscriptionID == invoice.SubscriptionID && stored.BillingReason == models.ReasonSubscriptionCycle &&
+			stored.PeriodStart.Equal(invoice.PeriodStart) {
+			return copyInvoice(stored), false, nil
+		}
+	}
+	invoice.BillingReason = models.ReasonSubscriptionCycle
+	if invoice.Status != models.Draft {
+		s.finalize(invoice)
+	}
+	s.invoices[invoice.ID] = copyInvoice(invoice)
+	return invoice, true, nil
+}
+
+func (s *memStore) FinalizeInvoice(ctx context.Context, id string) (*models.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice, ok := s.invoices[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	if invoice.Status != models.Draft {
+		return nil, repository.ErrFinalized
+	}
+	invoice.Status = models.Open
+	s.finalize(invoice)
+	return copyInvoice(invoice), nil
+}
+
+func (s *memStore) UpdateInvoice(ctx context.Context, invoice *models.Invoice) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.invoices[invoice.ID]; !ok {
+		return repository.ErrNotFound
+	}
+	s.invoices[invoice.ID] = copyInvoice(invoice)
+	return nil
+}
+
+func (s *memStore) VoidUnpaidInvoices(ctx context.Context, subscriptionId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, invoice := range s.invoices {
+		switch invoice.Status {
+		case models.Draft, models.Open, models.Overdue:
+			if invoice.SubscriptionID == subscriptionId {
+				invoice.Status = models.Void
+				invoice.NextPaymentAttempt = nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memStore) RefundableInvoices(ctx context.Context, subscriptionId string, at time.Time) ([]models.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoices := []models.Invoice{}
+	for _, invoice := range s.invoices {
+		if invoice.SubscriptionID == subscriptionId && invoice.Status == models.Paid &&
+			!invoice.PeriodStart.After(at) && invoice.PeriodEnd.After(at) && invoice.AmountCredited < invoice.Amount {
+			invoices = append(invoices, *copyInvoice(invoice))
+		}
+	}
+	return invoices, nil
+}
+
+func (s *memStore) ListPendingItems(ctx context.Context, subscriptionId string) ([]models.PendingInvoiceItem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := []models.PendingInvoiceItem{}
+	for _, item := range s.pending {
+		if item.SubscriptionID == subscriptionId && item.InvoiceID == "" {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (s *memStore) CreatePendingItems(ctx context.Context, items []models.PendingInvoiceItem) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(s.pending, items...)
+	return nil
+}
+
+func (s *memStore) CreateCreditNote(ctx context.Context, note *models.CreditNote) (*models.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice, ok := s.invoices[note.InvoiceID]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	if note.Method != models.CreditRefund {
+		if note.Amount > roundAmount(invoice.Amount-invoice.AmountCredited) {
+			return nil, repository.ErrUnavailable
+		}
+		invoice.AmountCredited = roundAmount(invoice.AmountCredited + note.Amount)
+	}
+	note.Number = fmt.Sprintf("INV-CN-%06d", len(s.notes)+1)
+	s.notes = append(s.notes, *note)
+	return copyInvoice(invoice), nil
+}
+
+func (s *memStore) ReserveRefund(ctx context.Context, invoiceId string, amount float64) (*models.Invoice, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice, ok := s.invoices[invoiceId]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	if invoice.Status != models.Paid || amount <= 0 || amount > roundAmount(invoice.Amount-invoice.AmountCredited) {
+		return nil, repository.ErrUnavailable
+	}
+	invoice.AmountCredited = roundAmount(invoice.AmountCredited + amount)
+	invoice.AmountRefunded = roundAmount(invoice.AmountRefunded + amount)
+	return copyInvoice(invoice), nil
+}
+
+func (s *memStore) ReleaseRefund(ctx context.Context, invoiceId string, amount float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invoice := s.invoices[invoiceId]
+	invoice.AmountCredited = roundAmount(invoice.AmountCredited - amount)
+	invoice.AmountRefunded = roundAmount(invoice.AmountRefunded - amount)
+	return nil
+}
+
+func (s *memStore) GetCustomer(ctx context.Context, id string) (*models.Customer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	customer, ok := s.customers[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	c := *customer
+	return &c, nil
+}
+
+func (s *memStore) GetPlan(ctx context.Context, id string) (*models.Plan, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	plan, ok := s.plans[id]
+	if !ok {
+		return nil, repository.ErrNotFound
+	}
+	c := *plan
+	return &c, nil
+}
+
+func (s *memStore) GetComponents(ctx context.Context, ids []string) (map[string]*models.MeteredComponent, error) {
+	return map[string]*models.MeteredComponent{}, nil
+}
+
+func (s *memStore) UnbilledUsage(ctx context.Context, subscriptionId string, before time.Time) ([]models.UsageRecord, error) {
+	return nil, nil
+}
+
+// errResponseLost is a charge that went through but whose response never
+// arrived
+var errResponseLost = errors.New("payment service timed out after charging")
+
+// errUnavailable is a charge the payment service never received
+var errUnavailable = errors.New("payment service unavailable")
+
+// fakeGateway is a payment service that keeps one payment per idempotency
+// key, like POST /process. Each new key takes the next of outcomes: nil
+// charges, a *DeclineError declines, errResponseLost charges but reports
+// an error and any other error charges nothing. Once outcomes run out,
+// every charge goes through.
+type fakeGateway struct {
+	mu       sync.Mutex
+	outcomes []error
+	// payments holds the payment made for each key
+	payments map[string]string
+	// keys lists the key of every charge tried, in order
+	keys []string
+}
+
+func newFakeGateway(outcomes ...error) *fakeGateway {
+	return &fakeGateway{outcomes: outcomes, payments: map[string]string{}}
+}
+
+func (g *fakeGateway) Charge(ctx context.Context, charge Charge) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.keys = append(g.keys, charge.IdempotencyKey)
+	if paymentId, ok := g.payments[charge.IdempotencyKey]; ok {
+		return paymentId, nil
+	}
+
+	var outcome error
+	if len(g.outcomes) > 0 {
+		outcome, g.outcomes = g.outcomes[0], g.outcomes[1:]
+	}
+	if outcome != nil && outcome != errResponseLost {
+		return "", outcome
+	}
+	paymentId := fmt.Sprintf("pay_%d", len(g.payments)+1)
+	g.payments[charge.IdempotencyKey] = paymentId
+	if outcome != nil {
+		return "", outcome
+	}
+	return paymentId, nil
+}
+
+func (g *fakeGateway) Refund(ctx context.Context, paymentId string, amount float64) (string, error) {
+	return "re_" + paymentId, nil
+}
+
+// paymentCount is how many payments were actually made
+func (g *fakeGateway) paymentCount() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.payments)
+}
+
+// fakeNotifier records the kind of every notification sent
+type fakeNotifier struct {
+	mu    sync.Mutex
+	kinds []string
+}
+
+func (n *fakeNotifier) Notify(ctx context.Context, customerId, kind, message string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.kinds = append(n.kinds, kind)
+	return nil
+}
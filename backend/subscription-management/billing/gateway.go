@@ -0,0 +1,222 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Charge is a request to collect an invoice's amount from a customer
+type Charge struct {
+	InvoiceID     string
+	CustomerID    string
+	Email         string
+	PaymentMethod string
+	Amount        float64
+	Currency      string
+	// IdempotencyKey is the same for every try of one payment attempt on
+	// an invoice, so a charge retried after an unknown outcome returns the
+	// first payment instead of making a second one
+	IdempotencyKey string
+}
+
+// PaymentGateway collects payments for invoices
+type PaymentGateway interface {
+	// Charge collects the amount and returns the payment id. A payment the
+	// customer's bank or fraud screening refused, or that cannot complete
+	// without someone present, is reported as a *DeclineError. It must not
+	// be able to go through later, since a declined invoice is charged
+	// again. Any other error means the outcome is unknown and the charge
+	// can be retried.
+	Charge(ctx context.Context, charge Charge) (string, error)
+	// Refund gives back amount of a payment and returns the refund id. A
+	// refund the payment service turned down is reported as a
+	// *DeclineError; any other error means the outcome is unknown.
+	Refund(ctx context.Context, paymentId string, amount float64) (string, error)
+}
+
+// DeclineError is a charge or refund that was refused
+type DeclineError struct {
+	PaymentID string
+	Reason    string
+}
+
+func (e *DeclineError) Error() string {
+	return e.Reason
+}
+
+// HTTPGateway charges through the payment service's POST /process and
+// refunds through POST /refund/:id. Renewal payments held for fraud review
+// are voided through POST /void/:id.
+type HTTPGateway struct {
+	BaseURL    string
+	MerchantID string
+	Client     *http.Client
+}
+
+// NewHTTPGateway returns a gateway for the payment service at baseURL
+func NewHTTPGateway(baseURL, merchantId string, timeout time.Duration) *HTTPGateway {
+	return &HTTPGateway{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		MerchantID: merchantId,
+		Client:     &http.Client{Timeout: timeout},
+	}
+}
+
+// Charge implements PaymentGateway
+func (g *HTTPGateway) Charge(ctx context.Context, charge Charge) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"amount":         charge.Amount,
+		"currency":       charge.Currency,
+		"payment_method": charge.PaymentMethod,
+		"customer_id":    charge.CustomerID,
+		"email":          charge.Email,
+		"merchant_id":    g.MerchantID,
+	})
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, g.BaseURL+"/process", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if charge.IdempotencyKey != "" {
+		request.Header.Set("Idempotency-Key", charge.IdempotencyKey)
+	}
+
+	resp, err := g.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error   string `json:"error"`
+		Payment struct {
+			ID            string `json:"id"`
+			Status        string `json:"status"`
+			FailureReason string `json:"failure_reason"`
+		} `json:"payment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("payment service returned %s", resp.Status)
+	}
+	payment := result.Payment
+
+	switch {
+	case resp.StatusCode == http.StatusOK && payment.Status == "succeeded":
+		return payment.ID, nil
+	case resp.StatusCode == http.StatusOK && payment.Status == "held":
+		// Renewals run without an analyst, and a held payment left open
+		// could still be captured after dunning has charged the invoice
+		// again, so it is voided and handled as a decline
+		return g.voidHeld(ctx, payment.ID)
+	case resp.StatusCode == http.StatusOK:
+		// Renewals also run without the customer, so a payment that needs
+		// them to authenticate cannot complete. Nobody is sent its
+		// challenge, so it fails when the challenge times out.
+		return "", &DeclineError{PaymentID: payment.ID, Reason: "payment " + payment.Status}
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusConflict:
+		// A conflict means a try with the same idempotency key is still
+		// running, so its outcome is not known yet
+		return "", fmt.Errorf("payment service returned %s", resp.Status)
+	case result.Error != "":
+		return "", &DeclineError{PaymentID: payment.ID, Reason: result.Error}
+	}
+	return "", &DeclineError{PaymentID: payment.ID, Reason: resp.Status}
+}
+
+// voidHeld voids a payment held for fraud review. If an analyst captured it
+// first the charge went through after all, and its id is returned.
+func (g *HTTPGateway) voidHeld(ctx context.Context, paymentId string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, g.BaseURL+"/void/"+url.PathEscape(paymentId), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := g.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return "", &DeclineError{PaymentID: paymentId, Reason: "payment held for fraud review"}
+	case http.StatusConflict:
+		// No longer held: it was captured or voided in the meantime
+	default:
+		return "", fmt.Errorf("voiding held payment %s: payment service returned %s", paymentId, resp.Status)
+	}
+
+	status, err := g.paymentStatus(ctx, paymentId)
+	if err != nil {
+		return "", err
+	}
+	switch status {
+	case "succeeded":
+		return paymentId, nil
+	case "voided":
+		return "", &DeclineError{PaymentID: paymentId, Reason: "payment held for fraud review"}
+	}
+	return "", fmt.Errorf("held payment %s is %s and could not be voided", paymentId, status)
+}
+
+// paymentStatus reads a payment's status through GET /status/:id
+func (g *HTTPGateway) paymentStatus(ctx context.Context, paymentId string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, g.BaseURL+"/status/"+url.PathEscape(paymentId), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := g.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Payment struct {
+			Status string `json:"status"`
+		} `json:"payment"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("payment service returned %s", resp.Status)
+	}
+	return result.Payment.Status, nil
+}
+
+// Refund implements PaymentGateway
+func (g *HTTPGateway) Refund(ctx context.Context, paymentId string, amount float64) (string, error) {
+	body, _ := json.Marshal(map[string]interface{}{"amount": amount})
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, g.BaseURL+"/refund/"+url.PathEscape(paymentId), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.Client.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Error  string `json:"error"`
+		Refund struct {
+			ID string `json:"id"`
+		} `json:"refund"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || resp.StatusCode != http.StatusOK {
+		// A 4xx is the payment service refusing the refund before making
+		// it; anything else may have happened after it was made
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && result.Error != "" {
+			return "", &DeclineError{PaymentID: paymentId, Reason: fmt.Sprintf("refunding payment %s failed: %s", paymentId, result.Error)}
+		}
+		return "", fmt.Errorf("payment service returned %s", resp.Status)
+	}
+	return result.Refund.ID, nil
+}
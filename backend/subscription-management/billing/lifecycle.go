@@ -0,0 +1,257 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+var (
+	// ErrEnded is returned when a subscription has already been canceled or
+	// has expired
+	ErrEnded = errors.New("subscription has ended")
+	// ErrNotActive is returned when a subscription is not in a state the
+	// change applies to
+	ErrNotActive = errors.New("subscription is not active")
+	// ErrRefundFailed is returned when the payment service refused or
+	// failed a refund
+	ErrRefundFailed = errors.New("refund failed")
+)
+
+// CancelOptions says how to cancel a subscription
+type CancelOptions struct {
+	// AtPeriodEnd lets the subscription run to the end of the period it
+	// has paid for. Otherwise it is canceled now.
+	AtPeriodEnd bool
+	// Refund gives back the unused part of the current period when
+	// canceling now
+	Refund   bool
+	Reason   models.CancellationReason
+	Feedback string
+}
+
+// Refund is money returned for the unused part of a paid invoice, with the
+// credit note recording it
+type Refund struct {
+	InvoiceID    string  `json:"invoice_id"`
+	PaymentID    string  `json:"payment_id"`
+	RefundID     string  `json:"refund_id"`
+	CreditNoteID string  `json:"credit_note_id"`
+	Amount       float64 `json:"amount"`
+	Currency     string  `json:"currency"`
+}
+
+// CancelResult is the outcome of a cancellation
+type CancelResult struct {
+	Subscription *models.Subscription `json:"subscription"`
+	Refunds      []Refund             `json:"refunds"`
+}
+
+// Cancel cancels a subscription now or at the end of its period. Canceling
+// now voids its unpaid invoices and, with opts.Refund, refunds the unused
+// part of the current period. A refund that fails leaves the subscription
+// active so the cancellation can be retried.
+func (e *Engine) Cancel(ctx context.Context, subscriptionId string, opts CancelOptions) (*CancelResult, error) {
+	subscription, release, err := e.lease(ctx, subscriptionId, "cancel")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if subscription.Status == models.Canceled || subscription.Status == models.Expired {
+		return nil, ErrEnded
+	}
+	if opts.AtPeriodEnd && subscription.Status == models.Suspended {
+		// Dunning already decides when a suspended subscription ends
+		return nil, ErrNotActive
+	}
+	result := &CancelResult{Subscription: subscription, Refunds: []Refund{}}
+	subscription.CancellationReason = opts.Reason
+	subscription.CancellationFeedback = opts.Feedback
+
+	if opts.AtPeriodEnd {
+		subscription.CancelAtPeriodEnd = true
+		return result, e.Repo.UpdateSubscription(ctx, subscription)
+	}
+
+	now := e.Clock.Now()
+	if opts.Refund {
+		refunds, err := e.refundUnused(ctx, subscription, now)
+		result.Refunds = refunds
+		if err != nil {
+			return result, err
+		}
+	}
+	if err := e.Repo.VoidUnpaidInvoices(ctx, subscription.ID); err != nil {
+		return result, err
+	}
+
+	subscription.Status = models.Canceled
+	subscription.CanceledAt = &now
+	subscription.CancelAtPeriodEnd = false
+	if err := e.Repo.UpdateSubscription(ctx, subscription); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// refundUnused refunds, for each paid invoice covering now, the part of
+// its period charge for the time after now, issuing a credit note for each
+// refund
+func (e *Engine) refundUnused(ctx context.Context, subscription *models.Subscription, now time.Time) ([]Refund, error) {
+	invoices, err := e.Repo.RefundableInvoices(ctx, subscription.ID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	refunds := []Refund{}
+	for i := range invoices {
+		invoice := &invoices[i]
+		total := invoice.PeriodEnd.Sub(invoice.PeriodStart)
+		if total <= 0 {
+			continue
+		}
+		fraction := float64(invoice.PeriodEnd.Sub(now)) / float64(total)
+		amount := roundAmount(periodCharge(invoice) * fraction)
+		if remaining := roundAmount(invoice.Amount - invoice.AmountCredited); amount > remaining {
+			amount = remaining
+		}
+		if amount <= 0 {
+			continue
+		}
+
+		note := &models.CreditNote{
+			ID:         "cn_" + uuid.New().String()[:8],
+			MerchantID: e.MerchantID,
+			InvoiceID:  invoice.ID,
+			Amount:     amount,
+			Reason:     models.CreditOrderChange,
+			Method:     models.CreditRefund,
+			Memo:       "Subscription canceled",
+			Items: []models.InvoiceItem{{
+				Description: fmt.Sprintf("Unused time (%s - %s)", now.Format("Jan 2, 2006"), invoice.PeriodEnd.Format("Jan 2, 2006")),
+				Amount:      amount,
+				Quantity:    1,
+			}},
+		}
+		if err := e.refund(ctx, invoice, note); err != nil {
+			return refunds, err
+		}
+		refunds = append(refunds, Refund{
+			InvoiceID:    invoice.ID,
+			PaymentID:    invoice.PaymentID,
+			RefundID:     note.RefundID,
+			CreditNoteID: note.ID,
+			Amount:       amount,
+			Currency:     invoice.Currency,
+		})
+	}
+	return refunds, nil
+}
+
+// periodCharge returns what a paid invoice charged for its own period, the
+// part refunded pro rata when the subscription is canceled early. For a
+// renewal that is the plan fee less its share of the discount: the usage
+// from the period before, and prorations carried in from earlier changes,
+// were used already. Other invoices, such as prorations charged at once,
+// are for their period in full.
+func periodCharge(invoice *models.Invoice) float64 {
+	if invoice.BillingReason != models.ReasonSubscriptionCycle {
+		return invoice.Amount
+	}
+
+	var fee, usage, discount float64
+	typed := false
+	for _, item := range invoice.Items {
+		switch item.Type {
+		case models.ItemSubscription:
+			fee += item.Amount
+			typed = true
+		case models.ItemUsage:
+			usage += item.Amount
+		case models.ItemDiscount:
+			discount += item.Amount
+		}
+	}
+	if !typed {
+		// Saved before lines had types; the plan fee always comes first
+		if len(invoice.Items) == 0 {
+			return 0
+		}
+		return invoice.Items[0].Amount
+	}
+	// The coupon discounted the fee and usage together
+	if fee+usage > 0 {
+		fee += discount * fee / (fee + usage)
+	}
+	return fee
+}
+
+// Pause stops billing an active subscription until it is resumed, or until
+// resumeAt if that is set. While paused its periods still roll over, and
+// behavior says whether they are skipped or invoiced as drafts.
+func (e *Engine) Pause(ctx context.Context, subscriptionId string, behavior models.PauseBehavior, resumeAt *time.Time) (*models.Subscription, error) {
+	subscription, release, err := e.lease(ctx, subscriptionId, "pause")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if subscription.Status != models.Active {
+		return nil, ErrNotActive
+	}
+	now := e.Clock.Now()
+	subscription.Status = models.Paused
+	subscription.PauseBehavior = behavior
+	subscription.PausedAt = &now
+	subscription.ResumeAt = resumeAt
+	return subscription, e.Repo.UpdateSubscription(ctx, subscription)
+}
+
+// Resume reactivates a paused subscription. Its current period is billed
+// as usual when it ends; drafts invoiced during the pause stay drafts.
+func (e *Engine) Resume(ctx context.Context, subscriptionId string) (*models.Subscription, error) {
+	subscription, release, err := e.lease(ctx, subscriptionId, "resume")
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if subscription.Status != models.Paused {
+		return nil, ErrNotActive
+	}
+	resume(subscription)
+	return subscription, e.Repo.UpdateSubscription(ctx, subscription)
+}
+
+func resume(subscription *models.Subscription) {
+	subscription.Status = models.Active
+	subscription.PauseBehavior = ""
+	subscription.PausedAt = nil
+	subscription.ResumeAt = nil
+}
+
+// lease takes the billing lease on a subscription for a change made outside
+// a billing run and loads it. The returned func releases the lease.
+func (e *Engine) lease(ctx context.Context, subscriptionId, purpose string) (*models.Subscription, func(), error) {
+	owner := fmt.Sprintf("%s/%s/%d", e.instance, purpose, e.nextRun())
+	leased, err := e.Repo.AcquireBillingLease(ctx, subscriptionId, owner, e.LeaseTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !leased {
+		return nil, nil, ErrBusy
+	}
+	release := func() { e.releaseLease(subscriptionId, owner) }
+
+	subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return subscription, release, nil
+}
@@ -0,0 +1,57 @@
+package billing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifier tells customers about their subscriptions
+type Notifier interface {
+	Notify(ctx context.Context, customerId, kind, message string) error
+}
+
+// HTTPNotifier posts notifications to the notification service
+type HTTPNotifier struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// NewHTTPNotifier returns a notifier for the notification service at
+// baseURL
+func NewHTTPNotifier(baseURL string, timeout time.Duration) *HTTPNotifier {
+	return &HTTPNotifier{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// Notify implements Notifier
+func (n *HTTPNotifier) Notify(ctx context.Context, customerId, kind, message string) error {
+	body, _ := json.Marshal(map[string]string{
+		"user_id": customerId,
+		"type":    kind,
+		"message": message,
+	})
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.BaseURL+"/", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.Client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("notification service returned %s", resp.Status)
+	}
+	return nil
+}
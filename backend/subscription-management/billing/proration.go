@@ -0,0 +1,268 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ProrationBehavior says how the proration for a mid-cycle change is billed
+type ProrationBehavior string
+
+const (
+	// ProrateInvoiceNow invoices and charges the proration immediately
+	ProrateInvoiceNow ProrationBehavior = "invoice_now"
+	// ProrateNextInvoice adds the proration to the next renewal invoice
+	ProrateNextInvoice ProrationBehavior = "next_invoice"
+	// ProrateNone changes the subscription without prorating
+	ProrateNone ProrationBehavior = "none"
+)
+
+// ParseProrationBehavior returns the behavior named s, defaulting to
+// ProrateNextInvoice when s is empty
+func ParseProrationBehavior(s string) (ProrationBehavior, error) {
+	switch behavior := ProrationBehavior(s); behavior {
+	case "":
+		return ProrateNextInvoice, nil
+	case ProrateInvoiceNow, ProrateNextInvoice, ProrateNone:
+		return behavior, nil
+	}
+	return "", fmt.Errorf("proration_behavior must be invoice_now, next_invoice or none")
+}
+
+// ErrBusy is returned when a subscription is being billed by another run
+var ErrBusy = errors.New("subscription is being billed, try again shortly")
+
+// ErrInvalidQuantity is returned when a change asks for a seat count the
+// plan does not allow
+var ErrInvalidQuantity = errors.New("quantity is not allowed on the plan")
+
+// ErrLeaseLost is returned when a run's billing lease expired and another
+// run took the subscription over before a charge
+var ErrLeaseLost = errors.New("billing lease was taken over by another run")
+
+// Proration is the cost of changing a subscription's plan or quantity part
+// way through its period
+type Proration struct {
+	// ProrationDate is when the change takes effect
+	ProrationDate time.Time            `json:"proration_date"`
+	Lines         []models.InvoiceItem `json:"lines"`
+	Amount        float64              `json:"amount"`
+	Currency      string               `json:"currency"`
+	// PeriodStart and PeriodEnd are the subscription's period after the
+	// change. Changing to a plan with a different interval starts a new
+	// period, charged in full.
+	PeriodStart  time.Time `json:"period_start"`
+	PeriodEnd    time.Time `json:"period_end"`
+	ResetsPeriod bool      `json:"resets_period"`
+}
+
+// Prorate prices moving a subscription to newPlan and newQuantity at the
+// given time: a credit for the unused part of the current period on the old
+// plan and a charge for the rest of it on the new one. Each is followed by
+// its coupon discount, if the subscription has one. A trial is free, so
+// changing plans during one costs nothing and keeps the trial's end.
+// subscription.Plan must be loaded.
+func Prorate(subscription *models.Subscription, newPlan *models.Plan, newQuantity int, at time.Time) Proration {
+	oldPlan := subscription.Plan
+	start, end := subscription.CurrentPeriodStart, subscription.CurrentPeriodEnd
+	if subscription.Status == models.Trial {
+		return Proration{
+			ProrationDate: at,
+			Lines:         []models.InvoiceItem{},
+			Currency:      newPlan.Currency,
+			PeriodStart:   start,
+			PeriodEnd:     end,
+		}
+	}
+
+	fraction := 0.0
+	if total := end.Sub(start); total > 0 && at.Before(end) {
+		remaining := end.Sub(at)
+		if remaining > total {
+			remaining = total
+		}
+		fraction = float64(remaining) / float64(total)
+	}
+
+	proration := Proration{
+		ProrationDate: at,
+		Lines:         []models.InvoiceItem{},
+		Currency:      newPlan.Currency,
+		PeriodStart:   start,
+		PeriodEnd:     end,
+	}
+	addLine := func(line models.InvoiceItem) {
+		line.Amount = roundAmount(line.Amount)
+		if line.Amount == 0 {
+			return
+		}
+		proration.Lines = append(proration.Lines, line)
+		proration.Amount = roundAmount(proration.Amount + line.Amount)
+	}
+	// addPlanLine adds a charge, or a credit, for fraction of a period on
+	// plan and the discount coupon gives on it
+	addPlanLine := func(description string, plan *models.Plan, quantity int, fraction float64, credit bool, coupon *models.Coupon) {
+		amount := roundAmount(plan.Amount * float64(quantity) * fraction)
+		if credit {
+			amount = -amount
+		}
+		addLine(models.InvoiceItem{Description: description, Amount: amount, Quantity: quantity})
+		if discount, ok := discountLine(coupon, plan, amount, fraction); ok {
+			addLine(discount)
+		}
+	}
+
+	// The credit is for what was charged for this period, so it carries the
+	// discount that applied when the period started
+	addPlanLine(fmt.Sprintf("Unused time on %s x %s after %s", seats(subscription.Quantity), oldPlan.Name, at.Format("Jan 2, 2006")),
+		oldPlan, subscription.Quantity, fraction, true, subscription.DiscountAt(start))
+
+	if newPlan.Interval != oldPlan.Interval {
+		proration.ResetsPeriod = true
+		proration.PeriodStart = at
+		proration.PeriodEnd = newPlan.Interval.Next(at)
+		addPlanLine(fmt.Sprintf("%s x %s (%s - %s)", seats(newQuantity), newPlan.Name, at.Format("Jan 2, 2006"), proration.PeriodEnd.Format("Jan 2, 2006")),
+			newPlan, newQuantity, 1, false, subscription.DiscountAt(at))
+	} else {
+		addPlanLine(fmt.Sprintf("Remaining time on %s x %s after %s", seats(newQuantity), newPlan.Name, at.Format("Jan 2, 2006")),
+			newPlan, newQuantity, fraction, false, subscription.DiscountAt(at))
+	}
+	return proration
+}
+
+// Behavior returns how the proration is billed when behavior is asked for.
+// A change that resets the period is paid for up front like any new period,
+// so it is always invoiced now; queueing it for the next renewal would give
+// the whole new period away until it ended.
+func (p Proration) Behavior(requested ProrationBehavior) ProrationBehavior {
+	if p.ResetsPeriod {
+		return ProrateInvoiceNow
+	}
+	return requested
+}
+
+// ChangeResult is the outcome of a mid-cycle change
+type ChangeResult struct {
+	Subscription *models.Subscription `json:"subscription"`
+	Proration    Proration            `json:"proration"`
+	Invoice      *models.Invoice      `json:"invoice,omitempty"`
+}
+
+// ChangePlan moves a subscription to the plan newPlanId and newQuantity
+// now, billing the proration as behavior says, or at once if the change
+// resets the period. An empty newPlanId keeps the plan the subscription is
+// on when the lease is taken, so a seat change cannot undo a plan change
+// made meanwhile. With ProrateInvoiceNow a positive proration is invoiced
+// and charged at once, and a declined charge leaves the subscription
+// unchanged; a net credit is always carried to the next invoice.
+//
+// It returns ErrNotActive unless the subscription is active or trialing,
+// and ErrInvalidQuantity if the plan does not allow newQuantity seats.
+func (e *Engine) ChangePlan(ctx context.Context, subscriptionId, newPlanId string, newQuantity int, behavior ProrationBehavior) (*ChangeResult, error) {
+	owner := fmt.Sprintf("%s/change/%d", e.instance, e.nextRun())
+	leased, err := e.Repo.AcquireBillingLease(ctx, subscriptionId, owner, e.LeaseTTL)
+	if err != nil {
+		return nil, err
+	}
+	if !leased {
+		return nil, ErrBusy
+	}
+	defer e.releaseLease(subscriptionId, owner)
+
+	subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.Status != models.Active && subscription.Status != models.Trial {
+		return nil, ErrNotActive
+	}
+	newPlan := subscription.Plan
+	if newPlanId != "" {
+		if newPlan, err = e.Repo.GetPlan(ctx, newPlanId); err != nil {
+			return nil, err
+		}
+	}
+	if err := newPlan.CheckQuantity(newQuantity); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuantity, err)
+	}
+
+	now := e.Clock.Now()
+	result := &ChangeResult{Proration: Prorate(subscription, newPlan, newQuantity, now)}
+	proration := result.Proration
+	behavior = proration.Behavior(behavior)
+	description := "Change to " + newPlan.Name
+	if newPlan.ID == subscription.PlanID {
+		description = fmt.Sprintf("Change from %s to %s", seats(subscription.Quantity), seats(newQuantity))
+	}
+
+	switch {
+	case behavior == ProrateNone || len(proration.Lines) == 0:
+	case behavior == ProrateInvoiceNow && proration.Amount > 0:
+		invoice := &models.Invoice{
+			ID:             "in_" + uuid.New().String()[:8],
+			SubscriptionID: subscription.ID,
+			CustomerID:     subscription.CustomerID,
+			MerchantID:     e.MerchantID,
+			Amount:         proration.Amount,
+			Currency:       proration.Currency,
+			Status:         models.Open,
+			BillingReason:  models.ReasonSubscriptionUpdate,
+			DueDate:        now,
+			PeriodStart:    now,
+			PeriodEnd:      proration.PeriodEnd,
+			Description:    description,
+			Items:          proration.Lines,
+		}
+		if err := e.Repo.CreateInvoice(ctx, invoice); err != nil {
+			return nil, err
+		}
+		result.Invoice = invoice
+
+		paid, err := e.collect(ctx, invoice, subscription.CustomerID, owner, now)
+		if err != nil {
+			return result, err
+		}
+		if !paid {
+			decline := &DeclineError{PaymentID: invoice.PaymentID, Reason: invoice.LastPaymentError}
+			invoice.Status = models.Void
+			invoice.NextPaymentAttempt = nil
+			if err := e.Repo.UpdateInvoice(ctx, invoice); err != nil {
+				return result, err
+			}
+			return result, decline
+		}
+	default:
+		items := make([]models.PendingInvoiceItem, 0, len(proration.Lines))
+		for _, line := range proration.Lines {
+			items = append(items, models.PendingInvoiceItem{
+				ID:             "ii_" + uuid.New().String()[:8],
+				SubscriptionID: subscription.ID,
+				CustomerID:     subscription.CustomerID,
+				Description:    line.Description,
+				Amount:         line.Amount,
+				Quantity:       line.Quantity,
+				Currency:       proration.Currency,
+			})
+		}
+		if err := e.Repo.CreatePendingItems(ctx, items); err != nil {
+			return nil, err
+		}
+	}
+
+	subscription.PlanID = newPlan.ID
+	subscription.Plan = newPlan
+	subscription.PendingPlanID = ""
+	subscription.Quantity = newQuantity
+	subscription.CurrentPeriodStart = proration.PeriodStart
+	subscription.CurrentPeriodEnd = proration.PeriodEnd
+	if err := e.Repo.UpdateSubscription(ctx, subscription); err != nil {
+		return result, err
+	}
+	result.Subscription = subscription
+	return result, nil
+}
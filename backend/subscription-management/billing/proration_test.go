@@ -0,0 +1,191 @@
+package billing
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+func TestProrate(t *testing.T) {
+	start := time.Date(2026, time.April, 1, 0, 0, 0, 0, time.UTC)
+	end := time.Date(2026, time.May, 1, 0, 0, 0, 0, time.UTC)
+	halfway := time.Date(2026, time.April, 16, 0, 0, 0, 0, time.UTC)
+	beforeStart := time.Date(2026, time.March, 1, 0, 0, 0, 0, time.UTC)
+	midPeriod := time.Date(2026, time.April, 10, 0, 0, 0, 0, time.UTC)
+
+	basic := &models.Plan{ID: "plan_basic", Name: "Basic", Amount: 30, Currency: "USD", Interval: models.Monthly}
+	pro := &models.Plan{ID: "plan_pro", Name: "Pro", Amount: 60, Currency: "USD", Interval: models.Monthly}
+	lite := &models.Plan{ID: "plan_lite", Name: "Lite", Amount: 10, Currency: "USD", Interval: models.Monthly}
+	annual := &models.Plan{ID: "plan_annual", Name: "Annual", Amount: 300, Currency: "USD", Interval: models.Annual}
+	twentyOff := &models.Coupon{ID: "SAVE20", Name: "Save 20", PercentOff: 20, Duration: models.DurationForever}
+
+	tests := []struct {
+		name          string
+		status        models.SubscriptionStatus
+		coupon        *models.Coupon
+		discountStart *time.Time
+		newPlan       *models.Plan
+		newQuantity   int
+		at            time.Time
+		amount        float64
+		lines         []float64
+		resets        bool
+		periodStart   time.Time
+		periodEnd     time.Time
+	}{
+		{
+			name: "upgrade halfway", newPlan: pro, newQuantity: 1, at: halfway,
+			amount: 15, lines: []float64{-15, 30}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "downgrade halfway", newPlan: lite, newQuantity: 1, at: halfway,
+			amount: -10, lines: []float64{-15, 5}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "add seats", newPlan: basic, newQuantity: 3, at: halfway,
+			amount: 30, lines: []float64{-15, 45}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "change interval", newPlan: annual, newQuantity: 1, at: halfway,
+			amount: 285, lines: []float64{-15, 300}, resets: true,
+			periodStart: halfway, periodEnd: time.Date(2027, time.April, 16, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "discounted both ways", coupon: twentyOff, discountStart: &beforeStart, newPlan: pro, newQuantity: 1, at: halfway,
+			amount: 12, lines: []float64{-15, 3, 30, -6}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "discount started after the period", coupon: twentyOff, discountStart: &midPeriod, newPlan: pro, newQuantity: 1, at: halfway,
+			amount: 9, lines: []float64{-15, 30, -6}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "trial", status: models.Trial, newPlan: pro, newQuantity: 1, at: halfway,
+			amount: 0, lines: []float64{}, periodStart: start, periodEnd: end,
+		},
+		{
+			name: "after the period ended", newPlan: pro, newQuantity: 1, at: end.Add(24 * time.Hour),
+			amount: 0, lines: []float64{}, periodStart: start, periodEnd: end,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := tt.status
+			if status == "" {
+				status = models.Active
+			}
+			subscription := &models.Subscription{
+				ID:                 "sub_1",
+				PlanID:             basic.ID,
+				Plan:               basic,
+				Status:             status,
+				Quantity:           1,
+				CurrentPeriodStart: start,
+				CurrentPeriodEnd:   end,
+				Coupon:             tt.coupon,
+				DiscountStart:      tt.discountStart,
+			}
+
+			proration := Prorate(subscription, tt.newPlan, tt.newQuantity, tt.at)
+			if proration.Amount != tt.amount {
+				t.Errorf("amount = %v, want %v", proration.Amount, tt.amount)
+			}
+			lines := []float64{}
+			for _, line := range proration.Lines {
+				lines = append(lines, line.Amount)
+			}
+			if len(lines) != len(tt.lines) {
+				t.Fatalf("lines = %v, want %v", lines, tt.lines)
+			}
+			for i := range lines {
+				if lines[i] != tt.lines[i] {
+					t.Errorf("lines = %v, want %v", lines, tt.lines)
+					break
+				}
+			}
+			if proration.ResetsPeriod != tt.resets || !proration.PeriodStart.Equal(tt.periodStart) || !proration.PeriodEnd.Equal(tt.periodEnd) {
+				t.Errorf("period %v - %v (resets %v), want %v - %v (resets %v)",
+					proration.PeriodStart, proration.PeriodEnd, proration.ResetsPeriod, tt.periodStart, tt.periodEnd, tt.resets)
+			}
+		})
+	}
+}
+
+func TestProrationBehavior(t *testing.T) {
+	tests := []struct {
+		resets    bool
+		requested ProrationBehavior
+		want      ProrationBehavior
+	}{
+		{false, ProrateNextInvoice, ProrateNextInvoice},
+		{false, ProrateNone, ProrateNone},
+		{false, ProrateInvoiceNow, ProrateInvoiceNow},
+		{true, ProrateNextInvoice, ProrateInvoiceNow},
+		{true, ProrateNone, ProrateInvoiceNow},
+		{true, ProrateInvoiceNow, ProrateInvoiceNow},
+	}
+
+	for _, tt := range tests {
+		if got := (Proration{ResetsPeriod: tt.resets}).Behavior(tt.requested); got != tt.want {
+			t.Errorf("Behavior(%s) with resets %v = %s, want %s", tt.requested, tt.resets, got, tt.want)
+		}
+	}
+}
+
+// ChangePlan resolves the plan and checks the subscription under the
+// billing lease, so a seat change made from a stale read keeps the plan the
+// subscription is on and nothing is charged once it has stopped being active
+func TestChangePlan(t *testing.T) {
+	midPeriod := time.Date(2026, time.January, 16, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		status      models.SubscriptionStatus
+		storedPlan  string
+		newPlanId   string
+		newQuantity int
+		err         error
+		plan        string
+		quantity    int
+		amount      float64
+	}{
+		{"seat change keeps the current plan", models.Active, "plan_pro", "", 2, nil, "plan_pro", 2, 30.97},
+		{"upgrade", models.Active, "plan_basic", "plan_pro", 1, nil, "plan_pro", 1, 15.49},
+		{"trialing", models.Trial, "plan_basic", "", 3, nil, "plan_basic", 3, 0},
+		{"past due", models.PastDue, "plan_basic", "", 2, ErrNotActive, "plan_basic", 1, 0},
+		{"suspended", models.Suspended, "plan_basic", "plan_pro", 1, ErrNotActive, "plan_basic", 1, 0},
+		{"canceled", models.Canceled, "plan_basic", "", 2, ErrNotActive, "plan_basic", 1, 0},
+		{"too many seats on the current plan", models.Active, "plan_pro", "", 6, ErrInvalidQuantity, "plan_pro", 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBilling(models.Subscription{Status: tt.status}, 30, "pm_card")
+			b.store.addPlan(models.Plan{ID: "plan_pro", Name: "Pro", Amount: 60, Currency: "USD", Interval: models.Monthly, IsActive: true, MaxQuantity: 5})
+			b.store.subscriptions["sub_1"].PlanID = tt.storedPlan
+			b.clock.Set(midPeriod)
+
+			result, err := b.engine.ChangePlan(context.Background(), "sub_1", tt.newPlanId, tt.newQuantity, ProrateInvoiceNow)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("ChangePlan: %v, want %v", err, tt.err)
+			}
+			if err == nil && result.Proration.Amount != tt.amount {
+				t.Errorf("proration %v, want %v", result.Proration.Amount, tt.amount)
+			}
+			subscription := b.store.subscription("sub_1")
+			if subscription.PlanID != tt.plan || subscription.Quantity != tt.quantity {
+				t.Errorf("subscription is on %s with %d seats, want %s with %d", subscription.PlanID, subscription.Quantity, tt.plan, tt.quantity)
+			}
+			wantPayments := 0
+			if tt.amount > 0 {
+				wantPayments = 1
+			}
+			if got := b.gateway.paymentCount(); got != wantPayments {
+				t.Errorf("%d payments made, want %d", got, wantPayments)
+			}
+		})
+	}
+}
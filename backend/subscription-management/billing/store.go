@@ -0,0 +1,56 @@
+package billing
+
+import (
+	"context"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// Store is where the engine reads and saves subscriptions and invoices.
+// *repository.Repository implements it; see there for what each method
+// does.
+type Store interface {
+	// Billing leases
+	AcquireBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error)
+	ExtendBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error)
+	ReleaseBillingLease(ctx context.Context, subscriptionId, owner string) error
+
+	// Subscriptions
+	GetSubscription(ctx context.Context, id string) (*models.Subscription, error)
+	ListCustomerSubscriptions(ctx context.Context, customerId string) ([]models.Subscription, error)
+	UpdateSubscription(ctx context.Context, subscription *models.Subscription) error
+	DueSubscriptions(ctx context.Context, now time.Time, limit int) ([]string, error)
+	AdvancePeriod(ctx context.Context, subscriptionId string, from, start, end time.Time, status models.SubscriptionStatus) (bool, error)
+	ApplyPendingPlan(ctx context.Context, subscriptionId string) (bool, error)
+	SetSubscriptionStatus(ctx context.Context, subscriptionId string, status models.SubscriptionStatus, at time.Time) error
+	SuspendedBefore(ctx context.Context, cutoff time.Time, limit int) ([]string, error)
+
+	// Trials
+	TrialsEndingBefore(ctx context.Context, now, cutoff time.Time, limit int) ([]string, error)
+	ClaimTrialReminder(ctx context.Context, subscriptionId string, at time.Time) (bool, error)
+	UnclaimTrialReminder(ctx context.Context, subscriptionId string) error
+	ExpireTrial(ctx context.Context, subscriptionId string) (bool, error)
+
+	// Invoices
+	GetInvoice(ctx context.Context, id string) (*models.Invoice, error)
+	CreateInvoice(ctx context.Context, invoice *models.Invoice) error
+	EnsureRenewalInvoice(ctx context.Context, invoice *models.Invoice, usageIds []string) (*models.Invoice, bool, error)
+	FinalizeInvoice(ctx context.Context, id string) (*models.Invoice, error)
+	UpdateInvoice(ctx context.Context, invoice *models.Invoice) error
+	VoidUnpaidInvoices(ctx context.Context, subscriptionId string) error
+	RefundableInvoices(ctx context.Context, subscriptionId string, at time.Time) ([]models.Invoice, error)
+	ListPendingItems(ctx context.Context, subscriptionId string) ([]models.PendingInvoiceItem, error)
+	CreatePendingItems(ctx context.Context, items []models.PendingInvoiceItem) error
+
+	// Credit notes and refunds
+	CreateCreditNote(ctx context.Context, note *models.CreditNote) (*models.Invoice, error)
+	ReserveRefund(ctx context.Context, invoiceId string, amount float64) (*models.Invoice, error)
+	ReleaseRefund(ctx context.Context, invoiceId string, amount float64) error
+
+	// Customers, plans and usage
+	GetCustomer(ctx context.Context, id string) (*models.Customer, error)
+	GetPlan(ctx context.Context, id string) (*models.Plan, error)
+	GetComponents(ctx context.Context, ids []string) (map[string]*models.MeteredComponent, error)
+	UnbilledUsage(ctx context.Context, subscriptionId string, before time.Time) ([]models.UsageRecord, error)
+}
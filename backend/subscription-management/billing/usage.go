@@ -0,0 +1,95 @@
+package billing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// usageLines prices a subscription's unbilled usage recorded before the
+// given time, one line per metered component, and returns the ids of the
+// usage records they bill. Usage reported after its period was invoiced is
+// billed with the next invoice. Usage during a free trial is not charged,
+// but is still returned so it is marked as billed.
+func (e *Engine) usageLines(ctx context.Context, subscription *models.Subscription, before time.Time) ([]models.InvoiceItem, []string, error) {
+	records, err := e.Repo.UnbilledUsage(ctx, subscription.ID, before)
+	if err != nil || len(records) == 0 {
+		return nil, nil, err
+	}
+
+	ids := make([]string, 0, len(records))
+	totals := map[string]int64{}
+	componentIds := []string{}
+	for _, record := range records {
+		ids = append(ids, record.ID)
+		if _, ok := totals[record.ComponentID]; !ok {
+			componentIds = append(componentIds, record.ComponentID)
+		}
+		totals[record.ComponentID] += record.Quantity
+	}
+	if subscription.Status == models.Trial {
+		return nil, ids, nil
+	}
+
+	components, err := e.Repo.GetComponents(ctx, componentIds)
+	if err != nil {
+		return nil, nil, err
+	}
+	period := fmt.Sprintf("%s - %s", subscription.CurrentPeriodStart.Format("Jan 2, 2006"), before.Format("Jan 2, 2006"))
+	lines := make([]models.InvoiceItem, 0, len(componentIds))
+	for _, id := range componentIds {
+		component, ok := components[id]
+		if !ok {
+			return nil, nil, fmt.Errorf("metered component %s not found", id)
+		}
+		lines = append(lines, models.InvoiceItem{
+			Description: fmt.Sprintf("%s: %d %s (%s)", component.Name, totals[id], component.UnitName, period),
+			Amount:      roundAmount(component.Price(totals[id])),
+			Quantity:    int(totals[id]),
+			Type:        models.ItemUsage,
+		})
+	}
+	return lines, ids, nil
+}
+
+// UpcomingInvoice estimates a subscription's next renewal invoice as if
+// the period ended now: the next period's fee, the usage reported so far
+// and any pending prorations and credits. Nothing is saved.
+func (e *Engine) UpcomingInvoice(ctx context.Context, subscriptionId string) (*models.Invoice, error) {
+	subscription, err := e.Repo.GetSubscription(ctx, subscriptionId)
+	if err != nil {
+		return nil, err
+	}
+	if subscription.PendingPlanID != "" {
+		if subscription.Plan, err = e.Repo.GetPlan(ctx, subscription.PendingPlanID); err != nil {
+			return nil, err
+		}
+	}
+
+	usage, _, err := e.usageLines(ctx, subscription, e.Clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	invoice := renewalInvoice(subscription, usage)
+	invoice.ID = "upcoming"
+	invoice.Status = models.Draft
+
+	pending, err := e.Repo.ListPendingItems(ctx, subscription.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range pending {
+		invoice.Items = append(invoice.Items, models.InvoiceItem{
+			Description: item.Description,
+			Amount:      item.Amount,
+			Quantity:    item.Quantity,
+		})
+		invoice.Amount = roundAmount(invoice.Amount + item.Amount)
+	}
+	if invoice.Amount < 0 {
+		invoice.Amount = 0
+	}
+	return invoice, nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// couponRequest is the body for creating a coupon. Exactly one of
+// percent_off and amount_off is required.
+type couponRequest struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name" binding:"required"`
+	PercentOff        float64    `json:"percent_off" binding:"omitempty,gt=0,lte=100"`
+	AmountOff         float64    `json:"amount_off" binding:"omitempty,gt=0"`
+	Currency          string     `json:"currency"`
+	Duration          string     `json:"duration" binding:"required"`
+	DurationInPeriods int        `json:"duration_in_periods" binding:"omitempty,min=1"`
+	MaxRedemptions    int        `json:"max_redemptions" binding:"omitempty,min=1"`
+	RedeemBy          *time.Time `json:"redeem_by"`
+	AppliesToPlans    []string   `json:"applies_to_plans"`
+}
+
+// coupon validates the request and returns the coupon it describes
+func (r couponRequest) coupon() (*models.Coupon, error) {
+	coupon := &models.Coupon{
+		ID:             r.ID,
+		Name:           strings.TrimSpace(r.Name),
+		PercentOff:     r.PercentOff,
+		AmountOff:      r.AmountOff,
+		Duration:       models.CouponDuration(r.Duration),
+		MaxRedemptions: r.MaxRedemptions,
+		RedeemBy:       r.RedeemBy,
+		AppliesToPlans: r.AppliesToPlans,
+		IsActive:       true,
+	}
+	if coupon.ID == "" {
+		coupon.ID = "coupon_" + uuid.New().String()[:8]
+	}
+
+	if coupon.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	if (r.PercentOff > 0) == (r.AmountOff > 0) {
+		return nil, errors.New("exactly one of percent_off and amount_off is required")
+	}
+	if r.AmountOff > 0 {
+		coupon.Currency = strings.ToUpper(strings.TrimSpace(r.Currency))
+		if len(coupon.Currency) != 3 {
+			return nil, errors.New("amount_off needs a three letter currency")
+		}
+	}
+	switch coupon.Duration {
+	case models.DurationOnce, models.DurationForever:
+		if r.DurationInPeriods != 0 {
+			return nil, errors.New("duration_in_periods is only allowed with a repeating duration")
+		}
+	case models.DurationRepeating:
+		if r.DurationInPeriods == 0 {
+			return nil, errors.New("a repeating coupon needs duration_in_periods")
+		}
+		coupon.DurationInPeriods = r.DurationInPeriods
+	default:
+		return nil, errors.New("duration must be once, repeating or forever")
+	}
+	return coupon, nil
+}
+
+// handleListCoupons lists the active coupons, or every coupon with
+// ?include_inactive=true
+func handleListCoupons(c *gin.Context) {
+	coupons, err := repo.ListCoupons(c.Request.Context(), c.Query("include_inactive") == "true")
+	if err != nil {
+		respondError(c, err, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"coupons": coupons})
+}
+
+func handleGetCoupon(c *gin.Context) {
+	ctx := c.Request.Context()
+	coupon, err := repo.GetCoupon(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Coupon not found")
+		return
+	}
+	codes, err := repo.ListPromotionCodes(ctx, coupon.ID)
+	if err != nil {
+		respondError(c, err, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"coupon":          coupon,
+		"promotion_codes": codes,
+	})
+}
+
+func handleCreateCoupon(c *gin.Context) {
+	var request couponRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	coupon, err := request.coupon()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx := c.Request.Context()
+	for _, planId := range coupon.AppliesToPlans {
+		if _, err := repo.GetPlan(ctx, planId); err != nil {
+			if errors.Is(err, repository.ErrNotFound) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown plan " + planId})
+				return
+			}
+			respondError(c, err, "Plan not found")
+			return
+		}
+	}
+
+	if err := repo.CreateCoupon(ctx, coupon); err != nil {
+		if errors.Is(err, repository.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A coupon with this id already exists"})
+			return
+		}
+		respondError(c, err, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Coupon created successfully",
+		"coupon":  coupon,
+	})
+}
+
+// handleDeleteCoupon deactivates a coupon. Subscriptions that already have
+// it keep their discount.
+func handleDeleteCoupon(c *gin.Context) {
+	if err := repo.DeactivateCoupon(c.Request.Context(), c.Param("id")); err != nil {
+		respondError(c, err, "Coupon not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Coupon deactivated successfully"})
+}
+
+// handleListPromotionCodes lists promotion codes, optionally for one
+// ?coupon_id
+func handleListPromotionCodes(c *gin.Context) {
+	codes, err := repo.ListPromotionCodes(c.Request.Context(), c.Query("coupon_id"))
+	if err != nil {
+		respondError(c, err, "Promotion code not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"promotion_codes": codes})
+}
+
+func handleCreatePromotionCode(c *gin.Context) {
+	var request struct {
+		Code           string     `json:"code" binding:"required"`
+		CouponId       string     `json:"coupon_id" binding:"required"`
+		MaxRedemptions int        `json:"max_redemptions" binding:"omitempty,min=1"`
+		ExpiresAt      *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	code := &models.PromotionCode{
+		ID:             "promo_" + uuid.New().String()[:8],
+		Code:           request.Code,
+		CouponID:       request.CouponId,
+		MaxRedemptions: request.MaxRedemptions,
+		ExpiresAt:      request.ExpiresAt,
+		IsActive:       true,
+	}
+	if err := repo.CreatePromotionCode(c.Request.Context(), code); err != nil {
+		switch {
+		case errors.Is(err, repository.ErrConflict):
+			c.JSON(http.StatusConflict, gin.H{"error": "This promotion code already exists"})
+		case errors.Is(err, repository.ErrInUse):
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Coupon not found"})
+		default:
+			respondError(c, err, "Promotion code not found")
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":        "Promotion code created successfully",
+		"promotion_code": code,
+	})
+}
+
+func handleDeletePromotionCode(c *gin.Context) {
+	if err := repo.DeactivatePromotionCode(c.Request.Context(), c.Param("id")); err != nil {
+		respondError(c, err, "Promotion code not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Promotion code deactivated successfully"})
+}
+
+// discountRequest names the coupon to apply to a subscription, directly or
+// through a customer-facing promotion code
+type discountRequest struct {
+	Coupon        string `json:"coupon"`
+	PromotionCode string `json:"promotion_code"`
+}
+
+// applyDiscount looks up the requested coupon, checks it can be redeemed on
+// subscription and sets the subscription's discount, starting now and
+// covering the periods billed from the end of the current one. It writes an
+// error response and returns false if the coupon cannot be used. The
+// redemption itself is counted when the subscription is saved.
+func applyDiscount(ctx context.Context, c *gin.Context, request discountRequest, subscription *models.Subscription, plan *models.Plan, now time.Time) bool {
+	var coupon *models.Coupon
+	promotionCodeId := ""
+	switch {
+	case request.Coupon != "" && request.PromotionCode != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Give a coupon or a promotion code, not both"})
+		return false
+	case request.PromotionCode != "":
+		code, err := repo.GetPromotionCodeByCode(ctx, request.PromotionCode)
+		if err != nil {
+			respondError(c, err, "Promotion code not found")
+			return false
+		}
+		if err := code.Redeemable(now); err != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return false
+		}
+		coupon, promotionCodeId = code.Coupon, code.ID
+	default:
+		var err error
+		if coupon, err = repo.GetCoupon(ctx, request.Coupon); err != nil {
+			respondError(c, err, "Coupon not found")
+			return false
+		}
+	}
+
+	if err := coupon.Redeemable(now); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return false
+	}
+	if !coupon.AppliesTo(plan.ID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Coupon does not apply to plan " + plan.ID})
+		return false
+	}
+	if coupon.AmountOff > 0 && coupon.Currency != plan.Currency {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Coupon currency does not match the plan's"})
+		return false
+	}
+
+	subscription.CouponID = coupon.ID
+	subscription.Coupon = coupon
+	subscription.PromotionCodeID = promotionCodeId
+	subscription.DiscountStart = &now
+	subscription.DiscountEnd = coupon.Ends(subscription.CurrentPeriodEnd, plan.Interval)
+	return true
+}
+
+// handleSetDiscount applies a coupon or promotion code to a subscription,
+// replacing any discount it had
+func handleSetDiscount(c *gin.Context) {
+	var request discountRequest
+	if err := c.ShouldBindJSON(&request); err != nil || (request.Coupon == "" && request.PromotionCode == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A coupon or promotion_code is required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	subscription, err := repo.GetSubscription(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	if subscription.Status == models.Canceled || subscription.Status == models.Expired {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription has ended"})
+		return
+	}
+	if !applyDiscount(ctx, c, request, subscription, subscription.Plan, time.Now().UTC().Truncate(time.Second)) {
+		return
+	}
+
+	if err := repo.UpdateDiscount(ctx, subscription); err != nil {
+		if errors.Is(err, repository.ErrUnavailable) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Coupon is no longer available"})
+			return
+		}
+		respondError(c, err, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Discount applied successfully",
+		"subscription": subscription,
+	})
+}
+
+// handleDeleteDiscount removes a subscription's discount from its next
+// invoice on
+func handleDeleteDiscount(c *gin.Context) {
+	ctx := c.Request.Context()
+	subscription, err := repo.GetSubscription(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	if subscription.CouponID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription has no discount"})
+		return
+	}
+
+	subscription.CouponID = ""
+	subscription.Coupon = nil
+	subscription.PromotionCodeID = ""
+	subscription.DiscountStart = nil
+	subscription.DiscountEnd = nil
+	if err := repo.UpdateDiscount(ctx, subscription); err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Discount removed successfully",
+		"subscription": subscription,
+	})
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// customerRequest is the body for creating or updating a customer. Fields
+// left out of an update keep their current value.
+type customerRequest struct {
+	ID                   string                  `json:"id"`
+	Name                 *string                 `json:"name"`
+	Email                *string                 `json:"email"`
+	Phone                *string                 `json:"phone"`
+	Address              *string                 `json:"address"`
+	City                 *string                 `json:"city"`
+	State                *string                 `json:"state"`
+	Country              *string                 `json:"country"`
+	ZipCode              *string                 `json:"zip_code"`
+	DefaultPaymentMethod *string                 `json:"default_payment_method"`
+	Metadata             *map[string]interface{} `json:"metadata"`
+}
+
+// apply copies the request's fields onto customer
+func (r customerRequest) apply(customer *models.Customer) error {
+	fields := []struct {
+		value  *string
+		target *string
+	}{
+		{r.Name, &customer.Name},
+		{r.Phone, &customer.Phone},
+		{r.Address, &customer.Address},
+		{r.City, &customer.City},
+		{r.State, &customer.State},
+		{r.Country, &customer.Country},
+		{r.ZipCode, &customer.ZipCode},
+		{r.DefaultPaymentMethod, &customer.DefaultPaymentMethod},
+	}
+	for _, field := range fields {
+		if field.value != nil {
+			*field.target = strings.TrimSpace(*field.value)
+		}
+	}
+	if r.Email != nil {
+		customer.Email = strings.ToLower(strings.TrimSpace(*r.Email))
+	}
+	if r.Metadata != nil {
+		customer.Metadata = *r.Metadata
+	}
+
+	if customer.Name == "" {
+		return errors.New("name is required")
+	}
+	if _, err := mail.ParseAddress(customer.Email); err != nil {
+		return errors.New("a valid email is required")
+	}
+	return nil
+}
+
+// handleListCustomers lists customers a page at a time with limit (default
+// 50, at most 200) and offset
+func handleListCustomers(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 200 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 200"})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "offset must not be negative"})
+		return
+	}
+
+	customers, total, err := repo.ListCustomers(c.Request.Context(), limit, offset)
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"customers": customers,
+		"count":     len(customers),
+		"total":     total,
+	})
+}
+
+func handleGetCustomer(c *gin.Context) {
+	customer, err := repo.GetCustomer(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"customer": customer})
+}
+
+func handleCreateCustomer(c *gin.Context) {
+	var request customerRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	customer := &models.Customer{ID: request.ID}
+	if customer.ID == "" {
+		customer.ID = "cus_" + uuid.New().String()[:8]
+	}
+	if err := request.apply(customer); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := repo.CreateCustomer(c.Request.Context(), customer); err != nil {
+		if errors.Is(err, repository.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A customer with this id or email already exists"})
+			return
+		}
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":  "Customer created successfully",
+		"customer": customer,
+	})
+}
+
+func handleUpdateCustomer(c *gin.Context) {
+	var request customerRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	customer, err := repo.GetCustomer(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return
+	}
+	paymentMethod := customer.DefaultPaymentMethod
+	if err := request.apply(customer); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := repo.UpdateCustomer(ctx, customer); err != nil {
+		if errors.Is(err, repository.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A customer with this email already exists"})
+			return
+		}
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	response := gin.H{
+		"message":  "Customer updated successfully",
+		"customer": customer,
+	}
+	// A new payment method pays off overdue renewals straight away
+	if customer.DefaultPaymentMethod != "" && customer.DefaultPaymentMethod != paymentMethod {
+		report, err := billingEngine.RetryCustomer(ctx, customer.ID)
+		if err != nil {
+			log.Printf("Retrying overdue renewals for %s failed: %v", customer.ID, err)
+		} else if report.Due > 0 {
+			response["billing"] = report
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+func handleDeleteCustomer(c *gin.Context) {
+	if err := repo.DeleteCustomer(c.Request.Context(), c.Param("id")); err != nil {
+		if errors.Is(err, repository.ErrInUse) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Customer has subscriptions or invoices and cannot be deleted"})
+			return
+		}
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Customer deleted successfully"})
+}
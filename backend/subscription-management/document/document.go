@@ -0,0 +1,276 @@
+// Package document renders invoices and credit notes for customers, as
+// HTML pages and as PDF files
+package document
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// defaultBrandColor is used for merchants that have not set one
+const defaultBrandColor = "#1f2937"
+
+const dateFormat = "Jan 2, 2006"
+
+// Document is an invoice or credit note laid out for reading, with every
+// amount and date already formatted
+type Document struct {
+	Title string
+	// Number is the document number, or "Draft" for an invoice that has not
+	// been finalized
+	Number     string
+	Status     string
+	StatusNote string
+	Details    []Field
+	Merchant   Party
+	Customer   Party
+	BrandColor string
+	LogoURL    string
+	Lines      []Line
+	Totals     []Total
+	Footer     string
+}
+
+// Field is a labeled value, such as the date of issue
+type Field struct {
+	Label string
+	Value string
+}
+
+// Party is who a document is from or to: a name and the address and
+// contact lines printed under it
+type Party struct {
+	Name  string
+	Lines []string
+}
+
+// Line is a line item
+type Line struct {
+	Description string
+	Quantity    string
+	Amount      string
+}
+
+// Total is a row of the totals table. Strong rows are the ones to pay or
+// credited.
+type Total struct {
+	Label  string
+	Amount string
+	Strong bool
+}
+
+// ForInvoice lays out an invoice from merchant to customer. A finalized
+// invoice shows the merchant details it was issued with; merchant's current
+// ones are only used for a draft.
+func ForInvoice(invoice *models.Invoice, merchant *models.Merchant, customer *models.Customer) *Document {
+	d := newDocument("Invoice", issuer(invoice.Issuer, merchant), customer)
+	d.Number = invoice.Number
+	if d.Number == "" {
+		d.Number = "Draft"
+	}
+
+	issued := invoice.CreatedAt
+	if invoice.FinalizedAt != nil {
+		issued = *invoice.FinalizedAt
+	}
+	d.Details = []Field{
+		{"Invoice number", d.Number},
+		{"Date of issue", issued.Format(dateFormat)},
+		{"Date due", invoice.DueDate.Format(dateFormat)},
+		{"Service period", fmt.Sprintf("%s - %s", invoice.PeriodStart.Format(dateFormat), invoice.PeriodEnd.Format(dateFormat))},
+	}
+
+	switch invoice.Status {
+	case models.Draft:
+		d.Status, d.StatusNote = "Draft", "This invoice is a draft and is not payable yet."
+	case models.Open:
+		d.Status, d.StatusNote = "Open", fmt.Sprintf("%s due by %s.", money(invoice.AmountDue(), invoice.Currency), invoice.DueDate.Format(dateFormat))
+	case models.Overdue:
+		d.Status, d.StatusNote = "Overdue", fmt.Sprintf("%s was due by %s.", money(invoice.AmountDue(), invoice.Currency), invoice.DueDate.Format(dateFormat))
+	case models.Paid:
+		d.Status, d.StatusNote = "Paid", "Paid. Thank you."
+		if invoice.PaidAt != nil {
+			d.StatusNote = fmt.Sprintf("Paid on %s. Thank you.", invoice.PaidAt.Format(dateFormat))
+		}
+	case models.Void, models.InvoiceCanceled:
+		d.Status, d.StatusNote = "Void", "This invoice has been voided and is not payable."
+	default:
+		d.Status = titleCase(string(invoice.Status))
+	}
+
+	d.Lines = lines(invoice.Items, invoice.Currency)
+	d.Totals = totals(invoice.Amount, invoice.Taxes, invoice.Currency, "Total")
+	if invoice.AmountCredited > 0 {
+		d.Totals = append(d.Totals, Total{Label: "Credited", Amount: money(-invoice.AmountCredited, invoice.Currency)})
+	}
+	if invoice.AmountRefunded > 0 {
+		d.Totals = append(d.Totals, Total{Label: "Refunded", Amount: money(invoice.AmountRefunded, invoice.Currency)})
+	}
+	d.Totals = append(d.Totals, Total{Label: "Amount due", Amount: money(invoice.AmountDue(), invoice.Currency), Strong: true})
+	return d
+}
+
+// ForCreditNote lays out a credit note against invoice, showing the merchant
+// details it was issued with
+func ForCreditNote(note *models.CreditNote, invoice *models.Invoice, merchant *models.Merchant, customer *models.Customer) *Document {
+	d := newDocument("Credit note", issuer(note.Issuer, merchant), customer)
+	d.Number = note.Number
+	invoiceNumber := invoice.Number
+	if invoiceNumber == "" {
+		invoiceNumber = invoice.ID
+	}
+	d.Details = []Field{
+		{"Credit note number", note.Number},
+		{"Date of issue", note.CreatedAt.Format(dateFormat)},
+		{"Invoice", invoiceNumber},
+		{"Reason", titleCase(string(note.Reason))},
+	}
+
+	d.Status = "Issued"
+	switch note.Method {
+	case models.CreditReduceDue:
+		d.StatusNote = fmt.Sprintf("Deducted from the amount due on invoice %s.", invoiceNumber)
+	case models.CreditRefund:
+		d.Status, d.StatusNote = "Refunded", "Refunded to the original payment method."
+	case models.CreditBalance:
+		d.StatusNote = "Credited to your next invoice."
+	}
+	if note.Memo != "" {
+		d.StatusNote += " " + note.Memo
+	}
+
+	d.Lines = lines(note.Items, note.Currency)
+	d.Totals = totals(note.Amount, note.Taxes, note.Currency, "Total credit")
+	return d
+}
+
+// issuer returns the details a document was issued with, or merchant's
+// current ones if it has none saved
+func issuer(saved *models.Issuer, merchant *models.Merchant) *models.Issuer {
+	if saved != nil {
+		return saved
+	}
+	return merchant.Issuer()
+}
+
+func newDocument(title string, merchant *models.Issuer, customer *models.Customer) *Document {
+	d := &Document{
+		Title:      title,
+		BrandColor: merchant.BrandColor,
+		LogoURL:    merchant.LogoURL,
+		Footer:     merchant.Footer,
+	}
+	if d.BrandColor == "" {
+		d.BrandColor = defaultBrandColor
+	}
+
+	d.Merchant.Name = merchant.Name
+	if merchant.LegalName != "" {
+		d.Merchant.Name = merchant.LegalName
+	}
+	d.Merchant.Lines = append(splitLines(merchant.Address), nonEmpty(merchant.Email, merchant.Phone)...)
+	if merchant.TaxID != "" {
+		d.Merchant.Lines = append(d.Merchant.Lines, "Tax ID: "+merchant.TaxID)
+	}
+
+	d.Customer.Name = customer.Name
+	locality := strings.Join(nonEmpty(customer.City, strings.Join(nonEmpty(customer.State, customer.ZipCode), " ")), ", ")
+	d.Customer.Lines = nonEmpty(customer.Email, customer.Address, locality, customer.Country)
+	return d
+}
+
+func lines(items []models.InvoiceItem, currency string) []Line {
+	result := make([]Line, 0, len(items))
+	for _, item := range items {
+		quantity := ""
+		if item.Quantity > 0 {
+			quantity = strconv.Itoa(item.Quantity)
+		}
+		result = append(result, Line{
+			Description: item.Description,
+			Quantity:    quantity,
+			Amount:      money(item.Amount, currency),
+		})
+	}
+	return result
+}
+
+// totals returns the subtotal without tax, the tax breakdown and the total
+// of a tax-inclusive amount
+func totals(amount float64, taxes []models.TaxLine, currency, totalLabel string) []Total {
+	result := []Total{}
+	if len(taxes) > 0 {
+		subtotal := amount
+		for _, tax := range taxes {
+			subtotal -= tax.Amount
+		}
+		result = append(result, Total{Label: "Subtotal", Amount: money(subtotal, currency)})
+		for _, tax := range taxes {
+			label := fmt.Sprintf("%s (%s%% of %s)", tax.Name, strconv.FormatFloat(tax.Rate, 'f', -1, 64), money(tax.Taxable, currency))
+			result = append(result, Total{Label: label, Amount: money(tax.Amount, currency)})
+		}
+	}
+	return append(result, Total{Label: totalLabel, Amount: money(amount, currency), Strong: true})
+}
+
+// money formats an amount with thousands separators and its currency, such
+// as "1,234.50 USD"
+func money(amount float64, currency string) string {
+	cents := int64(math.Round(math.Abs(amount) * 100))
+	whole := strconv.FormatInt(cents/100, 10)
+	for i := len(whole) - 3; i > 0; i -= 3 {
+		whole = whole[:i] + "," + whole[i:]
+	}
+	sign := ""
+	if cents > 0 && amount < 0 {
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%s.%02d %s", sign, whole, cents%100, currency)
+}
+
+// titleCase turns a value such as "product_unsatisfactory" into
+// "Product unsatisfactory"
+func titleCase(s string) string {
+	s = strings.ReplaceAll(s, "_", " ")
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+func splitLines(s string) []string {
+	result := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func nonEmpty(values ...string) []string {
+	result := []string{}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// Filename is the name to download the document as, such as
+// "invoice-INV-000042.pdf"
+func (d *Document) Filename(extension string) string {
+	name := strings.ToLower(strings.ReplaceAll(d.Title, " ", "-")) + "-" + d.Number
+	safe := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return safe + "." + extension
+}
@@ -0,0 +1,73 @@
+package document
+
+// font is one of the standard PDF fonts every reader has, so nothing needs
+// embedding. widths are the glyph widths of the printable ASCII characters,
+// in thousandths of the font size, from Adobe's font metrics.
+type font struct {
+	resource string
+	name     string
+	widths   [95]int
+}
+
+// averageWidth is used for characters outside printable ASCII
+const averageWidth = 556
+
+var helvetica = &font{resource: "F1", name: "Helvetica", widths: [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // space to /
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556, // 0 to ?
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778, // @ to O
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556, // P to _
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556, // ` to o
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584, // p to ~
+}}
+
+var helveticaBold = &font{resource: "F2", name: "Helvetica-Bold", widths: [95]int{
+	278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+	975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+	333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+	611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+}}
+
+// width returns how wide s is at size points
+func (f *font) width(s string, size float64) float64 {
+	total := 0
+	for _, b := range winAnsi(s) {
+		if b >= 32 && b < 127 {
+			total += f.widths[b-32]
+		} else {
+			total += averageWidth
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// winAnsi encodes s in the Windows-1252 encoding the standard fonts use.
+// Characters it cannot represent become question marks.
+func winAnsi(s string) []byte {
+	encoded := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r < 32:
+			encoded = append(encoded, ' ')
+		case r < 127, r >= 0xa0 && r <= 0xff:
+			encoded = append(encoded, byte(r))
+		default:
+			if b, ok := winAnsiExtras[r]; ok {
+				encoded = append(encoded, b)
+			} else {
+				encoded = append(encoded, '?')
+			}
+		}
+	}
+	return encoded
+}
+
+// winAnsiExtras are the characters Windows-1252 puts in 0x80-0x9f
+var winAnsiExtras = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8a, '‹': 0x8b, 'Œ': 0x8c, 'Ž': 0x8e,
+	'‘': 0x91, '’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97,
+	'˜': 0x98, '™': 0x99, 'š': 0x9a, '›': 0x9b, 'œ': 0x9c, 'ž': 0x9e, 'Ÿ': 0x9f,
+}
@@ -0,0 +1,34 @@
+package document
+
+import (
+	"embed"
+	"html/template"
+	"io"
+)
+
+//go:embed templates/*.html
+var templateFiles embed.FS
+
+var htmlTemplate = template.Must(template.ParseFS(templateFiles, "templates/document.html"))
+
+// HTML writes the document as a standalone HTML page
+func (d *Document) HTML(w io.Writer) error {
+	return htmlTemplate.Execute(w, d)
+}
+
+// BrandText is the color of text on the brand color
+func (d *Document) BrandText() string {
+	if parseColor(d.BrandColor).light() {
+		return "#1f1f1f"
+	}
+	return "#ffffff"
+}
+
+// Accent is the brand color, or a dark one where the brand color is too
+// light to read on white
+func (d *Document) Accent() string {
+	if parseColor(d.BrandColor).light() {
+		return "#1f1f1f"
+	}
+	return d.BrandColor
+}
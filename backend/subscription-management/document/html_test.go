@@ -0,0 +1,47 @@
+package document
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestInvoiceHTML(t *testing.T) {
+	invoice, merchant, customer := testInvoice()
+	invoice.Items[0].Description = `<script>alert("x")</script> setup`
+	merchant.BrandColor = "#fde68a"
+	d := ForInvoice(invoice, merchant, customer)
+
+	var buf bytes.Buffer
+	if err := d.HTML(&buf); err != nil {
+		t.Fatalf("HTML: %v", err)
+	}
+	page := buf.String()
+
+	for _, want := range []string{
+		"<title>Invoice INV-000042 - Acme (Europe) Ltd</title>",
+		"<h1>Acme (Europe) Ltd</h1>",
+		"<dt>Invoice number</dt><dd>INV-000042</dd>",
+		"<dt>Date due</dt><dd>Jan 15, 2026</dd>",
+		`<div class="muted">75002 Paris</div>`,
+		`<p class="status">Open</p>`,
+		"<td>Zoë’s café — €5 日本</td>",
+		"&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; setup",
+		`<td class="number">3</td><td class="number">1.25 EUR</td>`,
+		`<tr class="strong"><td>Amount due</td><td class="number">115.00 EUR</td></tr>`,
+		"<footer>Acme (Europe) Ltd is registered in France",
+		// A light brand color gets dark text, and a dark accent
+		"background: #fde68a; color: #1f1f1f;",
+		".status { margin: 0; color: #1f1f1f;",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("page has no %q", want)
+		}
+	}
+	if strings.Contains(page, "<script>") {
+		t.Error("a line item description is not escaped")
+	}
+	if got := strings.Count(page, `<td class="number">1.25 EUR</td>`); got != 80 {
+		t.Errorf("%d metered lines, want 80", got)
+	}
+}
@@ -0,0 +1,363 @@
+package document
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A4 in points, with positions measured from the top left corner
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+	margin     = 50.0
+	bandHeight = 80.0
+	// footerBaseline is the baseline of the footer's last line, which the
+	// footer grows upward from
+	footerBaseline = pageHeight - 40
+	footerLeading  = 10.0
+	// contentBottom is as low as the body goes above a one line footer.
+	// Each further footer line raises it by footerLeading.
+	contentBottom = pageHeight - 70
+)
+
+// Columns of the line item table
+const (
+	quantityRight = 430.0
+	detailsLeft   = 330.0
+	right         = pageWidth - margin
+)
+
+type rgb struct{ r, g, b float64 }
+
+var (
+	black     = rgb{0.12, 0.12, 0.12}
+	gray      = rgb{0.42, 0.45, 0.5}
+	lightGray = rgb{0.95, 0.95, 0.96}
+	ruleGray  = rgb{0.85, 0.86, 0.88}
+	white     = rgb{1, 1, 1}
+)
+
+// parseColor reads a "#rrggbb" color, falling back to the default brand
+// color
+func parseColor(hex string) rgb {
+	if len(hex) != 7 || hex[0] != '#' {
+		hex = defaultBrandColor
+	}
+	value, err := strconv.ParseUint(hex[1:], 16, 32)
+	if err != nil {
+		return parseColor(defaultBrandColor)
+	}
+	return rgb{float64(value>>16&0xff) / 255, float64(value>>8&0xff) / 255, float64(value&0xff) / 255}
+}
+
+// light reports whether dark text reads better on c than white
+func (c rgb) light() bool {
+	return 0.299*c.r+0.587*c.g+0.114*c.b > 0.6
+}
+
+// pdfWriter draws on pages and writes them out as a PDF file
+type pdfWriter struct {
+	pages []*bytes.Buffer
+	page  *bytes.Buffer
+}
+
+func (p *pdfWriter) addPage() {
+	p.page = &bytes.Buffer{}
+	p.pages = append(p.pages, p.page)
+}
+
+// fillRect fills the rectangle whose top left corner is at x, y
+func (p *pdfWriter) fillRect(x, y, w, h float64, c rgb) {
+	fmt.Fprintf(p.page, "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f\n", c.r, c.g, c.b, x, pageHeight-y-h, w, h)
+}
+
+// rule draws a horizontal line at y
+func (p *pdfWriter) rule(x1, x2, y float64, c rgb) {
+	fmt.Fprintf(p.page, "%.3f %.3f %.3f RG 0.75 w %.2f %.2f m %.2f %.2f l S\n", c.r, c.g, c.b, x1, pageHeight-y, x2, pageHeight-y)
+}
+
+// text writes s with its baseline at y
+func (p *pdfWriter) text(x, y float64, f *font, size float64, c rgb, s string) {
+	fmt.Fprintf(p.page, "BT /%s %.1f Tf %.3f %.3f %.3f rg %.2f %.2f Td %s Tj ET\n",
+		f.resource, size, c.r, c.g, c.b, x, pageHeight-y, pdfString(s))
+}
+
+// textRight writes s ending at x
+func (p *pdfWriter) textRight(x, y float64, f *font, size float64, c rgb, s string) {
+	p.text(x-f.width(s, size), y, f, size, c, s)
+}
+
+// pdfString encodes s as a PDF literal string
+func pdfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, c := range winAnsi(s) {
+		if c == '(' || c == ')' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// writeTo writes the pages as a PDF document titled title
+func (p *pdfWriter) writeTo(w io.Writer, title string) error {
+	out := &countingWriter{w: bufio.NewWriter(w)}
+	offsets := []int64{}
+	object := func(body string) {
+		offsets = append(offsets, out.n)
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+
+	fmt.Fprint(out, "%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	// Objects 1 to 4 are fixed; each page then takes a page object and a
+	// content stream
+	kids := make([]string, len(p.pages))
+	for i := range p.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(p.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /" + helvetica.name + " /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /" + helveticaBold.name + " /Encoding /WinAnsiEncoding >>")
+	for i, page := range p.pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources << /Font << /%s 3 0 R /%s 4 0 R >> >> /Contents %d 0 R >>",
+			pageWidth, pageHeight, helvetica.resource, helveticaBold.resource, 6+2*i))
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		if _, err := zw.Write(page.Bytes()); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+	object(fmt.Sprintf("<< /Title %s /Producer (SecurePay) >>", pdfString(title)))
+
+	xref := out.n
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, len(offsets), xref)
+	if out.err != nil {
+		return out.err
+	}
+	return out.w.Flush()
+}
+
+// countingWriter tracks the offset objects are written at and keeps the
+// first error
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+// wrap breaks s into lines no wider than width
+func wrap(s string, f *font, size, width float64) []string {
+	result := []string{}
+	line := ""
+	for _, word := range strings.Fields(s) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if f.width(candidate, size) <= width {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			result = append(result, line)
+		}
+		// A word wider than the column is split wherever it has to be
+		runes := []rune(word)
+		for f.width(string(runes), size) > width {
+			cut := len(runes) - 1
+			for cut > 1 && f.width(string(runes[:cut]), size) > width {
+				cut--
+			}
+			result = append(result, string(runes[:cut]))
+			runes = runes[cut:]
+		}
+		line = string(runes)
+	}
+	if line != "" || len(result) == 0 {
+		result = append(result, line)
+	}
+	return result
+}
+
+// PDF writes the document as a PDF file
+func (d *Document) PDF(w io.Writer) error {
+	footer := wrap(d.Footer, helvetica, 8, right-margin-70)
+	l := &pdfLayout{
+		doc:    d,
+		pdf:    &pdfWriter{},
+		brand:  parseColor(d.BrandColor),
+		footer: footer,
+		bottom: contentBottom - footerLeading*float64(len(footer)-1),
+	}
+	l.firstPage()
+	l.lineItems()
+	l.totals()
+	l.footers()
+	return l.pdf.writeTo(w, d.Title+" "+d.Number)
+}
+
+// pdfLayout places a document on pages, top to bottom. y is the top of the
+// next thing to draw and bottom as low as it may go above the footer.
+type pdfLayout struct {
+	doc    *Document
+	pdf    *pdfWriter
+	brand  rgb
+	footer []string
+	y      float64
+	bottom float64
+}
+
+func (l *pdfLayout) firstPage() {
+	d, p := l.doc, l.pdf
+	p.addPage()
+
+	onBrand := white
+	if l.brand.light() {
+		onBrand = black
+	}
+	p.fillRect(0, 0, pageWidth, bandHeight, l.brand)
+	p.text(margin, 48, helveticaBold, 20, onBrand, d.Merchant.Name)
+	p.textRight(right, 40, helveticaBold, 18, onBrand, strings.ToUpper(d.Title))
+	p.textRight(right, 58, helvetica, 10, onBrand, d.Number)
+
+	// From, on the left, and the document details on the right
+	y := bandHeight + 36
+	p.text(margin, y, helveticaBold, 10, black, d.Merchant.Name)
+	for _, line := range d.Merchant.Lines {
+		y += 13
+		p.text(margin, y, helvetica, 9, gray, line)
+	}
+	detailsY := bandHeight + 36
+	for _, field := range d.Details {
+		p.text(detailsLeft, detailsY, helvetica, 9, gray, field.Label)
+		p.textRight(right, detailsY, helveticaBold, 9, black, field.Value)
+		detailsY += 14
+	}
+	if detailsY > y {
+		y = detailsY
+	}
+
+	// Bill to, with the payment status beside it
+	y += 30
+	p.text(margin, y, helveticaBold, 8, gray, "BILL TO")
+	p.text(detailsLeft, y, helveticaBold, 8, gray, "STATUS")
+	statusY := y + 18
+	p.text(detailsLeft, statusY, helveticaBold, 14, parseColor(d.Accent()), strings.ToUpper(d.Status))
+	for _, line := range wrap(d.StatusNote, helvetica, 9, right-detailsLeft) {
+		statusY += 13
+		p.text(detailsLeft, statusY, helvetica, 9, black, line)
+	}
+	y += 16
+	p.text(margin, y, helveticaBold, 10, black, d.Customer.Name)
+	for _, line := range d.Customer.Lines {
+		y += 13
+		p.text(margin, y, helvetica, 9, gray, line)
+	}
+	if statusY > y {
+		y = statusY
+	}
+	l.y = y + 30
+}
+
+func (l *pdfLayout) tableHeader() {
+	p := l.pdf
+	p.fillRect(margin, l.y, right-margin, 20, lightGray)
+	p.text(margin+6, l.y+13.5, helveticaBold, 8, gray, "DESCRIPTION")
+	p.textRight(quantityRight, l.y+13.5, helveticaBold, 8, gray, "QTY")
+	p.textRight(right-6, l.y+13.5, helveticaBold, 8, gray, "AMOUNT")
+	l.y += 20
+}
+
+// newPage continues the document on a new page
+func (l *pdfLayout) newPage() {
+	l.pdf.addPage()
+	l.pdf.fillRect(0, 0, pageWidth, 6, l.brand)
+	l.pdf.text(margin, 40, helveticaBold, 10, black, fmt.Sprintf("%s %s (continued)", l.doc.Title, l.doc.Number))
+	l.y = 60
+}
+
+func (l *pdfLayout) lineItems() {
+	p := l.pdf
+	l.tableHeader()
+	descriptionWidth := quantityRight - 40 - (margin + 6)
+	for _, line := range l.doc.Lines {
+		wrapped := wrap(line.Description, helvetica, 9.5, descriptionWidth)
+		height := 10 + 13*float64(len(wrapped))
+		if l.y+height > l.bottom {
+			l.newPage()
+			l.tableHeader()
+		}
+		baseline := l.y + 17
+		p.textRight(quantityRight, baseline, helvetica, 9.5, black, line.Quantity)
+		p.textRight(right-6, baseline, helvetica, 9.5, black, line.Amount)
+		for _, text := range wrapped {
+			p.text(margin+6, baseline, helvetica, 9.5, black, text)
+			baseline += 13
+		}
+		l.y += height
+		p.rule(margin, right, l.y, ruleGray)
+	}
+}
+
+func (l *pdfLayout) totals() {
+	p := l.pdf
+	if l.y+18*float64(len(l.doc.Totals))+20 > l.bottom {
+		l.newPage()
+	}
+	l.y += 8
+	for _, total := range l.doc.Totals {
+		f, size := helvetica, 9.5
+		if total.Strong {
+			f, size = helveticaBold, 10.5
+			p.rule(detailsLeft, right, l.y+2, ruleGray)
+			l.y += 4
+		}
+		l.y += 16
+		p.text(detailsLeft, l.y, f, size, black, total.Label)
+		p.textRight(right-6, l.y, f, size, black, total.Amount)
+	}
+}
+
+// footers adds the merchant's footer and page numbers to every page. The
+// footer ends at footerBaseline however many lines it wraps to.
+func (l *pdfLayout) footers() {
+	pages := l.pdf.pages
+	top := footerBaseline - footerLeading*float64(len(l.footer)-1)
+	for i, page := range pages {
+		l.pdf.page = page
+		l.pdf.rule(margin, right, top-14, ruleGray)
+		y := top
+		for _, line := range l.footer {
+			l.pdf.text(margin, y, helvetica, 8, gray, line)
+			y += footerLeading
+		}
+		l.pdf.textRight(right, footerBaseline, helvetica, 8, gray, fmt.Sprintf("Page %d of %d", i+1, len(pages)))
+	}
+}
@@ -0,0 +1,230 @@
+package document
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// testInvoice is an open invoice long enough to run over three pages, with
+// characters PDF strings escape, text outside Latin-1 and a footer that
+// wraps to several lines
+func testInvoice() (*models.Invoice, *models.Merchant, *models.Customer) {
+	issued := time.Date(2026, time.January, 1, 0, 0, 0, 0, time.UTC)
+	invoice := &models.Invoice{
+		ID:          "inv_1",
+		Number:      "INV-000042",
+		Currency:    "EUR",
+		Status:      models.Open,
+		DueDate:     issued.AddDate(0, 0, 14),
+		PeriodStart: issued,
+		PeriodEnd:   issued.AddDate(0, 1, 0),
+		FinalizedAt: &issued,
+		Items: []models.InvoiceItem{
+			{Description: `Setup (one-off) \ fee`, Amount: 10, Quantity: 1},
+			{Description: "Zoë’s café — €5 日本", Amount: 5, Quantity: 1},
+		},
+	}
+	for i := 0; i < 80; i++ {
+		invoice.Items = append(invoice.Items, models.InvoiceItem{
+			Description: fmt.Sprintf("API calls for project %d, billed per thousand requests over the included allowance", i+1),
+			Amount:      1.25,
+			Quantity:    3,
+		})
+	}
+	for _, item := range invoice.Items {
+		invoice.Amount += item.Amount
+	}
+
+	merchant := &models.Merchant{
+		ID:      "mer_1",
+		Name:    "Acme (Europe) Ltd",
+		Address: "1 Rue de la Paix\n75002 Paris",
+		Email:   "billing@acme.example",
+		Footer: "Acme (Europe) Ltd is registered in France under number 123 456 789. " +
+			"Payments are due within 14 days of the date of issue; late payments accrue interest at three times the legal rate " +
+			"and a fixed recovery fee of €40. Questions about this invoice can be sent to billing@acme.example.",
+	}
+	customer := &models.Customer{ID: "cus_1", Name: "Ada", Email: "ada@example.com", City: "Zürich", Country: "CH"}
+	return invoice, merchant, customer
+}
+
+var (
+	textOp = regexp.MustCompile(`BT /\w+ ([\d.]+) Tf [\d.]+ [\d.]+ [\d.]+ rg ([\d.]+) ([\d.]+) Td \(((?:\\.|[^\\)])*)\) Tj ET`)
+	ruleOp = regexp.MustCompile(`RG 0\.75 w ([\d.]+) ([\d.]+) m ([\d.]+) ([\d.]+) l S`)
+)
+
+func TestInvoicePDF(t *testing.T) {
+	invoice, merchant, customer := testInvoice()
+	d := ForInvoice(invoice, merchant, customer)
+	var buf bytes.Buffer
+	if err := d.PDF(&buf); err != nil {
+		t.Fatalf("PDF: %v", err)
+	}
+	data := buf.Bytes()
+
+	objects := readXref(t, data)
+	pages := (len(objects) - 5) / 2
+	if pages < 3 {
+		t.Fatalf("%d pages, want at least 3", pages)
+	}
+	footer := wrap(d.Footer, helvetica, 8, right-margin-70)
+	if len(footer) < 3 {
+		t.Fatalf("footer wraps to %d lines, want at least 3", len(footer))
+	}
+
+	var content bytes.Buffer
+	for i := 0; i < pages; i++ {
+		page := pageContent(t, data, objects[6+2*i])
+		content.Write(page)
+		checkFooterClear(t, i+1, page, footer)
+	}
+
+	// Parentheses and backslashes are escaped, and text is in WinAnsi, with
+	// what it has no code for replaced
+	for _, want := range []string{
+		`(Setup \(one-off\) \\ fee)`,
+		"(Zo\xeb\x92s caf\xe9 \x97 \x805 ??)",
+		`(Acme \(Europe\) Ltd)`,
+		"(Z\xfcrich)",
+	} {
+		if !bytes.Contains(content.Bytes(), []byte(want)) {
+			t.Errorf("content has no %q", want)
+		}
+	}
+	if info := string(objectBody(t, data, objects[len(objects)-1])); !strings.Contains(info, "/Title (Invoice INV-000042)") {
+		t.Errorf("info object is %q", info)
+	}
+}
+
+// readXref checks the cross-reference table points at every object and
+// returns their offsets, indexed by object number
+func readXref(t *testing.T, data []byte) []int {
+	t.Helper()
+	trailer := bytes.LastIndex(data, []byte("startxref\n"))
+	if trailer < 0 || !bytes.HasSuffix(data, []byte("%%EOF\n")) {
+		t.Fatal("no startxref or end of file marker")
+	}
+	xref, err := strconv.Atoi(strings.Fields(string(data[trailer+len("startxref\n"):]))[0])
+	if err != nil {
+		t.Fatalf("startxref: %v", err)
+	}
+	table := string(data[xref:])
+	if !strings.HasPrefix(table, "xref\n0 ") {
+		t.Fatalf("startxref %d points at %q", xref, table[:min(len(table), 20)])
+	}
+
+	var count int
+	if _, err := fmt.Sscanf(table, "xref\n0 %d\n", &count); err != nil {
+		t.Fatalf("xref header: %v", err)
+	}
+	entries := table[strings.Index(table, "\n0000000000 65535 f \n")+1:]
+	offsets := make([]int, count)
+	for i := 1; i < count; i++ {
+		// Entries are 20 bytes each, the free head of the list first
+		entry := entries[20*i : 20*i+20]
+		if !strings.HasSuffix(entry, " 00000 n \n") {
+			t.Fatalf("xref entry %d is %q", i, entry)
+		}
+		offset, err := strconv.Atoi(entry[:10])
+		if err != nil {
+			t.Fatalf("xref entry %d: %v", i, err)
+		}
+		if want := fmt.Sprintf("%d 0 obj\n", i); !bytes.HasPrefix(data[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q, want %q", i, data[offset:min(len(data), offset+12)], want)
+		}
+		offsets[i] = offset
+	}
+	if !strings.Contains(entries[20*count:], fmt.Sprintf("/Size %d ", count)) {
+		t.Errorf("trailer does not give size %d", count)
+	}
+	return offsets
+}
+
+func objectBody(t *testing.T, data []byte, offset int) []byte {
+	t.Helper()
+	end := bytes.Index(data[offset:], []byte("\nendobj\n"))
+	if end < 0 {
+		t.Fatalf("object at %d has no endobj", offset)
+	}
+	return data[offset : offset+end]
+}
+
+// pageContent inflates the content stream at offset
+func pageContent(t *testing.T, data []byte, offset int) []byte {
+	t.Helper()
+	body := objectBody(t, data, offset)
+	start := bytes.Index(body, []byte("stream\n"))
+	end := bytes.LastIndex(body, []byte("\nendstream"))
+	if start < 0 || end < 0 {
+		t.Fatalf("object at %d is not a stream", offset)
+	}
+	var length int
+	if _, err := fmt.Sscanf(string(body[bytes.Index(body, []byte("/Length")):]), "/Length %d", &length); err != nil {
+		t.Fatalf("stream length: %v", err)
+	}
+	stream := body[start+len("stream\n") : end]
+	if len(stream) != length {
+		t.Errorf("stream is %d bytes, /Length says %d", len(stream), length)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatalf("inflating stream: %v", err)
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("inflating stream: %v", err)
+	}
+	return content
+}
+
+// checkFooterClear checks nothing but the footer and page number is drawn
+// at or below the footer's rule, the lowest one on the page, and that text
+// above it stays clear of it
+func checkFooterClear(t *testing.T, page int, content []byte, footer []string) {
+	t.Helper()
+	ruleY := pageHeight
+	for _, m := range ruleOp.FindAllSubmatch(content, -1) {
+		y, _ := strconv.ParseFloat(string(m[2]), 64)
+		ruleY = min(ruleY, y)
+	}
+
+	below := []string{}
+	for _, m := range textOp.FindAllSubmatch(content, -1) {
+		size, _ := strconv.ParseFloat(string(m[1]), 64)
+		y, _ := strconv.ParseFloat(string(m[3]), 64)
+		if y < ruleY {
+			below = append(below, string(m[4]))
+			continue
+		}
+		// The text's descenders, about a quarter of its size, clear the rule
+		if y-size/4 <= ruleY {
+			t.Errorf("page %d: %q at %.2f overlaps the footer rule at %.2f", page, m[4], y, ruleY)
+		}
+	}
+
+	want := []string{}
+	for _, line := range footer {
+		s := pdfString(line)
+		want = append(want, s[1:len(s)-1])
+	}
+	if len(below) != len(want)+1 {
+		t.Fatalf("page %d: %q below the footer rule, want the footer %q and page number", page, below, want)
+	}
+	for i, line := range want {
+		if below[i] != line {
+			t.Errorf("page %d: footer line %d is %q, want %q", page, i+1, below[i], line)
+		}
+	}
+	if !strings.HasPrefix(below[len(want)], fmt.Sprintf("Page %d of ", page)) {
+		t.Errorf("page %d: page number is %q", page, below[len(want)])
+	}
+}
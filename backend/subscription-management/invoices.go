@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/securepay/subscription-management/billing"
+	"github.com/securepay/subscription-management/document"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// handleListInvoices lists invoices, filtered by the customer_id,
+// subscription_id and status query parameters
+func handleListInvoices(c *gin.Context) {
+	filter := repository.InvoiceFilter{
+		CustomerID:     c.Query("customer_id"),
+		SubscriptionID: c.Query("subscription_id"),
+		Status:         models.InvoiceStatus(c.Query("status")),
+	}
+
+	invoices, err := repo.ListInvoices(c.Request.Context(), filter)
+	if err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoices": invoices,
+		"count":    len(invoices),
+	})
+}
+
+// handleGetInvoice returns an invoice with the credit notes issued
+// against it
+func handleGetInvoice(c *gin.Context) {
+	ctx := c.Request.Context()
+	invoice, err := repo.GetInvoice(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+	notes, err := repo.ListCreditNotes(ctx, invoice.ID)
+	if err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"invoice":      invoice,
+		"credit_notes": notes,
+	})
+}
+
+// handleFinalizeInvoice issues a draft invoice, numbering it. It can no
+// longer be changed after that.
+func handleFinalizeInvoice(c *gin.Context) {
+	invoice, err := repo.FinalizeInvoice(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, repository.ErrFinalized) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice is not a draft"})
+			return
+		}
+		respondError(c, err, "Invoice not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Invoice finalized successfully",
+		"invoice": invoice,
+	})
+}
+
+// handleInvoicePDF downloads an invoice as a PDF file
+func handleInvoicePDF(c *gin.Context) {
+	if d, ok := invoiceDocument(c); ok {
+		respondPDF(c, d)
+	}
+}
+
+// handleInvoiceHTML shows an invoice as a web page
+func handleInvoiceHTML(c *gin.Context) {
+	d, ok := invoiceDocument(c)
+	if !ok {
+		return
+	}
+	var page bytes.Buffer
+	if err := d.HTML(&page); err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", page.Bytes())
+}
+
+// handleCreateCreditNote corrects a finalized invoice. Credit on an unpaid
+// invoice lowers what is due; on a paid one it is refunded with refund, or
+// otherwise taken off the subscription's next invoice.
+func handleCreateCreditNote(c *gin.Context) {
+	var request struct {
+		Amount float64 `json:"amount" binding:"required,gt=0"`
+		Reason string  `json:"reason"`
+		Memo   string  `json:"memo" binding:"max=500"`
+		Refund bool    `json:"refund"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	reason, err := models.ParseCreditNoteReason(request.Reason)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := billingEngine.IssueCreditNote(c.Request.Context(), c.Param("id"), billing.CreditRequest{
+		Amount: request.Amount,
+		Reason: reason,
+		Memo:   request.Memo,
+		Refund: request.Refund,
+	})
+	if err != nil {
+		switch {
+		case errors.Is(err, billing.ErrNotCreditable):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case errors.Is(err, repository.ErrUnavailable):
+			c.JSON(http.StatusConflict, gin.H{"error": "Invoice cannot be credited that much"})
+		case errors.Is(err, billing.ErrRefundFailed):
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		case errors.Is(err, billing.ErrBusy):
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is being billed, try again shortly"})
+		default:
+			respondError(c, err, "Invoice not found")
+		}
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":     "Credit note issued successfully",
+		"credit_note": result.CreditNote,
+		"invoice":     result.Invoice,
+	})
+}
+
+func handleGetCreditNote(c *gin.Context) {
+	note, err := repo.GetCreditNote(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Credit note not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"credit_note": note})
+}
+
+// handleCreditNotePDF downloads a credit note as a PDF file
+func handleCreditNotePDF(c *gin.Context) {
+	ctx := c.Request.Context()
+	note, err := repo.GetCreditNote(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Credit note not found")
+		return
+	}
+	invoice, err := repo.GetInvoice(ctx, note.InvoiceID)
+	if err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+	merchant, customer, err := documentParties(ctx, note.MerchantID, note.CustomerID)
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return
+	}
+	respondPDF(c, document.ForCreditNote(note, invoice, merchant, customer))
+}
+
+// invoiceDocument loads the invoice named in the path and lays it out. It
+// writes the error response and returns false if it cannot.
+func invoiceDocument(c *gin.Context) (*document.Document, bool) {
+	ctx := c.Request.Context()
+	invoice, err := repo.GetInvoice(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Invoice not found")
+		return nil, false
+	}
+	merchantId := invoice.MerchantID
+	if merchantId == "" {
+		merchantId = billingEngine.MerchantID
+	}
+	merchant, customer, err := documentParties(ctx, merchantId, invoice.CustomerID)
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return nil, false
+	}
+	return document.ForInvoice(invoice, merchant, customer), true
+}
+
+// documentParties loads the merchant and customer a document is between. A
+// merchant that has not saved its details is shown by id.
+func documentParties(ctx context.Context, merchantId, customerId string) (*models.Merchant, *models.Customer, error) {
+	merchant, err := repo.GetMerchant(ctx, merchantId)
+	if errors.Is(err, repository.ErrNotFound) {
+		merchant, err = &models.Merchant{ID: merchantId, Name: merchantId}, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	customer, err := repo.GetCustomer(ctx, customerId)
+	if err != nil {
+		return nil, nil, err
+	}
+	return merchant, customer, nil
+}
+
+func respondPDF(c *gin.Context, d *document.Document) {
+	var file bytes.Buffer
+	if err := d.PDF(&file); err != nil {
+		respondError(c, err, "Invoice not found")
+		return
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+d.Filename("pdf")+`"`)
+	c.Data(http.StatusOK, "application/pdf", file.Bytes())
+}
+
+// handleRunBilling renews the subscriptions that are due now instead of
+// waiting for the next scheduled run
+func handleRunBilling(c *gin.Context) {
+	report, err := billingEngine.Run(c.Request.Context())
+	if err != nil {
+		respondError(c, err, "Billing run failed")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Billing run completed",
+		"report":  report,
+	})
+}
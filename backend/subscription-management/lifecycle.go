@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/securepay/subscription-management/billing"
+	"github.com/securepay/subscription-management/models"
+)
+
+// churnFeedbackLimit is how many recent cancellation comments the churn
+// stats include
+const churnFeedbackLimit = 20
+
+// handleCancelSubscription cancels a subscription now, or at the end of its
+// period with at_period_end. The body is optional; without one the
+// subscription is canceled now without a refund.
+func handleCancelSubscription(c *gin.Context) {
+	var request struct {
+		AtPeriodEnd bool   `json:"at_period_end"`
+		Refund      bool   `json:"refund"`
+		Reason      string `json:"reason"`
+		Feedback    string `json:"feedback" binding:"max=2000"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	reason, err := models.ParseCancellationReason(request.Reason)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.AtPeriodEnd && request.Refund {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Only an immediate cancellation can be refunded"})
+		return
+	}
+
+	result, err := billingEngine.Cancel(c.Request.Context(), c.Param("id"), billing.CancelOptions{
+		AtPeriodEnd: request.AtPeriodEnd,
+		Refund:      request.Refund,
+		Reason:      reason,
+		Feedback:    request.Feedback,
+	})
+	if err != nil {
+		if errors.Is(err, billing.ErrRefundFailed) {
+			// Refunds made before the failure are reported so they are not
+			// lost; the subscription stays active
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error":   "Refunding the subscription failed: " + err.Error(),
+				"refunds": result.Refunds,
+			})
+			return
+		}
+		respondLifecycleError(c, err)
+		return
+	}
+
+	message := "Subscription canceled successfully"
+	if request.AtPeriodEnd {
+		message = "Subscription will be canceled at the end of the current period"
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":      message,
+		"subscription": result.Subscription,
+		"refunds":      result.Refunds,
+	})
+}
+
+// handleUndoCancel keeps a subscription that was set to cancel at the end
+// of its period
+func handleUndoCancel(c *gin.Context) {
+	ctx := c.Request.Context()
+	undone, err := repo.UndoCancel(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	subscription, err := repo.GetSubscription(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	if !undone {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription has no scheduled cancellation"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Scheduled cancellation removed",
+		"subscription": subscription,
+	})
+}
+
+// handlePauseSubscription pauses an active subscription. behavior says
+// whether renewals while paused are skipped (void, the default) or invoiced
+// as drafts (keep_as_draft); resume_at resumes it automatically.
+func handlePauseSubscription(c *gin.Context) {
+	var request struct {
+		Behavior string     `json:"behavior"`
+		ResumeAt *time.Time `json:"resume_at"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+			return
+		}
+	}
+	behavior := models.PauseBehavior(request.Behavior)
+	switch behavior {
+	case "":
+		behavior = models.PauseVoid
+	case models.PauseVoid, models.PauseKeepAsDraft:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "behavior must be void or keep_as_draft"})
+		return
+	}
+	if request.ResumeAt != nil {
+		resumeAt := request.ResumeAt.UTC()
+		if !resumeAt.After(billingEngine.Clock.Now()) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "resume_at must be in the future"})
+			return
+		}
+		request.ResumeAt = &resumeAt
+	}
+
+	subscription, err := billingEngine.Pause(c.Request.Context(), c.Param("id"), behavior, request.ResumeAt)
+	if err != nil {
+		respondLifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription paused successfully",
+		"subscription": subscription,
+	})
+}
+
+func handleResumeSubscription(c *gin.Context) {
+	subscription, err := billingEngine.Resume(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		if errors.Is(err, billing.ErrNotActive) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not paused"})
+			return
+		}
+		respondLifecycleError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription resumed successfully",
+		"subscription": subscription,
+	})
+}
+
+// handleChurnStats reports cancellations over the last ?days (30 by
+// default) by reason, with recent customer feedback
+func handleChurnStats(c *gin.Context) {
+	days := 30
+	if value := c.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 3650 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be between 1 and 3650"})
+			return
+		}
+		days = parsed
+	}
+
+	since := billingEngine.Clock.Now().AddDate(0, 0, -days)
+	stats, err := repo.ChurnStats(c.Request.Context(), since, churnFeedbackLimit)
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stats": stats})
+}
+
+func respondLifecycleError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, billing.ErrBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is being billed, try again shortly"})
+	case errors.Is(err, billing.ErrEnded):
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription has already ended"})
+	case errors.Is(err, billing.ErrNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+	default:
+		respondError(c, err, "Subscription not found")
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -9,83 +11,91 @@ import (
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/billing"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
 )
 
-// MockSubscriptions represents a simple in-memory subscription store
-var MockSubscriptions = []gin.H{
-	{
-		"id":             "sub_1",
-		"customer_id":    "usr_1",
-		"plan_id":        "plan_premium",
-		"plan_name":      "Premium Plan",
-		"amount":         49.99,
-		"currency":       "USD",
-		"interval":       "monthly",
-		"status":         "active",
-		"start_date":     "2023-01-15T00:00:00Z",
-		"current_period_end": "2023-05-15T00:00:00Z",
-		"created_at":     "2023-01-15T10:30:00Z",
-	},
-	{
-		"id":             "sub_2",
-		"customer_id":    "usr_2",
-		"plan_id":        "plan_basic",
-		"plan_name":      "Basic Plan",
-		"amount":         19.99,
-		"currency":       "USD",
-		"interval":       "monthly",
-		"status":         "active",
-		"start_date":     "2023-02-20T00:00:00Z",
-		"current_period_end": "2023-05-20T00:00:00Z",
-		"created_at":     "2023-02-20T14:45:00Z",
-	},
-	{
-		"id":             "sub_3",
-		"customer_id":    "usr_3",
-		"plan_id":        "plan_enterprise",
-		"plan_name":      "Enterprise Plan",
-		"amount":         299.99,
-		"currency":       "USD",
-		"interval":       "yearly",
-		"status":         "active",
-		"start_date":     "2023-03-10T00:00:00Z",
-		"current_period_end": "2024-03-10T00:00:00Z",
-		"created_at":     "2023-03-10T09:15:00Z",
-	},
-}
+var (
+	// repo is the service's Postgres store
+	repo *repository.Repository
+	// billingEngine renews subscriptions when their period ends
+	billingEngine *billing.Engine
+)
 
-// MockPlans represents available subscription plans
-var MockPlans = []gin.H{
+// defaultPlans are seeded on startup if they do not exist
+var defaultPlans = []models.Plan{
 	{
-		"id":          "plan_basic",
-		"name":        "Basic Plan",
-		"description": "For small businesses just getting started",
-		"amount":      19.99,
-		"currency":    "USD",
-		"interval":    "monthly",
-		"features":    []string{"Standard Payment Processing", "Basic Reporting", "Email Support"},
+		ID:          "plan_basic",
+		Name:        "Basic Plan",
+		Description: "For small businesses just getting started",
+		Amount:      19.99,
+		Currency:    "USD",
+		Interval:    models.Monthly,
+		Features:    []string{"Standard Payment Processing", "Basic Reporting", "Email Support"},
+		IsActive:    true,
 	},
 	{
-		"id":          "plan_premium",
-		"name":        "Premium Plan",
-		"description": "For growing businesses with higher volume",
-		"amount":      49.99,
-		"currency":    "USD",
-		"interval":    "monthly",
-		"features":    []string{"Advanced Payment Processing", "Detailed Analytics", "Priority Support", "Fraud Protection"},
+		ID:          "plan_premium",
+		Name:        "Premium Plan",
+		Description: "For growing businesses with higher volume",
+		Amount:      49.99,
+		Currency:    "USD",
+		Interval:    models.Monthly,
+		Features:    []string{"Advanced Payment Processing", "Detailed Analytics", "Priority Support", "Fraud Protection"},
+		IsActive:    true,
 	},
 	{
-		"id":          "plan_enterprise",
-		"name":        "Enterprise Plan",
-		"description": "For large businesses with specialized needs",
-		"amount":      299.99,
-		"currency":    "USD",
-		"interval":    "yearly",
-		"features":    []string{"Custom Payment Solutions", "Advanced Analytics", "Dedicated Account Manager", "Premium Fraud Protection", "Custom Integrations"},
+		ID:          "plan_enterprise",
+		Name:        "Enterprise Plan",
+		Description: "For large businesses with specialized needs",
+		Amount:      299.99,
+		Currency:    "USD",
+		Interval:    models.Annual,
+		Features:    []string{"Custom Payment Solutions", "Advanced Analytics", "Dedicated Account Manager", "Premium Fraud Protection", "Custom Integrations"},
+		IsActive:    true,
 	},
 }
 
 func main() {
+	repo = repository.Open(repository.ConfigFromEnv())
+	defer repo.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	applied, err := repo.Migrate(ctx)
+	if err != nil {
+		log.Fatalf("Failed to migrate database: %v", err)
+	}
+	for _, version := range applied {
+		log.Printf("Applied migration %s", version)
+	}
+	if err := repo.SeedPlans(ctx, defaultPlans); err != nil {
+		log.Fatalf("Failed to seed plans: %v", err)
+	}
+	cancel()
+
+	gateway := billing.NewHTTPGateway(paymentServiceURL(), os.Getenv("BILLING_MERCHANT_ID"), envDuration("PAYMENT_TIMEOUT", 10*time.Second))
+	billingEngine = billing.NewEngine(repo, gateway, billing.SystemClock{})
+	billingEngine.Notifier = billing.NewHTTPNotifier(notificationServiceURL(), 5*time.Second)
+	if gateway.MerchantID != "" {
+		billingEngine.MerchantID = gateway.MerchantID
+	}
+	if schedule := os.Getenv("DUNNING_SCHEDULE"); schedule != "" {
+		if billingEngine.Dunning.Schedule, err = billing.ParseDunningSchedule(schedule); err != nil {
+			log.Fatalf("Invalid DUNNING_SCHEDULE: %v", err)
+		}
+	}
+	if status := os.Getenv("DUNNING_END_STATUS"); status != "" {
+		if billingEngine.Dunning.EndStatus, err = billing.ParseEndStatus(status); err != nil {
+			log.Fatalf("Invalid DUNNING_END_STATUS: %v", err)
+		}
+	}
+	billingEngine.Dunning.SuspendFor = envDuration("DUNNING_SUSPEND_FOR", billingEngine.Dunning.SuspendFor)
+	billingEngine.TrialReminderLead = envDuration("TRIAL_REMINDER_LEAD", billingEngine.TrialReminderLead)
+	if interval := envDuration("BILLING_INTERVAL", time.Minute); interval > 0 {
+		billingEngine.Start(context.Background(), interval)
+	}
+
 	r := gin.Default()
 
 	// Configure CORS
@@ -100,19 +110,76 @@ func main() {
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "ok",
-			"service": "subscription-service",
-			"time":    time.Now().Format(time.RFC3339),
+		status, database := http.StatusOK, "ok"
+		if err := repo.Ping(c.Request.Context()); err != nil {
+			status, database = http.StatusServiceUnavailable, "unavailable"
+		}
+		c.JSON(status, gin.H{
+			"status":   "ok",
+			"service":  "subscription-service",
+			"database": database,
+			"time":     time.Now().Format(time.RFC3339),
 		})
 	})
 
-	// Subscription endpoints
+	// Plan endpoints
 	r.GET("/plans", handleListPlans)
+	r.POST("/plans", handleCreatePlan)
+	r.GET("/plans/:id", handleGetPlan)
+	r.PUT("/plans/:id", handleUpdatePlan)
+	r.DELETE("/plans/:id", handleDeletePlan)
+	r.GET("/plans/:id/components", handleListComponents)
+	r.POST("/plans/:id/components", handleCreateComponent)
+	r.DELETE("/plans/:id/components/:componentId", handleDeleteComponent)
+
+	// Customer endpoints
+	r.GET("/customers", handleListCustomers)
+	r.POST("/customers", handleCreateCustomer)
+	r.GET("/customers/:id", handleGetCustomer)
+	r.PUT("/customers/:id", handleUpdateCustomer)
+	r.DELETE("/customers/:id", handleDeleteCustomer)
+
+	// Merchant endpoints
+	r.GET("/merchants/:id", handleGetMerchant)
+	r.PUT("/merchants/:id", handleSaveMerchant)
+
+	// Billing endpoints
+	r.GET("/invoices", handleListInvoices)
+	r.GET("/invoices/:id", handleGetInvoice)
+	r.POST("/invoices/:id/finalize", handleFinalizeInvoice)
+	r.GET("/invoices/:id/pdf", handleInvoicePDF)
+	r.GET("/invoices/:id/html", handleInvoiceHTML)
+	r.POST("/invoices/:id/credit-notes", handleCreateCreditNote)
+	r.GET("/credit-notes/:id", handleGetCreditNote)
+	r.GET("/credit-notes/:id/pdf", handleCreditNotePDF)
+	r.POST("/billing/run", handleRunBilling)
+	r.GET("/cancellations/stats", handleChurnStats)
+
+	// Discount endpoints
+	r.GET("/coupons", handleListCoupons)
+	r.POST("/coupons", handleCreateCoupon)
+	r.GET("/coupons/:id", handleGetCoupon)
+	r.DELETE("/coupons/:id", handleDeleteCoupon)
+	r.GET("/promotion-codes", handleListPromotionCodes)
+	r.POST("/promotion-codes", handleCreatePromotionCode)
+	r.DELETE("/promotion-codes/:id", handleDeletePromotionCode)
+
+	// Subscription endpoints
 	r.GET("/customer/:customerId", handleGetCustomerSubscriptions)
 	r.POST("/subscribe", handleCreateSubscription)
+	r.GET("/:id", handleGetSubscription)
 	r.PUT("/:id/cancel", handleCancelSubscription)
+	r.DELETE("/:id/cancel", handleUndoCancel)
+	r.PUT("/:id/pause", handlePauseSubscription)
+	r.PUT("/:id/resume", handleResumeSubscription)
 	r.PUT("/:id/upgrade", handleUpgradeSubscription)
+	r.POST("/:id/upgrade/preview", handlePreviewUpgrade)
+	r.PUT("/:id/quantity", handleUpdateQuantity)
+	r.POST("/:id/quantity/preview", handlePreviewQuantity)
+	r.PUT("/:id/discount", handleSetDiscount)
+	r.DELETE("/:id/discount", handleDeleteDiscount)
+	r.POST("/:id/usage", handleRecordUsage)
+	r.GET("/:id/upcoming-invoice", handleUpcomingInvoice)
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -126,33 +193,75 @@ func main() {
 	}
 }
 
-func handleListPlans(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"plans": MockPlans,
-	})
+func paymentServiceURL() string {
+	if url := os.Getenv("PAYMENT_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:4002"
+}
+
+func notificationServiceURL() string {
+	if url := os.Getenv("NOTIFICATION_SERVICE_URL"); url != "" {
+		return url
+	}
+	return "http://localhost:4005"
+}
+
+// envDuration reads a duration such as "90s" from the environment. A bad
+// value falls back to the default; "0" is kept so settings can be disabled.
+func envDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || value < 0 {
+		return fallback
+	}
+	return value
+}
+
+// respondError writes the response for a repository error. ErrNotFound
+// becomes a 404 with notFound as the message; anything unexpected is logged
+// and hidden behind a 500.
+func respondError(c *gin.Context, err error, notFound string) {
+	if errors.Is(err, repository.ErrNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return
+	}
+	log.Printf("%s %s: %v", c.Request.Method, c.Request.URL.Path, err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
 }
 
 func handleGetCustomerSubscriptions(c *gin.Context) {
 	customerId := c.Param("customerId")
-	
-	// Filter subscriptions by customer ID
-	var customerSubscriptions []gin.H
-	for _, subscription := range MockSubscriptions {
-		if subscription["customer_id"] == customerId {
-			customerSubscriptions = append(customerSubscriptions, subscription)
-		}
+
+	subscriptions, err := repo.ListCustomerSubscriptions(c.Request.Context(), customerId)
+	if err != nil {
+		respondError(c, err, "Customer not found")
+		return
 	}
-	
+
 	c.JSON(http.StatusOK, gin.H{
-		"subscriptions": customerSubscriptions,
-		"count":         len(customerSubscriptions),
+		"subscriptions": subscriptions,
+		"count":         len(subscriptions),
 	})
 }
 
+func handleGetSubscription(c *gin.Context) {
+	subscription, err := repo.GetSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscription": subscription})
+}
+
 func handleCreateSubscription(c *gin.Context) {
 	var request struct {
 		CustomerId string `json:"customer_id" binding:"required"`
 		PlanId     string `json:"plan_id" binding:"required"`
+		Quantity   int    `json:"quantity" binding:"omitempty,min=1"`
+		// TrialDays overrides the plan's trial length; 0 skips the trial
+		TrialDays *int `json:"trial_days" binding:"omitempty,min=0,max=730"`
+		discountRequest
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -160,124 +269,255 @@ func handleCreateSubscription(c *gin.Context) {
 		return
 	}
 
-	// Verify that the plan exists
-	var selectedPlan gin.H
-	planFound := false
-	for _, plan := range MockPlans {
-		if plan["id"] == request.PlanId {
-			selectedPlan = plan
-			planFound = true
-			break
+	ctx := c.Request.Context()
+	if _, err := repo.GetCustomer(ctx, request.CustomerId); err != nil {
+		respondError(c, err, "Customer not found")
+		return
+	}
+
+	// Verify that the plan exists and can be subscribed to
+	plan, err := repo.GetPlan(ctx, request.PlanId)
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+	if !plan.IsActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Plan is no longer available"})
+		return
+	}
+
+	quantity := request.Quantity
+	if quantity == 0 {
+		quantity = plan.MinQuantity
+	}
+	if err := plan.CheckQuantity(quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	trialDays := plan.TrialDays
+	if request.TrialDays != nil {
+		trialDays = *request.TrialDays
+	}
+
+	startDate := time.Now().UTC().Truncate(time.Second)
+	subscription := &models.Subscription{
+		ID:                 "sub_" + uuid.New().String()[:8],
+		CustomerID:         request.CustomerId,
+		PlanID:             plan.ID,
+		Status:             models.Active,
+		CurrentPeriodStart: startDate,
+		CurrentPeriodEnd:   plan.Interval.Next(startDate),
+		Quantity:           quantity,
+	}
+	message := "Subscription created successfully"
+	// A trial is a free first period; billing converts it when it ends
+	if trialDays > 0 {
+		trialEnd := startDate.AddDate(0, 0, trialDays)
+		subscription.Status = models.Trial
+		subscription.TrialStart = &startDate
+		subscription.TrialEnd = &trialEnd
+		subscription.CurrentPeriodEnd = trialEnd
+		message = "Subscription trial started"
+	}
+	if request.Coupon != "" || request.PromotionCode != "" {
+		if !applyDiscount(ctx, c, request.discountRequest, subscription, plan, startDate) {
+			return
 		}
 	}
-	
-	if !planFound {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+
+	if err := repo.CreateSubscription(ctx, subscription); err != nil {
+		if errors.Is(err, repository.ErrUnavailable) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Coupon is no longer available"})
+			return
+		}
+		respondError(c, err, "Subscription not found")
 		return
 	}
-	
-	// Create subscription start date and end date based on interval
-	startDate := time.Now()
-	var endDate time.Time
-	
-	if selectedPlan["interval"] == "monthly" {
-		endDate = startDate.AddDate(0, 1, 0)
-	} else if selectedPlan["interval"] == "yearly" {
-		endDate = startDate.AddDate(1, 0, 0)
-	} else {
-		// Default to monthly
-		endDate = startDate.AddDate(0, 1, 0)
-	}
-	
-	// Create a new subscription
-	subscriptionId := "sub_" + uuid.New().String()[:8]
-	
-	newSubscription := gin.H{
-		"id":                 subscriptionId,
-		"customer_id":        request.CustomerId,
-		"plan_id":            selectedPlan["id"],
-		"plan_name":          selectedPlan["name"],
-		"amount":             selectedPlan["amount"],
-		"currency":           selectedPlan["currency"],
-		"interval":           selectedPlan["interval"],
-		"status":             "active",
-		"start_date":         startDate.Format(time.RFC3339),
-		"current_period_end": endDate.Format(time.RFC3339),
-		"created_at":         time.Now().Format(time.RFC3339),
-	}
-	
-	// Add to mock subscriptions
-	MockSubscriptions = append(MockSubscriptions, newSubscription)
-	
+	subscription.Plan = plan
+
 	c.JSON(http.StatusCreated, gin.H{
-		"message":      "Subscription created successfully",
-		"subscription": newSubscription,
+		"message":      message,
+		"subscription": subscription,
 	})
 }
 
-func handleCancelSubscription(c *gin.Context) {
-	id := c.Param("id")
-
-	// Find and cancel the subscription
-	for i, subscription := range MockSubscriptions {
-		if subscription["id"] == id {
-			MockSubscriptions[i]["status"] = "cancelled"
-			
-			c.JSON(http.StatusOK, gin.H{
-				"message":      "Subscription cancelled successfully",
-				"subscription": MockSubscriptions[i],
-			})
-			return
+// planChangeRequest is the body for changing a subscription's plan
+type planChangeRequest struct {
+	PlanId            string `json:"plan_id" binding:"required"`
+	ProrationBehavior string `json:"proration_behavior"`
+	// AtPeriodEnd schedules the change for the end of the current period
+	// instead of applying it now, typically for downgrades
+	AtPeriodEnd bool `json:"at_period_end"`
+	// Quantity is the seat count on the new plan; it defaults to the
+	// current one
+	Quantity int `json:"quantity" binding:"omitempty,min=1"`
+}
+
+// loadPlanChange binds a plan change request and loads the subscription and
+// the plan it is moving to. It writes the error response and returns false
+// when the change is not possible.
+func loadPlanChange(c *gin.Context) (planChangeRequest, *models.Subscription, *models.Plan, bool) {
+	var request planChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return request, nil, nil, false
+	}
+
+	ctx := c.Request.Context()
+
+	// Verify that the plan exists
+	plan, err := repo.GetPlan(ctx, request.PlanId)
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return request, nil, nil, false
+	}
+
+	subscription, err := repo.GetSubscription(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return request, nil, nil, false
+	}
+	if subscription.Status != models.Active && subscription.Status != models.Trial {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+		return request, nil, nil, false
+	}
+	// Choosing the current plan again only cancels a scheduled change
+	if plan.ID != subscription.PlanID {
+		if !plan.IsActive {
+			c.JSON(http.StatusConflict, gin.H{"error": "Plan is no longer available"})
+			return request, nil, nil, false
+		}
+		if plan.Currency != subscription.Plan.Currency {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Plans must use the same currency"})
+			return request, nil, nil, false
 		}
 	}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+	if request.Quantity == 0 {
+		request.Quantity = subscription.Quantity
+	}
+	if request.AtPeriodEnd && request.Quantity != subscription.Quantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Seats can only be changed immediately"})
+		return request, nil, nil, false
+	}
+	if err := plan.CheckQuantity(request.Quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, nil, nil, false
+	}
+	return request, subscription, plan, true
 }
 
+// handleUpgradeSubscription moves a subscription to another plan, now with
+// proration or at the end of the current period
 func handleUpgradeSubscription(c *gin.Context) {
-	id := c.Param("id")
-	
-	var request struct {
-		PlanId string `json:"plan_id" binding:"required"`
+	request, subscription, plan, ok := loadPlanChange(c)
+	if !ok {
+		return
 	}
+	ctx := c.Request.Context()
 
-	if err := c.ShouldBindJSON(&request); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+	if plan.ID == subscription.PlanID || request.AtPeriodEnd {
+		pendingPlanId, message := plan.ID, "Plan change scheduled for the end of the period"
+		if plan.ID == subscription.PlanID {
+			if subscription.PendingPlanID == "" {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is already on this plan"})
+				return
+			}
+			pendingPlanId, message = "", "Scheduled plan change canceled"
+		}
+		scheduled, err := repo.SchedulePlan(ctx, subscription.ID, pendingPlanId)
+		if err != nil {
+			respondError(c, err, "Subscription not found")
+			return
+		}
+		if !scheduled {
+			c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+			return
+		}
+		subscription.PendingPlanID = pendingPlanId
+		c.JSON(http.StatusOK, gin.H{
+			"message":      message,
+			"subscription": subscription,
+		})
 		return
 	}
 
-	// Verify that the plan exists
-	var selectedPlan gin.H
-	planFound := false
-	for _, plan := range MockPlans {
-		if plan["id"] == request.PlanId {
-			selectedPlan = plan
-			planFound = true
-			break
-		}
+	behavior, err := billing.ParseProrationBehavior(request.ProrationBehavior)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
-	
-	if !planFound {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Plan not found"})
+
+	result, err := billingEngine.ChangePlan(ctx, subscription.ID, plan.ID, request.Quantity, behavior)
+	if err != nil {
+		respondChangeError(c, result, err)
 		return
 	}
 
-	// Find and upgrade the subscription
-	for i, subscription := range MockSubscriptions {
-		if subscription["id"] == id {
-			// Update plan details
-			MockSubscriptions[i]["plan_id"] = selectedPlan["id"]
-			MockSubscriptions[i]["plan_name"] = selectedPlan["name"]
-			MockSubscriptions[i]["amount"] = selectedPlan["amount"]
-			MockSubscriptions[i]["interval"] = selectedPlan["interval"]
-			
-			c.JSON(http.StatusOK, gin.H{
-				"message":      "Subscription upgraded successfully",
-				"subscription": MockSubscriptions[i],
-			})
-			return
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Subscription upgraded successfully",
+		"subscription": result.Subscription,
+		"proration":    result.Proration,
+		"invoice":      result.Invoice,
+	})
+}
+
+// handlePreviewUpgrade shows the proration a plan change would bill without
+// making it
+func handlePreviewUpgrade(c *gin.Context) {
+	request, subscription, plan, ok := loadPlanChange(c)
+	if !ok {
+		return
+	}
+	if plan.ID == subscription.PlanID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription is already on this plan"})
+		return
+	}
+
+	behavior, err := billing.ParseProrationBehavior(request.ProrationBehavior)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	preview := gin.H{
+		"subscription_id":    subscription.ID,
+		"plan_id":            plan.ID,
+		"proration_behavior": behavior,
+		"at_period_end":      request.AtPeriodEnd,
+	}
+	if request.AtPeriodEnd {
+		preview["effective_at"] = subscription.CurrentPeriodEnd
+	} else {
+		proration := billing.Prorate(subscription, plan, request.Quantity, billingEngine.Clock.Now())
+		behavior = proration.Behavior(behavior)
+		preview["proration_behavior"] = behavior
+		preview["proration"] = proration
+		preview["amount_due_now"] = 0.0
+		if behavior == billing.ProrateInvoiceNow && proration.Amount > 0 {
+			preview["amount_due_now"] = proration.Amount
 		}
 	}
+	c.JSON(http.StatusOK, gin.H{"preview": preview})
+}
 
-	c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
-}
\ No newline at end of file
+// respondChangeError writes the response for a failed mid-cycle change
+func respondChangeError(c *gin.Context, result *billing.ChangeResult, err error) {
+	var decline *billing.DeclineError
+	switch {
+	case errors.Is(err, billing.ErrBusy), errors.Is(err, billing.ErrLeaseLost):
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is being billed, try again shortly"})
+	case errors.Is(err, billing.ErrNotActive):
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+	case errors.Is(err, billing.ErrInvalidQuantity):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &decline):
+		c.JSON(http.StatusPaymentRequired, gin.H{
+			"error":   "Payment for the change was declined: " + decline.Reason,
+			"invoice": result.Invoice,
+		})
+	default:
+		respondError(c, err, "Subscription not found")
+	}
+}
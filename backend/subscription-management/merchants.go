@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/securepay/subscription-management/models"
+)
+
+var (
+	brandColorPattern    = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	invoicePrefixPattern = regexp.MustCompile(`^[A-Z0-9][A-Z0-9-]{0,11}$`)
+)
+
+func handleGetMerchant(c *gin.Context) {
+	merchant, err := repo.GetMerchant(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Merchant not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"merchant": merchant})
+}
+
+// handleSaveMerchant sets the details, branding and tax printed on a
+// merchant's invoices, creating the merchant if needed. Finalized invoices
+// and credit notes keep the details they were issued with.
+func handleSaveMerchant(c *gin.Context) {
+	var request struct {
+		Name          string  `json:"name" binding:"required"`
+		LegalName     string  `json:"legal_name"`
+		Email         string  `json:"email" binding:"omitempty,email"`
+		Phone         string  `json:"phone"`
+		Address       string  `json:"address"`
+		TaxId         string  `json:"tax_id"`
+		LogoURL       string  `json:"logo_url" binding:"omitempty,url"`
+		BrandColor    string  `json:"brand_color"`
+		Footer        string  `json:"footer" binding:"max=1000"`
+		InvoicePrefix string  `json:"invoice_prefix"`
+		TaxName       string  `json:"tax_name"`
+		TaxRate       float64 `json:"tax_rate" binding:"min=0,lt=100"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	merchant := &models.Merchant{
+		ID:            c.Param("id"),
+		Name:          strings.TrimSpace(request.Name),
+		LegalName:     strings.TrimSpace(request.LegalName),
+		Email:         strings.TrimSpace(request.Email),
+		Phone:         strings.TrimSpace(request.Phone),
+		Address:       strings.TrimSpace(request.Address),
+		TaxID:         strings.TrimSpace(request.TaxId),
+		LogoURL:       request.LogoURL,
+		BrandColor:    request.BrandColor,
+		Footer:        strings.TrimSpace(request.Footer),
+		InvoicePrefix: strings.ToUpper(strings.TrimSpace(request.InvoicePrefix)),
+		TaxName:       strings.TrimSpace(request.TaxName),
+		TaxRate:       request.TaxRate,
+	}
+	if merchant.InvoicePrefix == "" {
+		merchant.InvoicePrefix = "INV"
+	}
+	switch {
+	case merchant.Name == "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name is required"})
+		return
+	case merchant.BrandColor != "" && !brandColorPattern.MatchString(merchant.BrandColor):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "brand_color must look like #1a2b3c"})
+		return
+	case !invoicePrefixPattern.MatchString(merchant.InvoicePrefix):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invoice_prefix must be up to 12 letters, digits and dashes"})
+		return
+	}
+
+	if err := repo.SaveMerchant(c.Request.Context(), merchant); err != nil {
+		respondError(c, err, "Merchant not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "Merchant saved successfully",
+		"merchant": merchant,
+	})
+}
@@ -1,112 +1,739 @@
 package models
 
 import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 // PlanInterval represents the billing interval for a subscription plan
 type PlanInterval string
 
 const (
-	Monthly  PlanInterval = "monthly"
+	Monthly   PlanInterval = "monthly"
 	Quarterly PlanInterval = "quarterly"
-	Annual   PlanInterval = "annual"
+	Annual    PlanInterval = "annual"
 )
 
+// ParseInterval returns the canonical interval for s. "yearly" is accepted
+// as an alias for Annual because older clients send it.
+func ParseInterval(s string) (PlanInterval, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "monthly":
+		return Monthly, nil
+	case "quarterly":
+		return Quarterly, nil
+	case "annual", "yearly":
+		return Annual, nil
+	}
+	return "", fmt.Errorf("unknown interval %q, must be monthly, quarterly or annual", s)
+}
+
+// Months returns the length of the interval in months
+func (i PlanInterval) Months() int {
+	switch i {
+	case Quarterly:
+		return 3
+	case Annual:
+		return 12
+	}
+	return 1
+}
+
+// Next returns the end of the billing period that starts at start. Days
+// past the end of the target month are clamped to its last day, so a period
+// starting on January 31 ends on the last day of February.
+func (i PlanInterval) Next(start time.Time) time.Time {
+	year, month, day := start.Date()
+	firstOfTarget := time.Date(year, month+time.Month(i.Months()), 1, 0, 0, 0, 0, start.Location())
+	if lastDay := firstOfTarget.AddDate(0, 1, -1).Day(); day > lastDay {
+		day = lastDay
+	}
+	hour, min, sec := start.Clock()
+	return time.Date(firstOfTarget.Year(), firstOfTarget.Month(), day, hour, min, sec, start.Nanosecond(), start.Location())
+}
+
 // SubscriptionStatus represents the status of a subscription
 type SubscriptionStatus string
 
 const (
 	Active    SubscriptionStatus = "active"
+	PastDue   SubscriptionStatus = "past_due"
 	Canceled  SubscriptionStatus = "canceled"
 	Suspended SubscriptionStatus = "suspended"
 	Expired   SubscriptionStatus = "expired"
 	Trial     SubscriptionStatus = "trial"
+	Paused    SubscriptionStatus = "paused"
+)
+
+// PauseBehavior says what happens to renewals while a subscription is
+// paused
+type PauseBehavior string
+
+const (
+	// PauseVoid skips billing for paused periods
+	PauseVoid PauseBehavior = "void"
+	// PauseKeepAsDraft invoices paused periods as drafts that are not
+	// collected until someone finalizes them
+	PauseKeepAsDraft PauseBehavior = "keep_as_draft"
+)
+
+// CancellationReason is why a customer canceled, for churn analysis
+type CancellationReason string
+
+const (
+	CancelTooExpensive    CancellationReason = "too_expensive"
+	CancelMissingFeatures CancellationReason = "missing_features"
+	CancelSwitchedService CancellationReason = "switched_service"
+	CancelUnused          CancellationReason = "unused"
+	CancelCustomerService CancellationReason = "customer_service"
+	CancelTooComplex      CancellationReason = "too_complex"
+	CancelLowQuality      CancellationReason = "low_quality"
+	CancelOther           CancellationReason = "other"
 )
 
+// ParseCancellationReason returns the reason named s; an empty s is no
+// reason
+func ParseCancellationReason(s string) (CancellationReason, error) {
+	switch reason := CancellationReason(s); reason {
+	case "", CancelTooExpensive, CancelMissingFeatures, CancelSwitchedService, CancelUnused,
+		CancelCustomerService, CancelTooComplex, CancelLowQuality, CancelOther:
+		return reason, nil
+	}
+	return "", fmt.Errorf("unknown cancellation reason %q", s)
+}
+
 // InvoiceStatus represents the status of an invoice
 type InvoiceStatus string
 
 const (
-	Draft     InvoiceStatus = "draft"
-	Open      InvoiceStatus = "open"
-	Paid      InvoiceStatus = "paid"
-	Overdue   InvoiceStatus = "overdue"
-	Void      InvoiceStatus = "void"
-	Canceled  InvoiceStatus = "canceled"
+	Draft           InvoiceStatus = "draft"
+	Open            InvoiceStatus = "open"
+	Paid            InvoiceStatus = "paid"
+	Overdue         InvoiceStatus = "overdue"
+	Void            InvoiceStatus = "void"
+	InvoiceCanceled InvoiceStatus = "canceled"
+)
+
+// BillingReason says why an invoice was issued
+type BillingReason string
+
+const (
+	// ReasonSubscriptionCycle invoices renew a subscription for a period
+	ReasonSubscriptionCycle BillingReason = "subscription_cycle"
+	// ReasonSubscriptionUpdate invoices charge for a mid-cycle change
+	ReasonSubscriptionUpdate BillingReason = "subscription_update"
 )
 
-// Plan represents a subscription plan
+// Plan represents a subscription plan. Amount is charged per seat, and a
+// subscription's seat count must lie between MinQuantity and MaxQuantity (0
+// for no limit). New subscriptions to a plan with TrialDays start with a
+// free trial of that many days.
 type Plan struct {
+	tableName struct{} `pg:"plans"`
+
 	ID          string       `json:"id" pg:"id,pk"`
 	Name        string       `json:"name" pg:"name,notnull"`
 	Description string       `json:"description" pg:"description"`
-	Amount      float64      `json:"amount" pg:"amount,notnull"`
+	Amount      float64      `json:"amount" pg:"amount,notnull,use_zero"`
 	Currency    string       `json:"currency" pg:"currency,notnull"`
 	Interval    PlanInterval `json:"interval" pg:"interval,notnull"`
 	Features    []string     `json:"features" pg:"features,array"`
-	IsActive    bool         `json:"is_active" pg:"is_active,notnull,default:true"`
+	IsActive    bool         `json:"is_active" pg:"is_active,notnull,use_zero"`
+	TrialDays   int          `json:"trial_days" pg:"trial_days,notnull,use_zero"`
+	MinQuantity int          `json:"min_quantity" pg:"min_quantity,notnull,default:1"`
+	MaxQuantity int          `json:"max_quantity,omitempty" pg:"max_quantity"`
 	CreatedAt   time.Time    `json:"created_at" pg:"created_at,default:now()"`
 	UpdatedAt   time.Time    `json:"updated_at" pg:"updated_at,default:now()"`
 }
 
+// CheckQuantity returns why quantity seats are not allowed on the plan, or
+// nil
+func (p *Plan) CheckQuantity(quantity int) error {
+	if quantity < p.MinQuantity || quantity < 1 {
+		return fmt.Errorf("plan %s needs at least %d seats", p.ID, p.MinQuantity)
+	}
+	if p.MaxQuantity > 0 && quantity > p.MaxQuantity {
+		return fmt.Errorf("plan %s allows at most %d seats", p.ID, p.MaxQuantity)
+	}
+	return nil
+}
+
+// PricingModel says how a metered component prices a period's usage
+type PricingModel string
+
+const (
+	// PerUnit charges UnitAmount for every unit
+	PerUnit PricingModel = "per_unit"
+	// Tiered charges each unit at the rate of the tier it falls in, so
+	// the rate drops as usage climbs through the tiers
+	Tiered PricingModel = "tiered"
+	// Volume charges every unit at the rate of the tier the total falls in
+	Volume PricingModel = "volume"
+	// Package charges UnitAmount for every started block of PackageSize
+	// units
+	Package PricingModel = "package"
+)
+
+// PriceTier is one tier of a tiered or volume price. UpTo is the last unit
+// in the tier; 0 means unbounded and is only allowed on the last tier.
+// FlatAmount is charged once when usage reaches the tier.
+type PriceTier struct {
+	UpTo       int64   `json:"up_to"`
+	UnitAmount float64 `json:"unit_amount"`
+	FlatAmount float64 `json:"flat_amount"`
+}
+
+// MeteredComponent is a usage-based charge on a plan, billed in arrears
+// alongside the plan's flat fee. Usage is reported in UnitName units.
+type MeteredComponent struct {
+	tableName struct{} `pg:"metered_components"`
+
+	ID           string       `json:"id" pg:"id,pk"`
+	PlanID       string       `json:"plan_id" pg:"plan_id,notnull"`
+	Name         string       `json:"name" pg:"name,notnull"`
+	UnitName     string       `json:"unit_name" pg:"unit_name,notnull"`
+	PricingModel PricingModel `json:"pricing_model" pg:"pricing_model,notnull"`
+	UnitAmount   float64      `json:"unit_amount" pg:"unit_amount,notnull,use_zero"`
+	Tiers        []PriceTier  `json:"tiers,omitempty" pg:"tiers,type:jsonb"`
+	PackageSize  int64        `json:"package_size,omitempty" pg:"package_size"`
+	IsActive     bool         `json:"is_active" pg:"is_active,notnull,use_zero"`
+	CreatedAt    time.Time    `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt    time.Time    `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// Validate returns why the component's price is malformed, or nil
+func (m *MeteredComponent) Validate() error {
+	switch m.PricingModel {
+	case PerUnit:
+	case Package:
+		if m.PackageSize <= 0 {
+			return fmt.Errorf("package pricing needs a positive package_size")
+		}
+	case Tiered, Volume:
+		if len(m.Tiers) == 0 {
+			return fmt.Errorf("%s pricing needs tiers", m.PricingModel)
+		}
+		last := int64(0)
+		for i, tier := range m.Tiers {
+			if tier.UnitAmount < 0 || tier.FlatAmount < 0 {
+				return fmt.Errorf("tier amounts must not be negative")
+			}
+			if tier.UpTo == 0 {
+				if i != len(m.Tiers)-1 {
+					return fmt.Errorf("only the last tier can be unbounded")
+				}
+				continue
+			}
+			if tier.UpTo <= last {
+				return fmt.Errorf("tier up_to values must increase")
+			}
+			last = tier.UpTo
+		}
+	default:
+		return fmt.Errorf("pricing_model must be per_unit, tiered, volume or package")
+	}
+	if m.UnitAmount < 0 {
+		return fmt.Errorf("unit_amount must not be negative")
+	}
+	return nil
+}
+
+// Price returns the charge for quantity units used in one period
+func (m *MeteredComponent) Price(quantity int64) float64 {
+	if quantity <= 0 {
+		return 0
+	}
+	switch m.PricingModel {
+	case Package:
+		packages := (quantity + m.PackageSize - 1) / m.PackageSize
+		return float64(packages) * m.UnitAmount
+	case Volume:
+		for _, tier := range m.Tiers {
+			if tier.UpTo == 0 || quantity <= tier.UpTo {
+				return tier.FlatAmount + float64(quantity)*tier.UnitAmount
+			}
+		}
+		// Usage beyond a bounded last tier is charged at its rate
+		tier := m.Tiers[len(m.Tiers)-1]
+		return tier.FlatAmount + float64(quantity)*tier.UnitAmount
+	case Tiered:
+		total, floor := 0.0, int64(0)
+		for i, tier := range m.Tiers {
+			ceiling := tier.UpTo
+			if ceiling == 0 || ceiling > quantity || i == len(m.Tiers)-1 {
+				ceiling = quantity
+			}
+			if ceiling > floor {
+				total += tier.FlatAmount + float64(ceiling-floor)*tier.UnitAmount
+			}
+			if ceiling >= quantity {
+				break
+			}
+			floor = ceiling
+		}
+		return total
+	}
+	return float64(quantity) * m.UnitAmount
+}
+
+// CouponDuration says how many billing periods a coupon discounts
+type CouponDuration string
+
+const (
+	// DurationOnce discounts the first period billed after redemption
+	DurationOnce CouponDuration = "once"
+	// DurationRepeating discounts DurationInPeriods periods
+	DurationRepeating CouponDuration = "repeating"
+	// DurationForever discounts every period
+	DurationForever CouponDuration = "forever"
+)
+
+// Coupon is a discount on subscriptions: PercentOff percent or AmountOff in
+// Currency off each billing period. MaxRedemptions of 0 is unlimited, and
+// an empty AppliesToPlans applies to every plan.
+type Coupon struct {
+	tableName struct{} `pg:"coupons"`
+
+	ID                string         `json:"id" pg:"id,pk"`
+	Name              string         `json:"name" pg:"name,notnull"`
+	PercentOff        float64        `json:"percent_off,omitempty" pg:"percent_off"`
+	AmountOff         float64        `json:"amount_off,omitempty" pg:"amount_off"`
+	Currency          string         `json:"currency,omitempty" pg:"currency"`
+	Duration          CouponDuration `json:"duration" pg:"duration,notnull"`
+	DurationInPeriods int            `json:"duration_in_periods,omitempty" pg:"duration_in_periods"`
+	MaxRedemptions    int            `json:"max_redemptions,omitempty" pg:"max_redemptions"`
+	TimesRedeemed     int            `json:"times_redeemed" pg:"times_redeemed,notnull,use_zero"`
+	RedeemBy          *time.Time     `json:"redeem_by,omitempty" pg:"redeem_by"`
+	AppliesToPlans    []string       `json:"applies_to_plans" pg:"applies_to_plans,array"`
+	IsActive          bool           `json:"is_active" pg:"is_active,notnull,use_zero"`
+	CreatedAt         time.Time      `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt         time.Time      `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// AppliesTo reports whether the coupon discounts planId
+func (c *Coupon) AppliesTo(planId string) bool {
+	if len(c.AppliesToPlans) == 0 {
+		return true
+	}
+	for _, id := range c.AppliesToPlans {
+		if id == planId {
+			return true
+		}
+	}
+	return false
+}
+
+// Redeemable returns why the coupon cannot be redeemed at now, or nil
+func (c *Coupon) Redeemable(now time.Time) error {
+	switch {
+	case !c.IsActive:
+		return fmt.Errorf("coupon %s is no longer active", c.ID)
+	case c.RedeemBy != nil && !now.Before(*c.RedeemBy):
+		return fmt.Errorf("coupon %s has expired", c.ID)
+	case c.MaxRedemptions > 0 && c.TimesRedeemed >= c.MaxRedemptions:
+		return fmt.Errorf("coupon %s has been fully redeemed", c.ID)
+	}
+	return nil
+}
+
+// Discount returns how much the coupon takes off amount, a charge (or
+// credit) for fraction of a billing period. An amount off is scaled by
+// fraction and never exceeds the amount itself.
+func (c *Coupon) Discount(amount, fraction float64) float64 {
+	if c.PercentOff > 0 {
+		return amount * c.PercentOff / 100
+	}
+	discount := c.AmountOff * fraction
+	if discount > math.Abs(amount) {
+		discount = math.Abs(amount)
+	}
+	if amount < 0 {
+		return -discount
+	}
+	return discount
+}
+
+// Ends returns when a discount redeemed now stops, given the first period it
+// covers starts at firstPeriod and renews every interval. It is nil for
+// coupons that last forever.
+func (c *Coupon) Ends(firstPeriod time.Time, interval PlanInterval) *time.Time {
+	periods := 1
+	switch c.Duration {
+	case DurationForever:
+		return nil
+	case DurationRepeating:
+		periods = c.DurationInPeriods
+	}
+	end := firstPeriod
+	for i := 0; i < periods; i++ {
+		end = interval.Next(end)
+	}
+	return &end
+}
+
+// Label describes the coupon's discount, such as "20% off"
+func (c *Coupon) Label() string {
+	if c.PercentOff > 0 {
+		return strconv.FormatFloat(c.PercentOff, 'f', -1, 64) + "% off"
+	}
+	return fmt.Sprintf("%.2f %s off", c.AmountOff, c.Currency)
+}
+
+// PromotionCode is a customer-facing code that redeems a coupon. Codes are
+// stored upper case and matched case-insensitively.
+type PromotionCode struct {
+	tableName struct{} `pg:"promotion_codes"`
+
+	ID             string     `json:"id" pg:"id,pk"`
+	Code           string     `json:"code" pg:"code,notnull"`
+	CouponID       string     `json:"coupon_id" pg:"coupon_id,notnull"`
+	Coupon         *Coupon    `json:"coupon,omitempty" pg:"rel:has-one"`
+	MaxRedemptions int        `json:"max_redemptions,omitempty" pg:"max_redemptions"`
+	TimesRedeemed  int        `json:"times_redeemed" pg:"times_redeemed,notnull,use_zero"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty" pg:"expires_at"`
+	IsActive       bool       `json:"is_active" pg:"is_active,notnull,use_zero"`
+	CreatedAt      time.Time  `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt      time.Time  `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// Redeemable returns why the code cannot be redeemed at now, or nil
+func (p *PromotionCode) Redeemable(now time.Time) error {
+	switch {
+	case !p.IsActive:
+		return fmt.Errorf("promotion code %s is no longer active", p.Code)
+	case p.ExpiresAt != nil && !now.Before(*p.ExpiresAt):
+		return fmt.Errorf("promotion code %s has expired", p.Code)
+	case p.MaxRedemptions > 0 && p.TimesRedeemed >= p.MaxRedemptions:
+		return fmt.Errorf("promotion code %s has been fully redeemed", p.Code)
+	}
+	return nil
+}
+
 // Customer represents a customer who can subscribe to plans
 type Customer struct {
-	ID        string    `json:"id" pg:"id,pk"`
-	Name      string    `json:"name" pg:"name,notnull"`
-	Email     string    `json:"email" pg:"email,notnull,unique"`
-	Phone     string    `json:"phone" pg:"phone"`
-	Address   string    `json:"address" pg:"address"`
-	City      string    `json:"city" pg:"city"`
-	State     string    `json:"state" pg:"state"`
-	Country   string    `json:"country" pg:"country"`
-	ZipCode   string    `json:"zip_code" pg:"zip_code"`
-	Metadata  map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
-	CreatedAt time.Time `json:"created_at" pg:"created_at,default:now()"`
-	UpdatedAt time.Time `json:"updated_at" pg:"updated_at,default:now()"`
-}
-
-// Subscription represents a customer's subscription to a plan
+	tableName struct{} `pg:"customers"`
+
+	ID                   string                 `json:"id" pg:"id,pk"`
+	Name                 string                 `json:"name" pg:"name,notnull"`
+	Email                string                 `json:"email" pg:"email,notnull,unique"`
+	Phone                string                 `json:"phone" pg:"phone"`
+	Address              string                 `json:"address" pg:"address"`
+	City                 string                 `json:"city" pg:"city"`
+	State                string                 `json:"state" pg:"state"`
+	Country              string                 `json:"country" pg:"country"`
+	ZipCode              string                 `json:"zip_code" pg:"zip_code"`
+	DefaultPaymentMethod string                 `json:"default_payment_method,omitempty" pg:"default_payment_method"`
+	Metadata             map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
+	CreatedAt            time.Time              `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt            time.Time              `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// Subscription represents a customer's subscription to a plan.
+// PendingPlanID is a plan change scheduled for the end of the current
+// period. TrialReminderAt is when the customer was told their trial is
+// ending. SuspendedAt is when dunning gave up collecting a renewal. A
+// coupon discounts the subscription from DiscountStart until DiscountEnd, or
+// for good if DiscountEnd is nil. A subscription with CancelAtPeriodEnd is
+// canceled instead of renewed; a paused one resumes at ResumeAt, if set.
 type Subscription struct {
-	ID            string             `json:"id" pg:"id,pk"`
-	CustomerID    string             `json:"customer_id" pg:"customer_id,notnull"`
-	PlanID        string             `json:"plan_id" pg:"plan_id,notnull"`
-	Status        SubscriptionStatus `json:"status" pg:"status,notnull"`
-	CurrentPeriodStart time.Time     `json:"current_period_start" pg:"current_period_start,notnull"`
-	CurrentPeriodEnd   time.Time     `json:"current_period_end" pg:"current_period_end,notnull"`
-	CanceledAt    *time.Time         `json:"canceled_at,omitempty" pg:"canceled_at"`
-	TrialStart    *time.Time         `json:"trial_start,omitempty" pg:"trial_start"`
-	TrialEnd      *time.Time         `json:"trial_end,omitempty" pg:"trial_end"`
-	Quantity      int                `json:"quantity" pg:"quantity,notnull,default:1"`
-	Metadata      map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
-	CreatedAt     time.Time          `json:"created_at" pg:"created_at,default:now()"`
-	UpdatedAt     time.Time          `json:"updated_at" pg:"updated_at,default:now()"`
-}
-
-// Invoice represents a billing invoice for a subscription
+	tableName struct{} `pg:"subscriptions"`
+
+	ID                   string                 `json:"id" pg:"id,pk"`
+	CustomerID           string                 `json:"customer_id" pg:"customer_id,notnull"`
+	PlanID               string                 `json:"plan_id" pg:"plan_id,notnull"`
+	Plan                 *Plan                  `json:"plan,omitempty" pg:"rel:has-one"`
+	PendingPlanID        string                 `json:"pending_plan_id,omitempty" pg:"pending_plan_id"`
+	Status               SubscriptionStatus     `json:"status" pg:"status,notnull"`
+	CurrentPeriodStart   time.Time              `json:"current_period_start" pg:"current_period_start,notnull"`
+	CurrentPeriodEnd     time.Time              `json:"current_period_end" pg:"current_period_end,notnull"`
+	CanceledAt           *time.Time             `json:"canceled_at,omitempty" pg:"canceled_at"`
+	TrialStart           *time.Time             `json:"trial_start,omitempty" pg:"trial_start"`
+	TrialEnd             *time.Time             `json:"trial_end,omitempty" pg:"trial_end"`
+	TrialReminderAt      *time.Time             `json:"trial_reminder_at,omitempty" pg:"trial_reminder_at"`
+	SuspendedAt          *time.Time             `json:"suspended_at,omitempty" pg:"suspended_at"`
+	CouponID             string                 `json:"coupon_id,omitempty" pg:"coupon_id"`
+	Coupon               *Coupon                `json:"coupon,omitempty" pg:"rel:has-one"`
+	PromotionCodeID      string                 `json:"promotion_code_id,omitempty" pg:"promotion_code_id"`
+	DiscountStart        *time.Time             `json:"discount_start,omitempty" pg:"discount_start"`
+	DiscountEnd          *time.Time             `json:"discount_end,omitempty" pg:"discount_end"`
+	CancelAtPeriodEnd    bool                   `json:"cancel_at_period_end" pg:"cancel_at_period_end,notnull,use_zero"`
+	CancellationReason   CancellationReason     `json:"cancellation_reason,omitempty" pg:"cancellation_reason"`
+	CancellationFeedback string                 `json:"cancellation_feedback,omitempty" pg:"cancellation_feedback"`
+	PauseBehavior        PauseBehavior          `json:"pause_behavior,omitempty" pg:"pause_behavior"`
+	PausedAt             *time.Time             `json:"paused_at,omitempty" pg:"paused_at"`
+	ResumeAt             *time.Time             `json:"resume_at,omitempty" pg:"resume_at"`
+	Quantity             int                    `json:"quantity" pg:"quantity,notnull,default:1"`
+	Metadata             map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
+	CreatedAt            time.Time              `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt            time.Time              `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// DiscountAt returns the coupon discounting the subscription at t, or nil
+// if there is none. Coupon must be loaded.
+func (s *Subscription) DiscountAt(t time.Time) *Coupon {
+	if s.Coupon == nil || s.DiscountStart == nil || t.Before(*s.DiscountStart) {
+		return nil
+	}
+	if s.DiscountEnd != nil && !t.Before(*s.DiscountEnd) {
+		return nil
+	}
+	return s.Coupon
+}
+
+// Invoice represents a billing invoice for a subscription. PaymentID is the
+// payment service payment that settled it. AmountCredited is the total of
+// its credit notes, and AmountRefunded the part of that returned to the
+// customer's payment method.
+//
+// An invoice is given its merchant's next Number and its Taxes when it is
+// finalized, and its amounts and lines cannot change after that; it is
+// corrected with credit notes instead.
 type Invoice struct {
-	ID              string         `json:"id" pg:"id,pk"`
-	SubscriptionID  string         `json:"subscription_id" pg:"subscription_id,notnull"`
-	CustomerID      string         `json:"customer_id" pg:"customer_id,notnull"`
-	Amount          float64        `json:"amount" pg:"amount,notnull"`
-	Currency        string         `json:"currency" pg:"currency,notnull"`
-	Status          InvoiceStatus  `json:"status" pg:"status,notnull,default:'draft'"`
-	DueDate         time.Time      `json:"due_date" pg:"due_date,notnull"`
-	PaidAt          *time.Time     `json:"paid_at,omitempty" pg:"paid_at"`
-	PeriodStart     time.Time      `json:"period_start" pg:"period_start,notnull"`
-	PeriodEnd       time.Time      `json:"period_end" pg:"period_end,notnull"`
-	Description     string         `json:"description" pg:"description"`
-	Items           []InvoiceItem  `json:"items" pg:"items,type:jsonb"`
-	Metadata        map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
-	CreatedAt       time.Time      `json:"created_at" pg:"created_at,default:now()"`
-	UpdatedAt       time.Time      `json:"updated_at" pg:"updated_at,default:now()"`
-}
-
-// InvoiceItem represents a line item on an invoice
+	tableName struct{} `pg:"invoices"`
+
+	ID                 string                 `json:"id" pg:"id,pk"`
+	Number             string                 `json:"number,omitempty" pg:"number"`
+	MerchantID         string                 `json:"merchant_id,omitempty" pg:"merchant_id"`
+	SubscriptionID     string                 `json:"subscription_id" pg:"subscription_id,notnull"`
+	CustomerID         string                 `json:"customer_id" pg:"customer_id,notnull"`
+	Amount             float64                `json:"amount" pg:"amount,notnull,use_zero"`
+	Currency           string                 `json:"currency" pg:"currency,notnull"`
+	Status             InvoiceStatus          `json:"status" pg:"status,notnull,default:'draft'"`
+	BillingReason      BillingReason          `json:"billing_reason" pg:"billing_reason,notnull"`
+	DueDate            time.Time              `json:"due_date" pg:"due_date,notnull"`
+	PaidAt             *time.Time             `json:"paid_at,omitempty" pg:"paid_at"`
+	PeriodStart        time.Time              `json:"period_start" pg:"period_start,notnull"`
+	PeriodEnd          time.Time              `json:"period_end" pg:"period_end,notnull"`
+	Description        string                 `json:"description" pg:"description"`
+	Items              []InvoiceItem          `json:"items" pg:"items,type:jsonb"`
+	PaymentID          string                 `json:"payment_id,omitempty" pg:"payment_id"`
+	Taxes              []TaxLine              `json:"taxes,omitempty" pg:"taxes,type:jsonb"`
+	Issuer             *Issuer                `json:"issuer,omitempty" pg:"issuer,type:jsonb"`
+	AmountCredited     float64                `json:"amount_credited" pg:"amount_credited,notnull,use_zero"`
+	AmountRefunded     float64                `json:"amount_refunded" pg:"amount_refunded,notnull,use_zero"`
+	FinalizedAt        *time.Time             `json:"finalized_at,omitempty" pg:"finalized_at"`
+	AttemptCount       int                    `json:"attempt_count" pg:"attempt_count,notnull,use_zero"`
+	LastPaymentError   string                 `json:"last_payment_error,omitempty" pg:"last_payment_error"`
+	NextPaymentAttempt *time.Time             `json:"next_payment_attempt,omitempty" pg:"next_payment_attempt"`
+	Metadata           map[string]interface{} `json:"metadata" pg:"metadata,type:jsonb"`
+	CreatedAt          time.Time              `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt          time.Time              `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// AmountDue is what is left to collect on an open invoice
+func (i *Invoice) AmountDue() float64 {
+	switch i.Status {
+	case Paid, Void, InvoiceCanceled:
+		return 0
+	}
+	return math.Round((i.Amount-i.AmountCredited)*100) / 100
+}
+
+// InvoiceItem represents a line item on an invoice. Amount is the line
+// total, not the unit price.
 type InvoiceItem struct {
-	Description string  `json:"description"`
-	Amount      float64 `json:"amount"`
-	Quantity    int     `json:"quantity"`
-} 
\ No newline at end of file
+	Description string          `json:"description"`
+	Amount      float64         `json:"amount"`
+	Quantity    int             `json:"quantity"`
+	Type        InvoiceItemType `json:"type,omitempty"`
+}
+
+// InvoiceItemType says what a renewal invoice line charges for. Other
+// lines, and lines saved before types were recorded, have none.
+type InvoiceItemType string
+
+const (
+	// ItemSubscription is the plan fee for the invoice's period
+	ItemSubscription InvoiceItemType = "subscription"
+	// ItemUsage is metered usage from the period before
+	ItemUsage InvoiceItemType = "usage"
+	// ItemDiscount is a coupon's discount
+	ItemDiscount InvoiceItemType = "discount"
+)
+
+// TaxLine is the tax included in an invoice or credit note's total. Rate is
+// a percentage and Taxable the amount it was charged on, without the tax.
+type TaxLine struct {
+	Name    string  `json:"name"`
+	Rate    float64 `json:"rate"`
+	Taxable float64 `json:"taxable"`
+	Amount  float64 `json:"amount"`
+}
+
+// IncludedTax splits total into the tax at rate percent it includes and the
+// rest. It returns nil for a zero rate.
+func IncludedTax(name string, rate, total float64) []TaxLine {
+	if rate <= 0 {
+		return nil
+	}
+	if name == "" {
+		name = "Tax"
+	}
+	tax := math.Round(total*rate/(100+rate)*100) / 100
+	return []TaxLine{{
+		Name:    name,
+		Rate:    rate,
+		Taxable: math.Round((total-tax)*100) / 100,
+		Amount:  tax,
+	}}
+}
+
+// Merchant is the business invoices are issued by: the branding and details
+// printed on them, and the tax its prices include. Invoices and credit notes
+// are numbered from separate gap-free counters per merchant, formatted with
+// InvoicePrefix.
+type Merchant struct {
+	tableName struct{} `pg:"merchants"`
+
+	ID                   string    `json:"id" pg:"id,pk"`
+	Name                 string    `json:"name" pg:"name,notnull"`
+	LegalName            string    `json:"legal_name,omitempty" pg:"legal_name"`
+	Email                string    `json:"email,omitempty" pg:"email"`
+	Phone                string    `json:"phone,omitempty" pg:"phone"`
+	Address              string    `json:"address,omitempty" pg:"address"`
+	TaxID                string    `json:"tax_id,omitempty" pg:"tax_id"`
+	LogoURL              string    `json:"logo_url,omitempty" pg:"logo_url"`
+	BrandColor           string    `json:"brand_color,omitempty" pg:"brand_color"`
+	Footer               string    `json:"footer,omitempty" pg:"footer"`
+	InvoicePrefix        string    `json:"invoice_prefix" pg:"invoice_prefix,notnull,default:'INV'"`
+	TaxName              string    `json:"tax_name,omitempty" pg:"tax_name"`
+	TaxRate              float64   `json:"tax_rate" pg:"tax_rate,notnull,use_zero"`
+	NextInvoiceNumber    int64     `json:"next_invoice_number" pg:"next_invoice_number,notnull,default:1"`
+	NextCreditNoteNumber int64     `json:"next_credit_note_number" pg:"next_credit_note_number,notnull,default:1"`
+	CreatedAt            time.Time `json:"created_at" pg:"created_at,default:now()"`
+	UpdatedAt            time.Time `json:"updated_at" pg:"updated_at,default:now()"`
+}
+
+// InvoiceNumber formats the invoice number with the given sequence
+func (m *Merchant) InvoiceNumber(sequence int64) string {
+	return fmt.Sprintf("%s-%06d", m.InvoicePrefix, sequence)
+}
+
+// CreditNoteNumber formats the credit note number with the given sequence
+func (m *Merchant) CreditNoteNumber(sequence int64) string {
+	return fmt.Sprintf("%s-CN-%06d", m.InvoicePrefix, sequence)
+}
+
+// Issuer returns the merchant's details as printed on a document issued now
+func (m *Merchant) Issuer() *Issuer {
+	return &Issuer{
+		Name:       m.Name,
+		LegalName:  m.LegalName,
+		Email:      m.Email,
+		Phone:      m.Phone,
+		Address:    m.Address,
+		TaxID:      m.TaxID,
+		LogoURL:    m.LogoURL,
+		BrandColor: m.BrandColor,
+		Footer:     m.Footer,
+	}
+}
+
+// Issuer is the merchant's details and branding printed on an invoice or
+// credit note. Finalized invoices and credit notes keep the ones they were
+// issued with, so later changes to the merchant do not alter them.
+type Issuer struct {
+	Name       string `json:"name"`
+	LegalName  string `json:"legal_name,omitempty"`
+	Email      string `json:"email,omitempty"`
+	Phone      string `json:"phone,omitempty"`
+	Address    string `json:"address,omitempty"`
+	TaxID      string `json:"tax_id,omitempty"`
+	LogoURL    string `json:"logo_url,omitempty"`
+	BrandColor string `json:"brand_color,omitempty"`
+	Footer     string `json:"footer,omitempty"`
+}
+
+// CreditNoteReason says why an invoice was corrected
+type CreditNoteReason string
+
+const (
+	CreditDuplicate      CreditNoteReason = "duplicate"
+	CreditFraudulent     CreditNoteReason = "fraudulent"
+	CreditOrderChange    CreditNoteReason = "order_change"
+	CreditUnsatisfactory CreditNoteReason = "product_unsatisfactory"
+	CreditOther          CreditNoteReason = "other"
+)
+
+// ParseCreditNoteReason returns the reason named s, defaulting to
+// CreditOther
+func ParseCreditNoteReason(s string) (CreditNoteReason, error) {
+	switch reason := CreditNoteReason(s); reason {
+	case "":
+		return CreditOther, nil
+	case CreditDuplicate, CreditFraudulent, CreditOrderChange, CreditUnsatisfactory, CreditOther:
+		return reason, nil
+	}
+	return "", fmt.Errorf("unknown credit note reason %q", s)
+}
+
+// CreditMethod says how a credit note's amount reaches the customer
+type CreditMethod string
+
+const (
+	// CreditReduceDue lowers what is left to pay on an unpaid invoice
+	CreditReduceDue CreditMethod = "reduce_amount_due"
+	// CreditRefund returns the amount to the payment method that paid
+	CreditRefund CreditMethod = "refund"
+	// CreditBalance takes the amount off the subscription's next invoice
+	CreditBalance CreditMethod = "customer_balance"
+)
+
+// CreditNote corrects a finalized invoice by crediting part or all of it.
+// RefundID is the payment service refund for CreditRefund notes.
+type CreditNote struct {
+	tableName struct{} `pg:"credit_notes"`
+
+	ID             string           `json:"id" pg:"id,pk"`
+	Number         string           `json:"number" pg:"number,notnull"`
+	MerchantID     string           `json:"merchant_id" pg:"merchant_id,notnull"`
+	InvoiceID      string           `json:"invoice_id" pg:"invoice_id,notnull"`
+	SubscriptionID string           `json:"subscription_id" pg:"subscription_id,notnull"`
+	CustomerID     string           `json:"customer_id" pg:"customer_id,notnull"`
+	Amount         float64          `json:"amount" pg:"amount,notnull"`
+	Currency       string           `json:"currency" pg:"currency,notnull"`
+	Reason         CreditNoteReason `json:"reason" pg:"reason,notnull"`
+	Method         CreditMethod     `json:"method" pg:"method,notnull"`
+	Memo           string           `json:"memo,omitempty" pg:"memo"`
+	Items          []InvoiceItem    `json:"items" pg:"items,type:jsonb"`
+	Taxes          []TaxLine        `json:"taxes,omitempty" pg:"taxes,type:jsonb"`
+	Issuer         *Issuer          `json:"issuer,omitempty" pg:"issuer,type:jsonb"`
+	RefundID       string           `json:"refund_id,omitempty" pg:"refund_id"`
+	CreatedAt      time.Time        `json:"created_at" pg:"created_at,default:now()"`
+}
+
+// PendingInvoiceItem is a charge or credit waiting to be added to the
+// subscription's next renewal invoice. InvoiceID is set once it has been.
+type PendingInvoiceItem struct {
+	tableName struct{} `pg:"pending_invoice_items"`
+
+	ID             string    `json:"id" pg:"id,pk"`
+	SubscriptionID string    `json:"subscription_id" pg:"subscription_id,notnull"`
+	CustomerID     string    `json:"customer_id" pg:"customer_id,notnull"`
+	Description    string    `json:"description" pg:"description,notnull"`
+	Amount         float64   `json:"amount" pg:"amount,notnull,use_zero"`
+	Quantity       int       `json:"quantity" pg:"quantity,notnull,use_zero"`
+	Currency       string    `json:"currency" pg:"currency,notnull"`
+	InvoiceID      string    `json:"invoice_id,omitempty" pg:"invoice_id"`
+	CreatedAt      time.Time `json:"created_at" pg:"created_at,default:now()"`
+}
+
+// UsageRecord is usage of a metered component reported for a subscription.
+// EventID is the reporter's id for the event, unique per subscription, so
+// reporting the same event twice records it once. InvoiceID is set once the
+// usage has been billed.
+type UsageRecord struct {
+	tableName struct{} `pg:"usage_records"`
+
+	ID             string    `json:"id" pg:"id,pk"`
+	SubscriptionID string    `json:"subscription_id" pg:"subscription_id,notnull"`
+	ComponentID    string    `json:"component_id" pg:"component_id,notnull"`
+	EventID        string    `json:"event_id" pg:"event_id,notnull"`
+	Quantity       int64     `json:"quantity" pg:"quantity,notnull,use_zero"`
+	Timestamp      time.Time `json:"timestamp" pg:"recorded_at,notnull"`
+	InvoiceID      string    `json:"invoice_id,omitempty" pg:"invoice_id"`
+	CreatedAt      time.Time `json:"created_at" pg:"created_at,default:now()"`
+}
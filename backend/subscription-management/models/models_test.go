@@ -0,0 +1,107 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeteredComponentPrice(t *testing.T) {
+	graduated := []PriceTier{{UpTo: 100, UnitAmount: 1}, {UpTo: 1000, UnitAmount: 0.5}, {UnitAmount: 0.1}}
+
+	tests := []struct {
+		name      string
+		component MeteredComponent
+		quantity  int64
+		want      float64
+	}{
+		{"per unit", MeteredComponent{PricingModel: PerUnit, UnitAmount: 0.5}, 10, 5},
+		{"no usage", MeteredComponent{PricingModel: PerUnit, UnitAmount: 0.5}, 0, 0},
+		{"negative usage", MeteredComponent{PricingModel: PerUnit, UnitAmount: 0.5}, -3, 0},
+
+		{"package part used", MeteredComponent{PricingModel: Package, UnitAmount: 2, PackageSize: 100}, 1, 2},
+		{"package filled", MeteredComponent{PricingModel: Package, UnitAmount: 2, PackageSize: 100}, 100, 2},
+		{"package started", MeteredComponent{PricingModel: Package, UnitAmount: 2, PackageSize: 100}, 101, 4},
+
+		{"volume first tier", MeteredComponent{PricingModel: Volume, Tiers: []PriceTier{{UpTo: 100, UnitAmount: 1}, {UnitAmount: 0.5, FlatAmount: 10}}}, 100, 100},
+		{"volume every unit at the top tier", MeteredComponent{PricingModel: Volume, Tiers: []PriceTier{{UpTo: 100, UnitAmount: 1}, {UnitAmount: 0.5, FlatAmount: 10}}}, 101, 60.5},
+		{"volume beyond a bounded last tier", MeteredComponent{PricingModel: Volume, Tiers: []PriceTier{{UpTo: 100, UnitAmount: 1}, {UpTo: 1000, UnitAmount: 0.5}}}, 2000, 1000},
+
+		{"tiered within the first tier", MeteredComponent{PricingModel: Tiered, Tiers: graduated}, 50, 50},
+		{"tiered across two tiers", MeteredComponent{PricingModel: Tiered, Tiers: graduated}, 150, 125},
+		{"tiered across every tier", MeteredComponent{PricingModel: Tiered, Tiers: graduated}, 1500, 600},
+		{"tiered flat amount", MeteredComponent{PricingModel: Tiered, Tiers: []PriceTier{{UpTo: 10, FlatAmount: 5}, {UnitAmount: 1}}}, 12, 7},
+		{"tiered flat amount only", MeteredComponent{PricingModel: Tiered, Tiers: []PriceTier{{UpTo: 10, FlatAmount: 5}, {UnitAmount: 1}}}, 5, 5},
+		{"tiered beyond a bounded last tier", MeteredComponent{PricingModel: Tiered, Tiers: []PriceTier{{UpTo: 10, UnitAmount: 1}, {UpTo: 20, UnitAmount: 2}}}, 30, 50},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.component.Price(tt.quantity); got != tt.want {
+				t.Errorf("Price(%d) = %v, want %v", tt.quantity, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponDiscount(t *testing.T) {
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		amount   float64
+		fraction float64
+		want     float64
+	}{
+		{"percent off a charge", Coupon{PercentOff: 20}, 50, 1, 10},
+		{"percent off a credit", Coupon{PercentOff: 20}, -50, 0.5, -10},
+		{"amount off a full period", Coupon{AmountOff: 10}, 50, 1, 10},
+		{"amount off part of a period", Coupon{AmountOff: 10}, 50, 0.5, 5},
+		{"amount off capped at the charge", Coupon{AmountOff: 10}, 3, 1, 3},
+		{"amount off a credit", Coupon{AmountOff: 10}, -30, 0.5, -5},
+		{"amount off capped at the credit", Coupon{AmountOff: 10}, -3, 1, -3},
+		{"nothing to discount", Coupon{AmountOff: 10}, 0, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.coupon.Discount(tt.amount, tt.fraction); got != tt.want {
+				t.Errorf("Discount(%v, %v) = %v, want %v", tt.amount, tt.fraction, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCouponEnds(t *testing.T) {
+	jan15 := time.Date(2026, time.January, 15, 9, 30, 0, 0, time.UTC)
+	jan31 := time.Date(2026, time.January, 31, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		coupon   Coupon
+		first    time.Time
+		interval PlanInterval
+		want     *time.Time
+	}{
+		{"forever", Coupon{Duration: DurationForever}, jan15, Monthly, nil},
+		{"once", Coupon{Duration: DurationOnce}, jan15, Monthly, date(2026, time.February, 15, 9, 30)},
+		{"once at a month end", Coupon{Duration: DurationOnce}, jan31, Monthly, date(2026, time.February, 28, 0, 0)},
+		{"repeating", Coupon{Duration: DurationRepeating, DurationInPeriods: 3}, jan15, Monthly, date(2026, time.April, 15, 9, 30)},
+		{"repeating quarters", Coupon{Duration: DurationRepeating, DurationInPeriods: 2}, jan15, Quarterly, date(2026, time.July, 15, 9, 30)},
+		{"once annual", Coupon{Duration: DurationOnce}, jan15, Annual, date(2027, time.January, 15, 9, 30)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.coupon.Ends(tt.first, tt.interval)
+			switch {
+			case got == nil && tt.want == nil:
+			case got == nil || tt.want == nil || !got.Equal(*tt.want):
+				t.Errorf("Ends(%v, %s) = %v, want %v", tt.first, tt.interval, got, tt.want)
+			}
+		})
+	}
+}
+
+func date(year int, month time.Month, day, hour, min int) *time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	return &t
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// planRequest is the body for creating or updating a plan. Fields left out
+// of an update keep their current value.
+type planRequest struct {
+	ID          string    `json:"id"`
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Amount      *float64  `json:"amount" binding:"omitempty,min=0"`
+	Currency    *string   `json:"currency"`
+	Interval    *string   `json:"interval"`
+	Features    *[]string `json:"features"`
+	IsActive    *bool     `json:"is_active"`
+	TrialDays   *int      `json:"trial_days" binding:"omitempty,min=0,max=730"`
+	MinQuantity *int      `json:"min_quantity" binding:"omitempty,min=1"`
+	MaxQuantity *int      `json:"max_quantity" binding:"omitempty,min=0"`
+}
+
+// apply copies the request's fields onto plan
+func (r planRequest) apply(plan *models.Plan) error {
+	if r.Name != nil {
+		plan.Name = strings.TrimSpace(*r.Name)
+	}
+	if r.Description != nil {
+		plan.Description = *r.Description
+	}
+	if r.Amount != nil {
+		plan.Amount = *r.Amount
+	}
+	if r.Currency != nil {
+		plan.Currency = strings.ToUpper(strings.TrimSpace(*r.Currency))
+	}
+	if r.Interval != nil {
+		interval, err := models.ParseInterval(*r.Interval)
+		if err != nil {
+			return err
+		}
+		plan.Interval = interval
+	}
+	if r.Features != nil {
+		plan.Features = *r.Features
+	}
+	if r.IsActive != nil {
+		plan.IsActive = *r.IsActive
+	}
+	if r.TrialDays != nil {
+		plan.TrialDays = *r.TrialDays
+	}
+	if r.MinQuantity != nil {
+		plan.MinQuantity = *r.MinQuantity
+	}
+	if r.MaxQuantity != nil {
+		plan.MaxQuantity = *r.MaxQuantity
+	}
+
+	if plan.Name == "" {
+		return errors.New("name is required")
+	}
+	if len(plan.Currency) != 3 {
+		return errors.New("currency must be a three letter code")
+	}
+	if plan.MaxQuantity > 0 && plan.MaxQuantity < plan.MinQuantity {
+		return errors.New("max_quantity must not be less than min_quantity")
+	}
+	return nil
+}
+
+// handleListPlans lists the active plans, or every plan with
+// ?include_inactive=true
+func handleListPlans(c *gin.Context) {
+	plans, err := repo.ListPlans(c.Request.Context(), c.Query("include_inactive") == "true")
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"plans": plans,
+	})
+}
+
+func handleGetPlan(c *gin.Context) {
+	plan, err := repo.GetPlan(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"plan": plan})
+}
+
+func handleCreatePlan(c *gin.Context) {
+	var request planRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+	if request.Amount == nil || request.Interval == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "amount and interval are required"})
+		return
+	}
+
+	plan := &models.Plan{
+		ID:          request.ID,
+		Currency:    "USD",
+		IsActive:    true,
+		MinQuantity: 1,
+	}
+	if plan.ID == "" {
+		plan.ID = "plan_" + uuid.New().String()[:8]
+	}
+	if err := request.apply(plan); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := repo.CreatePlan(c.Request.Context(), plan); err != nil {
+		if errors.Is(err, repository.ErrConflict) {
+			c.JSON(http.StatusConflict, gin.H{"error": "A plan with this id already exists"})
+			return
+		}
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "Plan created successfully",
+		"plan":    plan,
+	})
+}
+
+func handleUpdatePlan(c *gin.Context) {
+	var request planRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	plan, err := repo.GetPlan(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+	if err := request.apply(plan); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := repo.UpdatePlan(ctx, plan); err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan updated successfully",
+		"plan":    plan,
+	})
+}
+
+// handleDeletePlan archives a plan. Existing subscriptions keep it, but no
+// new subscriptions can be made to it.
+func handleDeletePlan(c *gin.Context) {
+	ctx := c.Request.Context()
+	plan, err := repo.GetPlan(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	plan.IsActive = false
+	if err := repo.UpdatePlan(ctx, plan); err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message": "Plan archived successfully",
+		"plan":    plan,
+	})
+}
@@ -0,0 +1,232 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// DueSubscriptions returns the ids of up to limit active, trialing, past due
+// or paused subscriptions whose current period ended at or before now and
+// that no billing run holds, oldest first
+func (r *Repository) DueSubscriptions(ctx context.Context, now time.Time, limit int) ([]string, error) {
+	var ids []string
+	_, err := r.db.QueryContext(ctx, &ids, `
+		SELECT id FROM subscriptions
+		WHERE status IN (?, ?, ?, ?) AND current_period_end <= ?
+		  AND (billing_lease_expires_at IS NULL OR billing_lease_expires_at < now())
+		ORDER BY current_period_end, id
+		LIMIT ?`, models.Active, models.Trial, models.PastDue, models.Paused, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// AcquireBillingLease claims a subscription for one billing run for up to
+// ttl. It returns false if another run holds an unexpired lease. Leases live
+// in the database, so runs on different replicas never bill the same
+// subscription at once, and a lease left by a crashed run simply expires.
+func (r *Repository) AcquireBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET billing_lease_owner = ?, billing_lease_expires_at = now() + ? * interval '1 millisecond'
+		WHERE id = ? AND (billing_lease_expires_at IS NULL OR billing_lease_expires_at < now())`,
+		owner, ttl.Milliseconds(), subscriptionId)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// ExtendBillingLease pushes the expiry of a lease taken with
+// AcquireBillingLease to ttl from now. It returns false if owner no longer
+// holds it because another run took it over after it expired.
+func (r *Repository) ExtendBillingLease(ctx context.Context, subscriptionId, owner string, ttl time.Duration) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET billing_lease_expires_at = now() + ? * interval '1 millisecond'
+		WHERE id = ? AND billing_lease_owner = ?`,
+		ttl.Milliseconds(), subscriptionId, owner)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// ReleaseBillingLease gives up a lease taken with AcquireBillingLease
+func (r *Repository) ReleaseBillingLease(ctx context.Context, subscriptionId, owner string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET billing_lease_owner = NULL, billing_lease_expires_at = NULL
+		WHERE id = ? AND billing_lease_owner = ?`, subscriptionId, owner)
+	return err
+}
+
+// AdvancePeriod moves a subscription to the period [start, end) with the
+// given status if its current period still ends at from. It returns false
+// when the subscription has already been moved on.
+func (r *Repository) AdvancePeriod(ctx context.Context, subscriptionId string, from, start, end time.Time, status models.SubscriptionStatus) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET current_period_start = ?, current_period_end = ?, status = ?, suspended_at = NULL, updated_at = now()
+		WHERE id = ? AND current_period_end = ?`, start, end, status, subscriptionId, from)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// ApplyPendingPlan moves a subscription onto its scheduled plan, if it has
+// one
+func (r *Repository) ApplyPendingPlan(ctx context.Context, subscriptionId string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET plan_id = pending_plan_id, pending_plan_id = NULL, updated_at = now()
+		WHERE id = ? AND pending_plan_id IS NOT NULL`, subscriptionId)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// SchedulePlan sets the plan an active or trialing subscription moves to at
+// the end of its period, or clears it when planId is empty. Only that column
+// is written, so it does not undo a billing run working on the subscription
+// meanwhile. It returns false if the subscription is no longer active or
+// trialing.
+func (r *Repository) SchedulePlan(ctx context.Context, subscriptionId, planId string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET pending_plan_id = NULLIF(?, ''), updated_at = now()
+		WHERE id = ? AND status IN (?, ?)`,
+		planId, subscriptionId, models.Active, models.Trial)
+	if err != nil {
+		return false, translateError(err)
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// TrialsEndingBefore returns the ids of trialing subscriptions whose trial
+// ends after now but before cutoff and that have not been reminded yet
+func (r *Repository) TrialsEndingBefore(ctx context.Context, now, cutoff time.Time, limit int) ([]string, error) {
+	var ids []string
+	_, err := r.db.QueryContext(ctx, &ids, `
+		SELECT id FROM subscriptions
+		WHERE status = ? AND trial_reminder_at IS NULL AND trial_end > ? AND trial_end <= ?
+		ORDER BY trial_end, id
+		LIMIT ?`, models.Trial, now, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ClaimTrialReminder marks a trial as reminded at the given time. It
+// returns false if another run got there first.
+func (r *Repository) ClaimTrialReminder(ctx context.Context, subscriptionId string, at time.Time) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions SET trial_reminder_at = ?
+		WHERE id = ? AND status = ? AND trial_reminder_at IS NULL`, at, subscriptionId, models.Trial)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// UnclaimTrialReminder undoes ClaimTrialReminder so a reminder that could
+// not be sent is tried again
+func (r *Repository) UnclaimTrialReminder(ctx context.Context, subscriptionId string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions SET trial_reminder_at = NULL WHERE id = ?`, subscriptionId)
+	return err
+}
+
+// ExpireTrial ends a trial without converting it
+func (r *Repository) ExpireTrial(ctx context.Context, subscriptionId string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions SET status = ?, updated_at = now()
+		WHERE id = ? AND status = ?`, models.Expired, subscriptionId, models.Trial)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
+
+// SetSubscriptionStatus moves a subscription to status at the given time,
+// recording when it was suspended or canceled
+func (r *Repository) SetSubscriptionStatus(ctx context.Context, subscriptionId string, status models.SubscriptionStatus, at time.Time) error {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET status = ?,
+		    suspended_at = CASE WHEN ? THEN COALESCE(suspended_at, ?) END,
+		    canceled_at = CASE WHEN ? THEN ? ELSE canceled_at END,
+		    updated_at = now()
+		WHERE id = ?`,
+		status, status == models.Suspended, at, status == models.Canceled, at, subscriptionId)
+	if err != nil {
+		return err
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SuspendedBefore returns the ids of up to limit subscriptions suspended at
+// or before cutoff, oldest first
+func (r *Repository) SuspendedBefore(ctx context.Context, cutoff time.Time, limit int) ([]string, error) {
+	var ids []string
+	_, err := r.db.QueryContext(ctx, &ids, `
+		SELECT id FROM subscriptions
+		WHERE status = ? AND suspended_at <= ?
+		ORDER BY suspended_at, id
+		LIMIT ?`, models.Suspended, cutoff, limit)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// VoidUnpaidInvoices voids a subscription's invoices that are still
+// waiting to be paid
+func (r *Repository) VoidUnpaidInvoices(ctx context.Context, subscriptionId string) error {
+	_, err := r.db.ExecContext(ctx, `
+		UPDATE invoices SET status = ?, next_payment_attempt = NULL, updated_at = now()
+		WHERE subscription_id = ? AND status IN (?, ?, ?)`,
+		models.Void, subscriptionId, models.Draft, models.Open, models.Overdue)
+	return err
+}
+
+// RefundableInvoices returns a subscription's paid invoices whose period
+// covers at and that have not been fully credited
+func (r *Repository) RefundableInvoices(ctx context.Context, subscriptionId string, at time.Time) ([]models.Invoice, error) {
+	invoices := []models.Invoice{}
+	err := r.db.ModelContext(ctx, &invoices).
+		Where("subscription_id = ?", subscriptionId).
+		Where("status = ?", models.Paid).
+		Where("payment_id IS NOT NULL").
+		Where("amount_credited < amount").
+		Where("period_start <= ? AND period_end > ?", at, at).
+		Order("period_start", "id").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// UndoCancel clears a subscription's scheduled cancellation. It returns
+// false if there was none, or it has already taken effect.
+func (r *Repository) UndoCancel(ctx context.Context, subscriptionId string) (bool, error) {
+	result, err := r.db.ExecContext(ctx, `
+		UPDATE subscriptions
+		SET cancel_at_period_end = false, cancellation_reason = NULL, cancellation_feedback = NULL, updated_at = now()
+		WHERE id = ? AND cancel_at_period_end AND status NOT IN (?, ?)`,
+		subscriptionId, models.Canceled, models.Expired)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() == 1, nil
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"time"
+)
+
+// ReasonCount is how many subscriptions were canceled for one reason
+type ReasonCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+// Feedback is what a customer said when they canceled
+type Feedback struct {
+	SubscriptionID string    `json:"subscription_id"`
+	Reason         string    `json:"reason"`
+	Feedback       string    `json:"feedback"`
+	CanceledAt     time.Time `json:"canceled_at"`
+}
+
+// ChurnStats summarizes cancellations since a point in time. Subscribers
+// counts the subscriptions that were live at Since; Rate is the share of
+// them canceled since. Canceled also counts subscriptions started and
+// canceled after Since.
+type ChurnStats struct {
+	Since       time.Time     `json:"since"`
+	Subscribers int           `json:"subscribers"`
+	Canceled    int           `json:"canceled"`
+	Rate        float64       `json:"rate"`
+	Reasons     []ReasonCount `json:"reasons"`
+	Feedback    []Feedback    `json:"feedback"`
+}
+
+// ChurnStats counts cancellations since the given time by reason, with the
+// most recent feedback customers left
+func (r *Repository) ChurnStats(ctx context.Context, since time.Time, feedbackLimit int) (*ChurnStats, error) {
+	stats := &ChurnStats{Since: since, Reasons: []ReasonCount{}, Feedback: []Feedback{}}
+
+	var counts struct {
+		Subscribers int
+		Canceled    int
+		Churned     int
+	}
+	_, err := r.db.QueryOneContext(ctx, &counts, `
+		SELECT
+		  count(*) FILTER (WHERE created_at < ?0 AND (status NOT IN ('canceled', 'expired')
+		    OR coalesce(canceled_at, updated_at) >= ?0)) AS subscribers,
+		  count(*) FILTER (WHERE status = 'canceled' AND canceled_at >= ?0) AS canceled,
+		  count(*) FILTER (WHERE status = 'canceled' AND canceled_at >= ?0 AND created_at < ?0) AS churned
+		FROM subscriptions`, since)
+	if err != nil {
+		return nil, err
+	}
+	stats.Subscribers, stats.Canceled = counts.Subscribers, counts.Canceled
+	if stats.Subscribers > 0 {
+		stats.Rate = float64(counts.Churned) / float64(stats.Subscribers)
+	}
+
+	_, err = r.db.QueryContext(ctx, &stats.Reasons, `
+		SELECT coalesce(cancellation_reason, 'unspecified') AS reason, count(*) AS count
+		FROM subscriptions
+		WHERE status = 'canceled' AND canceled_at >= ?
+		GROUP BY 1
+		ORDER BY 2 DESC, 1`, since)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.db.QueryContext(ctx, &stats.Feedback, `
+		SELECT id AS subscription_id, coalesce(cancellation_reason, 'unspecified') AS reason,
+		       cancellation_feedback AS feedback, canceled_at
+		FROM subscriptions
+		WHERE status = 'canceled' AND canceled_at >= ? AND cancellation_feedback <> ''
+		ORDER BY canceled_at DESC
+		LIMIT ?`, since, feedbackLimit)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
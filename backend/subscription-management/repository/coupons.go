@@ -0,0 +1,150 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListCoupons returns coupons, newest first. Inactive coupons are left out
+// unless includeInactive is set.
+func (r *Repository) ListCoupons(ctx context.Context, includeInactive bool) ([]models.Coupon, error) {
+	coupons := []models.Coupon{}
+	query := r.db.ModelContext(ctx, &coupons).Order("created_at DESC", "id")
+	if !includeInactive {
+		query = query.Where("is_active")
+	}
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+	return coupons, nil
+}
+
+// GetCoupon returns a coupon by id
+func (r *Repository) GetCoupon(ctx context.Context, id string) (*models.Coupon, error) {
+	coupon := &models.Coupon{ID: id}
+	if err := r.db.ModelContext(ctx, coupon).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return coupon, nil
+}
+
+// CreateCoupon inserts a coupon. It returns ErrConflict if the id is taken.
+func (r *Repository) CreateCoupon(ctx context.Context, coupon *models.Coupon) error {
+	now := time.Now().UTC()
+	coupon.CreatedAt, coupon.UpdatedAt = now, now
+	if coupon.AppliesToPlans == nil {
+		coupon.AppliesToPlans = []string{}
+	}
+	_, err := r.db.ModelContext(ctx, coupon).Insert()
+	return translateError(err)
+}
+
+// DeactivateCoupon stops a coupon being redeemed. Subscriptions that
+// already have it keep their discount.
+func (r *Repository) DeactivateCoupon(ctx context.Context, id string) error {
+	result, err := r.db.ModelContext(ctx, &models.Coupon{ID: id}).
+		Set("is_active = false").
+		Set("updated_at = now()").
+		WherePK().
+		Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// ListPromotionCodes returns the promotion codes for a coupon, or every
+// code if couponId is empty, newest first
+func (r *Repository) ListPromotionCodes(ctx context.Context, couponId string) ([]models.PromotionCode, error) {
+	codes := []models.PromotionCode{}
+	query := r.db.ModelContext(ctx, &codes).Order("promotion_code.created_at DESC", "promotion_code.id")
+	if couponId != "" {
+		query = query.Where("promotion_code.coupon_id = ?", couponId)
+	}
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// GetPromotionCodeByCode returns a promotion code and its coupon by the
+// code customers enter, ignoring case
+func (r *Repository) GetPromotionCodeByCode(ctx context.Context, code string) (*models.PromotionCode, error) {
+	promotionCode := &models.PromotionCode{}
+	err := r.db.ModelContext(ctx, promotionCode).
+		Relation("Coupon").
+		Where("upper(promotion_code.code) = ?", strings.ToUpper(strings.TrimSpace(code))).
+		Select()
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return promotionCode, nil
+}
+
+// CreatePromotionCode inserts a promotion code. It returns ErrConflict if
+// the code is taken and ErrInUse if the coupon does not exist.
+func (r *Repository) CreatePromotionCode(ctx context.Context, code *models.PromotionCode) error {
+	now := time.Now().UTC()
+	code.CreatedAt, code.UpdatedAt = now, now
+	code.Code = strings.ToUpper(strings.TrimSpace(code.Code))
+	_, err := r.db.ModelContext(ctx, code).Insert()
+	return translateError(err)
+}
+
+// DeactivatePromotionCode stops a promotion code being redeemed
+func (r *Repository) DeactivatePromotionCode(ctx context.Context, id string) error {
+	result, err := r.db.ModelContext(ctx, &models.PromotionCode{ID: id}).
+		Set("is_active = false").
+		Set("updated_at = now()").
+		WherePK().
+		Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// redeem counts a redemption of the subscription's promotion code and
+// coupon, if it has them. The limits are checked in the same statement, so
+// concurrent redemptions never exceed them.
+func redeem(ctx context.Context, tx *pg.Tx, subscription *models.Subscription) error {
+	if subscription.PromotionCodeID != "" {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE promotion_codes
+			SET times_redeemed = times_redeemed + 1, updated_at = now()
+			WHERE id = ? AND is_active AND (expires_at IS NULL OR expires_at > now())
+			  AND (max_redemptions IS NULL OR times_redeemed < max_redemptions)`,
+			subscription.PromotionCodeID)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return ErrUnavailable
+		}
+	}
+	if subscription.CouponID != "" {
+		result, err := tx.ExecContext(ctx, `
+			UPDATE coupons
+			SET times_redeemed = times_redeemed + 1, updated_at = now()
+			WHERE id = ? AND is_active AND (redeem_by IS NULL OR redeem_by > now())
+			  AND (max_redemptions IS NULL OR times_redeemed < max_redemptions)`,
+			subscription.CouponID)
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return ErrUnavailable
+		}
+	}
+	return nil
+}
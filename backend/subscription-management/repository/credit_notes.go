@@ -0,0 +1,166 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListCreditNotes returns the credit notes issued against an invoice,
+// oldest first
+func (r *Repository) ListCreditNotes(ctx context.Context, invoiceId string) ([]models.CreditNote, error) {
+	notes := []models.CreditNote{}
+	err := r.db.ModelContext(ctx, &notes).
+		Where("invoice_id = ?", invoiceId).
+		Order("created_at", "id").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return notes, nil
+}
+
+// GetCreditNote returns a credit note by id
+func (r *Repository) GetCreditNote(ctx context.Context, id string) (*models.CreditNote, error) {
+	note := &models.CreditNote{ID: id}
+	if err := r.db.ModelContext(ctx, note).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return note, nil
+}
+
+// CreateCreditNote issues note against its invoice and returns the updated
+// invoice. The note is numbered from the invoice's merchant, or note's for
+// an invoice from before numbering, keeps that merchant's details as issued
+// and takes the invoice's tax rate. The invoice's credited total goes up by
+// the note's amount; an unpaid invoice with nothing left due is marked paid.
+// A refund's amount was already taken off the invoice by ReserveRefund, so
+// its note is only recorded. A customer balance credit is queued for the
+// subscription's next invoice.
+//
+// It returns ErrUnavailable if the invoice cannot be credited that way or
+// that much.
+func (r *Repository) CreateCreditNote(ctx context.Context, note *models.CreditNote) (*models.Invoice, error) {
+	invoice := &models.Invoice{ID: note.InvoiceID}
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := tx.ModelContext(ctx, invoice).WherePK().For("UPDATE").Select(); err != nil {
+			return err
+		}
+		switch {
+		case note.Method == models.CreditReduceDue && invoice.Status != models.Open && invoice.Status != models.Overdue:
+			return ErrUnavailable
+		case note.Method != models.CreditReduceDue && invoice.Status != models.Paid:
+			return ErrUnavailable
+		case note.Amount <= 0:
+			return ErrUnavailable
+		case note.Method != models.CreditRefund && note.Amount > roundCents(invoice.Amount-invoice.AmountCredited):
+			return ErrUnavailable
+		}
+
+		if invoice.MerchantID != "" {
+			note.MerchantID = invoice.MerchantID
+		}
+		merchant, sequence, err := claimNumber(ctx, tx, note.MerchantID, creditNoteCounter)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		note.Number = merchant.CreditNoteNumber(sequence)
+		note.Issuer = merchant.Issuer()
+		note.SubscriptionID = invoice.SubscriptionID
+		note.CustomerID = invoice.CustomerID
+		note.Currency = invoice.Currency
+		note.CreatedAt = now
+		if note.Items == nil {
+			note.Items = []models.InvoiceItem{}
+		}
+		if len(invoice.Taxes) > 0 {
+			note.Taxes = models.IncludedTax(invoice.Taxes[0].Name, invoice.Taxes[0].Rate, note.Amount)
+		}
+		if _, err := tx.ModelContext(ctx, note).Insert(); err != nil {
+			return err
+		}
+
+		if note.Method != models.CreditRefund {
+			invoice.AmountCredited = roundCents(invoice.AmountCredited + note.Amount)
+		}
+		if note.Method == models.CreditReduceDue && invoice.AmountDue() <= 0 {
+			invoice.Status = models.Paid
+			invoice.PaidAt = &now
+			invoice.NextPaymentAttempt = nil
+		}
+		invoice.UpdatedAt = now
+		_, err = tx.ModelContext(ctx, invoice).
+			Column("amount_credited", "amount_refunded", "status", "paid_at", "next_payment_attempt", "updated_at").
+			WherePK().
+			Update()
+		if err != nil || note.Method != models.CreditBalance {
+			return err
+		}
+
+		_, err = tx.ModelContext(ctx, &models.PendingInvoiceItem{
+			ID:             "ii_" + uuid.New().String()[:8],
+			SubscriptionID: invoice.SubscriptionID,
+			CustomerID:     invoice.CustomerID,
+			Description:    "Credit note " + note.Number,
+			Amount:         -note.Amount,
+			Quantity:       1,
+			Currency:       invoice.Currency,
+			CreatedAt:      now,
+		}).Insert()
+		return err
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return invoice, nil
+}
+
+// ReserveRefund takes amount off what is left to credit on a paid invoice
+// before it is refunded, raising its credited and refunded totals, so two
+// refunds cannot both return the same money. It returns the updated
+// invoice, or ErrUnavailable if the invoice is not paid or has less than
+// amount left to credit.
+func (r *Repository) ReserveRefund(ctx context.Context, invoiceId string, amount float64) (*models.Invoice, error) {
+	invoice := &models.Invoice{ID: invoiceId}
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := tx.ModelContext(ctx, invoice).WherePK().For("UPDATE").Select(); err != nil {
+			return err
+		}
+		if invoice.Status != models.Paid || amount <= 0 || amount > roundCents(invoice.Amount-invoice.AmountCredited) {
+			return ErrUnavailable
+		}
+		invoice.AmountCredited = roundCents(invoice.AmountCredited + amount)
+		invoice.AmountRefunded = roundCents(invoice.AmountRefunded + amount)
+		invoice.UpdatedAt = time.Now().UTC()
+		_, err := tx.ModelContext(ctx, invoice).
+			Column("amount_credited", "amount_refunded", "updated_at").
+			WherePK().
+			Update()
+		return err
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return invoice, nil
+}
+
+// ReleaseRefund gives back an amount reserved with ReserveRefund for a
+// refund the payment service refused
+func (r *Repository) ReleaseRefund(ctx context.Context, invoiceId string, amount float64) error {
+	_, err := r.db.ModelContext(ctx, (*models.Invoice)(nil)).
+		Set("amount_credited = amount_credited - ?", amount).
+		Set("amount_refunded = amount_refunded - ?", amount).
+		Set("updated_at = now()").
+		Where("id = ?", invoiceId).
+		Update()
+	return err
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,67 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListCustomers returns a page of customers, newest first
+func (r *Repository) ListCustomers(ctx context.Context, limit, offset int) ([]models.Customer, int, error) {
+	customers := []models.Customer{}
+	total, err := r.db.ModelContext(ctx, &customers).
+		Order("created_at DESC", "id").
+		Limit(limit).
+		Offset(offset).
+		SelectAndCount()
+	if err != nil {
+		return nil, 0, err
+	}
+	return customers, total, nil
+}
+
+// GetCustomer returns a customer by id
+func (r *Repository) GetCustomer(ctx context.Context, id string) (*models.Customer, error) {
+	customer := &models.Customer{ID: id}
+	if err := r.db.ModelContext(ctx, customer).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return customer, nil
+}
+
+// CreateCustomer inserts a customer. It returns ErrConflict if the id or
+// email is taken.
+func (r *Repository) CreateCustomer(ctx context.Context, customer *models.Customer) error {
+	now := time.Now().UTC()
+	customer.CreatedAt, customer.UpdatedAt = now, now
+	_, err := r.db.ModelContext(ctx, customer).Insert()
+	return translateError(err)
+}
+
+// UpdateCustomer saves every field of a customer. It returns ErrConflict if
+// the new email is taken.
+func (r *Repository) UpdateCustomer(ctx context.Context, customer *models.Customer) error {
+	customer.UpdatedAt = time.Now().UTC()
+	result, err := r.db.ModelContext(ctx, customer).WherePK().ExcludeColumn("created_at").Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteCustomer removes a customer. It returns ErrInUse if the customer
+// still has subscriptions or invoices.
+func (r *Repository) DeleteCustomer(ctx context.Context, id string) error {
+	result, err := r.db.ModelContext(ctx, &models.Customer{ID: id}).WherePK().Delete()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package repository
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+)
+
+// InvoiceFilter narrows ListInvoices. Empty fields match every invoice.
+type InvoiceFilter struct {
+	CustomerID     string
+	SubscriptionID string
+	Status         models.InvoiceStatus
+}
+
+// ListInvoices returns invoices matching filter, newest period first
+func (r *Repository) ListInvoices(ctx context.Context, filter InvoiceFilter) ([]models.Invoice, error) {
+	invoices := []models.Invoice{}
+	query := r.db.ModelContext(ctx, &invoices).Order("period_start DESC", "id")
+	if filter.CustomerID != "" {
+		query = query.Where("customer_id = ?", filter.CustomerID)
+	}
+	if filter.SubscriptionID != "" {
+		query = query.Where("subscription_id = ?", filter.SubscriptionID)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+	return invoices, nil
+}
+
+// GetInvoice returns an invoice by id
+func (r *Repository) GetInvoice(ctx context.Context, id string) (*models.Invoice, error) {
+	invoice := &models.Invoice{ID: id}
+	if err := r.db.ModelContext(ctx, invoice).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return invoice, nil
+}
+
+// CreateInvoice inserts an invoice, finalizing it unless it is a draft
+func (r *Repository) CreateInvoice(ctx context.Context, invoice *models.Invoice) error {
+	now := time.Now().UTC()
+	invoice.CreatedAt, invoice.UpdatedAt = now, now
+	if invoice.Items == nil {
+		invoice.Items = []models.InvoiceItem{}
+	}
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if invoice.Status != models.Draft {
+			if err := finalize(ctx, tx, invoice, now); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ModelContext(ctx, invoice).Insert()
+		return err
+	})
+	return translateError(err)
+}
+
+// FinalizeInvoice opens a draft invoice, giving it its number, taxes and the
+// merchant details it is issued with. It returns ErrFinalized if the invoice
+// is not a draft.
+func (r *Repository) FinalizeInvoice(ctx context.Context, id string) (*models.Invoice, error) {
+	invoice := &models.Invoice{ID: id}
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := tx.ModelContext(ctx, invoice).WherePK().For("UPDATE").Select(); err != nil {
+			return err
+		}
+		if invoice.Status != models.Draft {
+			return ErrFinalized
+		}
+		invoice.Status = models.Open
+		if err := finalize(ctx, tx, invoice, time.Now().UTC()); err != nil {
+			return err
+		}
+		_, err := tx.ModelContext(ctx, invoice).
+			Column("status", "number", "taxes", "issuer", "finalized_at", "updated_at").
+			WherePK().
+			Update()
+		return err
+	})
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return invoice, nil
+}
+
+// finalize numbers invoice from its merchant's invoice counter, works out
+// the tax its amount includes and keeps the merchant's details as issued.
+// The caller saves it in the same
+// transaction.
+func finalize(ctx context.Context, tx *pg.Tx, invoice *models.Invoice, now time.Time) error {
+	merchant, sequence, err := claimNumber(ctx, tx, invoice.MerchantID, invoiceCounter)
+	if err != nil {
+		return err
+	}
+	invoice.Number = merchant.InvoiceNumber(sequence)
+	invoice.Taxes = models.IncludedTax(merchant.TaxName, merchant.TaxRate, invoice.Amount)
+	invoice.Issuer = merchant.Issuer()
+	invoice.FinalizedAt = &now
+	invoice.UpdatedAt = now
+	return nil
+}
+
+// EnsureRenewalInvoice inserts a renewal invoice unless the subscription
+// already has one for the same period, and returns whichever is stored.
+// created reports whether invoice was the one inserted.
+//
+// A newly inserted invoice also takes the subscription's pending invoice
+// items, and the usage records with the given ids are marked as billed by
+// it. If the pending credits outweigh the charges, the invoice is zeroed
+// and the remaining credit is carried forward as a new pending item. It is
+// then finalized unless it is a draft.
+func (r *Repository) EnsureRenewalInvoice(ctx context.Context, invoice *models.Invoice, usageIds []string) (*models.Invoice, bool, error) {
+	now := time.Now().UTC()
+	invoice.CreatedAt, invoice.UpdatedAt = now, now
+	invoice.BillingReason = models.ReasonSubscriptionCycle
+	if invoice.Items == nil {
+		invoice.Items = []models.InvoiceItem{}
+	}
+
+	stored := invoice
+	created := false
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		result, err := tx.ModelContext(ctx, invoice).
+			OnConflict("(subscription_id, period_start) WHERE billing_reason = 'subscription_cycle' DO NOTHING").
+			Insert()
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			stored = &models.Invoice{}
+			return tx.ModelContext(ctx, stored).
+				Where("subscription_id = ?", invoice.SubscriptionID).
+				Where("period_start = ?", invoice.PeriodStart).
+				Where("billing_reason = ?", models.ReasonSubscriptionCycle).
+				Select()
+		}
+		created = true
+		if err := markUsageBilled(ctx, tx, invoice.ID, usageIds); err != nil {
+			return err
+		}
+		if err := attachPendingItems(ctx, tx, invoice); err != nil {
+			return err
+		}
+		if invoice.Status == models.Draft {
+			return nil
+		}
+		if err := finalize(ctx, tx, invoice, now); err != nil {
+			return err
+		}
+		_, err = tx.ModelContext(ctx, invoice).
+			Column("number", "taxes", "issuer", "finalized_at", "updated_at").
+			WherePK().
+			Update()
+		return err
+	})
+	if err != nil {
+		return nil, false, translateError(err)
+	}
+	return stored, created, nil
+}
+
+// attachPendingItems moves a subscription's pending items onto invoice
+func attachPendingItems(ctx context.Context, tx *pg.Tx, invoice *models.Invoice) error {
+	var pending []models.PendingInvoiceItem
+	err := tx.ModelContext(ctx, &pending).
+		Where("subscription_id = ?", invoice.SubscriptionID).
+		Where("invoice_id IS NULL").
+		Order("created_at", "id").
+		For("UPDATE").
+		Select()
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+
+	ids := make([]string, 0, len(pending))
+	for _, item := range pending {
+		invoice.Items = append(invoice.Items, models.InvoiceItem{
+			Description: item.Description,
+			Amount:      item.Amount,
+			Quantity:    item.Quantity,
+		})
+		invoice.Amount += item.Amount
+		ids = append(ids, item.ID)
+	}
+	invoice.Amount = math.Round(invoice.Amount*100) / 100
+
+	if invoice.Amount < 0 {
+		carried := &models.PendingInvoiceItem{
+			ID:             "ii_" + uuid.New().String()[:8],
+			SubscriptionID: invoice.SubscriptionID,
+			CustomerID:     invoice.CustomerID,
+			Description:    "Credit carried forward from " + invoice.ID,
+			Amount:         invoice.Amount,
+			Quantity:       1,
+			Currency:       invoice.Currency,
+			CreatedAt:      invoice.CreatedAt,
+		}
+		invoice.Items = append(invoice.Items, models.InvoiceItem{
+			Description: "Credit carried to the next invoice",
+			Amount:      -invoice.Amount,
+			Quantity:    1,
+		})
+		invoice.Amount = 0
+		if _, err := tx.ModelContext(ctx, carried).Insert(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ModelContext(ctx, invoice).WherePK().Update(); err != nil {
+		return err
+	}
+	_, err = tx.ModelContext(ctx, (*models.PendingInvoiceItem)(nil)).
+		Set("invoice_id = ?", invoice.ID).
+		Where("id IN (?)", pg.In(ids)).
+		Update()
+	return err
+}
+
+// CreatePendingItems queues items for the subscription's next renewal
+// invoice
+func (r *Repository) CreatePendingItems(ctx context.Context, items []models.PendingInvoiceItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	for i := range items {
+		items[i].CreatedAt = now
+	}
+	_, err := r.db.ModelContext(ctx, &items).Insert()
+	return translateError(err)
+}
+
+// ListPendingItems returns the items waiting for a subscription's next
+// renewal invoice
+func (r *Repository) ListPendingItems(ctx context.Context, subscriptionId string) ([]models.PendingInvoiceItem, error) {
+	items := []models.PendingInvoiceItem{}
+	err := r.db.ModelContext(ctx, &items).
+		Where("subscription_id = ?", subscriptionId).
+		Where("invoice_id IS NULL").
+		Order("created_at", "id").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// UpdateInvoice saves every field of an invoice. Only the payment state
+// of a finalized invoice can change; anything else returns ErrFinalized.
+func (r *Repository) UpdateInvoice(ctx context.Context, invoice *models.Invoice) error {
+	invoice.UpdatedAt = time.Now().UTC()
+	if invoice.Items == nil {
+		invoice.Items = []models.InvoiceItem{}
+	}
+	result, err := r.db.ModelContext(ctx, invoice).WherePK().ExcludeColumn("created_at").Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package repository
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/securepay/subscription-management/models"
+)
+
+// The merchant columns invoice and credit note numbers are drawn from
+const (
+	invoiceCounter    = "next_invoice_number"
+	creditNoteCounter = "next_credit_note_number"
+)
+
+// GetMerchant returns a merchant by id
+func (r *Repository) GetMerchant(ctx context.Context, id string) (*models.Merchant, error) {
+	merchant := &models.Merchant{ID: id}
+	if err := r.db.ModelContext(ctx, merchant).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return merchant, nil
+}
+
+// SaveMerchant creates a merchant or updates its details. Its number
+// counters are never changed here.
+func (r *Repository) SaveMerchant(ctx context.Context, merchant *models.Merchant) error {
+	now := time.Now().UTC()
+	merchant.CreatedAt, merchant.UpdatedAt = now, now
+	_, err := r.db.ModelContext(ctx, merchant).
+		ExcludeColumn("next_invoice_number", "next_credit_note_number").
+		OnConflict("(id) DO UPDATE").
+		Set("name = EXCLUDED.name").
+		Set("legal_name = EXCLUDED.legal_name").
+		Set("email = EXCLUDED.email").
+		Set("phone = EXCLUDED.phone").
+		Set("address = EXCLUDED.address").
+		Set("tax_id = EXCLUDED.tax_id").
+		Set("logo_url = EXCLUDED.logo_url").
+		Set("brand_color = EXCLUDED.brand_color").
+		Set("footer = EXCLUDED.footer").
+		Set("invoice_prefix = EXCLUDED.invoice_prefix").
+		Set("tax_name = EXCLUDED.tax_name").
+		Set("tax_rate = EXCLUDED.tax_rate").
+		Set("updated_at = EXCLUDED.updated_at").
+		Returning("*").
+		Insert()
+	return translateError(err)
+}
+
+// claimNumber takes the next value of one of a merchant's number counters
+// in tx and returns it with the merchant, creating the merchant with default
+// details if it does not exist. The merchant stays locked until tx ends, so
+// numbers are handed out in order, and one taken by a transaction that rolls
+// back is handed out again: the sequence has no gaps.
+func claimNumber(ctx context.Context, tx *pg.Tx, merchantId, counter string) (*models.Merchant, int64, error) {
+	if merchantId == "" {
+		return nil, 0, fmt.Errorf("no merchant to number the document for")
+	}
+	merchant := &models.Merchant{}
+	// counter is one of the constants above, never user input
+	_, err := tx.QueryOneContext(ctx, merchant, fmt.Sprintf(`
+		INSERT INTO merchants (id, name, %[1]s) VALUES (?0, ?0, 2)
+		ON CONFLICT (id) DO UPDATE SET %[1]s = merchants.%[1]s + 1, updated_at = now()
+		RETURNING *`, counter), merchantId)
+	if err != nil {
+		return nil, 0, err
+	}
+	if counter == creditNoteCounter {
+		return merchant, merchant.NextCreditNoteNumber - 1, nil
+	}
+	return merchant, merchant.NextInvoiceNumber - 1, nil
+}
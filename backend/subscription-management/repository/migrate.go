@@ -0,0 +1,77 @@
+package repository
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+
+	"github.com/go-pg/pg/v10"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID keys the advisory lock that stops two instances migrating
+// at the same time
+const migrationLockID = 7007001
+
+// Migrate applies the embedded migrations that have not run yet, in file
+// name order, and returns the versions it applied. Applied versions are
+// recorded in schema_migrations. All pending migrations run in a single
+// transaction, so a failure leaves the schema unchanged.
+func (r *Repository) Migrate(ctx context.Context) ([]string, error) {
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	applied := []string{}
+	err = r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(?)", migrationLockID); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    text PRIMARY KEY,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			return err
+		}
+
+		var done []string
+		if _, err := tx.QueryContext(ctx, pg.Scan(pg.Array(&done)), "SELECT coalesce(array_agg(version), '{}') FROM schema_migrations"); err != nil {
+			return err
+		}
+		ran := map[string]bool{}
+		for _, version := range done {
+			ran[version] = true
+		}
+
+		for _, name := range names {
+			version := strings.TrimSuffix(strings.TrimPrefix(name, "migrations/"), ".sql")
+			if ran[version] {
+				continue
+			}
+			script, err := migrationFiles.ReadFile(name)
+			if err != nil {
+				return err
+			}
+			// Without parameters go-pg sends the script as it is
+			if _, err := tx.ExecContext(ctx, string(script)); err != nil {
+				return fmt.Errorf("migration %s: %w", version, err)
+			}
+			if _, err := tx.ExecContext(ctx, "INSERT INTO schema_migrations (version) VALUES (?)", version); err != nil {
+				return err
+			}
+			applied = append(applied, version)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
@@ -0,0 +1,67 @@
+CREATE TABLE plans (
+    id          text PRIMARY KEY,
+    name        text NOT NULL,
+    description text,
+    amount      numeric(12, 2) NOT NULL CHECK (amount >= 0),
+    currency    text NOT NULL,
+    "interval"  text NOT NULL CHECK ("interval" IN ('monthly', 'quarterly', 'annual')),
+    features    text[] NOT NULL DEFAULT '{}',
+    is_active   boolean NOT NULL DEFAULT true,
+    created_at  timestamptz NOT NULL DEFAULT now(),
+    updated_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE customers (
+    id         text PRIMARY KEY,
+    name       text NOT NULL,
+    email      text NOT NULL UNIQUE,
+    phone      text,
+    address    text,
+    city       text,
+    state      text,
+    country    text,
+    zip_code   text,
+    metadata   jsonb,
+    created_at timestamptz NOT NULL DEFAULT now(),
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE subscriptions (
+    id                   text PRIMARY KEY,
+    customer_id          text NOT NULL REFERENCES customers (id),
+    plan_id              text NOT NULL REFERENCES plans (id),
+    status               text NOT NULL CHECK (status IN ('active', 'canceled', 'suspended', 'expired', 'trial')),
+    current_period_start timestamptz NOT NULL,
+    current_period_end   timestamptz NOT NULL,
+    canceled_at          timestamptz,
+    trial_start          timestamptz,
+    trial_end            timestamptz,
+    quantity             integer NOT NULL DEFAULT 1 CHECK (quantity > 0),
+    metadata             jsonb,
+    created_at           timestamptz NOT NULL DEFAULT now(),
+    updated_at           timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX subscriptions_customer_id_idx ON subscriptions (customer_id);
+CREATE INDEX subscriptions_plan_id_idx ON subscriptions (plan_id);
+
+CREATE TABLE invoices (
+    id              text PRIMARY KEY,
+    subscription_id text NOT NULL REFERENCES subscriptions (id),
+    customer_id     text NOT NULL REFERENCES customers (id),
+    amount          numeric(12, 2) NOT NULL,
+    currency        text NOT NULL,
+    status          text NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'open', 'paid', 'overdue', 'void', 'canceled')),
+    due_date        timestamptz NOT NULL,
+    paid_at         timestamptz,
+    period_start    timestamptz NOT NULL,
+    period_end      timestamptz NOT NULL,
+    description     text,
+    items           jsonb NOT NULL DEFAULT '[]',
+    metadata        jsonb,
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    updated_at      timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX invoices_subscription_id_idx ON invoices (subscription_id);
+CREATE INDEX invoices_customer_id_idx ON invoices (customer_id);
@@ -0,0 +1,16 @@
+ALTER TABLE customers ADD COLUMN default_payment_method text;
+
+ALTER TABLE subscriptions
+    ADD COLUMN billing_lease_owner text,
+    ADD COLUMN billing_lease_expires_at timestamptz;
+
+CREATE INDEX subscriptions_renewal_idx ON subscriptions (current_period_end) WHERE status = 'active';
+
+ALTER TABLE invoices
+    ADD COLUMN payment_id text,
+    ADD COLUMN attempt_count integer NOT NULL DEFAULT 0,
+    ADD COLUMN last_payment_error text,
+    ADD COLUMN next_payment_attempt timestamptz;
+
+-- One invoice per subscription period keeps renewals idempotent
+CREATE UNIQUE INDEX invoices_subscription_period_idx ON invoices (subscription_id, period_start);
@@ -0,0 +1,25 @@
+ALTER TABLE subscriptions ADD COLUMN pending_plan_id text REFERENCES plans (id);
+
+ALTER TABLE invoices ADD COLUMN billing_reason text NOT NULL DEFAULT 'subscription_cycle'
+    CHECK (billing_reason IN ('subscription_cycle', 'subscription_update'));
+
+-- Only renewals are limited to one invoice per period; mid-cycle changes
+-- can be invoiced at any time
+DROP INDEX invoices_subscription_period_idx;
+CREATE UNIQUE INDEX invoices_subscription_period_idx ON invoices (subscription_id, period_start)
+    WHERE billing_reason = 'subscription_cycle';
+
+CREATE TABLE pending_invoice_items (
+    id              text PRIMARY KEY,
+    subscription_id text NOT NULL REFERENCES subscriptions (id),
+    customer_id     text NOT NULL REFERENCES customers (id),
+    description     text NOT NULL,
+    amount          numeric(12, 2) NOT NULL,
+    quantity        integer NOT NULL DEFAULT 1,
+    currency        text NOT NULL,
+    invoice_id      text REFERENCES invoices (id),
+    created_at      timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX pending_invoice_items_subscription_idx ON pending_invoice_items (subscription_id)
+    WHERE invoice_id IS NULL;
@@ -0,0 +1,8 @@
+ALTER TABLE plans ADD COLUMN trial_days integer NOT NULL DEFAULT 0 CHECK (trial_days >= 0);
+
+ALTER TABLE subscriptions ADD COLUMN trial_reminder_at timestamptz;
+
+-- Trials convert through the same renewal run as active subscriptions
+DROP INDEX subscriptions_renewal_idx;
+CREATE INDEX subscriptions_renewal_idx ON subscriptions (current_period_end) WHERE status IN ('active', 'trial');
+CREATE INDEX subscriptions_trial_end_idx ON subscriptions (trial_end) WHERE status = 'trial' AND trial_reminder_at IS NULL;
@@ -0,0 +1,10 @@
+ALTER TABLE subscriptions DROP CONSTRAINT subscriptions_status_check;
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+    CHECK (status IN ('active', 'past_due', 'canceled', 'suspended', 'expired', 'trial'));
+
+ALTER TABLE subscriptions ADD COLUMN suspended_at timestamptz;
+
+-- Past due subscriptions stay in the renewal run until dunning gives up
+DROP INDEX subscriptions_renewal_idx;
+CREATE INDEX subscriptions_renewal_idx ON subscriptions (current_period_end) WHERE status IN ('active', 'trial', 'past_due');
+CREATE INDEX subscriptions_suspended_idx ON subscriptions (suspended_at) WHERE status = 'suspended';
@@ -0,0 +1,40 @@
+CREATE TABLE coupons (
+    id                  text PRIMARY KEY,
+    name                text NOT NULL,
+    percent_off         numeric(5, 2) CHECK (percent_off > 0 AND percent_off <= 100),
+    amount_off          numeric(12, 2) CHECK (amount_off > 0),
+    currency            text,
+    duration            text NOT NULL CHECK (duration IN ('once', 'repeating', 'forever')),
+    duration_in_periods integer CHECK (duration_in_periods > 0),
+    max_redemptions     integer CHECK (max_redemptions > 0),
+    times_redeemed      integer NOT NULL DEFAULT 0,
+    redeem_by           timestamptz,
+    applies_to_plans    text[] NOT NULL DEFAULT '{}',
+    is_active           boolean NOT NULL DEFAULT true,
+    created_at          timestamptz NOT NULL DEFAULT now(),
+    updated_at          timestamptz NOT NULL DEFAULT now(),
+    CHECK (num_nonnulls(percent_off, amount_off) = 1),
+    CHECK (amount_off IS NULL OR currency IS NOT NULL),
+    CHECK ((duration = 'repeating') = (duration_in_periods IS NOT NULL))
+);
+
+CREATE TABLE promotion_codes (
+    id              text PRIMARY KEY,
+    code            text NOT NULL,
+    coupon_id       text NOT NULL REFERENCES coupons (id),
+    max_redemptions integer CHECK (max_redemptions > 0),
+    times_redeemed  integer NOT NULL DEFAULT 0,
+    expires_at      timestamptz,
+    is_active       boolean NOT NULL DEFAULT true,
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    updated_at      timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX promotion_codes_code_idx ON promotion_codes (upper(code));
+CREATE INDEX promotion_codes_coupon_id_idx ON promotion_codes (coupon_id);
+
+ALTER TABLE subscriptions
+    ADD COLUMN coupon_id text REFERENCES coupons (id),
+    ADD COLUMN promotion_code_id text REFERENCES promotion_codes (id),
+    ADD COLUMN discount_start timestamptz,
+    ADD COLUMN discount_end timestamptz;
@@ -0,0 +1,30 @@
+CREATE TABLE metered_components (
+    id            text PRIMARY KEY,
+    plan_id       text NOT NULL REFERENCES plans (id),
+    name          text NOT NULL,
+    unit_name     text NOT NULL,
+    pricing_model text NOT NULL CHECK (pricing_model IN ('per_unit', 'tiered', 'volume', 'package')),
+    unit_amount   numeric(12, 6) NOT NULL DEFAULT 0 CHECK (unit_amount >= 0),
+    tiers         jsonb,
+    package_size  bigint CHECK (package_size > 0),
+    is_active     boolean NOT NULL DEFAULT true,
+    created_at    timestamptz NOT NULL DEFAULT now(),
+    updated_at    timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX metered_components_plan_id_idx ON metered_components (plan_id);
+
+CREATE TABLE usage_records (
+    id              text PRIMARY KEY,
+    subscription_id text NOT NULL REFERENCES subscriptions (id),
+    component_id    text NOT NULL REFERENCES metered_components (id),
+    event_id        text NOT NULL,
+    quantity        bigint NOT NULL CHECK (quantity >= 0),
+    recorded_at     timestamptz NOT NULL,
+    invoice_id      text REFERENCES invoices (id),
+    created_at      timestamptz NOT NULL DEFAULT now(),
+    UNIQUE (subscription_id, event_id)
+);
+
+CREATE INDEX usage_records_unbilled_idx ON usage_records (subscription_id, recorded_at)
+    WHERE invoice_id IS NULL;
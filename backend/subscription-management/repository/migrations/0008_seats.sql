@@ -0,0 +1,4 @@
+ALTER TABLE plans
+    ADD COLUMN min_quantity integer NOT NULL DEFAULT 1 CHECK (min_quantity >= 1),
+    ADD COLUMN max_quantity integer,
+    ADD CONSTRAINT plans_quantity_range_check CHECK (max_quantity IS NULL OR max_quantity >= min_quantity);
@@ -0,0 +1,20 @@
+ALTER TABLE subscriptions DROP CONSTRAINT subscriptions_status_check;
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+    CHECK (status IN ('active', 'past_due', 'canceled', 'suspended', 'expired', 'trial', 'paused'));
+
+ALTER TABLE subscriptions
+    ADD COLUMN cancel_at_period_end boolean NOT NULL DEFAULT false,
+    ADD COLUMN cancellation_reason text CHECK (cancellation_reason IN ('too_expensive', 'missing_features',
+        'switched_service', 'unused', 'customer_service', 'too_complex', 'low_quality', 'other')),
+    ADD COLUMN cancellation_feedback text,
+    ADD COLUMN pause_behavior text CHECK (pause_behavior IN ('void', 'keep_as_draft')),
+    ADD COLUMN paused_at timestamptz,
+    ADD COLUMN resume_at timestamptz;
+
+-- Paused subscriptions still move through their periods
+DROP INDEX subscriptions_renewal_idx;
+CREATE INDEX subscriptions_renewal_idx ON subscriptions (current_period_end)
+    WHERE status IN ('active', 'trial', 'past_due', 'paused');
+CREATE INDEX subscriptions_canceled_at_idx ON subscriptions (canceled_at) WHERE status = 'canceled';
+
+ALTER TABLE invoices ADD COLUMN amount_refunded numeric(12, 2) NOT NULL DEFAULT 0;
@@ -0,0 +1,96 @@
+CREATE TABLE merchants (
+    id                      text PRIMARY KEY,
+    name                    text NOT NULL,
+    legal_name              text,
+    email                   text,
+    phone                   text,
+    address                 text,
+    tax_id                  text,
+    logo_url                text,
+    brand_color             text CHECK (brand_color ~ '^#[0-9a-fA-F]{6}$'),
+    footer                  text,
+    invoice_prefix          text NOT NULL DEFAULT 'INV',
+    tax_name                text,
+    tax_rate                numeric(5, 2) NOT NULL DEFAULT 0 CHECK (tax_rate >= 0 AND tax_rate < 100),
+    next_invoice_number     bigint NOT NULL DEFAULT 1,
+    next_credit_note_number bigint NOT NULL DEFAULT 1,
+    created_at              timestamptz NOT NULL DEFAULT now(),
+    updated_at              timestamptz NOT NULL DEFAULT now()
+);
+
+-- Invoices issued before numbering was added keep no number and stay
+-- editable
+ALTER TABLE invoices
+    ADD COLUMN number text,
+    ADD COLUMN merchant_id text REFERENCES merchants (id),
+    ADD COLUMN taxes jsonb,
+    ADD COLUMN amount_credited numeric(12, 2) NOT NULL DEFAULT 0,
+    ADD COLUMN finalized_at timestamptz,
+    ADD CONSTRAINT invoices_finalized_check CHECK ((finalized_at IS NULL) = (number IS NULL));
+
+CREATE UNIQUE INDEX invoices_number_idx ON invoices (merchant_id, number);
+
+CREATE TABLE credit_notes (
+    id              text PRIMARY KEY,
+    number          text NOT NULL,
+    merchant_id     text NOT NULL REFERENCES merchants (id),
+    invoice_id      text NOT NULL REFERENCES invoices (id),
+    subscription_id text NOT NULL REFERENCES subscriptions (id),
+    customer_id     text NOT NULL REFERENCES customers (id),
+    amount          numeric(12, 2) NOT NULL CHECK (amount > 0),
+    currency        text NOT NULL,
+    reason          text NOT NULL CHECK (reason IN ('duplicate', 'fraudulent', 'order_change', 'product_unsatisfactory', 'other')),
+    method          text NOT NULL CHECK (method IN ('reduce_amount_due', 'refund', 'customer_balance')),
+    memo            text,
+    items           jsonb NOT NULL DEFAULT '[]',
+    taxes           jsonb,
+    refund_id       text,
+    created_at      timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE UNIQUE INDEX credit_notes_number_idx ON credit_notes (merchant_id, number);
+CREATE INDEX credit_notes_invoice_id_idx ON credit_notes (invoice_id);
+
+-- A finalized invoice is a legal document: only its payment state may
+-- change, and it is corrected with credit notes. Credit notes never change.
+CREATE FUNCTION invoices_immutable() RETURNS trigger AS $$
+BEGIN
+    IF OLD.finalized_at IS NULL THEN
+        RETURN COALESCE(NEW, OLD);
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % is finalized and cannot be deleted', OLD.id USING ERRCODE = '55000';
+    END IF;
+    IF NEW.number IS DISTINCT FROM OLD.number
+        OR NEW.merchant_id IS DISTINCT FROM OLD.merchant_id
+        OR NEW.subscription_id IS DISTINCT FROM OLD.subscription_id
+        OR NEW.customer_id IS DISTINCT FROM OLD.customer_id
+        OR NEW.amount IS DISTINCT FROM OLD.amount
+        OR NEW.currency IS DISTINCT FROM OLD.currency
+        OR NEW.billing_reason IS DISTINCT FROM OLD.billing_reason
+        OR NEW.due_date IS DISTINCT FROM OLD.due_date
+        OR NEW.period_start IS DISTINCT FROM OLD.period_start
+        OR NEW.period_end IS DISTINCT FROM OLD.period_end
+        OR NEW.description IS DISTINCT FROM OLD.description
+        OR NEW.items IS DISTINCT FROM OLD.items
+        OR NEW.taxes IS DISTINCT FROM OLD.taxes
+        OR NEW.finalized_at IS DISTINCT FROM OLD.finalized_at
+        OR NEW.created_at IS DISTINCT FROM OLD.created_at
+        OR NEW.status = 'draft' THEN
+        RAISE EXCEPTION 'invoice % is finalized; correct it with a credit note', OLD.id USING ERRCODE = '55000';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER invoices_immutable BEFORE UPDATE OR DELETE ON invoices
+    FOR EACH ROW EXECUTE FUNCTION invoices_immutable();
+
+CREATE FUNCTION credit_notes_immutable() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'credit note % cannot be changed', OLD.id USING ERRCODE = '55000';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER credit_notes_immutable BEFORE UPDATE OR DELETE ON credit_notes
+    FOR EACH ROW EXECUTE FUNCTION credit_notes_immutable();
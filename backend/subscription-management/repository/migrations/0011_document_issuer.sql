@@ -0,0 +1,54 @@
+-- Finalized invoices and credit notes keep the merchant details they were
+-- issued with. Documents issued before this take the merchant's details as
+-- they are now, the closest record there is.
+ALTER TABLE invoices ADD COLUMN issuer jsonb;
+ALTER TABLE credit_notes ADD COLUMN issuer jsonb;
+
+UPDATE invoices i
+SET issuer = jsonb_strip_nulls(jsonb_build_object(
+        'name', m.name, 'legal_name', m.legal_name, 'email', m.email,
+        'phone', m.phone, 'address', m.address, 'tax_id', m.tax_id,
+        'logo_url', m.logo_url, 'brand_color', m.brand_color, 'footer', m.footer))
+FROM merchants m
+WHERE m.id = i.merchant_id AND i.finalized_at IS NOT NULL;
+
+ALTER TABLE credit_notes DISABLE TRIGGER credit_notes_immutable;
+UPDATE credit_notes n
+SET issuer = jsonb_strip_nulls(jsonb_build_object(
+        'name', m.name, 'legal_name', m.legal_name, 'email', m.email,
+        'phone', m.phone, 'address', m.address, 'tax_id', m.tax_id,
+        'logo_url', m.logo_url, 'brand_color', m.brand_color, 'footer', m.footer))
+FROM merchants m
+WHERE m.id = n.merchant_id;
+ALTER TABLE credit_notes ENABLE TRIGGER credit_notes_immutable;
+
+CREATE OR REPLACE FUNCTION invoices_immutable() RETURNS trigger AS $$
+BEGIN
+    IF OLD.finalized_at IS NULL THEN
+        RETURN COALESCE(NEW, OLD);
+    END IF;
+    IF TG_OP = 'DELETE' THEN
+        RAISE EXCEPTION 'invoice % is finalized and cannot be deleted', OLD.id USING ERRCODE = '55000';
+    END IF;
+    IF NEW.number IS DISTINCT FROM OLD.number
+        OR NEW.merchant_id IS DISTINCT FROM OLD.merchant_id
+        OR NEW.subscription_id IS DISTINCT FROM OLD.subscription_id
+        OR NEW.customer_id IS DISTINCT FROM OLD.customer_id
+        OR NEW.amount IS DISTINCT FROM OLD.amount
+        OR NEW.currency IS DISTINCT FROM OLD.currency
+        OR NEW.billing_reason IS DISTINCT FROM OLD.billing_reason
+        OR NEW.due_date IS DISTINCT FROM OLD.due_date
+        OR NEW.period_start IS DISTINCT FROM OLD.period_start
+        OR NEW.period_end IS DISTINCT FROM OLD.period_end
+        OR NEW.description IS DISTINCT FROM OLD.description
+        OR NEW.items IS DISTINCT FROM OLD.items
+        OR NEW.taxes IS DISTINCT FROM OLD.taxes
+        OR NEW.issuer IS DISTINCT FROM OLD.issuer
+        OR NEW.finalized_at IS DISTINCT FROM OLD.finalized_at
+        OR NEW.created_at IS DISTINCT FROM OLD.created_at
+        OR NEW.status = 'draft' THEN
+        RAISE EXCEPTION 'invoice % is finalized; correct it with a credit note', OLD.id USING ERRCODE = '55000';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
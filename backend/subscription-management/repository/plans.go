@@ -0,0 +1,72 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListPlans returns plans ordered by price. Inactive plans are left out
+// unless includeInactive is set.
+func (r *Repository) ListPlans(ctx context.Context, includeInactive bool) ([]models.Plan, error) {
+	plans := []models.Plan{}
+	query := r.db.ModelContext(ctx, &plans).Order("amount", "id")
+	if !includeInactive {
+		query = query.Where("is_active")
+	}
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+	return plans, nil
+}
+
+// GetPlan returns a plan by id
+func (r *Repository) GetPlan(ctx context.Context, id string) (*models.Plan, error) {
+	plan := &models.Plan{ID: id}
+	if err := r.db.ModelContext(ctx, plan).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return plan, nil
+}
+
+// CreatePlan inserts a plan. It returns ErrConflict if the id is taken.
+func (r *Repository) CreatePlan(ctx context.Context, plan *models.Plan) error {
+	now := time.Now().UTC()
+	plan.CreatedAt, plan.UpdatedAt = now, now
+	if plan.Features == nil {
+		plan.Features = []string{}
+	}
+	_, err := r.db.ModelContext(ctx, plan).Insert()
+	return translateError(err)
+}
+
+// UpdatePlan saves every field of a plan
+func (r *Repository) UpdatePlan(ctx context.Context, plan *models.Plan) error {
+	plan.UpdatedAt = time.Now().UTC()
+	if plan.Features == nil {
+		plan.Features = []string{}
+	}
+	result, err := r.db.ModelContext(ctx, plan).WherePK().ExcludeColumn("created_at").Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SeedPlans inserts plans that do not exist yet, leaving existing ones as
+// they are
+func (r *Repository) SeedPlans(ctx context.Context, plans []models.Plan) error {
+	now := time.Now().UTC()
+	for i := range plans {
+		plans[i].CreatedAt, plans[i].UpdatedAt = now, now
+		if plans[i].Features == nil {
+			plans[i].Features = []string{}
+		}
+	}
+	_, err := r.db.ModelContext(ctx, &plans).OnConflict("(id) DO NOTHING").Insert()
+	return err
+}
@@ -0,0 +1,99 @@
+// Package repository stores the subscription service's models in Postgres
+package repository
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/go-pg/pg/v10"
+)
+
+var (
+	// ErrNotFound is returned when a record does not exist
+	ErrNotFound = errors.New("record not found")
+	// ErrConflict is returned when a record breaks a unique constraint
+	ErrConflict = errors.New("record already exists")
+	// ErrInUse is returned when a record is still referenced by another
+	ErrInUse = errors.New("record is still in use")
+	// ErrUnavailable is returned when a coupon or promotion code can no
+	// longer be redeemed
+	ErrUnavailable = errors.New("no longer available")
+	// ErrFinalized is returned when a finalized invoice or a credit note
+	// would be changed
+	ErrFinalized = errors.New("record is finalized")
+)
+
+// Config holds the database connection settings
+type Config struct {
+	Host     string
+	Port     string
+	Name     string
+	User     string
+	Password string
+}
+
+// ConfigFromEnv reads DB_HOST, DB_PORT, DB_NAME, DB_USER and DB_PASSWORD
+func ConfigFromEnv() Config {
+	return Config{
+		Host:     getEnv("DB_HOST", "localhost"),
+		Port:     getEnv("DB_PORT", "5432"),
+		Name:     getEnv("DB_NAME", "securepay"),
+		User:     getEnv("DB_USER", "postgres"),
+		Password: getEnv("DB_PASSWORD", "postgres"),
+	}
+}
+
+func getEnv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Repository reads and writes plans, customers, subscriptions and invoices
+type Repository struct {
+	db *pg.DB
+}
+
+// Open returns a repository backed by a connection pool. Connections are
+// made lazily, so use Ping to check the database is reachable.
+func Open(config Config) *Repository {
+	db := pg.Connect(&pg.Options{
+		Addr:     net.JoinHostPort(config.Host, config.Port),
+		User:     config.User,
+		Password: config.Password,
+		Database: config.Name,
+	})
+	return &Repository{db: db}
+}
+
+// Ping checks the database is reachable
+func (r *Repository) Ping(ctx context.Context) error {
+	return r.db.Ping(ctx)
+}
+
+// Close closes the connection pool
+func (r *Repository) Close() error {
+	return r.db.Close()
+}
+
+// translateError maps go-pg errors onto the repository's errors
+func translateError(err error) error {
+	if errors.Is(err, pg.ErrNoRows) {
+		return ErrNotFound
+	}
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		switch pgErr.Field('C') {
+		case "23505":
+			return ErrConflict
+		case "23503":
+			return ErrInUse
+		case "55000":
+			return ErrFinalized
+		}
+	}
+	return err
+}
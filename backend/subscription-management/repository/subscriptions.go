@@ -0,0 +1,92 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListCustomerSubscriptions returns a customer's subscriptions with their
+// plans and coupons, newest first
+func (r *Repository) ListCustomerSubscriptions(ctx context.Context, customerId string) ([]models.Subscription, error) {
+	subscriptions := []models.Subscription{}
+	err := r.db.ModelContext(ctx, &subscriptions).
+		Relation("Plan").
+		Relation("Coupon").
+		Where("subscription.customer_id = ?", customerId).
+		Order("subscription.created_at DESC").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// GetSubscription returns a subscription with its plan and coupon
+func (r *Repository) GetSubscription(ctx context.Context, id string) (*models.Subscription, error) {
+	subscription := &models.Subscription{}
+	err := r.db.ModelContext(ctx, subscription).
+		Relation("Plan").
+		Relation("Coupon").
+		Where("subscription.id = ?", id).
+		Select()
+	if err != nil {
+		return nil, translateError(err)
+	}
+	return subscription, nil
+}
+
+// CreateSubscription inserts a subscription, redeeming its coupon and
+// promotion code if it has them. It returns ErrInUse if the customer or plan
+// does not exist and ErrUnavailable if the discount cannot be redeemed.
+func (r *Repository) CreateSubscription(ctx context.Context, subscription *models.Subscription) error {
+	now := time.Now().UTC()
+	subscription.CreatedAt, subscription.UpdatedAt = now, now
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := redeem(ctx, tx, subscription); err != nil {
+			return err
+		}
+		_, err := tx.ModelContext(ctx, subscription).Insert()
+		return err
+	})
+	return translateError(err)
+}
+
+// UpdateSubscription saves every field of a subscription
+func (r *Repository) UpdateSubscription(ctx context.Context, subscription *models.Subscription) error {
+	subscription.UpdatedAt = time.Now().UTC()
+	result, err := r.db.ModelContext(ctx, subscription).WherePK().ExcludeColumn("created_at").Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// UpdateDiscount saves a subscription's coupon, promotion code and discount
+// period, redeeming the new coupon. It returns ErrUnavailable if the coupon
+// or promotion code cannot be redeemed.
+func (r *Repository) UpdateDiscount(ctx context.Context, subscription *models.Subscription) error {
+	subscription.UpdatedAt = time.Now().UTC()
+	err := r.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if err := redeem(ctx, tx, subscription); err != nil {
+			return err
+		}
+		result, err := tx.ModelContext(ctx, subscription).
+			Column("coupon_id", "promotion_code_id", "discount_start", "discount_end", "updated_at").
+			WherePK().
+			Update()
+		if err != nil {
+			return err
+		}
+		if result.RowsAffected() == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	return translateError(err)
+}
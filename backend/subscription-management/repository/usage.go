@@ -0,0 +1,132 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/securepay/subscription-management/models"
+)
+
+// ListComponents returns a plan's metered components. Inactive components
+// are left out unless includeInactive is set.
+func (r *Repository) ListComponents(ctx context.Context, planId string, includeInactive bool) ([]models.MeteredComponent, error) {
+	components := []models.MeteredComponent{}
+	query := r.db.ModelContext(ctx, &components).Where("plan_id = ?", planId).Order("created_at", "id")
+	if !includeInactive {
+		query = query.Where("is_active")
+	}
+	if err := query.Select(); err != nil {
+		return nil, err
+	}
+	return components, nil
+}
+
+// GetComponent returns a metered component by id
+func (r *Repository) GetComponent(ctx context.Context, id string) (*models.MeteredComponent, error) {
+	component := &models.MeteredComponent{ID: id}
+	if err := r.db.ModelContext(ctx, component).WherePK().Select(); err != nil {
+		return nil, translateError(err)
+	}
+	return component, nil
+}
+
+// GetComponents returns the metered components with the given ids, active
+// or not, keyed by id
+func (r *Repository) GetComponents(ctx context.Context, ids []string) (map[string]*models.MeteredComponent, error) {
+	byId := map[string]*models.MeteredComponent{}
+	if len(ids) == 0 {
+		return byId, nil
+	}
+	var components []models.MeteredComponent
+	if err := r.db.ModelContext(ctx, &components).Where("id IN (?)", pg.In(ids)).Select(); err != nil {
+		return nil, err
+	}
+	for i := range components {
+		byId[components[i].ID] = &components[i]
+	}
+	return byId, nil
+}
+
+// CreateComponent inserts a metered component. It returns ErrInUse if the
+// plan does not exist.
+func (r *Repository) CreateComponent(ctx context.Context, component *models.MeteredComponent) error {
+	now := time.Now().UTC()
+	component.CreatedAt, component.UpdatedAt = now, now
+	_, err := r.db.ModelContext(ctx, component).Insert()
+	return translateError(err)
+}
+
+// DeactivateComponent stops usage being reported for a component. Usage
+// already reported is still billed.
+func (r *Repository) DeactivateComponent(ctx context.Context, planId, id string) error {
+	result, err := r.db.ModelContext(ctx, (*models.MeteredComponent)(nil)).
+		Set("is_active = false").
+		Set("updated_at = now()").
+		Where("id = ?", id).
+		Where("plan_id = ?", planId).
+		Update()
+	if err != nil {
+		return translateError(err)
+	}
+	if result.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// RecordUsage inserts a usage record unless the subscription already has
+// one with the same event id, and returns whichever is stored. created
+// reports whether record was the one inserted.
+func (r *Repository) RecordUsage(ctx context.Context, record *models.UsageRecord) (*models.UsageRecord, bool, error) {
+	record.CreatedAt = time.Now().UTC()
+	result, err := r.db.ModelContext(ctx, record).
+		OnConflict("(subscription_id, event_id) DO NOTHING").
+		Insert()
+	if err != nil {
+		return nil, false, translateError(err)
+	}
+	if result.RowsAffected() == 1 {
+		return record, true, nil
+	}
+
+	stored := &models.UsageRecord{}
+	err = r.db.ModelContext(ctx, stored).
+		Where("subscription_id = ?", record.SubscriptionID).
+		Where("event_id = ?", record.EventID).
+		Select()
+	if err != nil {
+		return nil, false, translateError(err)
+	}
+	return stored, false, nil
+}
+
+// UnbilledUsage returns a subscription's usage recorded before the given
+// time that no invoice has billed yet, oldest first
+func (r *Repository) UnbilledUsage(ctx context.Context, subscriptionId string, before time.Time) ([]models.UsageRecord, error) {
+	records := []models.UsageRecord{}
+	err := r.db.ModelContext(ctx, &records).
+		Where("subscription_id = ?", subscriptionId).
+		Where("invoice_id IS NULL").
+		Where("recorded_at < ?", before).
+		Order("recorded_at", "id").
+		Select()
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// markUsageBilled records that invoice bills the usage records with the
+// given ids
+func markUsageBilled(ctx context.Context, tx *pg.Tx, invoiceId string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := tx.ModelContext(ctx, (*models.UsageRecord)(nil)).
+		Set("invoice_id = ?", invoiceId).
+		Where("id IN (?)", pg.In(ids)).
+		Where("invoice_id IS NULL").
+		Update()
+	return err
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/securepay/subscription-management/billing"
+	"github.com/securepay/subscription-management/models"
+)
+
+type quantityChangeRequest struct {
+	Quantity          int    `json:"quantity" binding:"required,min=1"`
+	ProrationBehavior string `json:"proration_behavior"`
+}
+
+// loadQuantityChange binds a seat change request and loads the
+// subscription. It writes the error response and returns false when the
+// change is not possible.
+func loadQuantityChange(c *gin.Context) (quantityChangeRequest, billing.ProrationBehavior, *models.Subscription, bool) {
+	var request quantityChangeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return request, "", nil, false
+	}
+	behavior, err := billing.ParseProrationBehavior(request.ProrationBehavior)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, "", nil, false
+	}
+
+	subscription, err := repo.GetSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return request, "", nil, false
+	}
+	if subscription.Status != models.Active && subscription.Status != models.Trial {
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+		return request, "", nil, false
+	}
+	if request.Quantity == subscription.Quantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Subscription already has this many seats"})
+		return request, "", nil, false
+	}
+	if err := subscription.Plan.CheckQuantity(request.Quantity); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, "", nil, false
+	}
+	return request, behavior, subscription, true
+}
+
+// handleUpdateQuantity changes a subscription's seat count now, charging
+// or crediting the rest of the period for the seats added or removed
+func handleUpdateQuantity(c *gin.Context) {
+	request, behavior, subscription, ok := loadQuantityChange(c)
+	if !ok {
+		return
+	}
+
+	result, err := billingEngine.ChangePlan(c.Request.Context(), subscription.ID, "", request.Quantity, behavior)
+	if err != nil {
+		respondChangeError(c, result, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message":      "Seats updated successfully",
+		"subscription": result.Subscription,
+		"proration":    result.Proration,
+		"invoice":      result.Invoice,
+	})
+}
+
+// handlePreviewQuantity shows the proration a seat change would bill
+// without making it
+func handlePreviewQuantity(c *gin.Context) {
+	request, behavior, subscription, ok := loadQuantityChange(c)
+	if !ok {
+		return
+	}
+
+	proration := billing.Prorate(subscription, subscription.Plan, request.Quantity, billingEngine.Clock.Now())
+	amountDueNow := 0.0
+	if behavior == billing.ProrateInvoiceNow && proration.Amount > 0 {
+		amountDueNow = proration.Amount
+	}
+	c.JSON(http.StatusOK, gin.H{"preview": gin.H{
+		"subscription_id":    subscription.ID,
+		"quantity":           request.Quantity,
+		"proration_behavior": behavior,
+		"proration":          proration,
+		"amount_due_now":     amountDueNow,
+	}})
+}
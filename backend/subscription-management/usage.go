@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/securepay/subscription-management/models"
+	"github.com/securepay/subscription-management/repository"
+)
+
+// maxUsageClockSkew is how far in the future a usage timestamp may be
+const maxUsageClockSkew = 5 * time.Minute
+
+// handleListComponents lists a plan's metered components, with inactive
+// ones included on ?include_inactive=true
+func handleListComponents(c *gin.Context) {
+	components, err := repo.ListComponents(c.Request.Context(), c.Param("id"), c.Query("include_inactive") == "true")
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"components": components})
+}
+
+func handleCreateComponent(c *gin.Context) {
+	var request struct {
+		Name         string             `json:"name" binding:"required"`
+		UnitName     string             `json:"unit_name" binding:"required"`
+		PricingModel string             `json:"pricing_model" binding:"required"`
+		UnitAmount   float64            `json:"unit_amount" binding:"omitempty,min=0"`
+		Tiers        []models.PriceTier `json:"tiers"`
+		PackageSize  int64              `json:"package_size" binding:"omitempty,min=1"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	plan, err := repo.GetPlan(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	component := &models.MeteredComponent{
+		ID:           "mc_" + uuid.New().String()[:8],
+		PlanID:       plan.ID,
+		Name:         strings.TrimSpace(request.Name),
+		UnitName:     strings.TrimSpace(request.UnitName),
+		PricingModel: models.PricingModel(request.PricingModel),
+		UnitAmount:   request.UnitAmount,
+		Tiers:        request.Tiers,
+		PackageSize:  request.PackageSize,
+		IsActive:     true,
+	}
+	if err := component.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := repo.CreateComponent(ctx, component); err != nil {
+		respondError(c, err, "Plan not found")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":   "Metered component created successfully",
+		"component": component,
+	})
+}
+
+// handleDeleteComponent deactivates a metered component. Usage already
+// reported is still billed.
+func handleDeleteComponent(c *gin.Context) {
+	if err := repo.DeactivateComponent(c.Request.Context(), c.Param("id"), c.Param("componentId")); err != nil {
+		respondError(c, err, "Metered component not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Metered component deactivated successfully"})
+}
+
+// handleRecordUsage records usage of one of the subscription's metered
+// components. Reporting the same event_id again returns the stored record
+// instead of counting it twice.
+func handleRecordUsage(c *gin.Context) {
+	var request struct {
+		ComponentId string     `json:"component_id" binding:"required"`
+		EventId     string     `json:"event_id" binding:"required"`
+		Quantity    int64      `json:"quantity" binding:"min=0"`
+		Timestamp   *time.Time `json:"timestamp"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+		return
+	}
+
+	now := time.Now().UTC()
+	timestamp := now
+	if request.Timestamp != nil {
+		timestamp = request.Timestamp.UTC()
+	}
+	if timestamp.After(now.Add(maxUsageClockSkew)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timestamp is in the future"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	subscription, err := repo.GetSubscription(ctx, c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	switch subscription.Status {
+	case models.Active, models.Trial, models.PastDue:
+	default:
+		c.JSON(http.StatusConflict, gin.H{"error": "Subscription is not active"})
+		return
+	}
+	if timestamp.Before(subscription.CreatedAt) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timestamp is before the subscription started"})
+		return
+	}
+
+	component, err := repo.GetComponent(ctx, request.ComponentId)
+	if err != nil {
+		respondError(c, err, "Metered component not found")
+		return
+	}
+	if component.PlanID != subscription.PlanID || !component.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Metered component is not part of the subscription's plan"})
+		return
+	}
+
+	record, created, err := repo.RecordUsage(ctx, &models.UsageRecord{
+		ID:             "ur_" + uuid.New().String()[:8],
+		SubscriptionID: subscription.ID,
+		ComponentID:    component.ID,
+		EventID:        request.EventId,
+		Quantity:       request.Quantity,
+		Timestamp:      timestamp,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrInUse) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+			return
+		}
+		respondError(c, err, "Subscription not found")
+		return
+	}
+	if !created {
+		if record.ComponentID != component.ID || record.Quantity != request.Quantity {
+			c.JSON(http.StatusConflict, gin.H{
+				"error":        "event_id was already used for different usage",
+				"usage_record": record,
+			})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"message":      "Usage already recorded",
+			"usage_record": record,
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message":      "Usage recorded successfully",
+		"usage_record": record,
+	})
+}
+
+// handleUpcomingInvoice shows what the subscription's next invoice would be
+// if its period ended now
+func handleUpcomingInvoice(c *gin.Context) {
+	invoice, err := billingEngine.UpcomingInvoice(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondError(c, err, "Subscription not found")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"upcoming_invoice": invoice})
+}